@@ -24,6 +24,7 @@ import (
 	"github.com/CodisLabs/codis/pkg/proxy"
 	"github.com/CodisLabs/codis/pkg/topom"
 	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/CodisLabs/codis/pkg/utils/math2"
 )
@@ -110,6 +111,9 @@ Options:
 	config := proxy.NewDefaultConfig()
 	if s, ok := utils.Argument(d, "--config"); ok {
 		if err := config.LoadFromFile(s); err != nil {
+			if errs, ok := err.(proxy.ValidationErrors); ok {
+				exitInvalidConfig(errs)
+			}
 			log.PanicErrorf(err, "load config %s failed", s)
 		}
 	}
@@ -161,14 +165,13 @@ Options:
 	}
 
 	var slots []*models.Slot
+	var slotsFile string
 	if s, ok := utils.Argument(d, "--fillslots"); ok {
-		b, err := ioutil.ReadFile(s)
+		x, err := LoadSlotsFromFile(s)
 		if err != nil {
 			log.PanicErrorf(err, "load slots from file failed")
 		}
-		if err := json.Unmarshal(b, &slots); err != nil {
-			log.PanicErrorf(err, "decode slots from json failed")
-		}
+		slots, slotsFile = x, s
 	}
 
 	if s, ok := utils.Argument(d, "--product_name"); ok {
@@ -184,6 +187,10 @@ Options:
 		log.Warnf("option --session_auth = %s", s)
 	}
 
+	if errs := config.ValidateAll(); len(errs) != 0 {
+		exitInvalidConfig(errs)
+	}
+
 	s, err := proxy.New(config)
 	if err != nil {
 		log.PanicErrorf(err, "create proxy with config file failed\n%s", config)
@@ -218,10 +225,19 @@ Options:
 
 	switch {
 	case dashboard != "":
+		s.SetSlotsLoader(func() ([]*models.Slot, error) {
+			return LoadSlotsFromDashboard(s, dashboard)
+		})
 		go AutoOnlineWithDashboard(s, dashboard)
 	case coordinator.name != "":
+		s.SetSlotsLoader(func() ([]*models.Slot, error) {
+			return LoadSlotsFromCoordinator(s, coordinator.name, coordinator.addr, coordinator.auth)
+		})
 		go AutoOnlineWithCoordinator(s, coordinator.name, coordinator.addr, coordinator.auth)
 	case slots != nil:
+		s.SetSlotsLoader(func() ([]*models.Slot, error) {
+			return LoadSlotsFromFile(slotsFile)
+		})
 		go AutoOnlineWithFillSlots(s, slots)
 	}
 
@@ -344,3 +360,48 @@ func OnlineProxy(p *proxy.Proxy, dashboard string) bool {
 		return true
 	}
 }
+
+func LoadSlotsFromDashboard(p *proxy.Proxy, dashboard string) ([]*models.Slot, error) {
+	client := topom.NewApiClient(dashboard)
+	client.SetXAuth(p.Config().ProductName)
+	return client.Slots()
+}
+
+func LoadSlotsFromCoordinator(p *proxy.Proxy, name, addr, auth string) ([]*models.Slot, error) {
+	client, err := models.NewClient(name, addr, auth, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	t, err := models.LoadTopom(client, p.Config().ProductName, false)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, errors.Errorf("topom of product %s is not found", p.Config().ProductName)
+	}
+	return LoadSlotsFromDashboard(p, t.AdminAddr)
+}
+
+func LoadSlotsFromFile(path string) ([]*models.Slot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var slots []*models.Slot
+	if err := json.Unmarshal(b, &slots); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return slots, nil
+}
+
+func exitInvalidConfig(errs []error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "found %d error(s) in config:", len(errs))
+	for _, err := range errs {
+		fmt.Fprintf(&b, "\n  - %s", err)
+	}
+	log.Errorf("%s", b.String())
+	fmt.Fprintln(os.Stderr, b.String())
+	os.Exit(1)
+}
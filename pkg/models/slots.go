@@ -23,7 +23,8 @@ type Slot struct {
 
 	ForwardMethod int `json:"forward_method,omitempty"`
 
-	ReplicaGroups [][]string `json:"replica_groups,omitempty"`
+	ReplicaGroups  [][]string `json:"replica_groups,omitempty"`
+	ReplicaWeights [][]int    `json:"replica_weights,omitempty"`
 }
 
 func ParseForwardMethod(s string) (int, bool) {
@@ -0,0 +1,133 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+)
+
+const accessLogBufferLen = 8192
+
+type AccessLogEntry struct {
+	Timestamp string `json:"ts"`
+	Client    string `json:"client"`
+	User      string `json:"user,omitempty"`
+	Command   string `json:"cmd"`
+	Key       string `json:"key,omitempty"`
+	Slot      int    `json:"slot"`
+	Backend   string `json:"backend,omitempty"`
+	LatencyUs int64  `json:"latency_us"`
+	Err       string `json:"err,omitempty"`
+}
+
+// AccessLog writes sampled requests as json lines. Entries are queued in a
+// bounded buffer drained by a dedicated goroutine, so recording never blocks
+// sessions; entries are dropped when the buffer is full.
+type AccessLog struct {
+	w    io.WriteCloser
+	rate float64
+
+	input chan *AccessLogEntry
+	exit  chan struct{}
+	done  chan struct{}
+
+	dropped atomic2.Int64
+	closed  atomic2.Bool
+}
+
+func OpenAccessLog(path string, rate float64) (*AccessLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return NewAccessLog(f, rate), nil
+}
+
+func NewAccessLog(w io.WriteCloser, rate float64) *AccessLog {
+	l := &AccessLog{w: w, rate: rate}
+	l.input = make(chan *AccessLogEntry, accessLogBufferLen)
+	l.exit = make(chan struct{})
+	l.done = make(chan struct{})
+	go l.loopWriter()
+	return l
+}
+
+func (l *AccessLog) Record(r *Request, client, user string, latency time.Duration, resp *redis.Resp) {
+	if l.rate < 1 && rand.Float64() >= l.rate {
+		return
+	}
+	e := &AccessLogEntry{
+		Timestamp: time.Unix(0, r.UnixNano).Format(time.RFC3339Nano),
+		Client:    client,
+		User:      user,
+		Command:   r.OpStr,
+		Slot:      -1,
+		Backend:   r.Backend,
+		LatencyUs: int64(latency / time.Microsecond),
+	}
+	if key := getHashKey(r.Multi, r.OpStr); key != nil {
+		e.Key = truncateSlowLogArg(key)
+	}
+	if r.Slot != nil {
+		e.Slot = r.Slot.id
+	}
+	if resp != nil && resp.IsError() {
+		e.Err = string(resp.Value)
+	}
+	select {
+	case l.input <- e:
+	default:
+		l.dropped.Incr()
+	}
+}
+
+func (l *AccessLog) Dropped() int64 {
+	return l.dropped.Int64()
+}
+
+func (l *AccessLog) Close() error {
+	if l.closed.CompareAndSwap(false, true) {
+		close(l.exit)
+	}
+	<-l.done
+	return nil
+}
+
+func (l *AccessLog) loopWriter() {
+	defer close(l.done)
+	defer l.w.Close()
+
+	var w = bufio.NewWriterSize(l.w, 64*1024)
+	var enc = json.NewEncoder(w)
+	var write = func(e *AccessLogEntry) {
+		if err := enc.Encode(e); err != nil {
+			log.WarnErrorf(err, "write access log failed")
+		}
+	}
+	for {
+		select {
+		case e := <-l.input:
+			write(e)
+			if len(l.input) == 0 {
+				w.Flush()
+			}
+		case <-l.exit:
+			for len(l.input) != 0 {
+				write(<-l.input)
+			}
+			w.Flush()
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+type accessLogBuffer struct {
+	bytes.Buffer
+}
+
+func (b *accessLogBuffer) Close() error {
+	return nil
+}
+
+func TestAccessLog(t *testing.T) {
+	var b = &accessLogBuffer{}
+	l := NewAccessLog(b, 1)
+	for i := 0; i < 4; i++ {
+		r := newRequest("GET", "key"+strconv.Itoa(i))
+		r.Backend = "127.0.0.1:6379"
+		r.Slot = &Slot{id: i}
+		var resp *redis.Resp
+		if i == 3 {
+			resp = redis.NewErrorf("ERR oops")
+		}
+		l.Record(r, "127.0.0.1:10000", "", time.Microsecond*time.Duration(100+i), resp)
+	}
+	l.Record(newRequest("PING"), "127.0.0.1:10000", "", time.Microsecond, nil)
+	assert.MustNoError(l.Close())
+
+	var entries []*AccessLogEntry
+	scanner := bufio.NewScanner(&b.Buffer)
+	for scanner.Scan() {
+		e := &AccessLogEntry{}
+		assert.MustNoError(json.Unmarshal(scanner.Bytes(), e))
+		entries = append(entries, e)
+	}
+	assert.Must(len(entries) == 5)
+	for i, e := range entries[:4] {
+		assert.Must(e.Client == "127.0.0.1:10000")
+		assert.Must(e.Command == "GET")
+		assert.Must(e.Key == "key"+strconv.Itoa(i))
+		assert.Must(e.Slot == i)
+		assert.Must(e.Backend == "127.0.0.1:6379")
+		assert.Must(e.LatencyUs == int64(100+i))
+		assert.Must(e.Timestamp != "")
+	}
+	assert.Must(entries[0].Err == "" && entries[3].Err == "ERR oops")
+	assert.Must(entries[4].Command == "PING" && entries[4].Key == "" && entries[4].Slot == -1)
+	assert.Must(l.Dropped() == 0)
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var b = &accessLogBuffer{}
+	l := NewAccessLog(b, 0)
+	for i := 0; i < 100; i++ {
+		l.Record(newRequest("GET", "key"), "127.0.0.1:10000", "", time.Microsecond, nil)
+	}
+	assert.MustNoError(l.Close())
+	assert.Must(b.Len() == 0)
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+const TokenHeader = "X-Codis-Admin-Token"
+
+type HAState struct {
+	Sentinels      []string       `json:"sentinels"`
+	Masters        map[int]string `json:"masters"`
+	MonitorRunning bool           `json:"monitor_running"`
+}
+
+type MigrationState struct {
+	SlotId        int       `json:"slot_id"`
+	FromAddr      string    `json:"from_addr"`
+	ToAddr        string    `json:"to_addr"`
+	KeysMigrated  int64     `json:"keys_migrated"`
+	KeysRemaining int64     `json:"keys_remaining"`
+	StartedAt     time.Time `json:"started_at"`
+}
+
+type ClientInfo struct {
+	Addr     string `json:"addr"`
+	Database int    `json:"db"`
+	Command  string `json:"cmd"`
+	Age      int64  `json:"age"`
+	Idle     int64  `json:"idle"`
+	Flags    string `json:"flags"`
+}
+
+type SlotRouter interface {
+	GetSlots() []*models.Slot
+	GetSlot(id int) *models.Slot
+	FillSlot(m *models.Slot) error
+	GetHA() HAState
+	GetMigrationProgress() []*MigrationState
+	ListClients() []*ClientInfo
+	KillClient(addr string) bool
+}
+
+type Server struct {
+	l      net.Listener
+	token  string
+	router SlotRouter
+}
+
+func New(addr, token string, router SlotRouter) (*Server, error) {
+	if token == "" {
+		return nil, errors.New("admin token is required")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Server{l: l, token: token, router: router}, nil
+}
+
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *Server) Serve() error {
+	log.Warnf("admin server start service on %s", s.l.Addr())
+	return http.Serve(s.l, s)
+}
+
+func (s *Server) Close() error {
+	return s.l.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	var token = req.Header.Get(TokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid admin token")
+		return
+	}
+
+	var path = strings.TrimSuffix(req.URL.Path, "/")
+	switch {
+	case path == "/api/v1/slots":
+		if req.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJson(w, s.router.GetSlots())
+	case strings.HasPrefix(path, "/api/v1/slots/"):
+		id, err := strconv.Atoi(strings.TrimPrefix(path, "/api/v1/slots/"))
+		if err != nil || id < 0 || id >= models.MaxSlotNum {
+			writeError(w, http.StatusNotFound, "invalid slot id")
+			return
+		}
+		switch req.Method {
+		case "GET":
+			writeJson(w, s.router.GetSlot(id))
+		case "PUT":
+			s.fillSlot(w, req, id)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case path == "/api/v1/ha":
+		if req.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJson(w, s.router.GetHA())
+	case path == "/api/v1/migrations":
+		if req.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJson(w, s.router.GetMigrationProgress())
+	case path == "/api/v1/clients":
+		if req.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJson(w, s.router.ListClients())
+	case strings.HasPrefix(path, "/api/v1/clients/"):
+		if req.Method != "DELETE" {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var addr = strings.TrimPrefix(path, "/api/v1/clients/")
+		if !s.router.KillClient(addr) {
+			writeError(w, http.StatusNotFound, "client not found")
+			return
+		}
+		log.Warnf("admin kill client %s from %s", addr, req.RemoteAddr)
+		writeJson(w, addr)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Server) fillSlot(w http.ResponseWriter, req *http.Request, id int) {
+	var m = &models.Slot{}
+	if err := json.NewDecoder(req.Body).Decode(m); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if m.Id != id {
+		writeError(w, http.StatusBadRequest, "slot id mismatch")
+		return
+	}
+	log.Warnf("admin fill slot-%04d from %s, backend.addr = %s, migrate.from = %s, locked = %t",
+		id, req.RemoteAddr, m.BackendAddr, m.MigrateFrom, m.Locked)
+
+	if err := s.router.FillSlot(m); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, s.router.GetSlot(id))
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	b, _ := json.Marshal(map[string]string{"error": msg})
+	w.WriteHeader(code)
+	w.Write(b)
+}
@@ -0,0 +1,166 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+type fakeRouter struct {
+	slots      []*models.Slot
+	ha         HAState
+	migrations []*MigrationState
+	clients    []*ClientInfo
+}
+
+func newFakeRouter() *fakeRouter {
+	r := &fakeRouter{}
+	for i := 0; i < models.MaxSlotNum; i++ {
+		r.slots = append(r.slots, &models.Slot{Id: i})
+	}
+	return r
+}
+
+func (r *fakeRouter) GetSlots() []*models.Slot {
+	return r.slots
+}
+
+func (r *fakeRouter) GetSlot(id int) *models.Slot {
+	return r.slots[id]
+}
+
+func (r *fakeRouter) FillSlot(m *models.Slot) error {
+	r.slots[m.Id] = m
+	return nil
+}
+
+func (r *fakeRouter) GetHA() HAState {
+	return r.ha
+}
+
+func (r *fakeRouter) GetMigrationProgress() []*MigrationState {
+	return r.migrations
+}
+
+func (r *fakeRouter) ListClients() []*ClientInfo {
+	return r.clients
+}
+
+func (r *fakeRouter) KillClient(addr string) bool {
+	for i, c := range r.clients {
+		if c.Addr == addr {
+			r.clients = append(r.clients[:i], r.clients[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func request(s *Server, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set(TokenHeader, token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminSlots(t *testing.T) {
+	_, err := New("127.0.0.1:0", "", nil)
+	assert.Must(err != nil)
+
+	s, err := New("127.0.0.1:0", "secret", newFakeRouter())
+	assert.MustNoError(err)
+	defer s.Close()
+
+	assert.Must(request(s, "GET", "/api/v1/slots", "", "").Code == http.StatusUnauthorized)
+	assert.Must(request(s, "GET", "/api/v1/slots", "wrong", "").Code == http.StatusUnauthorized)
+
+	w := request(s, "GET", "/api/v1/slots", "secret", "")
+	assert.Must(w.Code == http.StatusOK)
+	var slots []*models.Slot
+	assert.MustNoError(json.Unmarshal(w.Body.Bytes(), &slots))
+	assert.Must(len(slots) == models.MaxSlotNum)
+
+	assert.Must(request(s, "GET", "/api/v1/slots/1024", "secret", "").Code == http.StatusNotFound)
+	assert.Must(request(s, "PUT", "/api/v1/slots/3", "secret", `{"id":4}`).Code == http.StatusBadRequest)
+
+	w = request(s, "PUT", "/api/v1/slots/3", "secret", `{"id":3,"backend_addr":"127.0.0.1:6379"}`)
+	assert.Must(w.Code == http.StatusOK)
+
+	w = request(s, "GET", "/api/v1/slots/3", "secret", "")
+	var m models.Slot
+	assert.MustNoError(json.Unmarshal(w.Body.Bytes(), &m))
+	assert.Must(m.Id == 3 && m.BackendAddr == "127.0.0.1:6379")
+}
+
+func TestAdminHA(t *testing.T) {
+	r := newFakeRouter()
+	r.ha = HAState{
+		Sentinels: []string{"127.0.0.1:26379"},
+		Masters:   map[int]string{1: "127.0.0.1:6379"}, MonitorRunning: true,
+	}
+	s, err := New("127.0.0.1:0", "secret", r)
+	assert.MustNoError(err)
+	defer s.Close()
+
+	assert.Must(request(s, "GET", "/api/v1/ha", "", "").Code == http.StatusUnauthorized)
+	assert.Must(request(s, "PUT", "/api/v1/ha", "secret", "").Code == http.StatusMethodNotAllowed)
+
+	w := request(s, "GET", "/api/v1/ha", "secret", "")
+	assert.Must(w.Code == http.StatusOK)
+	var ha HAState
+	assert.MustNoError(json.Unmarshal(w.Body.Bytes(), &ha))
+	assert.Must(ha.MonitorRunning && len(ha.Sentinels) == 1 && ha.Masters[1] == "127.0.0.1:6379")
+}
+
+func TestAdminMigrations(t *testing.T) {
+	r := newFakeRouter()
+	r.migrations = []*MigrationState{{
+		SlotId: 3, FromAddr: "127.0.0.1:6379", ToAddr: "127.0.0.1:6380",
+		KeysMigrated: 10, KeysRemaining: 5,
+	}}
+	s, err := New("127.0.0.1:0", "secret", r)
+	assert.MustNoError(err)
+	defer s.Close()
+
+	assert.Must(request(s, "POST", "/api/v1/migrations", "secret", "").Code == http.StatusMethodNotAllowed)
+
+	w := request(s, "GET", "/api/v1/migrations", "secret", "")
+	assert.Must(w.Code == http.StatusOK)
+	var states []*MigrationState
+	assert.MustNoError(json.Unmarshal(w.Body.Bytes(), &states))
+	assert.Must(len(states) == 1 && states[0].SlotId == 3 && states[0].ToAddr == "127.0.0.1:6380")
+	assert.Must(states[0].KeysMigrated == 10 && states[0].KeysRemaining == 5)
+}
+
+func TestAdminClients(t *testing.T) {
+	r := newFakeRouter()
+	r.clients = []*ClientInfo{
+		{Addr: "127.0.0.1:10000", Command: "get", Flags: "N"},
+		{Addr: "127.0.0.1:10001", Database: 1, Command: "multi", Flags: "x"},
+	}
+	s, err := New("127.0.0.1:0", "secret", r)
+	assert.MustNoError(err)
+	defer s.Close()
+
+	w := request(s, "GET", "/api/v1/clients", "secret", "")
+	assert.Must(w.Code == http.StatusOK)
+	var clients []*ClientInfo
+	assert.MustNoError(json.Unmarshal(w.Body.Bytes(), &clients))
+	assert.Must(len(clients) == 2 && clients[1].Database == 1 && clients[1].Flags == "x")
+
+	assert.Must(request(s, "GET", "/api/v1/clients/127.0.0.1:10000", "secret", "").Code == http.StatusMethodNotAllowed)
+	assert.Must(request(s, "DELETE", "/api/v1/clients/127.0.0.1:10000", "secret", "").Code == http.StatusOK)
+	assert.Must(request(s, "DELETE", "/api/v1/clients/127.0.0.1:10000", "secret", "").Code == http.StatusNotFound)
+	assert.Must(len(r.clients) == 1)
+}
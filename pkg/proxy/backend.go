@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,6 +23,7 @@ import (
 const (
 	stateConnected = iota + 1
 	stateDataStale
+	stateIdle
 )
 
 type BackendConn struct {
@@ -34,18 +36,38 @@ type BackendConn struct {
 		delay Delay
 	}
 	state atomic2.Int64
+	using atomic2.Int64
+	reset atomic2.Bool
+
+	pending atomic2.Int64
+	failed  atomic2.Int64
+
+	maxPending atomic2.Int64
 
 	closed atomic2.Bool
 	config *Config
 
 	database int
+
+	// clientName is the request id last sent by CLIENT SETNAME, only used by loopWriter.
+	clientName string
+
+	breaker *circuitBreaker
+	health  *healthScorer
+	events  *eventHub
 }
 
 func NewBackendConn(addr string, database int, config *Config) *BackendConn {
+	return newBackendConn(addr, database, config, nil, nil, nil)
+}
+
+func newBackendConn(addr string, database int, config *Config, breaker *circuitBreaker, health *healthScorer, events *eventHub) *BackendConn {
 	bc := &BackendConn{
 		addr: addr, config: config, database: database,
+		breaker: breaker, health: health, events: events,
 	}
 	bc.input = make(chan *Request, 1024)
+	bc.using.Set(time.Now().UnixNano())
 	bc.retry.delay = &DelayExp2{
 		Min: 50, Max: 5000,
 		Unit: time.Millisecond,
@@ -68,27 +90,68 @@ func (bc *BackendConn) Close() {
 }
 
 func (bc *BackendConn) IsConnected() bool {
-	return bc.state.Int64() == stateConnected
+	switch bc.state.Int64() {
+	case stateConnected, stateIdle:
+		return true
+	}
+	return false
 }
 
 func (bc *BackendConn) PushBack(r *Request) {
+	r.Backend = bc.addr
+	bc.using.Set(time.Now().UnixNano())
+	bc.pushBack(r)
+}
+
+func (bc *BackendConn) pushBack(r *Request) {
+	n := bc.pending.Incr()
 	if r.Batch != nil {
 		r.Batch.Add(1)
 	}
+	if limit := bc.config.BackendMaxPendingRequests; limit != 0 && n > int64(limit) {
+		bc.setResponse(r, nil, ErrBackendOverloaded)
+		return
+	}
+	for {
+		max := bc.maxPending.Int64()
+		if n <= max || bc.maxPending.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	if !bc.breaker.Allow() {
+		bc.setResponse(r, nil, ErrCircuitOpen)
+		return
+	}
 	bc.input <- r
 }
 
 func (bc *BackendConn) KeepAlive() bool {
+	return bc.keepAlive(true)
+}
+
+// keepAlive pings the backend, connections idle for backend_max_idle_time are
+// closed instead if evictIdle is true.
+func (bc *BackendConn) keepAlive(evictIdle bool) bool {
 	if len(bc.input) != 0 {
 		return false
 	}
 	switch bc.state.Int64() {
+	case stateIdle:
+		return true
+
+	case stateConnected:
+		if evictIdle && bc.isIdleTimeout() {
+			bc.input <- idleMarker
+			return true
+		}
+		fallthrough
+
 	default:
 		m := &Request{}
 		m.Multi = []*redis.Resp{
 			redis.NewBulkBytes([]byte("PING")),
 		}
-		bc.PushBack(m)
+		bc.pushBack(m)
 
 	case stateDataStale:
 		m := &Request{}
@@ -96,7 +159,7 @@ func (bc *BackendConn) KeepAlive() bool {
 			redis.NewBulkBytes([]byte("INFO")),
 		}
 		m.Batch = &sync.WaitGroup{}
-		bc.PushBack(m)
+		bc.pushBack(m)
 
 		keepAliveCallback <- func() {
 			m.Batch.Wait()
@@ -144,6 +207,31 @@ func (bc *BackendConn) KeepAlive() bool {
 	return true
 }
 
+// reconnect closes the connection after requests already queued have been
+// sent, the backend is dialed again on the next request. It never blocks, since
+// it's called with the router locked: if the input is full, the connection is
+// closed once the writer has sent the next request instead.
+func (bc *BackendConn) reconnect() {
+	switch bc.state.Int64() {
+	case stateConnected, stateDataStale:
+		bc.reset.Set(true)
+		select {
+		case bc.input <- idleMarker:
+		default:
+		}
+	}
+}
+
+func (bc *BackendConn) isIdleTimeout() bool {
+	d := bc.config.BackendMaxIdleTime.Duration()
+	if d <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, bc.using.Int64())) > d
+}
+
+var idleMarker = &Request{}
+
 var keepAliveCallback = make(chan func(), 128)
 
 func init() {
@@ -155,21 +243,23 @@ func init() {
 }
 
 func (bc *BackendConn) newBackendReader(round int, config *Config) (*redis.Conn, chan<- *Request, error) {
-	c, err := redis.DialTimeout(bc.addr, time.Second*5,
-		config.BackendRecvBufsize.AsInt(),
-		config.BackendSendBufsize.AsInt())
+	c, err := dialBackend(bc.addr, config)
 	if err != nil {
+		bc.breaker.Failure()
 		return nil, nil, err
 	}
 	c.ReaderTimeout = config.BackendRecvTimeout.Duration()
 	c.WriterTimeout = config.BackendSendTimeout.Duration()
 	c.SetKeepAlivePeriod(config.BackendKeepAlivePeriod.Duration())
 
-	if err := bc.verifyAuth(c, config.ProductAuth); err != nil {
+	if err := verifyAuth(c, config); err != nil {
+		log.WarnErrorf(err, "backend conn [%p] to %s, db-%d auth failed",
+			bc, bc.addr, bc.database)
+		bc.breaker.Failure()
 		c.Close()
 		return nil, nil, err
 	}
-	if err := bc.selectDatabase(c, bc.database); err != nil {
+	if err := selectDatabase(c, bc.database); err != nil {
 		c.Close()
 		return nil, nil, err
 	}
@@ -180,15 +270,38 @@ func (bc *BackendConn) newBackendReader(round int, config *Config) (*redis.Conn,
 	return c, tasks, nil
 }
 
-func (bc *BackendConn) verifyAuth(c *redis.Conn, auth string) error {
-	if auth == "" {
+func dialBackend(addr string, config *Config) (*redis.Conn, error) {
+	var timeout = config.BackendConnectTimeout.Duration()
+	if timeout == 0 {
+		timeout = time.Second * 5
+	}
+	if !config.BackendTLS {
+		return redis.DialTimeout(addr, timeout,
+			config.BackendRecvBufsize.AsInt(),
+			config.BackendSendBufsize.AsInt())
+	}
+	tlsConfig, err := config.BackendTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return redis.DialTLSTimeout(addr, timeout,
+		config.BackendRecvBufsize.AsInt(),
+		config.BackendSendBufsize.AsInt(), tlsConfig)
+}
+
+func verifyAuth(c *redis.Conn, config *Config) error {
+	username, password := config.BackendAuth()
+	if password == "" {
 		return nil
 	}
 
 	multi := []*redis.Resp{
 		redis.NewBulkBytes([]byte("AUTH")),
-		redis.NewBulkBytes([]byte(auth)),
 	}
+	if username != "" {
+		multi = append(multi, redis.NewBulkBytes([]byte(username)))
+	}
+	multi = append(multi, redis.NewBulkBytes([]byte(password)))
 
 	if err := c.EncodeMultiBulk(multi, true); err != nil {
 		return err
@@ -209,7 +322,7 @@ func (bc *BackendConn) verifyAuth(c *redis.Conn, auth string) error {
 	}
 }
 
-func (bc *BackendConn) selectDatabase(c *redis.Conn, database int) error {
+func selectDatabase(c *redis.Conn, database int) error {
 	if database == 0 {
 		return nil
 	}
@@ -239,7 +352,26 @@ func (bc *BackendConn) selectDatabase(c *redis.Conn, database int) error {
 }
 
 func (bc *BackendConn) setResponse(r *Request, resp *redis.Resp, err error) error {
+	if r == idleMarker {
+		return err
+	}
 	r.Resp, r.Err = resp, err
+	bc.pending.Decr()
+	if err != nil {
+		bc.failed.Incr()
+	}
+	switch err {
+	case nil:
+		bc.breaker.Success()
+		bc.health.Record(r, false)
+	case ErrCircuitOpen, ErrRequestIsBroken, ErrBackendOverloaded:
+	default:
+		bc.breaker.Failure()
+		bc.health.Record(r, true)
+	}
+	if r.Slot != nil {
+		r.Slot.stats.incrResponse(resp, err)
+	}
 	if r.Group != nil {
 		r.Group.Done()
 	}
@@ -251,7 +383,11 @@ func (bc *BackendConn) setResponse(r *Request, resp *redis.Resp, err error) erro
 
 var (
 	ErrBackendConnReset = errors.New("backend conn reset")
+	ErrRequestNotSent   = errors.New("backend conn reset, request not sent")
+	ErrBackendConnIdle  = errors.New("backend conn idle")
 	ErrRequestIsBroken  = errors.New("request is broken")
+
+	ErrBackendOverloaded = errors.New("backend overloaded")
 )
 
 func (bc *BackendConn) run() {
@@ -260,7 +396,12 @@ func (bc *BackendConn) run() {
 	for round := 0; bc.closed.IsFalse(); round++ {
 		log.Warnf("backend conn [%p] to %s, db-%d round-[%d]",
 			bc, bc.addr, bc.database, round)
-		if err := bc.loopWriter(round); err != nil {
+		switch err := bc.loopWriter(round); {
+		case err == ErrBackendConnIdle:
+			log.Warnf("backend conn [%p] to %s, db-%d state = Idle",
+				bc, bc.addr, bc.database)
+			bc.state.Set(stateIdle)
+		case err != nil:
 			bc.delayBeforeRetry()
 		}
 	}
@@ -320,50 +461,165 @@ func (bc *BackendConn) delayBeforeRetry() {
 			if !ok {
 				return
 			}
-			bc.setResponse(r, nil, ErrBackendConnReset)
+			bc.setResponse(r, nil, ErrRequestNotSent)
 		}
 	}
 }
 
 func (bc *BackendConn) loopWriter(round int) (err error) {
 	defer func() {
+		if err == ErrBackendConnIdle {
+			return
+		}
 		for i := len(bc.input); i != 0; i-- {
 			r := <-bc.input
-			bc.setResponse(r, nil, ErrBackendConnReset)
+			bc.setResponse(r, nil, ErrRequestNotSent)
 		}
 		log.WarnErrorf(err, "backend conn [%p] to %s, db-%d writer-[%d] exit",
 			bc, bc.addr, bc.database, round)
 	}()
+
+	var first *Request
+	if bc.state.Int64() == stateIdle {
+		for first == nil || first == idleMarker {
+			r, ok := <-bc.input
+			if !ok {
+				return nil
+			}
+			first = r
+		}
+	}
+
 	c, tasks, err := bc.newBackendReader(round, bc.config)
 	if err != nil {
+		if first != nil {
+			bc.setResponse(first, nil, err)
+		}
 		return err
 	}
 	defer close(tasks)
 
 	defer bc.state.Set(0)
 
+	if fn := bc.config.OnBackendDisconnect; fn != nil {
+		defer func() {
+			fn(bc.addr, err)
+		}()
+	}
+	defer func() {
+		var fields = map[string]interface{}{"addr": bc.addr, "database": bc.database}
+		if err != nil {
+			fields["error"] = err.Error()
+		}
+		bc.events.Publish("backend_disconnect", fields)
+	}()
+	if fn := bc.config.OnBackendConnect; fn != nil {
+		fn(bc.addr)
+	}
+	bc.events.Publish("backend_connect", map[string]interface{}{"addr": bc.addr, "database": bc.database})
+
 	bc.state.Set(stateConnected)
 	bc.retry.fails = 0
+	bc.clientName = ""
 	bc.retry.delay.Reset()
 
+	var delay = bc.config.PipelineFlushDelay.Duration()
+
 	p := c.FlushEncoder()
-	p.MaxInterval = time.Millisecond
+	p.MaxInterval = math2.MaxDuration(time.Millisecond, delay)
 	p.MaxBuffered = cap(tasks) / 2
 
-	for r := range bc.input {
-		if r.IsReadOnly() && r.IsBroken() {
-			bc.setResponse(r, nil, ErrRequestIsBroken)
-			continue
+	if first != nil {
+		if err := bc.writeRequest(p, tasks, first, delay); err != nil {
+			return err
 		}
-		if err := p.EncodeMultiBulk(r.Multi); err != nil {
-			return bc.setResponse(r, nil, fmt.Errorf("backend conn failure, %s", err))
+	}
+	var linger = time.NewTimer(time.Hour)
+	linger.Stop()
+	defer linger.Stop()
+
+	for {
+		r, ok, err := bc.nextInput(p, linger, delay)
+		if err != nil {
+			return err
 		}
-		if err := p.Flush(len(bc.input) == 0); err != nil {
-			return bc.setResponse(r, nil, fmt.Errorf("backend conn failure, %s", err))
-		} else {
-			tasks <- r
+		if !ok {
+			return nil
+		}
+		if r != idleMarker {
+			if err := bc.writeRequest(p, tasks, r, delay); err != nil {
+				return err
+			}
+		}
+		if r == idleMarker || bc.reset.IsTrue() {
+			bc.reset.Set(false)
+			if err := p.Flush(true); err != nil {
+				return fmt.Errorf("backend conn failure, %s", err)
+			}
+			return ErrBackendConnIdle
+		}
+	}
+}
+
+// nextInput returns the next queued request. Buffered requests are flushed
+// before blocking, unless delay is set and the batch isn't full yet: then it
+// waits up to delay for another request to write together with them.
+func (bc *BackendConn) nextInput(p *redis.FlushEncoder, linger *time.Timer, delay time.Duration) (*Request, bool, error) {
+	if delay != 0 && p.Buffered() != 0 && p.Buffered() < p.MaxBuffered {
+		linger.Reset(delay)
+		select {
+		case r, ok := <-bc.input:
+			if !linger.Stop() {
+				<-linger.C
+			}
+			return r, ok, nil
+		case <-linger.C:
+		}
+	}
+	if p.Buffered() != 0 {
+		if err := p.Flush(true); err != nil {
+			return nil, false, fmt.Errorf("backend conn failure, %s", err)
 		}
 	}
+	r, ok := <-bc.input
+	return r, ok, nil
+}
+
+func (bc *BackendConn) writeRequest(p *redis.FlushEncoder, tasks chan<- *Request, r *Request, delay time.Duration) error {
+	if r.IsReadOnly() && r.IsBroken() {
+		bc.setResponse(r, nil, ErrRequestIsBroken)
+		return nil
+	}
+	if bc.config.EnableRequestIDPropagation && r.RequestID != bc.clientName {
+		if err := bc.writeClientName(p, tasks, r.RequestID); err != nil {
+			return bc.setResponse(r, nil, err)
+		}
+	}
+	if err := p.EncodeMultiBulk(r.Multi); err != nil {
+		return bc.setResponse(r, nil, fmt.Errorf("backend conn failure, %s", err))
+	}
+	if err := p.Flush(len(bc.input) == 0 && delay == 0); err != nil {
+		return bc.setResponse(r, nil, fmt.Errorf("backend conn failure, %s", err))
+	}
+	tasks <- r
+	return nil
+}
+
+// writeClientName queues CLIENT SETNAME ahead of the next request, its reply
+// is consumed by loopReader like any other request that has no waiters.
+func (bc *BackendConn) writeClientName(p *redis.FlushEncoder, tasks chan<- *Request, name string) error {
+	var x = &Request{OpStr: "CLIENT"}
+	x.Multi = []*redis.Resp{
+		redis.NewBulkBytes([]byte("CLIENT")),
+		redis.NewBulkBytes([]byte("SETNAME")),
+		redis.NewBulkBytes([]byte(name)),
+	}
+	if err := p.EncodeMultiBulk(x.Multi); err != nil {
+		return fmt.Errorf("backend conn failure, %s", err)
+	}
+	bc.pending.Incr()
+	bc.clientName = name
+	tasks <- x
 	return nil
 }
 
@@ -375,9 +631,14 @@ type sharedBackendConn struct {
 	owner *sharedBackendConnPool
 	conns [][]*BackendConn
 
+	breaker *circuitBreaker
+	health  *healthScorer
+
 	single []*BackendConn
 
 	refcnt int
+
+	resolved string
 }
 
 func newSharedBackendConn(addr string, pool *sharedBackendConnPool) *sharedBackendConn {
@@ -390,11 +651,16 @@ func newSharedBackendConn(addr string, pool *sharedBackendConnPool) *sharedBacke
 		host: []byte(host), port: []byte(port),
 	}
 	s.owner = pool
+	s.breaker = newCircuitBreaker(addr, pool.config)
+	if s.breaker != nil {
+		s.breaker.events = pool.events
+	}
+	s.health = newHealthScorer(pool.config)
 	s.conns = make([][]*BackendConn, pool.config.BackendNumberDatabases)
 	for database := range s.conns {
 		parallel := make([]*BackendConn, pool.parallel)
 		for i := range parallel {
-			parallel[i] = NewBackendConn(addr, database, pool.config)
+			parallel[i] = newBackendConn(addr, database, pool.config, s.breaker, s.health, pool.events)
 		}
 		s.conns[database] = parallel
 	}
@@ -447,17 +713,95 @@ func (s *sharedBackendConn) Retain() *sharedBackendConn {
 	return s
 }
 
+// KeepAlive keeps backend_min_pool_size connected connections from being
+// closed for being idle, otherwise Prewarm would connect them again.
 func (s *sharedBackendConn) KeepAlive() {
+	if s == nil {
+		return
+	}
+	var keep = s.owner.config.BackendMinPoolSize
+	for _, parallel := range s.conns {
+		for _, bc := range parallel {
+			if keep > 0 && bc.state.Int64() == stateConnected {
+				keep--
+				bc.keepAlive(false)
+			} else {
+				bc.KeepAlive()
+			}
+		}
+	}
+}
+
+// Prewarm connects idle connections until at least min of them are connected,
+// it returns number of connections being connected.
+func (s *sharedBackendConn) Prewarm(min int) int {
+	if s == nil || s.breaker.IsOpen() {
+		return 0
+	}
+	var connected int
+	var idle []*BackendConn
+	for _, parallel := range s.conns {
+		for _, bc := range parallel {
+			switch bc.state.Int64() {
+			case stateConnected, stateDataStale:
+				connected++
+			case stateIdle:
+				if len(bc.input) == 0 {
+					idle = append(idle, bc)
+				}
+			}
+		}
+	}
+	var n int
+	for _, bc := range idle {
+		if connected+n >= min {
+			break
+		}
+		m := &Request{}
+		m.Multi = []*redis.Resp{
+			redis.NewBulkBytes([]byte("PING")),
+		}
+		bc.PushBack(m)
+		n++
+	}
+	return n
+}
+
+func (s *sharedBackendConn) setResolved(ips string) {
+	if s.resolved != "" && s.resolved != ips {
+		log.Warnf("backend %s resolved to [%s], was [%s], reconnect", s.addr, ips, s.resolved)
+		s.Reconnect()
+	}
+	s.resolved = ips
+}
+
+func (s *sharedBackendConn) Reconnect() {
 	if s == nil {
 		return
 	}
 	for _, parallel := range s.conns {
 		for _, bc := range parallel {
-			bc.KeepAlive()
+			bc.reconnect()
 		}
 	}
 }
 
+func resolveBackendAddr(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	sort.Strings(ips)
+	return strings.Join(ips, ","), nil
+}
+
 func (s *sharedBackendConn) BackendConn(database int32, seed uint, must bool) *BackendConn {
 	if s == nil {
 		return nil
@@ -486,9 +830,92 @@ func (s *sharedBackendConn) BackendConn(database int32, seed uint, must bool) *B
 	return parallel[0]
 }
 
+// SlotKeys returns number of keys of slot id in database 0 using SLOTSINFO.
+func (s *sharedBackendConn) SlotKeys(id int) (int64, error) {
+	m := &Request{}
+	m.Multi = []*redis.Resp{
+		redis.NewBulkBytes([]byte("SLOTSINFO")),
+		redis.NewBulkBytes([]byte(strconv.Itoa(id))),
+		redis.NewBulkBytes([]byte("1")),
+	}
+	m.Batch = &sync.WaitGroup{}
+
+	s.BackendConn(0, 0, true).PushBack(m)
+
+	m.Batch.Wait()
+
+	if err := m.Err; err != nil {
+		return 0, err
+	}
+	switch resp := m.Resp; {
+	case resp == nil:
+		return 0, ErrRespIsRequired
+	case resp.IsError():
+		return 0, fmt.Errorf("bad slotsinfo resp: %s", resp.Value)
+	case resp.IsArray():
+		for _, info := range resp.Array {
+			if len(info.Array) != 2 {
+				return 0, fmt.Errorf("bad slotsinfo resp: array.len = %d", len(info.Array))
+			}
+			if slot, err := redis.Btoi64(info.Array[0].Value); err == nil && slot == int64(id) {
+				return redis.Btoi64(info.Array[1].Value)
+			}
+		}
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("bad slotsinfo resp: should be array, but got %s", resp.Type)
+	}
+}
+
+func (s *sharedBackendConn) WaitConnected(timeout time.Duration) int {
+	var deadline = time.Now().Add(timeout)
+	var connected int
+	for _, parallel := range s.conns {
+		for _, bc := range parallel {
+			for !bc.IsConnected() && bc.closed.IsFalse() && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond * 10)
+			}
+			if bc.IsConnected() {
+				connected++
+			}
+		}
+	}
+	return connected
+}
+
+type PoolStats struct {
+	Addr        string `json:"addr"`
+	TotalConns  int    `json:"total_conns"`
+	IdleConns   int    `json:"idle_conns"`
+	ActiveConns int    `json:"active_conns"`
+	TotalErrors int64  `json:"total_errors"`
+	MaxPending  int64  `json:"max_pending"`
+}
+
+func (s *sharedBackendConn) collectStats(stats *PoolStats) {
+	for _, parallel := range s.conns {
+		for _, bc := range parallel {
+			stats.TotalErrors += bc.failed.Int64()
+			if n := bc.maxPending.Int64(); n > stats.MaxPending {
+				stats.MaxPending = n
+			}
+			if !bc.IsConnected() {
+				continue
+			}
+			stats.TotalConns++
+			if bc.pending.Int64() != 0 {
+				stats.ActiveConns++
+			} else {
+				stats.IdleConns++
+			}
+		}
+	}
+}
+
 type sharedBackendConnPool struct {
 	config   *Config
 	parallel int
+	events   *eventHub
 
 	pool map[string]*sharedBackendConn
 }
@@ -507,6 +934,14 @@ func (p *sharedBackendConnPool) KeepAlive() {
 	}
 }
 
+func (p *sharedBackendConnPool) Prewarm(min int) int {
+	var n int
+	for _, bc := range p.pool {
+		n += bc.Prewarm(min)
+	}
+	return n
+}
+
 func (p *sharedBackendConnPool) Get(addr string) *sharedBackendConn {
 	return p.pool[addr]
 }
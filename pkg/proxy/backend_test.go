@@ -4,15 +4,27 @@
 package proxy
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
 	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
 )
 
 func newConnPair(config *Config) (*redis.Conn, *BackendConn) {
@@ -80,3 +92,505 @@ func TestBackend(t *testing.T) {
 		assert.Must(string(r.Resp.Value) == strconv.Itoa(i))
 	}
 }
+
+func newTLSListener(config *Config) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.MustNoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.MustNoError(err)
+	b, err := x509.MarshalECPrivateKey(key)
+	assert.MustNoError(err)
+
+	dir, err := ioutil.TempDir("", "codis-tls")
+	assert.MustNoError(err)
+	config.BackendTLSCertFile = filepath.Join(dir, "cert.pem")
+	config.BackendTLSKeyFile = filepath.Join(dir, "key.pem")
+	assert.MustNoError(ioutil.WriteFile(config.BackendTLSCertFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.MustNoError(ioutil.WriteFile(config.BackendTLSKeyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600))
+
+	cert, err := tls.LoadX509KeyPair(config.BackendTLSCertFile, config.BackendTLSKeyFile)
+	assert.MustNoError(err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	assert.MustNoError(err)
+	return l
+}
+
+func TestBackendTLS(t *testing.T) {
+	config := NewDefaultConfig()
+	config.BackendTLS = true
+	config.BackendTLSSkipVerify = true
+
+	l := newTLSListener(config)
+	defer l.Close()
+	defer os.RemoveAll(filepath.Dir(config.BackendTLSCertFile))
+
+	go func() {
+		for i := 0; i < 2; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn := redis.NewConn(c, 1024, 1024)
+			_, err = conn.Decode()
+			assert.MustNoError(err)
+			assert.MustNoError(conn.Encode(redis.NewString([]byte(strconv.Itoa(i))), true))
+			conn.Close()
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), 0, config)
+	defer bc.Close()
+
+	for i := 0; i < 2; i++ {
+		var r *Request
+		for j := 0; j < 100; j++ {
+			r = &Request{Batch: &sync.WaitGroup{}}
+			r.Multi = []*redis.Resp{redis.NewBulkBytes([]byte("PING"))}
+			bc.PushBack(r)
+			r.Batch.Wait()
+			if r.Err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond * 50)
+		}
+		assert.MustNoError(r.Err)
+		assert.Must(string(r.Resp.Value) == strconv.Itoa(i))
+	}
+}
+
+func TestBackendTLSRefusePlain(t *testing.T) {
+	config := NewDefaultConfig()
+
+	l := newTLSListener(config)
+	defer l.Close()
+	defer os.RemoveAll(filepath.Dir(config.BackendTLSCertFile))
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		assert.Must(c.(*tls.Conn).Handshake() != nil)
+	}()
+
+	c, err := redis.DialTimeout(l.Addr().String(), time.Second, 1024, 1024)
+	assert.MustNoError(err)
+	defer c.Close()
+	c.ReaderTimeout = time.Second
+	assert.MustNoError(c.EncodeMultiBulk([]*redis.Resp{
+		redis.NewBulkBytes([]byte("PING")),
+	}, true))
+	_, err = c.Decode()
+	assert.Must(err != nil)
+}
+
+func TestBackendIdleTimeout(t *testing.T) {
+	config := NewDefaultConfig()
+	config.BackendMaxIdleTime.Set(time.Millisecond * 50)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	var exit = make(chan int, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(i int, conn *redis.Conn) {
+				defer func() {
+					conn.Close()
+					exit <- i
+				}()
+				for {
+					if _, err := conn.Decode(); err != nil {
+						return
+					}
+					if err := conn.Encode(redis.NewString([]byte(strconv.Itoa(i))), true); err != nil {
+						return
+					}
+				}
+			}(i, redis.NewConn(c, 1024, 1024))
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), 0, config)
+	defer bc.Close()
+
+	ping := func() *Request {
+		r := &Request{Batch: &sync.WaitGroup{}}
+		r.Multi = []*redis.Resp{redis.NewBulkBytes([]byte("PING"))}
+		bc.PushBack(r)
+		r.Batch.Wait()
+		return r
+	}
+
+	r := ping()
+	assert.MustNoError(r.Err)
+	assert.Must(string(r.Resp.Value) == "0")
+
+	time.Sleep(time.Millisecond * 100)
+	assert.Must(bc.KeepAlive())
+	assert.Must(<-exit == 0)
+	for bc.state.Int64() != stateIdle {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Must(bc.IsConnected())
+	assert.Must(bc.KeepAlive())
+
+	r = ping()
+	assert.MustNoError(r.Err)
+	assert.Must(string(r.Resp.Value) == "1")
+	assert.Must(bc.state.Int64() == stateConnected)
+}
+
+func TestBackendReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	go func() {
+		for i := 0; ; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(i int, conn *redis.Conn) {
+				defer conn.Close()
+				for {
+					if _, err := conn.Decode(); err != nil {
+						return
+					}
+					if err := conn.Encode(redis.NewString([]byte(strconv.Itoa(i))), true); err != nil {
+						return
+					}
+				}
+			}(i, redis.NewConn(c, 1024, 1024))
+		}
+	}()
+
+	bc := NewBackendConn(l.Addr().String(), 0, NewDefaultConfig())
+	defer bc.Close()
+
+	ping := func() string {
+		r := &Request{Batch: &sync.WaitGroup{}}
+		r.Multi = []*redis.Resp{redis.NewBulkBytes([]byte("PING"))}
+		bc.PushBack(r)
+		r.Batch.Wait()
+		assert.MustNoError(r.Err)
+		return string(r.Resp.Value)
+	}
+	assert.Must(ping() == "0")
+
+	bc.reconnect()
+	for bc.state.Int64() != stateIdle {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Must(ping() == "1")
+
+	// The idle marker can't be queued, the connection is reset after the
+	// next request instead.
+	bc.reset.Set(true)
+	assert.Must(ping() == "1")
+	for bc.state.Int64() != stateIdle {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Must(ping() == "2")
+
+	// Reconnecting never blocks on a full input.
+	full := &BackendConn{input: make(chan *Request, 1)}
+	full.state.Set(stateConnected)
+	full.input <- &Request{}
+	full.reconnect()
+	assert.Must(full.reset.IsTrue() && len(full.input) == 1)
+}
+
+func TestBackendAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	var auth = make(chan []string, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *redis.Conn) {
+				defer conn.Close()
+				for {
+					multi, err := conn.DecodeMultiBulk()
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, m := range multi {
+						args = append(args, string(m.Value))
+					}
+					switch {
+					case args[0] != "AUTH":
+						conn.Encode(redis.NewString([]byte("PONG")), true)
+					case args[len(args)-1] == "secret":
+						auth <- args
+						conn.Encode(redis.NewString([]byte("OK")), true)
+					default:
+						auth <- args
+						conn.Encode(redis.NewErrorf("WRONGPASS invalid username-password pair"), true)
+						return
+					}
+				}
+			}(redis.NewConn(c, 1024, 1024))
+		}
+	}()
+
+	ping := func(bc *BackendConn) *Request {
+		r := &Request{Batch: &sync.WaitGroup{}}
+		r.Multi = []*redis.Resp{redis.NewBulkBytes([]byte("PING"))}
+		bc.PushBack(r)
+		r.Batch.Wait()
+		return r
+	}
+
+	config := NewDefaultConfig()
+	config.ProductAuth = "product"
+	config.BackendUsername = "user"
+	config.BackendPassword = "secret"
+	assert.MustNoError(config.Validate())
+
+	bc := NewBackendConn(l.Addr().String(), 0, config)
+	assert.Must(strings.Join(<-auth, " ") == "AUTH user secret")
+	r := ping(bc)
+	assert.MustNoError(r.Err)
+	assert.Must(string(r.Resp.Value) == "PONG")
+	bc.Close()
+
+	config = NewDefaultConfig()
+	config.ProductAuth = "product"
+	config.BackendCircuitBreakerThreshold = 1
+	config.BackendCircuitBreakerTimeout.Set(time.Minute)
+
+	breaker := newCircuitBreaker(l.Addr().String(), config)
+	bc = newBackendConn(l.Addr().String(), 0, config, breaker, nil, nil)
+	defer bc.Close()
+	assert.Must(strings.Join(<-auth, " ") == "AUTH product")
+	for !breaker.IsOpen() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Must(!bc.IsConnected())
+	assert.Must(ping(bc).Err == ErrCircuitOpen)
+
+	config.BackendUsername = "user"
+	assert.Must(config.Validate() != nil)
+}
+
+func TestBackendTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	var accepted = make(chan net.Conn, 16)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	config := NewDefaultConfig()
+	config.ProductAuth = ""
+	config.BackendRecvTimeout.Set(time.Millisecond * 100)
+	config.BackendCircuitBreakerThreshold = 1
+	config.BackendCircuitBreakerTimeout.Set(time.Minute)
+
+	breaker := newCircuitBreaker(l.Addr().String(), config)
+	bc := newBackendConn(l.Addr().String(), 0, config, breaker, nil, nil)
+	defer bc.Close()
+
+	r := &Request{Batch: &sync.WaitGroup{}}
+	r.Multi = []*redis.Resp{redis.NewBulkBytes([]byte("PING"))}
+	bc.PushBack(r)
+	r.Batch.Wait()
+	assert.Must(r.Err != nil)
+	assert.Must(breaker.IsOpen())
+
+	c := <-accepted
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = ioutil.ReadAll(c)
+	assert.Must(err == nil)
+}
+
+func TestBackendMaxPending(t *testing.T) {
+	config := NewDefaultConfig()
+	config.BackendMaxPendingRequests = 4
+
+	conn, bc := newConnPair(config)
+	defer bc.Close()
+
+	var array = make([]*Request, 8)
+	for i := range array {
+		array[i] = &Request{Batch: &sync.WaitGroup{}}
+		array[i].Multi = []*redis.Resp{redis.NewBulkBytes([]byte("PING"))}
+		bc.PushBack(array[i])
+	}
+
+	go func() {
+		defer conn.Close()
+		for i := 0; i < 4; i++ {
+			_, err := conn.Decode()
+			assert.MustNoError(err)
+			assert.MustNoError(conn.Encode(redis.NewString([]byte("PONG")), true))
+		}
+	}()
+
+	for i, r := range array {
+		r.Batch.Wait()
+		if i < 4 {
+			assert.MustNoError(r.Err)
+		} else {
+			assert.Must(r.Err == ErrBackendOverloaded)
+		}
+	}
+
+	var stats = &PoolStats{}
+	s := &sharedBackendConn{conns: [][]*BackendConn{{bc}}}
+	s.collectStats(stats)
+	assert.Must(stats.MaxPending == 4 && stats.TotalErrors == 4)
+}
+
+func newPongServer() net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c *redis.Conn) {
+				defer c.Close()
+				for {
+					if _, err := c.Decode(); err != nil {
+						return
+					}
+					if err := c.Encode(redis.NewString([]byte("PONG")), true); err != nil {
+						return
+					}
+				}
+			}(redis.NewConn(c, 1024*64, 1024*64))
+		}
+	}()
+	return l
+}
+
+func TestBackendPipelineFlushDelay(t *testing.T) {
+	l := newPongServer()
+	defer l.Close()
+
+	config := NewDefaultConfig()
+	config.ProductAuth = ""
+	config.PipelineFlushDelay.Set(time.Millisecond * 5)
+
+	bc := NewBackendConn(l.Addr().String(), 0, config)
+	defer bc.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 16; j++ {
+				r := &Request{Batch: &sync.WaitGroup{}}
+				r.Multi = []*redis.Resp{redis.NewBulkBytes([]byte("PING"))}
+				bc.PushBack(r)
+				r.Batch.Wait()
+				assert.MustNoError(r.Err)
+				assert.Must(string(r.Resp.Value) == "PONG")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBackendPipelineFlushFullBatch(t *testing.T) {
+	l := newPongServer()
+	defer l.Close()
+
+	config := NewDefaultConfig()
+	config.ProductAuth = ""
+	config.BackendMaxPipeline = 8
+	config.PipelineFlushDelay.Set(time.Second * 2)
+
+	bc := NewBackendConn(l.Addr().String(), 0, config)
+	defer bc.Close()
+
+	// Full batches are flushed right away, only the last partial one waits
+	// for the delay.
+	var done atomic2.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		r := &Request{Batch: &sync.WaitGroup{}}
+		r.Multi = []*redis.Resp{redis.NewBulkBytes([]byte("PING"))}
+		bc.PushBack(r)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Batch.Wait()
+			assert.MustNoError(r.Err)
+			assert.Must(string(r.Resp.Value) == "PONG")
+			done.Incr()
+		}()
+	}
+	var start = time.Now()
+	for done.Int64() < 16-4 && time.Since(start) < time.Second {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(done.Int64() >= 16-4)
+	wg.Wait()
+}
+
+func benchmarkBackendFlushDelay(b *testing.B, delay time.Duration) {
+	l := newPongServer()
+	defer l.Close()
+
+	config := NewDefaultConfig()
+	config.ProductAuth = ""
+	config.PipelineFlushDelay.Set(delay)
+
+	bc := NewBackendConn(l.Addr().String(), 0, config)
+	defer bc.Close()
+
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r := &Request{Batch: &sync.WaitGroup{}}
+			r.Multi = []*redis.Resp{redis.NewBulkBytes([]byte("PING"))}
+			bc.PushBack(r)
+			r.Batch.Wait()
+		}
+	})
+}
+
+func BenchmarkBackendFlushDelay0(b *testing.B)    { benchmarkBackendFlushDelay(b, 0) }
+func BenchmarkBackendFlushDelay50us(b *testing.B) { benchmarkBackendFlushDelay(b, time.Microsecond*50) }
+func BenchmarkBackendFlushDelay200us(b *testing.B) {
+	benchmarkBackendFlushDelay(b, time.Microsecond*200)
+}
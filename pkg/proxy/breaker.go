@@ -0,0 +1,109 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuitBreaker struct {
+	addr string
+
+	threshold int64
+	timeout   time.Duration
+
+	state atomic2.Int64
+	fails atomic2.Int64
+	since atomic2.Int64
+
+	events *eventHub
+}
+
+func newCircuitBreaker(addr string, config *Config) *circuitBreaker {
+	if config.BackendCircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{
+		addr:      addr,
+		threshold: int64(config.BackendCircuitBreakerThreshold),
+		timeout:   config.BackendCircuitBreakerTimeout.Duration(),
+	}
+}
+
+func (b *circuitBreaker) IsOpen() bool {
+	return b != nil && b.state.Int64() != circuitClosed
+}
+
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	switch b.state.Int64() {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if time.Now().UnixNano()-b.since.Int64() < int64(b.timeout) {
+			return false
+		}
+		if b.state.CompareAndSwap(circuitOpen, circuitHalfOpen) {
+			log.Warnf("circuit breaker to %s state = HalfOpen", b.addr)
+			b.publish("half_open")
+			return true
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+func (b *circuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.fails.Set(0)
+	if b.state.Swap(circuitClosed) != circuitClosed {
+		log.Warnf("circuit breaker to %s state = Closed", b.addr)
+		b.publish("closed")
+	}
+}
+
+func (b *circuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	n := b.fails.Incr()
+	switch b.state.Int64() {
+	case circuitClosed:
+		if n < b.threshold {
+			return
+		}
+		b.since.Set(time.Now().UnixNano())
+		if b.state.CompareAndSwap(circuitClosed, circuitOpen) {
+			log.Warnf("circuit breaker to %s state = Open, %d consecutive failures", b.addr, n)
+			b.publish("open")
+		}
+	case circuitHalfOpen:
+		b.since.Set(time.Now().UnixNano())
+		if b.state.CompareAndSwap(circuitHalfOpen, circuitOpen) {
+			log.Warnf("circuit breaker to %s state = Open, probe failed", b.addr)
+			b.publish("open")
+		}
+	}
+}
+
+func (b *circuitBreaker) publish(state string) {
+	b.events.Publish("circuit_breaker", map[string]interface{}{"addr": b.addr, "state": state})
+}
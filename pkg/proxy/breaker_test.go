@@ -0,0 +1,42 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	config := NewDefaultConfig()
+	assert.Must(newCircuitBreaker("x.x.x.x:xxxx", config) == nil)
+
+	config.BackendCircuitBreakerThreshold = 3
+	config.BackendCircuitBreakerTimeout.Set(time.Millisecond * 100)
+
+	b := newCircuitBreaker("x.x.x.x:xxxx", config)
+	for i := 0; i < 2; i++ {
+		b.Failure()
+		assert.Must(b.Allow())
+	}
+	b.Success()
+	for i := 0; i < 3; i++ {
+		assert.Must(b.Allow())
+		b.Failure()
+	}
+	assert.Must(b.IsOpen() && !b.Allow())
+
+	time.Sleep(time.Millisecond * 150)
+	assert.Must(b.Allow())
+	assert.Must(!b.Allow())
+	b.Failure()
+	assert.Must(b.IsOpen() && !b.Allow())
+
+	time.Sleep(time.Millisecond * 150)
+	assert.Must(b.Allow())
+	b.Success()
+	assert.Must(!b.IsOpen() && b.Allow())
+}
@@ -0,0 +1,355 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+type commandType int
+
+const (
+	// Routed by the slot of the hash key, see getHashKey.
+	commandKeyBased commandType = iota
+	// Served by the proxy itself, never forwarded as is.
+	commandAdmin
+	// Served by a dedicated backend connection, see session_pubsub.go.
+	commandPubSub
+	// Not key based, any online backend gives the same answer, they are sent
+	// to the backend of slot any_backend_slot.
+	commandAnyBackend
+)
+
+var commandTypes = map[string]commandType{
+	"AUTH":         commandAdmin,
+	"CLUSTER":      commandAdmin,
+	"HELLO":        commandAdmin,
+	"INFO":         commandAdmin,
+	"PING":         commandAdmin,
+	"PROXY":        commandAdmin,
+	"QUIT":         commandAdmin,
+	"RESET":        commandAdmin,
+	"SELECT":       commandAdmin,
+	"SLOTSINFO":    commandAdmin,
+	"SLOTSMAPPING": commandAdmin,
+
+	"PSUBSCRIBE":   commandPubSub,
+	"PUNSUBSCRIBE": commandPubSub,
+	"SUBSCRIBE":    commandPubSub,
+	"UNSUBSCRIBE":  commandPubSub,
+
+	"COMMAND": commandAnyBackend,
+	"LOLWUT":  commandAnyBackend,
+}
+
+func getCommandType(multi []*redis.Resp, opstr string) commandType {
+	switch opstr {
+	case "OBJECT":
+		if len(multi) == 2 && strings.ToUpper(string(multi[1].Value)) == "HELP" {
+			return commandAnyBackend
+		}
+	}
+	return commandTypes[opstr]
+}
+
+type commandFamily int
+
+const (
+	commandFamilyString commandFamily = iota
+	commandFamilyHash
+	commandFamilyList
+	commandFamilySet
+	commandFamilyZSet
+	commandFamilyStream
+	// Everything else, including keyspace commands like DEL or EXPIRE.
+	commandFamilyServer
+
+	numCommandFamilies = int(commandFamilyServer) + 1
+)
+
+var commandFamilyNames = [numCommandFamilies]string{
+	"string", "hash", "list", "set", "zset", "stream", "server",
+}
+
+func (f commandFamily) String() string {
+	return commandFamilyNames[f]
+}
+
+var commandFamilies = map[string]commandFamily{}
+
+func init() {
+	for family, ops := range map[commandFamily][]string{
+		commandFamilyString: {
+			"APPEND", "BITCOUNT", "BITFIELD", "BITFIELD_RO", "BITOP", "BITPOS", "DECR", "DECRBY",
+			"GET", "GETBIT", "GETRANGE", "GETSET", "INCR", "INCRBY", "INCRBYFLOAT",
+			"MGET", "MSET", "MSETNX", "PSETEX", "SET", "SETBIT", "SETEX", "SETNX",
+			"SETRANGE", "STRLEN", "SUBSTR", "PFADD", "PFCOUNT", "PFMERGE",
+		},
+		commandFamilyList: {
+			"BLMPOP", "BLPOP", "BRPOP", "BRPOPLPUSH", "LINDEX", "LINSERT", "LLEN", "LMPOP", "LPOP",
+			"LPOS", "LPUSH", "LPUSHX", "LRANGE", "LREM", "LSET", "LTRIM", "RPOP",
+			"RPOPLPUSH", "RPUSH", "RPUSHX",
+		},
+		commandFamilySet: {
+			"SADD", "SCARD", "SDIFF", "SDIFFSTORE", "SINTER", "SINTERSTORE",
+			"SISMEMBER", "SMEMBERS", "SMOVE", "SPOP", "SRANDMEMBER", "SREM",
+			"SSCAN", "SUNION", "SUNIONSTORE",
+		},
+		commandFamilyZSet: {
+			"BZMPOP", "BZPOPMAX", "BZPOPMIN", "GEOADD", "GEODIST", "GEOHASH", "GEOPOS",
+			"GEORADIUS", "GEORADIUSBYMEMBER", "GEORADIUSBYMEMBER_RO", "GEORADIUS_RO",
+			"GEOSEARCH", "GEOSEARCHSTORE",
+		},
+	} {
+		for _, opstr := range ops {
+			commandFamilies[opstr] = family
+		}
+	}
+}
+
+func getCommandFamily(opstr string) commandFamily {
+	if f, ok := commandFamilies[opstr]; ok {
+		return f
+	}
+	switch {
+	case opstr == "HELLO" || opstr == "":
+		return commandFamilyServer
+	case opstr[0] == 'H':
+		return commandFamilyHash
+	case opstr[0] == 'Z':
+		return commandFamilyZSet
+	case opstr[0] == 'X':
+		return commandFamilyStream
+	}
+	return commandFamilyServer
+}
+
+// commandInfo is the metadata of a command served by COMMAND INFO and
+// COMMAND DOCS, the flags are derived from the opTable.
+type commandInfo struct {
+	Arity    int
+	FirstKey int
+	LastKey  int
+	Step     int
+	Since    string
+	Summary  string
+}
+
+// commandTable has an entry for every command the proxy accepts, it must be
+// kept in sync with the opTable.
+var commandTable = map[string]commandInfo{
+	"APPEND":               {3, 1, 1, 1, "2.0.0", "Append a value to a key"},
+	"AUTH":                 {-2, 0, 0, 0, "1.0.0", "Authenticate to the server"},
+	"BITCOUNT":             {-2, 1, 1, 1, "2.6.0", "Count set bits in a string"},
+	"BITFIELD":             {-2, 1, 1, 1, "3.2.0", "Perform arbitrary bitfield integer operations on strings"},
+	"BITFIELD_RO":          {-2, 1, 1, 1, "6.0.0", "Perform arbitrary bitfield integer operations on strings, read-only variant"},
+	"BITOP":                {-4, 2, -1, 1, "2.6.0", "Perform bitwise operations between strings"},
+	"BITPOS":               {-3, 1, 1, 1, "2.8.7", "Find first bit set or clear in a string"},
+	"CLUSTER":              {-2, 0, 0, 0, "3.0.0", "A container for cluster commands"},
+	"COMMAND":              {-1, 0, 0, 0, "2.8.13", "Get array of command details"},
+	"COPY":                 {-3, 1, 2, 1, "6.2.0", "Copy a key"},
+	"DECR":                 {2, 1, 1, 1, "1.0.0", "Decrement the integer value of a key by one"},
+	"DECRBY":               {3, 1, 1, 1, "1.0.0", "Decrement the integer value of a key by the given number"},
+	"DEBUG":                {-2, 0, 0, 0, "1.0.0", "A container for debugging commands"},
+	"DEL":                  {-2, 1, -1, 1, "1.0.0", "Delete a key"},
+	"DISCARD":              {1, 0, 0, 0, "2.0.0", "Discard all commands issued after MULTI"},
+	"DUMP":                 {2, 1, 1, 1, "2.6.0", "Return a serialized version of the value stored at the specified key"},
+	"ECHO":                 {2, 0, 0, 0, "1.0.0", "Echo the given string"},
+	"EVAL":                 {-3, 0, 0, 0, "2.6.0", "Execute a Lua script server side"},
+	"EVALSHA":              {-3, 0, 0, 0, "2.6.0", "Execute a Lua script server side"},
+	"EVALSHA_RO":           {-3, 0, 0, 0, "7.0.0", "Execute a read-only Lua script server side"},
+	"EVAL_RO":              {-3, 0, 0, 0, "7.0.0", "Execute a read-only Lua script server side"},
+	"EXEC":                 {1, 0, 0, 0, "1.2.0", "Execute all commands issued after MULTI"},
+	"EXISTS":               {-2, 1, -1, 1, "1.0.0", "Determine if a key exists"},
+	"EXPIRE":               {-3, 1, 1, 1, "1.0.0", "Set a key's time to live in seconds"},
+	"EXPIREAT":             {-3, 1, 1, 1, "1.2.0", "Set the expiration for a key as a UNIX timestamp"},
+	"FCALL":                {-3, 0, 0, 0, "7.0.0", "Invoke a function"},
+	"FCALL_RO":             {-3, 0, 0, 0, "7.0.0", "Invoke a read-only function"},
+	"FUNCTION":             {-2, 0, 0, 0, "7.0.0", "A container for function commands"},
+	"GEOADD":               {-5, 1, 1, 1, "3.2.0", "Add one or more geospatial items in the geospatial index represented using a sorted set"},
+	"GEODIST":              {-4, 1, 1, 1, "3.2.0", "Returns the distance between two members of a geospatial index"},
+	"GEOHASH":              {-2, 1, 1, 1, "3.2.0", "Returns members of a geospatial index as standard geohash strings"},
+	"GEOPOS":               {-2, 1, 1, 1, "3.2.0", "Returns longitude and latitude of members of a geospatial index"},
+	"GEORADIUS":            {-6, 1, 1, 1, "3.2.0", "Query a geospatial index to fetch members matching a given maximum distance from a point"},
+	"GEORADIUSBYMEMBER":    {-5, 1, 1, 1, "3.2.0", "Query a geospatial index to fetch members matching a given maximum distance from a member"},
+	"GEORADIUSBYMEMBER_RO": {-5, 1, 1, 1, "3.2.10", "A read-only variant for GEORADIUSBYMEMBER"},
+	"GEORADIUS_RO":         {-6, 1, 1, 1, "3.2.10", "A read-only variant for GEORADIUS"},
+	"GEOSEARCH":            {-7, 1, 1, 1, "6.2.0", "Query a geospatial index to fetch members inside an area of a box or a circle"},
+	"GEOSEARCHSTORE":       {-8, 1, 2, 1, "6.2.0", "Query a geospatial index to fetch members inside an area of a box or a circle, and store the result in another key"},
+	"GET":                  {2, 1, 1, 1, "1.0.0", "Get the value of a key"},
+	"GETBIT":               {3, 1, 1, 1, "2.2.0", "Returns the bit value at offset in the string value stored at key"},
+	"GETRANGE":             {4, 1, 1, 1, "2.4.0", "Get a substring of the string stored at a key"},
+	"GETSET":               {3, 1, 1, 1, "1.0.0", "Set the string value of a key and return its old value"},
+	"HDEL":                 {-3, 1, 1, 1, "2.0.0", "Delete one or more hash fields"},
+	"HELLO":                {-1, 0, 0, 0, "6.0.0", "Handshake with the server"},
+	"HEXISTS":              {3, 1, 1, 1, "2.0.0", "Determine if a hash field exists"},
+	"HGET":                 {3, 1, 1, 1, "2.0.0", "Get the value of a hash field"},
+	"HGETALL":              {2, 1, 1, 1, "2.0.0", "Get all the fields and values in a hash"},
+	"HINCRBY":              {4, 1, 1, 1, "2.0.0", "Increment the integer value of a hash field by the given number"},
+	"HINCRBYFLOAT":         {4, 1, 1, 1, "2.6.0", "Increment the float value of a hash field by the given amount"},
+	"HKEYS":                {2, 1, 1, 1, "2.0.0", "Get all the fields in a hash"},
+	"HLEN":                 {2, 1, 1, 1, "2.0.0", "Get the number of fields in a hash"},
+	"HMGET":                {-3, 1, 1, 1, "2.0.0", "Get the values of all the given hash fields"},
+	"HMSET":                {-4, 1, 1, 1, "2.0.0", "Set multiple hash fields to multiple values"},
+	"HSCAN":                {-3, 1, 1, 1, "2.8.0", "Incrementally iterate hash fields and associated values"},
+	"HSET":                 {-4, 1, 1, 1, "2.0.0", "Set the string value of a hash field"},
+	"HSETNX":               {4, 1, 1, 1, "2.0.0", "Set the value of a hash field, only if the field does not exist"},
+	"HSTRLEN":              {3, 1, 1, 1, "3.2.0", "Get the length of the value of a hash field"},
+	"HVALS":                {2, 1, 1, 1, "2.0.0", "Get all the values in a hash"},
+	"INCR":                 {2, 1, 1, 1, "1.0.0", "Increment the integer value of a key by one"},
+	"INCRBY":               {3, 1, 1, 1, "1.0.0", "Increment the integer value of a key by the given amount"},
+	"INCRBYFLOAT":          {3, 1, 1, 1, "2.6.0", "Increment the float value of a key by the given amount"},
+	"INFO":                 {-1, 0, 0, 0, "1.0.0", "Get information and statistics about the server"},
+	"LINDEX":               {3, 1, 1, 1, "1.0.0", "Get an element from a list by its index"},
+	"LINSERT":              {5, 1, 1, 1, "2.2.0", "Insert an element before or after another element in a list"},
+	"LLEN":                 {2, 1, 1, 1, "1.0.0", "Get the length of a list"},
+	"LMPOP":                {-4, 0, 0, 0, "7.0.0", "Pop elements from a list"},
+	"LOLWUT":               {-1, 0, 0, 0, "5.0.0", "Display some computer art and the server version"},
+	"LPOP":                 {-2, 1, 1, 1, "1.0.0", "Remove and get the first elements in a list"},
+	"LPOS":                 {-3, 1, 1, 1, "6.0.6", "Return the index of matching elements on a list"},
+	"LPUSH":                {-3, 1, 1, 1, "1.0.0", "Prepend one or multiple elements to a list"},
+	"LPUSHX":               {-3, 1, 1, 1, "2.2.0", "Prepend an element to a list, only if the list exists"},
+	"LRANGE":               {4, 1, 1, 1, "1.0.0", "Get a range of elements from a list"},
+	"LREM":                 {4, 1, 1, 1, "1.0.0", "Remove elements from a list"},
+	"LSET":                 {4, 1, 1, 1, "1.0.0", "Set the value of an element in a list by its index"},
+	"LTRIM":                {4, 1, 1, 1, "1.0.0", "Trim a list to the specified range"},
+	"MGET":                 {-2, 1, -1, 1, "1.0.0", "Get the values of all the given keys"},
+	"MSET":                 {-3, 1, -1, 2, "1.0.1", "Set multiple keys to multiple values"},
+	"MSETNX":               {-3, 1, -1, 2, "1.0.1", "Set multiple keys to multiple values, only if none of the keys exist"},
+	"MULTI":                {1, 0, 0, 0, "1.2.0", "Mark the start of a transaction block"},
+	"OBJECT":               {-2, 2, 2, 1, "2.2.3", "Inspect the internals of objects"},
+	"PERSIST":              {2, 1, 1, 1, "2.2.0", "Remove the expiration from a key"},
+	"PEXPIRE":              {-3, 1, 1, 1, "2.6.0", "Set a key's time to live in milliseconds"},
+	"PEXPIREAT":            {-3, 1, 1, 1, "2.6.0", "Set the expiration for a key as a UNIX timestamp specified in milliseconds"},
+	"PFADD":                {-2, 1, 1, 1, "2.8.9", "Adds the specified elements to the specified HyperLogLog"},
+	"PFCOUNT":              {-2, 1, -1, 1, "2.8.9", "Return the approximated cardinality of the set(s) observed by the HyperLogLog at key(s)"},
+	"PFDEBUG":              {3, 2, 2, 1, "2.8.9", "Internal commands for debugging HyperLogLog values"},
+	"PFMERGE":              {-2, 1, -1, 1, "2.8.9", "Merge N different HyperLogLogs into a single one"},
+	"PFSELFTEST":           {1, 0, 0, 0, "2.8.9", "An internal command for testing HyperLogLog values"},
+	"PING":                 {-1, 0, 0, 0, "1.0.0", "Ping the server"},
+	"PROXY":                {-2, 0, 0, 0, "", "Inspect and manage the proxy"},
+	"PSETEX":               {4, 1, 1, 1, "2.6.0", "Set the value and expiration in milliseconds of a key"},
+	"PSUBSCRIBE":           {-2, 0, 0, 0, "2.0.0", "Listen for messages published to channels matching the given patterns"},
+	"PTTL":                 {2, 1, 1, 1, "2.6.0", "Get the time to live for a key in milliseconds"},
+	"PUBLISH":              {3, 0, 0, 0, "2.0.0", "Post a message to a channel"},
+	"PUBSUB":               {-2, 0, 0, 0, "2.8.0", "Inspect the state of the Pub/Sub subsystem"},
+	"PUNSUBSCRIBE":         {-1, 0, 0, 0, "2.0.0", "Stop listening for messages posted to channels matching the given patterns"},
+	"QUIT":                 {-1, 0, 0, 0, "1.0.0", "Close the connection"},
+	"RESET":                {1, 0, 0, 0, "6.2.0", "Reset the connection"},
+	"RESTORE":              {-4, 1, 1, 1, "2.6.0", "Create a key using the provided serialized value, previously obtained using DUMP"},
+	"ROLE":                 {1, 0, 0, 0, "2.8.12", "Return the role of the instance in the context of replication"},
+	"RPOP":                 {-2, 1, 1, 1, "1.0.0", "Remove and get the last elements in a list"},
+	"RPOPLPUSH":            {3, 1, 2, 1, "1.2.0", "Remove the last element in a list, prepend it to another list and return it"},
+	"RPUSH":                {-3, 1, 1, 1, "1.0.0", "Append one or multiple elements to a list"},
+	"RPUSHX":               {-3, 1, 1, 1, "2.2.0", "Append an element to a list, only if the list exists"},
+	"SADD":                 {-3, 1, 1, 1, "1.0.0", "Add one or more members to a set"},
+	"SCAN":                 {-2, 0, 0, 0, "2.8.0", "Incrementally iterate the keys space"},
+	"SCARD":                {2, 1, 1, 1, "1.0.0", "Get the number of members in a set"},
+	"SDIFF":                {-2, 1, -1, 1, "1.0.0", "Subtract multiple sets"},
+	"SDIFFSTORE":           {-3, 1, -1, 1, "1.0.0", "Subtract multiple sets and store the resulting set in a key"},
+	"SELECT":               {2, 0, 0, 0, "1.0.0", "Change the selected database for the current connection"},
+	"SET":                  {-3, 1, 1, 1, "1.0.0", "Set the string value of a key"},
+	"SETBIT":               {4, 1, 1, 1, "2.2.0", "Sets or clears the bit at offset in the string value stored at key"},
+	"SETEX":                {4, 1, 1, 1, "2.0.0", "Set the value and expiration of a key"},
+	"SETNX":                {3, 1, 1, 1, "1.0.0", "Set the value of a key, only if the key does not exist"},
+	"SETRANGE":             {4, 1, 1, 1, "2.2.0", "Overwrite part of a string at key starting at the specified offset"},
+	"SINTER":               {-2, 1, -1, 1, "1.0.0", "Intersect multiple sets"},
+	"SINTERSTORE":          {-3, 1, -1, 1, "1.0.0", "Intersect multiple sets and store the resulting set in a key"},
+	"SISMEMBER":            {3, 1, 1, 1, "1.0.0", "Determine if a given value is a member of a set"},
+	"SLOTSHASHKEY":         {-1, 0, 0, 0, "", "Get the slots of the given keys"},
+	"SLOTSINFO":            {-1, 0, 0, 0, "", "Get the number of keys of the slots"},
+	"SLOTSMAPPING":         {-1, 0, 0, 0, "", "Get the mapping of the slots"},
+	"SLOTSRESTORE":         {-4, 1, -1, 3, "", "Create keys using the provided serialized values while migrating slots"},
+	"SLOTSSCAN":            {-3, 0, 0, 0, "", "Incrementally iterate the keys of a slot"},
+	"SMEMBERS":             {2, 1, 1, 1, "1.0.0", "Get all the members in a set"},
+	"SMOVE":                {4, 1, 2, 1, "1.0.0", "Move a member from one set to another"},
+	"SORT":                 {-2, 1, 1, 1, "1.0.0", "Sort the elements in a list, set or sorted set"},
+	"SPOP":                 {-2, 1, 1, 1, "1.0.0", "Remove and return one or multiple random members from a set"},
+	"SRANDMEMBER":          {-2, 1, 1, 1, "1.0.0", "Get one or multiple random members from a set"},
+	"SREM":                 {-3, 1, 1, 1, "1.0.0", "Remove one or more members from a set"},
+	"SSCAN":                {-3, 1, 1, 1, "2.8.0", "Incrementally iterate set elements"},
+	"STRLEN":               {2, 1, 1, 1, "2.2.0", "Get the length of the value stored in a key"},
+	"SUBSCRIBE":            {-2, 0, 0, 0, "2.0.0", "Listen for messages published to the given channels"},
+	"SUBSTR":               {4, 1, 1, 1, "1.0.0", "Get a substring of the string stored at a key"},
+	"SUNION":               {-2, 1, -1, 1, "1.0.0", "Add multiple sets"},
+	"SUNIONSTORE":          {-3, 1, -1, 1, "1.0.0", "Add multiple sets and store the resulting set in a key"},
+	"TOUCH":                {-2, 1, -1, 1, "3.2.1", "Alters the last access time of a key(s)"},
+	"TTL":                  {2, 1, 1, 1, "1.0.0", "Get the time to live for a key in seconds"},
+	"TYPE":                 {2, 1, 1, 1, "1.0.0", "Determine the type stored at key"},
+	"UNLINK":               {-2, 1, -1, 1, "4.0.0", "Delete a key asynchronously"},
+	"UNSUBSCRIBE":          {-1, 0, 0, 0, "2.0.0", "Stop listening for messages posted to the given channels"},
+	"UNWATCH":              {1, 0, 0, 0, "2.2.0", "Forget about all watched keys"},
+	"WAIT":                 {3, 0, 0, 0, "3.0.0", "Wait for the synchronous replication of all the write commands sent in the context of the current connection"},
+	"WATCH":                {-2, 1, -1, 1, "2.2.0", "Watch the given keys to determine execution of the MULTI/EXEC block"},
+	"XREAD":                {-4, 0, 0, 0, "5.0.0", "Return never seen elements in multiple streams"},
+	"XREADGROUP":           {-7, 0, 0, 0, "5.0.0", "Return new entries from a stream using a consumer group"},
+	"ZADD":                 {-4, 1, 1, 1, "1.2.0", "Add one or more members to a sorted set, or update its score if it already exists"},
+	"ZCARD":                {2, 1, 1, 1, "1.2.0", "Get the number of members in a sorted set"},
+	"ZCOUNT":               {4, 1, 1, 1, "2.0.0", "Count the members in a sorted set with scores within the given values"},
+	"ZINCRBY":              {4, 1, 1, 1, "1.2.0", "Increment the score of a member in a sorted set"},
+	"ZINTERSTORE":          {-4, 1, 1, 1, "2.0.0", "Intersect multiple sorted sets and store the resulting sorted set in a new key"},
+	"ZLEXCOUNT":            {4, 1, 1, 1, "2.8.9", "Count the number of members in a sorted set between a given lexicographical range"},
+	"ZMPOP":                {-4, 0, 0, 0, "7.0.0", "Remove and return members with scores in a sorted set"},
+	"ZRANGE":               {-4, 1, 1, 1, "1.2.0", "Return a range of members in a sorted set"},
+	"ZRANGEBYLEX":          {-4, 1, 1, 1, "2.8.9", "Return a range of members in a sorted set, by lexicographical range"},
+	"ZRANGEBYSCORE":        {-4, 1, 1, 1, "1.0.5", "Return a range of members in a sorted set, by score"},
+	"ZRANK":                {3, 1, 1, 1, "2.0.0", "Determine the index of a member in a sorted set"},
+	"ZREM":                 {-3, 1, 1, 1, "1.2.0", "Remove one or more members from a sorted set"},
+	"ZREMRANGEBYLEX":       {4, 1, 1, 1, "2.8.9", "Remove all members in a sorted set between the given lexicographical range"},
+	"ZREMRANGEBYRANK":      {4, 1, 1, 1, "2.0.0", "Remove all members in a sorted set within the given indexes"},
+	"ZREMRANGEBYSCORE":     {4, 1, 1, 1, "1.2.0", "Remove all members in a sorted set within the given scores"},
+	"ZREVRANGE":            {-4, 1, 1, 1, "1.2.0", "Return a range of members in a sorted set, by index, with scores ordered from high to low"},
+	"ZREVRANGEBYLEX":       {-4, 1, 1, 1, "2.8.9", "Return a range of members in a sorted set, by lexicographical range, ordered from higher to lower strings"},
+	"ZREVRANGEBYSCORE":     {-4, 1, 1, 1, "2.2.0", "Return a range of members in a sorted set, by score, with scores ordered from high to low"},
+	"ZREVRANK":             {3, 1, 1, 1, "2.0.0", "Determine the index of a member in a sorted set, with scores ordered from high to low"},
+	"ZSCAN":                {-3, 1, 1, 1, "2.8.0", "Incrementally iterate sorted sets elements and associated scores"},
+	"ZSCORE":               {3, 1, 1, 1, "1.2.0", "Get the score associated with the given member in a sorted set"},
+	"ZUNIONSTORE":          {-4, 1, 1, 1, "2.0.0", "Add multiple sorted sets and store the resulting sorted set in a new key"},
+}
+
+// commandFlags returns the flags of opstr in the format of COMMAND INFO.
+func commandFlags(opstr string) []string {
+	var flags []string
+	if opTable[opstr].Flag.IsReadOnly() {
+		flags = append(flags, "readonly")
+	} else {
+		flags = append(flags, "write")
+	}
+	switch getCommandType(nil, opstr) {
+	case commandAdmin:
+		flags = append(flags, "noscript")
+	case commandPubSub:
+		flags = append(flags, "pubsub")
+	}
+	switch opstr {
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO",
+		"LMPOP", "ZMPOP", "XREAD", "XREADGROUP", "ZINTERSTORE", "ZUNIONSTORE",
+		"SORT", "GEORADIUS", "GEORADIUSBYMEMBER":
+		flags = append(flags, "movablekeys")
+	}
+	return flags
+}
+
+// commandKeys returns the keys of multi by commandTable, or only the hash key
+// if keys of the command are movable.
+func commandKeys(multi []*redis.Resp, opstr string) [][]byte {
+	var info, ok = commandTable[opstr]
+	if !ok || info.FirstKey <= 0 {
+		if hkey := getHashKey(multi, opstr); len(hkey) != 0 {
+			return [][]byte{hkey}
+		}
+		return nil
+	}
+	var last = info.LastKey
+	if last < 0 {
+		last += len(multi)
+	}
+	var keys [][]byte
+	for i := info.FirstKey; i <= last && i < len(multi); i += info.Step {
+		keys = append(keys, multi[i].Value)
+	}
+	return keys
+}
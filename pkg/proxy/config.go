@@ -5,6 +5,12 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 
@@ -30,11 +36,21 @@ product_auth = ""
 #      codis-proxy and codis-server.
 #   2. session_auth is different from product_auth, it requires clients
 #      to issue AUTH <PASSWORD> before processing any other commands.
+#      AUTH is always checked by the proxy and never forwarded to backends,
+#      which are authenticated on connecting, see backend_password.
+#   3. session_users adds users for AUTH <USERNAME> <PASSWORD> or HELLO AUTH,
+#      each one is formatted as "username:password".
 session_auth = ""
+session_users = []
 
 # Set bind address for admin(rpc), tcp only.
 admin_addr = "0.0.0.0:11080"
 
+# Set bind address & token for admin api to inspect and modify slots directly, token is
+# required in header X-Codis-Admin-Token. (empty address to disable)
+admin_api_addr = ""
+admin_token = ""
+
 # Set bind address for proxy, proto_type can be "tcp", "tcp4", "tcp6", "unix" or "unixpacket".
 proto_type = "tcp4"
 proxy_addr = "0.0.0.0:19000"
@@ -57,18 +73,41 @@ jodis_compatible = false
 # Set datacenter of proxy.
 proxy_datacenter = ""
 
+# Set hash function of keys to slots, can be "crc32", "fnv1a", "murmur3" or "xxhash".
+# WARNING: codis-server always uses crc32 to migrate and count keys of slots, other functions
+# are only for data already sharded by them, slots must NOT be migrated. Changing it on a
+# running cluster maps existing keys to other slots, which requires a full re-slot. SCAN is
+# served by SLOTSSCAN, so scan_aggregation must be disabled with other functions.
+# Empty means "crc32".
+hash_func = "crc32"
+
 # Set max number of alive sessions.
 proxy_max_clients = 1000
 
+# Once the number of alive sessions exceeds the soft limit, a warning is logged and new
+# connections are refused, they're still counted until their error reply is sent. Once it
+# exceeds the hard limit, e.g. by connections refused meanwhile, the longest idle session
+# is closed to make room for the new one. It must be soft <= hard <= proxy_max_clients.
+# (0 to disable)
+proxy_max_clients_soft_limit = 0
+proxy_max_clients_hard_limit = 0
+
 # Set max offheap memory size. (0 to disable)
 proxy_max_offheap_size = "1024mb"
 
 # Set heap placeholder to reduce GC frequency.
 proxy_heap_placeholder = "256mb"
 
+# Set drain timeout on shutdown, proxy stops accepting new requests and waits for
+# in-flight requests to finish before closing backend connections. (0 to disable)
+proxy_drain_timeout = "10s"
+
 # Proxy will ping backend redis (and clear 'MASTERDOWN' state) in a predefined interval. (0 to disable)
 backend_ping_period = "5s"
 
+# Set backend connect timeout.
+backend_connect_timeout = "5s"
+
 # Set backend recv buffer size & timeout.
 backend_recv_bufsize = "128kb"
 backend_recv_timeout = "30s"
@@ -77,22 +116,92 @@ backend_recv_timeout = "30s"
 backend_send_bufsize = "128kb"
 backend_send_timeout = "30s"
 
-# Set backend pipeline buffer size.
+# Set backend pipeline buffer size, which is the max number of requests in flight on a
+# backend connection. Requests are written without waiting for replies, and replies are
+# matched to requests by order since redis always responds in order.
 backend_max_pipeline = 20480
 
+# Set max number of pending requests of a backend connection, requests beyond it
+# are rejected with backend overloaded instead of being queued. (0 to disable)
+backend_max_pending_requests = 0
+
+# Set max delay before flushing requests to a backend connection when no more requests are
+# queued, waiting lets requests pipelined by clients be written to the backend together.
+# Batches are flushed without waiting once they reach half of backend_max_pipeline. (0 to disable)
+pipeline_flush_delay = "0ms"
+
 # Set backend never read replica groups, default is false
 backend_primary_only = false
 
-# Set backend parallel connections per server
+# Set read preference for read-only commands if replica groups exist.
+#   1. "replica" reads from replicas first and falls back to primary.
+#   2. "master" reads from primary first and falls back to replicas.
+#   3. "roundrobin" & "random" spread reads across primary and replicas.
+# Clients can override it per session with PROXY READ <preference>.
+backend_read_preference = "replica"
+
+# Set backend parallel connections per server, which is the size of the connection pool
+# of each server and database.
 backend_primary_parallel = 1
 backend_replica_parallel = 1
 
+# Set max idle time of backend connections in the pools above, idle connections will be
+# closed on keepalive and reconnected on demand. (0 to disable)
+backend_max_idle_time = "0s"
+
+# Set min number of connected connections per backend server, connections closed for being
+# idle are re-established in background to avoid latency spikes when traffic ramps up, unless
+# the circuit of the server is open. (0 to disable)
+backend_min_pool_size = 0
+
+# Set number of backend servers connected in parallel before the proxy goes online, so the
+# first requests don't wait for connections. (0 to disable)
+backend_warmup_concurrency = 16
+
 # Set backend tcp keepalive period. (0 to disable)
 backend_keepalive_period = "75s"
 
+# Set interval of resolving backend addresses again, connections are re-established if the
+# ips of a backend change, e.g. pods restarted in kubernetes. (0 to disable)
+backend_dns_refresh_interval = "0s"
+
 # Set number of databases of backend.
 backend_number_databases = 16
 
+# Set auth for backend connections, product_auth is used if backend_password is empty.
+# backend_username is optional, used for Redis 6 ACL, proxy will send AUTH <username> <password>.
+backend_username = ""
+backend_password = ""
+
+# Set TLS for backend connections.
+#   1. backend_tls_cert_file & backend_tls_key_file are optional, used for mutual auth.
+#   2. backend_tls_ca_file is used to verify backend servers, system roots are used if empty.
+#   3. backend_tls_server_name overrides SNI, default is the host of backend address.
+#   4. backend_tls_skip_verify should be used for testing only.
+backend_tls = false
+backend_tls_cert_file = ""
+backend_tls_key_file = ""
+backend_tls_ca_file = ""
+backend_tls_server_name = ""
+backend_tls_skip_verify = false
+
+# Set circuit breaker for backend connections. (0 to disable)
+#   1. after backend_circuit_breaker_threshold consecutive failures, requests to the backend will fail immediately.
+#   2. after backend_circuit_breaker_timeout, a probe request is allowed to check whether the backend is recovered.
+backend_circuit_breaker_threshold = 0
+backend_circuit_breaker_timeout = "5s"
+
+# Set retries for requests failed by transient backend errors, only read-only requests
+# or requests that have not been sent to backend will be retried. (0 to disable)
+backend_max_retries = 0
+backend_retry_backoff = "10ms"
+
+# Set health scoring of backends, replicas are chosen by a score in [0, 1] computed from moving
+# averages of error rate and latency over backend_health_score_window instead of in turn, reads
+# fall back to master if no replica scores backend_health_min_score or above. (0 to disable)
+backend_health_score_window = "0s"
+backend_health_min_score = 0.0
+
 # If there is no request from client for a long time, the connection will be closed. (0 to disable)
 # Set session recv buffer size & timeout.
 session_recv_bufsize = "128kb"
@@ -112,6 +221,113 @@ session_keepalive_period = "75s"
 # Set session to be sensitive to failures. Default is false, instead of closing socket, proxy will send an error response to client.
 session_break_on_failure = false
 
+# Set SCAN to iterate over all slots through the proxy, the cursor returned to clients
+# encodes both slot and backend cursor. Disable it if clients do their own fanout with SLOTSSCAN.
+scan_aggregation = true
+
+# Set SELECT to switch the database of a session, backend connections are pooled per database
+# so requests are always sent over connections which have selected the right one.
+# Disable it to keep all clients on database 0.
+allow_select = true
+
+# Set SINTERSTORE/SUNIONSTORE/SDIFFSTORE to work on keys across slots, members of source keys
+# are fetched with SMEMBERS and the result is stored by the proxy, which is NOT atomic.
+allow_cross_slot_set_ops = false
+
+# Set SINTER/SUNION to work on keys across slots, members of the keys are fetched with
+# SMEMBERS in parallel and the result is computed by the proxy.
+allow_cross_slot_read_ops = false
+
+# Set key prefixes which clients are not allowed to write, e.g. ["__codis__:"]. Prefixes are matched
+# against both keys and their hash tags, so "{__codis__:migrate}:foo" is blocked as well.
+# Reads are always allowed.
+blocked_key_prefixes = []
+
+# Set max TTL of keys by glob patterns, each rule is formatted as "<pattern>=<max_ttl>", e.g. ["cache:*=1h"].
+# After a write to a key matching a rule, the first matching one, the proxy checks its TTL in background
+# and sends EXPIRE if the key has no TTL or a longer one. Keys are checked one at a time, and skipped
+# if 4096 checks are already pending.
+max_ttl_rules = []
+
+# Set max timeout of WAIT, WAIT blocks a shared backend connection so larger timeouts
+# requested by clients (including 0) will be capped to wait_timeout. (0 to disable)
+wait_timeout = "1s"
+
+# Set max duration of DEBUG SLEEP, longer sleeps requested by clients will be capped to it.
+# Other DEBUG subcommands are never allowed. (0 to disable DEBUG SLEEP)
+debug_sleep_max_duration = "0s"
+
+# Set slot whose backend serves commands which are not key based, e.g. COMMAND, OBJECT HELP and LOLWUT.
+any_backend_slot = 0
+
+# Set per client ip rate limit, requests exceeding the limit will be rejected with an error. (0 to disable)
+client_rate_limit_rps = 0.0
+client_rate_limit_burst = 100
+
+# Set sentinel polling, tune them up if sentinels are far away from proxy.
+#   1. sentinel_poll_timeout is the timeout of fetching masters from sentinels.
+#   2. sentinel_subscribe_expiry is how long a subscription to +switch-master lasts before it's renewed.
+#   3. sentinel_retry_interval is the delay before resubscribing after a failure.
+#   4. sentinel_backoff_sleep is the delay between two rounds of fetching masters.
+sentinel_poll_timeout = "5s"
+sentinel_subscribe_expiry = "15m"
+sentinel_retry_interval = "10s"
+sentinel_backoff_sleep = "5s"
+
+# Set slowlog threshold & max number of entries kept in memory, requests slower than
+# slowlog_threshold can be inspected with PROXY SLOWLOG GET [n]. (0 to disable)
+slowlog_threshold = "10ms"
+slowlog_max_len = 128
+
+# Set access log file, every sampled request is written as a json line. Requests are
+# sampled with probability access_log_sample_rate in [0.0, 1.0]. (empty to disable)
+access_log_file = ""
+access_log_sample_rate = 1.0
+
+# Set hot slot detection, a slot is reported as hot if its request rate exceeds
+# hot_slot_factor times the mean rate of all slots and hot_slot_min_rps. (0 to disable)
+hot_slot_factor = 0.0
+hot_slot_min_rps = 1000
+
+# Warn if a slot is kept locked longer than slot_lock_timeout, such as when a migration
+# crashed, and unlock it if auto_unlock_stale_locks is true. (0 to disable)
+slot_lock_timeout = "0s"
+auto_unlock_stale_locks = false
+
+# Quarantine slots whose backend error rate over slot_error_rate_window exceeds the
+# thresholds in [0.0, 1.0]. Above the soft one a warning is reported, above the hard one
+# requests of the slot fail without reaching the backend until the rate drops. (0 to disable)
+# Only connection failures and MASTERDOWN/LOADING replies count as backend errors, error
+# replies of commands like WRONGTYPE don't. Slots with fewer than slot_error_rate_min_calls
+# requests in the window are never quarantined.
+slot_error_rate_window = "10s"
+slot_error_rate_min_calls = 100
+slot_soft_quarantine_threshold = 0.0
+slot_hard_quarantine_threshold = 0.0
+
+# Answer OBJECT ENCODING of string keys by the encodings inferred from plain SET through
+# the proxy, and of any keys by the hints given with PROXY HINT ENCODING <key> <encoding>.
+# Hints are dropped by any other write, but may be stale if keys are written by others.
+enable_encoding_cache = false
+
+# Tag backend connections with the request id set by PROXY REQUEST-ID, the proxy sends
+# CLIENT SETNAME <id> ahead of requests whenever the id on a backend connection changes.
+enable_request_id_propagation = false
+
+# Share a single backend subscription for each channel or pattern among all sessions
+# subscribing to it through the proxy, messages are fanned out locally.
+enable_pubsub_fanout = false
+
+# Publish internal events as JSON messages to channel __codis_proxy__, which clients may SUBSCRIBE
+# to through the proxy: slot fills, master switches, backend connects/disconnects and circuit
+# breaker state changes. The channel can't be subscribed together with other channels.
+enable_internal_event_channel = false
+
+# Allow PROXY subcommands that change the state of the proxy, such as DRAIN, KILL, RESET-BACKEND,
+# SLOTS-RELOAD, MIGRATE-KEY, LOGLEVEL <level> and STATS/SLOWLOG RESET, on the proxy port.
+# Sessions must issue PROXY AUTH <product_auth> first, they're refused if product_auth is empty.
+enable_proxy_admin_commands = false
+
 # Set metrics server (such as http://localhost:28000), proxy will report json formatted metrics to specified server in a predefined period.
 metrics_report_server = ""
 metrics_report_period = "1s"
@@ -129,11 +345,31 @@ metrics_report_statsd_period = "1s"
 metrics_report_statsd_prefix = ""
 `
 
+// EventHooks are optional callbacks of router and backend lifecycle events, they're called
+// synchronously and should not block.
+type EventHooks struct {
+	// OnSlotFill is called after a slot is filled.
+	OnSlotFill func(slotID int, backendAddr string)
+	// OnMasterSwitch is called once per group when sentinels switch its master.
+	OnMasterSwitch func(groupID int, oldAddr, newAddr string)
+	// OnBackendConnect and OnBackendDisconnect are called for every backend connection.
+	OnBackendConnect    func(addr string)
+	OnBackendDisconnect func(addr string, err error)
+	// OnSlotLockTimeout is called when a slot is kept locked longer than slot_lock_timeout.
+	OnSlotLockTimeout func(slotID int)
+	// OnSlotQuarantine is called when the backend error rate of a slot exceeds the soft or
+	// the hard quarantine threshold.
+	OnSlotQuarantine func(slotID int, errorRate float64, hard bool)
+}
+
 type Config struct {
 	ProtoType string `toml:"proto_type" json:"proto_type"`
 	ProxyAddr string `toml:"proxy_addr" json:"proxy_addr"`
 	AdminAddr string `toml:"admin_addr" json:"admin_addr"`
 
+	AdminApiAddr string `toml:"admin_api_addr" json:"admin_api_addr"`
+	AdminToken   string `toml:"admin_token" json:"-"`
+
 	HostProxy string `toml:"-" json:"-"`
 	HostAdmin string `toml:"-" json:"-"`
 
@@ -147,23 +383,59 @@ type Config struct {
 	ProductAuth string `toml:"product_auth" json:"-"`
 	SessionAuth string `toml:"session_auth" json:"-"`
 
+	SessionUsers []string `toml:"session_users" json:"-"`
+
 	ProxyDataCenter      string         `toml:"proxy_datacenter" json:"proxy_datacenter"`
 	ProxyMaxClients      int            `toml:"proxy_max_clients" json:"proxy_max_clients"`
 	ProxyMaxOffheapBytes bytesize.Int64 `toml:"proxy_max_offheap_size" json:"proxy_max_offheap_size"`
 	ProxyHeapPlaceholder bytesize.Int64 `toml:"proxy_heap_placeholder" json:"proxy_heap_placeholder"`
 
+	ProxyMaxClientsSoftLimit int `toml:"proxy_max_clients_soft_limit" json:"proxy_max_clients_soft_limit"`
+	ProxyMaxClientsHardLimit int `toml:"proxy_max_clients_hard_limit" json:"proxy_max_clients_hard_limit"`
+
+	ProxyDrainTimeout timesize.Duration `toml:"proxy_drain_timeout" json:"proxy_drain_timeout"`
+
+	HashFunc string `toml:"hash_func" json:"hash_func"`
+
 	BackendPingPeriod      timesize.Duration `toml:"backend_ping_period" json:"backend_ping_period"`
+	BackendConnectTimeout  timesize.Duration `toml:"backend_connect_timeout" json:"backend_connect_timeout"`
 	BackendRecvBufsize     bytesize.Int64    `toml:"backend_recv_bufsize" json:"backend_recv_bufsize"`
 	BackendRecvTimeout     timesize.Duration `toml:"backend_recv_timeout" json:"backend_recv_timeout"`
 	BackendSendBufsize     bytesize.Int64    `toml:"backend_send_bufsize" json:"backend_send_bufsize"`
 	BackendSendTimeout     timesize.Duration `toml:"backend_send_timeout" json:"backend_send_timeout"`
 	BackendMaxPipeline     int               `toml:"backend_max_pipeline" json:"backend_max_pipeline"`
 	BackendPrimaryOnly     bool              `toml:"backend_primary_only" json:"backend_primary_only"`
+	BackendReadPreference  string            `toml:"backend_read_preference" json:"backend_read_preference"`
 	BackendPrimaryParallel int               `toml:"backend_primary_parallel" json:"backend_primary_parallel"`
 	BackendReplicaParallel int               `toml:"backend_replica_parallel" json:"backend_replica_parallel"`
+	BackendMaxIdleTime     timesize.Duration `toml:"backend_max_idle_time" json:"backend_max_idle_time"`
 	BackendKeepAlivePeriod timesize.Duration `toml:"backend_keepalive_period" json:"backend_keepalive_period"`
 	BackendNumberDatabases int32             `toml:"backend_number_databases" json:"backend_number_databases"`
 
+	BackendMaxPendingRequests int               `toml:"backend_max_pending_requests" json:"backend_max_pending_requests"`
+	PipelineFlushDelay        timesize.Duration `toml:"pipeline_flush_delay" json:"pipeline_flush_delay"`
+	BackendDNSRefreshInterval timesize.Duration `toml:"backend_dns_refresh_interval" json:"backend_dns_refresh_interval"`
+	BackendMinPoolSize        int               `toml:"backend_min_pool_size" json:"backend_min_pool_size"`
+	BackendWarmUpConcurrency  int               `toml:"backend_warmup_concurrency" json:"backend_warmup_concurrency"`
+
+	BackendUsername string `toml:"backend_username" json:"backend_username"`
+	BackendPassword string `toml:"backend_password" json:"-"`
+
+	BackendTLS           bool   `toml:"backend_tls" json:"backend_tls"`
+	BackendTLSCertFile   string `toml:"backend_tls_cert_file" json:"backend_tls_cert_file"`
+	BackendTLSKeyFile    string `toml:"backend_tls_key_file" json:"backend_tls_key_file"`
+	BackendTLSCAFile     string `toml:"backend_tls_ca_file" json:"backend_tls_ca_file"`
+	BackendTLSServerName string `toml:"backend_tls_server_name" json:"backend_tls_server_name"`
+	BackendTLSSkipVerify bool   `toml:"backend_tls_skip_verify" json:"backend_tls_skip_verify"`
+
+	BackendCircuitBreakerThreshold int               `toml:"backend_circuit_breaker_threshold" json:"backend_circuit_breaker_threshold"`
+	BackendCircuitBreakerTimeout   timesize.Duration `toml:"backend_circuit_breaker_timeout" json:"backend_circuit_breaker_timeout"`
+	BackendMaxRetries              int               `toml:"backend_max_retries" json:"backend_max_retries"`
+	BackendRetryBackoff            timesize.Duration `toml:"backend_retry_backoff" json:"backend_retry_backoff"`
+
+	BackendHealthScoreWindow timesize.Duration `toml:"backend_health_score_window" json:"backend_health_score_window"`
+	BackendHealthMinScore    float64           `toml:"backend_health_min_score" json:"backend_health_min_score"`
+
 	SessionRecvBufsize     bytesize.Int64    `toml:"session_recv_bufsize" json:"session_recv_bufsize"`
 	SessionRecvTimeout     timesize.Duration `toml:"session_recv_timeout" json:"session_recv_timeout"`
 	SessionSendBufsize     bytesize.Int64    `toml:"session_send_bufsize" json:"session_send_bufsize"`
@@ -172,6 +444,64 @@ type Config struct {
 	SessionKeepAlivePeriod timesize.Duration `toml:"session_keepalive_period" json:"session_keepalive_period"`
 	SessionBreakOnFailure  bool              `toml:"session_break_on_failure" json:"session_break_on_failure"`
 
+	ScanAggregation bool              `toml:"scan_aggregation" json:"scan_aggregation"`
+	AllowSelect     bool              `toml:"allow_select" json:"allow_select"`
+	WaitTimeout     timesize.Duration `toml:"wait_timeout" json:"wait_timeout"`
+
+	DebugSleepMaxDuration timesize.Duration `toml:"debug_sleep_max_duration" json:"debug_sleep_max_duration"`
+
+	AllowCrossSlotSetOps  bool `toml:"allow_cross_slot_set_ops" json:"allow_cross_slot_set_ops"`
+	AllowCrossSlotReadOps bool `toml:"allow_cross_slot_read_ops" json:"allow_cross_slot_read_ops"`
+	AnyBackendSlot        int  `toml:"any_backend_slot" json:"any_backend_slot"`
+
+	BlockedKeyPrefixes []string  `toml:"blocked_key_prefixes" json:"blocked_key_prefixes"`
+	MaxTTLRules        []TTLRule `toml:"max_ttl_rules" json:"max_ttl_rules"`
+
+	ClientRateLimitRPS   float64 `toml:"client_rate_limit_rps" json:"client_rate_limit_rps"`
+	ClientRateLimitBurst int     `toml:"client_rate_limit_burst" json:"client_rate_limit_burst"`
+
+	SentinelPollTimeout     timesize.Duration `toml:"sentinel_poll_timeout" json:"sentinel_poll_timeout"`
+	SentinelSubscribeExpiry timesize.Duration `toml:"sentinel_subscribe_expiry" json:"sentinel_subscribe_expiry"`
+	SentinelRetryInterval   timesize.Duration `toml:"sentinel_retry_interval" json:"sentinel_retry_interval"`
+	SentinelBackoffSleep    timesize.Duration `toml:"sentinel_backoff_sleep" json:"sentinel_backoff_sleep"`
+
+	SlowLogThreshold timesize.Duration `toml:"slowlog_threshold" json:"slowlog_threshold"`
+	SlowLogMaxLen    int               `toml:"slowlog_max_len" json:"slowlog_max_len"`
+
+	AccessLogFile       string  `toml:"access_log_file" json:"access_log_file"`
+	AccessLogSampleRate float64 `toml:"access_log_sample_rate" json:"access_log_sample_rate"`
+
+	HotSlotFactor float64 `toml:"hot_slot_factor" json:"hot_slot_factor"`
+	HotSlotMinRPS int64   `toml:"hot_slot_min_rps" json:"hot_slot_min_rps"`
+
+	SlotLockTimeout      timesize.Duration `toml:"slot_lock_timeout" json:"slot_lock_timeout"`
+	AutoUnlockStaleLocks bool              `toml:"auto_unlock_stale_locks" json:"auto_unlock_stale_locks"`
+
+	SlotErrorRateWindow         timesize.Duration `toml:"slot_error_rate_window" json:"slot_error_rate_window"`
+	SlotErrorRateMinCalls       int               `toml:"slot_error_rate_min_calls" json:"slot_error_rate_min_calls"`
+	SlotSoftQuarantineThreshold float64           `toml:"slot_soft_quarantine_threshold" json:"slot_soft_quarantine_threshold"`
+	SlotHardQuarantineThreshold float64           `toml:"slot_hard_quarantine_threshold" json:"slot_hard_quarantine_threshold"`
+
+	EnableEncodingCache bool `toml:"enable_encoding_cache" json:"enable_encoding_cache"`
+
+	EnableRequestIDPropagation bool `toml:"enable_request_id_propagation" json:"enable_request_id_propagation"`
+
+	EnablePubSubFanout bool `toml:"enable_pubsub_fanout" json:"enable_pubsub_fanout"`
+
+	EnableInternalEventChannel bool `toml:"enable_internal_event_channel" json:"enable_internal_event_channel"`
+
+	EnableProxyAdminCommands bool `toml:"enable_proxy_admin_commands" json:"enable_proxy_admin_commands"`
+
+	// HotSlotCallback is called from the stats goroutine when a slot becomes hot, it should not block.
+	HotSlotCallback func(slotID int, rps float64) `toml:"-" json:"-"`
+
+	// SlotAffinityFunc overrides the slot of a hash key, it returns a slot in [0, MaxSlotNum) or -1
+	// to use the default hash. Keys are still migrated by codis-server using the default hash,
+	// so slots returned here should not be migrated.
+	SlotAffinityFunc func(key []byte) int `toml:"-" json:"-"`
+
+	EventHooks `toml:"-" json:"-"`
+
 	MetricsReportServer           string            `toml:"metrics_report_server" json:"metrics_report_server"`
 	MetricsReportPeriod           timesize.Duration `toml:"metrics_report_period" json:"metrics_report_period"`
 	MetricsReportInfluxdbServer   string            `toml:"metrics_report_influxdb_server" json:"metrics_report_influxdb_server"`
@@ -211,98 +541,304 @@ func (c *Config) String() string {
 	return b.String()
 }
 
+// ValidationErrors holds all of the misconfigurations found by ValidateAll.
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
 func (c *Config) Validate() error {
+	if errs := c.ValidateAll(); len(errs) != 0 {
+		return ValidationErrors(errs)
+	}
+	return nil
+}
+
+// ValidateAll checks the whole config and returns every misconfiguration
+// instead of stopping at the first one.
+func (c *Config) ValidateAll() []error {
+	var errs []error
 	if c.ProtoType == "" {
-		return errors.New("invalid proto_type")
+		errs = append(errs, errors.New("invalid proto_type"))
 	}
 	if c.ProxyAddr == "" {
-		return errors.New("invalid proxy_addr")
+		errs = append(errs, errors.New("invalid proxy_addr"))
+	} else if strings.HasPrefix(c.ProtoType, "tcp") && !isHostPort(c.ProxyAddr) {
+		errs = append(errs, errors.New("invalid proxy_addr, should be host:port"))
 	}
 	if c.AdminAddr == "" {
-		return errors.New("invalid admin_addr")
+		errs = append(errs, errors.New("invalid admin_addr"))
+	} else if !isHostPort(c.AdminAddr) {
+		errs = append(errs, errors.New("invalid admin_addr, should be host:port"))
+	}
+	if c.AdminApiAddr != "" && c.AdminToken == "" {
+		errs = append(errs, errors.New("invalid admin_token"))
 	}
 	if c.JodisName != "" {
 		if c.JodisAddr == "" {
-			return errors.New("invalid jodis_addr")
+			errs = append(errs, errors.New("invalid jodis_addr"))
 		}
 		if c.JodisTimeout < 0 {
-			return errors.New("invalid jodis_timeout")
+			errs = append(errs, errors.New("invalid jodis_timeout"))
 		}
 	}
 	if c.ProductName == "" {
-		return errors.New("invalid product_name")
+		errs = append(errs, errors.New("invalid product_name"))
+	}
+	for _, p := range c.BlockedKeyPrefixes {
+		if p == "" {
+			errs = append(errs, errors.New("invalid blocked_key_prefixes, should not be empty"))
+			break
+		}
+	}
+	for _, r := range c.MaxTTLRules {
+		if r.Pattern == "" || r.MaxTTL < time.Second {
+			errs = append(errs, errors.New("invalid max_ttl_rules, max_ttl should be at least 1s"))
+			break
+		}
+	}
+	for _, u := range c.SessionUsers {
+		if strings.IndexByte(u, ':') <= 0 {
+			errs = append(errs, errors.New("invalid session_users, should be username:password"))
+			break
+		}
+	}
+	if _, ok := hashFuncs[c.HashFunc]; !ok && c.HashFunc != "" {
+		errs = append(errs, errors.New("invalid hash_func"))
+	} else if c.HashFunc != "" && c.HashFunc != "crc32" && c.ScanAggregation {
+		errs = append(errs, errors.New("invalid hash_func, scan_aggregation requires crc32"))
 	}
 	if c.ProxyMaxClients < 0 {
-		return errors.New("invalid proxy_max_clients")
+		errs = append(errs, errors.New("invalid proxy_max_clients"))
+	}
+	if n := c.ProxyMaxClientsSoftLimit; n < 0 || n > c.ProxyMaxClients {
+		errs = append(errs, errors.New("invalid proxy_max_clients_soft_limit"))
+	} else if m := c.ProxyMaxClientsHardLimit; n != 0 && m != 0 && n > m {
+		errs = append(errs, errors.New("invalid proxy_max_clients_soft_limit, should not exceed the hard limit"))
+	}
+	if n := c.ProxyMaxClientsHardLimit; n < 0 || n > c.ProxyMaxClients {
+		errs = append(errs, errors.New("invalid proxy_max_clients_hard_limit"))
 	}
 
 	const MaxInt = bytesize.Int64(^uint(0) >> 1)
 
 	if d := c.ProxyMaxOffheapBytes; d < 0 || d > MaxInt {
-		return errors.New("invalid proxy_max_offheap_size")
+		errs = append(errs, errors.New("invalid proxy_max_offheap_size"))
 	}
 	if d := c.ProxyHeapPlaceholder; d < 0 || d > MaxInt {
-		return errors.New("invalid proxy_heap_placeholder")
+		errs = append(errs, errors.New("invalid proxy_heap_placeholder"))
+	}
+	if c.ProxyDrainTimeout < 0 {
+		errs = append(errs, errors.New("invalid proxy_drain_timeout"))
 	}
 	if c.BackendPingPeriod < 0 {
-		return errors.New("invalid backend_ping_period")
+		errs = append(errs, errors.New("invalid backend_ping_period"))
 	}
 
+	if c.BackendConnectTimeout < 0 {
+		errs = append(errs, errors.New("invalid backend_connect_timeout"))
+	}
 	if d := c.BackendRecvBufsize; d < 0 || d > MaxInt {
-		return errors.New("invalid backend_recv_bufsize")
+		errs = append(errs, errors.New("invalid backend_recv_bufsize"))
 	}
 	if c.BackendRecvTimeout < 0 {
-		return errors.New("invalid backend_recv_timeout")
+		errs = append(errs, errors.New("invalid backend_recv_timeout"))
 	}
 	if d := c.BackendSendBufsize; d < 0 || d > MaxInt {
-		return errors.New("invalid backend_send_bufsize")
+		errs = append(errs, errors.New("invalid backend_send_bufsize"))
 	}
 	if c.BackendSendTimeout < 0 {
-		return errors.New("invalid backend_send_timeout")
+		errs = append(errs, errors.New("invalid backend_send_timeout"))
 	}
 	if c.BackendMaxPipeline < 0 {
-		return errors.New("invalid backend_max_pipeline")
+		errs = append(errs, errors.New("invalid backend_max_pipeline"))
+	}
+	if c.BackendMaxPendingRequests < 0 {
+		errs = append(errs, errors.New("invalid backend_max_pending_requests"))
+	}
+	if c.PipelineFlushDelay < 0 {
+		errs = append(errs, errors.New("invalid pipeline_flush_delay"))
+	}
+	if _, ok := ParseReadPreference(c.BackendReadPreference); !ok {
+		errs = append(errs, errors.New("invalid backend_read_preference"))
 	}
 	if c.BackendPrimaryParallel < 0 {
-		return errors.New("invalid backend_primary_parallel")
+		errs = append(errs, errors.New("invalid backend_primary_parallel"))
 	}
 	if c.BackendReplicaParallel < 0 {
-		return errors.New("invalid backend_replica_parallel")
+		errs = append(errs, errors.New("invalid backend_replica_parallel"))
+	}
+	if c.BackendMaxIdleTime < 0 {
+		errs = append(errs, errors.New("invalid backend_max_idle_time"))
+	}
+	if c.BackendMinPoolSize < 0 {
+		errs = append(errs, errors.New("invalid backend_min_pool_size"))
+	}
+	if c.BackendWarmUpConcurrency < 0 {
+		errs = append(errs, errors.New("invalid backend_warmup_concurrency"))
 	}
 	if c.BackendKeepAlivePeriod < 0 {
-		return errors.New("invalid backend_keepalive_period")
+		errs = append(errs, errors.New("invalid backend_keepalive_period"))
+	}
+	if c.BackendDNSRefreshInterval < 0 {
+		errs = append(errs, errors.New("invalid backend_dns_refresh_interval"))
 	}
 	if c.BackendNumberDatabases < 1 {
-		return errors.New("invalid backend_number_databases")
+		errs = append(errs, errors.New("invalid backend_number_databases"))
+	}
+	if c.BackendUsername != "" && c.BackendPassword == "" {
+		errs = append(errs, errors.New("invalid backend_password, required by backend_username"))
+	}
+	if (c.BackendTLSCertFile == "") != (c.BackendTLSKeyFile == "") {
+		errs = append(errs, errors.New("invalid backend_tls_cert_file & backend_tls_key_file"))
+	}
+	if c.BackendCircuitBreakerThreshold < 0 {
+		errs = append(errs, errors.New("invalid backend_circuit_breaker_threshold"))
+	}
+	if c.BackendCircuitBreakerTimeout < 0 {
+		errs = append(errs, errors.New("invalid backend_circuit_breaker_timeout"))
+	}
+	if c.BackendMaxRetries < 0 {
+		errs = append(errs, errors.New("invalid backend_max_retries"))
+	}
+	if c.BackendRetryBackoff < 0 {
+		errs = append(errs, errors.New("invalid backend_retry_backoff"))
+	}
+	if c.BackendHealthScoreWindow < 0 {
+		errs = append(errs, errors.New("invalid backend_health_score_window"))
+	}
+	if c.BackendHealthMinScore < 0 || c.BackendHealthMinScore > 1 {
+		errs = append(errs, errors.New("invalid backend_health_min_score"))
 	}
 
 	if d := c.SessionRecvBufsize; d < 0 || d > MaxInt {
-		return errors.New("invalid session_recv_bufsize")
+		errs = append(errs, errors.New("invalid session_recv_bufsize"))
 	}
 	if c.SessionRecvTimeout < 0 {
-		return errors.New("invalid session_recv_timeout")
+		errs = append(errs, errors.New("invalid session_recv_timeout"))
 	}
 	if d := c.SessionSendBufsize; d < 0 || d > MaxInt {
-		return errors.New("invalid session_send_bufsize")
+		errs = append(errs, errors.New("invalid session_send_bufsize"))
 	}
 	if c.SessionSendTimeout < 0 {
-		return errors.New("invalid session_send_timeout")
+		errs = append(errs, errors.New("invalid session_send_timeout"))
 	}
 	if c.SessionMaxPipeline < 0 {
-		return errors.New("invalid session_max_pipeline")
+		errs = append(errs, errors.New("invalid session_max_pipeline"))
 	}
 	if c.SessionKeepAlivePeriod < 0 {
-		return errors.New("invalid session_keepalive_period")
+		errs = append(errs, errors.New("invalid session_keepalive_period"))
+	}
+
+	if c.SlowLogThreshold < 0 {
+		errs = append(errs, errors.New("invalid slowlog_threshold"))
+	}
+	if c.SlowLogMaxLen < 0 {
+		errs = append(errs, errors.New("invalid slowlog_max_len"))
+	}
+	if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+		errs = append(errs, errors.New("invalid access_log_sample_rate"))
+	}
+	if c.WaitTimeout < 0 {
+		errs = append(errs, errors.New("invalid wait_timeout"))
+	}
+	if c.DebugSleepMaxDuration < 0 {
+		errs = append(errs, errors.New("invalid debug_sleep_max_duration"))
+	}
+	if c.AnyBackendSlot < 0 || c.AnyBackendSlot >= MaxSlotNum {
+		errs = append(errs, errors.New("invalid any_backend_slot"))
+	}
+	if c.ClientRateLimitRPS < 0 {
+		errs = append(errs, errors.New("invalid client_rate_limit_rps"))
+	}
+	if c.ClientRateLimitBurst < 0 {
+		errs = append(errs, errors.New("invalid client_rate_limit_burst"))
+	}
+	if c.SentinelPollTimeout <= 0 {
+		errs = append(errs, errors.New("invalid sentinel_poll_timeout"))
+	}
+	if c.SentinelSubscribeExpiry <= 0 {
+		errs = append(errs, errors.New("invalid sentinel_subscribe_expiry"))
+	}
+	if c.SentinelRetryInterval < 0 {
+		errs = append(errs, errors.New("invalid sentinel_retry_interval"))
+	}
+	if c.SentinelBackoffSleep < 0 {
+		errs = append(errs, errors.New("invalid sentinel_backoff_sleep"))
+	}
+	if c.HotSlotFactor < 0 {
+		errs = append(errs, errors.New("invalid hot_slot_factor"))
+	}
+	if c.HotSlotMinRPS < 0 {
+		errs = append(errs, errors.New("invalid hot_slot_min_rps"))
+	}
+	if c.SlotLockTimeout < 0 {
+		errs = append(errs, errors.New("invalid slot_lock_timeout"))
+	}
+	if c.SlotErrorRateWindow < 0 {
+		errs = append(errs, errors.New("invalid slot_error_rate_window"))
+	}
+	if c.SlotErrorRateMinCalls < 0 {
+		errs = append(errs, errors.New("invalid slot_error_rate_min_calls"))
+	}
+	if c.SlotSoftQuarantineThreshold < 0 || c.SlotSoftQuarantineThreshold > 1 {
+		errs = append(errs, errors.New("invalid slot_soft_quarantine_threshold"))
+	}
+	if c.SlotHardQuarantineThreshold < 0 || c.SlotHardQuarantineThreshold > 1 {
+		errs = append(errs, errors.New("invalid slot_hard_quarantine_threshold"))
 	}
 
 	if c.MetricsReportPeriod < 0 {
-		return errors.New("invalid metrics_report_period")
+		errs = append(errs, errors.New("invalid metrics_report_period"))
 	}
 	if c.MetricsReportInfluxdbPeriod < 0 {
-		return errors.New("invalid metrics_report_influxdb_period")
+		errs = append(errs, errors.New("invalid metrics_report_influxdb_period"))
 	}
 	if c.MetricsReportStatsdPeriod < 0 {
-		return errors.New("invalid metrics_report_statsd_period")
+		errs = append(errs, errors.New("invalid metrics_report_statsd_period"))
 	}
-	return nil
+	return errs
+}
+
+func isHostPort(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port != ""
+}
+
+func (c *Config) BackendAuth() (username, password string) {
+	if c.BackendPassword != "" {
+		return c.BackendUsername, c.BackendPassword
+	}
+	return "", c.ProductAuth
+}
+
+func (c *Config) BackendTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.BackendTLSServerName,
+		InsecureSkipVerify: c.BackendTLSSkipVerify,
+	}
+	if c.BackendTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.BackendTLSCertFile, c.BackendTLSKeyFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.BackendTLSCAFile != "" {
+		b, err := ioutil.ReadFile(c.BackendTLSCAFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("invalid backend_tls_ca_file %s", c.BackendTLSCAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
 }
@@ -0,0 +1,162 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+const encodingCacheSize = 4096
+
+// encodingCache keeps OBJECT ENCODING hints of string keys inferred from plain
+// SET, and hints of any keys given by PROXY HINT ENCODING, so that OBJECT
+// ENCODING can be answered without a round-trip. Any other write through this
+// proxy drops the hints of its arguments and so does refilling a slot, but
+// writes sent to backends by others are not seen, so hints may be stale.
+type encodingCache struct {
+	mu sync.Mutex
+
+	size int
+	list *list.List
+	keys map[encodingKey]*list.Element
+
+	// slots indexes entries by slot, so that refilling a slot drops its hints
+	// without scanning the whole cache.
+	slots    map[int]map[*list.Element]bool
+	hashSlot func(key []byte) int
+}
+
+type encodingKey struct {
+	database int32
+	key      string
+}
+
+type encodingEntry struct {
+	encodingKey
+	slot int
+	hint string
+}
+
+func newEncodingCache(size int, hashSlot func(key []byte) int) *encodingCache {
+	return &encodingCache{
+		size: size, list: list.New(), keys: make(map[encodingKey]*list.Element),
+		slots: make(map[int]map[*list.Element]bool), hashSlot: hashSlot,
+	}
+}
+
+// objectEncodings are the replies of OBJECT ENCODING that clients may hint.
+var objectEncodings = map[string]bool{
+	"raw": true, "int": true, "embstr": true, "hashtable": true, "intset": true,
+	"listpack": true, "ziplist": true, "zipmap": true, "linkedlist": true,
+	"quicklist": true, "skiplist": true, "stream": true,
+}
+
+// inferEncoding returns the encoding redis uses for string value.
+func inferEncoding(value []byte) string {
+	if len(value) <= 20 {
+		if n, err := strconv.ParseInt(string(value), 10, 64); err == nil && strconv.FormatInt(n, 10) == string(value) {
+			return "int"
+		}
+	}
+	if len(value) <= 44 {
+		return "embstr"
+	}
+	return "raw"
+}
+
+// Observe updates hints with request r, it returns the reply of OBJECT ENCODING
+// if the hint of the key is cached. Replies of GET are never used: the value of
+// a key written by APPEND or SETRANGE is raw whatever its length.
+func (c *encodingCache) Observe(r *Request) *redis.Resp {
+	switch {
+	case r.OpStr == "OBJECT":
+		if len(r.Multi) == 3 && strings.ToUpper(string(r.Multi[1].Value)) == "ENCODING" {
+			if hint := c.get(r.Database, string(r.Multi[2].Value)); hint != "" {
+				return redis.NewBulkBytes([]byte(hint))
+			}
+		}
+	case r.OpStr == "SET" && len(r.Multi) == 3:
+		c.set(r.Database, string(r.Multi[1].Value), inferEncoding(r.Multi[2].Value))
+	case r.OpStr == "EXEC":
+		// Queued writes are applied now, but it's not known what they are.
+		c.purge()
+	case !r.OpFlag.IsReadOnly():
+		for _, arg := range r.Multi[1:] {
+			c.del(r.Database, string(arg.Value))
+		}
+	}
+	return nil
+}
+
+func (c *encodingCache) get(database int32, key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.keys[encodingKey{database, key}]; e != nil {
+		c.list.MoveToFront(e)
+		return e.Value.(*encodingEntry).hint
+	}
+	return ""
+}
+
+func (c *encodingCache) set(database int32, key string, hint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var k = encodingKey{database, key}
+	if e := c.keys[k]; e != nil {
+		e.Value.(*encodingEntry).hint = hint
+		c.list.MoveToFront(e)
+		return
+	}
+	var id = c.hashSlot([]byte(key))
+	var e = c.list.PushFront(&encodingEntry{encodingKey: k, slot: id, hint: hint})
+	c.keys[k] = e
+	if c.slots[id] == nil {
+		c.slots[id] = make(map[*list.Element]bool)
+	}
+	c.slots[id][e] = true
+	for c.list.Len() > c.size {
+		c.remove(c.list.Back())
+	}
+}
+
+func (c *encodingCache) del(database int32, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.keys[encodingKey{database, key}]; e != nil {
+		c.remove(e)
+	}
+}
+
+func (c *encodingCache) remove(e *list.Element) {
+	var x = c.list.Remove(e).(*encodingEntry)
+	delete(c.keys, x.encodingKey)
+	if m := c.slots[x.slot]; m != nil {
+		delete(m, e)
+		if len(m) == 0 {
+			delete(c.slots, x.slot)
+		}
+	}
+}
+
+// purgeSlot drops the hints of keys hashed to slot id.
+func (c *encodingCache) purgeSlot(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := range c.slots[id] {
+		c.remove(e)
+	}
+}
+
+func (c *encodingCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.list.Init()
+	c.keys = make(map[encodingKey]*list.Element)
+	c.slots = make(map[int]map[*list.Element]bool)
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestEncodingCachePurgeSlot(t *testing.T) {
+	var hashSlot = func(key []byte) int {
+		return int(key[0] - '0')
+	}
+	c := newEncodingCache(3, hashSlot)
+
+	c.set(0, "1a", "int")
+	c.set(1, "1a", "raw")
+	c.set(0, "2a", "embstr")
+	c.purgeSlot(1)
+	assert.Must(c.get(0, "1a") == "" && c.get(1, "1a") == "")
+	assert.Must(c.get(0, "2a") == "embstr")
+	assert.Must(len(c.slots) == 1 && len(c.slots[2]) == 1)
+
+	// Evicted and deleted entries are dropped from the index.
+	c.set(0, "3a", "int")
+	c.set(0, "3b", "int")
+	c.set(0, "3c", "int")
+	assert.Must(c.get(0, "2a") == "" && len(c.slots) == 1 && len(c.slots[3]) == 3)
+	c.del(0, "3a")
+	assert.Must(len(c.slots[3]) == 2 && len(c.keys) == 2)
+	c.purgeSlot(3)
+	assert.Must(c.list.Len() == 0 && len(c.keys) == 0 && len(c.slots) == 0)
+}
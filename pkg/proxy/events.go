@@ -0,0 +1,82 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// eventChannel is the channel that internal events are published to, if
+// enable_internal_event_channel is set.
+const eventChannel = "__codis_proxy__"
+
+// eventHub publishes internal events of the router and backends to sessions
+// subscribing to eventChannel, messages are JSON objects with the name of the
+// event, the time it happened and fields of the event.
+type eventHub struct {
+	mu sync.Mutex
+
+	subs map[*pubsubConn]*keyspaceSub
+
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*pubsubConn]*keyspaceSub)}
+}
+
+func (h *eventHub) Update(pc *pubsubConn, tasks *RequestChan) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.subs[pc] = newKeyspaceSub(pc, tasks)
+}
+
+func (h *eventHub) Remove(pc *pubsubConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, pc)
+}
+
+func (h *eventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	h.subs = make(map[*pubsubConn]*keyspaceSub)
+}
+
+// Publish sends event to the subscribers, it's a no-op on a nil hub or if
+// nobody is subscribing.
+func (h *eventHub) Publish(event string, fields map[string]interface{}) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	var m = make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		m[k] = v
+	}
+	m["event"] = event
+	m["unixtime"] = time.Now().Unix()
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.WarnErrorf(err, "encode event %s failed", event)
+		return
+	}
+	var channel = redis.NewBulkBytes([]byte(eventChannel))
+	for _, sub := range h.subs {
+		sub.publish(channel, redis.NewBulkBytes(b))
+	}
+}
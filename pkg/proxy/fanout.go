@@ -0,0 +1,340 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+// fanoutHub keeps a single subscription on the backends for each channel or
+// pattern subscribed by local sessions, and fans out messages to them.
+type fanoutHub struct {
+	mu sync.Mutex
+
+	subs   map[*pubsubConn]*keyspaceSub
+	fanin  map[string]*fanoutConn
+	routes map[string]string
+
+	// backends are where patterns are subscribed, since they may match
+	// channels of any slot.
+	backends []string
+
+	config *Config
+	route  func(channel []byte) string
+	addrs  func() []string
+
+	running bool
+	closed  bool
+}
+
+func newFanoutHub(config *Config, route func(channel []byte) string, addrs func() []string) *fanoutHub {
+	return &fanoutHub{
+		subs:   make(map[*pubsubConn]*keyspaceSub),
+		fanin:  make(map[string]*fanoutConn),
+		routes: make(map[string]string),
+		config: config, route: route, addrs: addrs,
+	}
+}
+
+func (h *fanoutHub) Update(pc *pubsubConn, tasks *RequestChan) {
+	var routes = make(map[string]string)
+	for channel := range pc.channels {
+		routes[channel] = h.route([]byte(channel))
+	}
+	var backends = h.addrs()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.subs[pc] = newKeyspaceSub(pc, tasks)
+
+	for k, addr := range routes {
+		h.routes[k] = addr
+	}
+	h.backends = backends
+	h.syncFanIn()
+
+	if !h.running {
+		h.running = true
+		go h.loopRefresh()
+	}
+}
+
+func (h *fanoutHub) Remove(pc *pubsubConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	delete(h.subs, pc)
+	h.syncFanIn()
+}
+
+func (h *fanoutHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	h.subs = make(map[*pubsubConn]*keyspaceSub)
+	for addr, f := range h.fanin {
+		f.Close()
+		delete(h.fanin, addr)
+	}
+}
+
+// loopRefresh re-routes subscriptions periodically, so they follow slots
+// that are moved to other backends.
+func (h *fanoutHub) loopRefresh() {
+	for {
+		time.Sleep(time.Second)
+
+		h.mu.Lock()
+		if h.closed || len(h.subs) == 0 {
+			h.running = false
+			h.mu.Unlock()
+			return
+		}
+		var keys []string
+		for k := range h.routes {
+			keys = append(keys, k)
+		}
+		h.mu.Unlock()
+
+		var routes = make(map[string]string, len(keys))
+		for _, k := range keys {
+			routes[k] = h.route([]byte(k))
+		}
+		var backends = h.addrs()
+
+		h.mu.Lock()
+		for k, addr := range routes {
+			if _, ok := h.routes[k]; ok {
+				h.routes[k] = addr
+			}
+		}
+		h.backends = backends
+		h.syncFanIn()
+		h.mu.Unlock()
+	}
+}
+
+// syncFanIn subscribes to the union of channels and patterns wanted by local
+// sessions on each backend, and drops the ones no longer needed.
+func (h *fanoutHub) syncFanIn() {
+	var channels = make(map[string]map[string]bool)
+	var patterns = make(map[string]map[string]bool)
+	var wanted = func(sets map[string]map[string]bool, addr, k string) {
+		if addr == "" {
+			return
+		}
+		if sets[addr] == nil {
+			sets[addr] = make(map[string]bool)
+		}
+		sets[addr][k] = true
+	}
+	var inuse = make(map[string]bool)
+	for _, sub := range h.subs {
+		for channel := range sub.channels {
+			inuse[channel] = true
+			wanted(channels, h.routes[channel], channel)
+		}
+		for _, pattern := range sub.patterns {
+			for _, addr := range h.backends {
+				wanted(patterns, addr, pattern)
+			}
+		}
+	}
+	for k := range h.routes {
+		if !inuse[k] {
+			delete(h.routes, k)
+		}
+	}
+	for addr, f := range h.fanin {
+		if channels[addr] == nil && patterns[addr] == nil {
+			f.Close()
+			delete(h.fanin, addr)
+		}
+	}
+	for _, sets := range []map[string]map[string]bool{channels, patterns} {
+		for addr := range sets {
+			if h.fanin[addr] == nil {
+				f := &fanoutConn{addr: addr, quit: make(chan struct{})}
+				h.fanin[addr] = f
+				go f.loop(h)
+			}
+		}
+	}
+	for addr, f := range h.fanin {
+		f.Update(channels[addr], patterns[addr])
+	}
+}
+
+func (h *fanoutHub) publish(pattern, channel, message *redis.Resp) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sub := range h.subs {
+		if pattern == nil {
+			if sub.channels[string(channel.Value)] {
+				sub.push(redis.NewArray([]*redis.Resp{
+					redis.NewBulkBytes([]byte("message")), channel, message,
+				}))
+			}
+			continue
+		}
+		for _, p := range sub.patterns {
+			if p == string(pattern.Value) {
+				sub.push(redis.NewArray([]*redis.Resp{
+					redis.NewBulkBytes([]byte("pmessage")), pattern, channel, message,
+				}))
+			}
+		}
+	}
+}
+
+type fanoutConn struct {
+	mu sync.Mutex
+
+	addr string
+	conn *redis.Conn
+	quit chan struct{}
+
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+func (f *fanoutConn) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.quit:
+		return
+	default:
+		close(f.quit)
+	}
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+// Update sends the difference between the current subscriptions and the
+// wanted ones to the backend, it's applied on reconnecting if not connected.
+func (f *fanoutConn) Update(channels, patterns map[string]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.update(channels, patterns)
+}
+
+func (f *fanoutConn) update(channels, patterns map[string]bool) {
+	if f.conn != nil {
+		var err error
+		for _, cmd := range [][2]string{{"SUBSCRIBE", "UNSUBSCRIBE"}, {"PSUBSCRIBE", "PUNSUBSCRIBE"}} {
+			var current, target = f.channels, channels
+			if cmd[0] == "PSUBSCRIBE" {
+				current, target = f.patterns, patterns
+			}
+			if err == nil {
+				err = f.send(cmd[0], diffKeys(target, current))
+			}
+			if err == nil {
+				err = f.send(cmd[1], diffKeys(current, target))
+			}
+		}
+		if err != nil {
+			f.conn.Close()
+		}
+	}
+	f.channels, f.patterns = channels, patterns
+}
+
+func (f *fanoutConn) send(opstr string, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	var multi = []*redis.Resp{redis.NewBulkBytes([]byte(opstr))}
+	for _, arg := range args {
+		multi = append(multi, redis.NewBulkBytes([]byte(arg)))
+	}
+	return f.conn.EncodeMultiBulk(multi, true)
+}
+
+func diffKeys(a, b map[string]bool) []string {
+	var keys []string
+	for k := range a {
+		if !b[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fanoutConn) loop(h *fanoutHub) {
+	for {
+		err := f.subscribe(h)
+		select {
+		case <-f.quit:
+			return
+		case <-time.After(time.Second):
+		}
+		log.WarnErrorf(err, "pubsub fan-in to %s failed, reconnecting", f.addr)
+	}
+}
+
+func (f *fanoutConn) subscribe(h *fanoutHub) error {
+	c, err := dialBackend(f.addr, h.config)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.WriterTimeout = h.config.BackendSendTimeout.Duration()
+	c.SetKeepAlivePeriod(h.config.BackendKeepAlivePeriod.Duration())
+
+	if err := verifyAuth(c, h.config); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	select {
+	case <-f.quit:
+		f.mu.Unlock()
+		return nil
+	default:
+		f.conn = c
+	}
+	var channels, patterns = f.channels, f.patterns
+	f.channels, f.patterns = nil, nil
+	f.update(channels, patterns)
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.conn = nil
+		f.mu.Unlock()
+	}()
+
+	for {
+		resp, err := c.Decode()
+		if err != nil {
+			return err
+		}
+		switch {
+		case resp.IsError():
+			return fmt.Errorf("error resp: %s", resp.Value)
+		case !resp.IsArray() || len(resp.Array) < 3:
+			continue
+		case string(resp.Array[0].Value) == "message":
+			h.publish(nil, resp.Array[1], resp.Array[2])
+		case string(resp.Array[0].Value) == "pmessage" && len(resp.Array) == 4:
+			h.publish(resp.Array[1], resp.Array[2], resp.Array[3])
+		}
+	}
+}
@@ -5,6 +5,7 @@ package proxy
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,6 +23,8 @@ type forwardMethod interface {
 var (
 	ErrSlotIsNotReady = errors.New("slot is not ready, may be offline")
 	ErrRespIsRequired = errors.New("resp is required")
+
+	ErrSlotQuarantined = errors.New("slot is quarantined, backend error rate is too high")
 )
 
 type forwardSync struct {
@@ -39,7 +42,9 @@ func (d *forwardSync) Forward(s *Slot, r *Request, hkey []byte) error {
 	if err != nil {
 		return err
 	}
-	bc.PushBack(r)
+	if bc != nil {
+		bc.PushBack(r)
+	}
 	return nil
 }
 
@@ -49,10 +54,24 @@ func (d *forwardSync) process(s *Slot, r *Request, hkey []byte) (*BackendConn, e
 			s.id, hkey)
 		return nil, ErrSlotIsNotReady
 	}
+	// OBJECT and TYPE inspect the key without moving it, since migration would
+	// reset its encoding and LRU/LFU state: they're sent to the target first,
+	// and to the source if the key hasn't been migrated yet.
+	if s.migrate.bc != nil && (r.OpStr == "OBJECT" || r.OpStr == "TYPE") && len(hkey) != 0 {
+		resp, err := d.inspectOnTarget(s, r)
+		if err != nil {
+			return nil, err
+		}
+		if resp != nil {
+			r.Resp = resp
+			return nil, nil
+		}
+		r.Group = &s.refs
+		r.Group.Add(1)
+		return s.migrate.bc.BackendConn(r.Database, r.Seed16(), true), nil
+	}
 	if s.migrate.bc != nil && len(hkey) != 0 {
-		if err := d.slotsmgrt(s, hkey, r.Database, r.Seed16()); err != nil {
-			log.Debugf("slot-%04d migrate from = %s to %s failed: hash key = '%s', database = %d, error = %s",
-				s.id, s.migrate.bc.Addr(), s.backend.bc.Addr(), hkey, r.Database, err)
+		if err := d.slotsmgrtKeys(s, r, migrateKeys(r, hkey)); err != nil {
 			return nil, err
 		}
 	}
@@ -110,7 +129,17 @@ func (d *forwardSemiAsync) process(s *Slot, r *Request, hkey []byte) (_ *Backend
 			s.id, hkey)
 		return nil, false, ErrSlotIsNotReady
 	}
+	var keys [][]byte
 	if s.migrate.bc != nil && len(hkey) != 0 {
+		keys = migrateKeys(r, hkey)
+	}
+	// The wrapper executes commands of a single hash tag only, keys of other
+	// hash tags in the same slot are migrated first like forwardSync.
+	if len(keys) > 1 {
+		if err := d.slotsmgrtKeys(s, r, keys); err != nil {
+			return nil, false, err
+		}
+	} else if len(keys) != 0 {
 		resp, moved, err := d.slotsmgrtExecWrapper(s, hkey, r.Database, r.Seed16(), r.Multi)
 		switch {
 		case err != nil:
@@ -158,6 +187,9 @@ func (d *forwardHelper) slotsmgrt(s *Slot, hkey []byte, database int32, seed uin
 	case resp.IsError():
 		return fmt.Errorf("bad slotsmgrt resp: %s", resp.Value)
 	case resp.IsInt():
+		if n, err := redis.Btoi64(resp.Value); err == nil {
+			s.migrated.Add(n)
+		}
 		log.Debugf("slot-%04d migrate from %s to %s: hash key = %s, database = %d, resp = %s",
 			s.id, s.migrate.bc.Addr(), s.backend.bc.Addr(), hkey, database, resp.Value)
 		return nil
@@ -166,6 +198,69 @@ func (d *forwardHelper) slotsmgrt(s *Slot, hkey []byte, database int32, seed uin
 	}
 }
 
+// slotsmgrtKeys migrates the keys of r one hash tag at a time.
+func (d *forwardHelper) slotsmgrtKeys(s *Slot, r *Request, keys [][]byte) error {
+	for _, key := range keys {
+		if err := d.slotsmgrt(s, key, r.Database, r.Seed16()); err != nil {
+			log.Debugf("slot-%04d migrate from = %s to %s failed: hash key = '%s', database = %d, error = %s",
+				s.id, s.migrate.bc.Addr(), s.backend.bc.Addr(), key, r.Database, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateKeys returns hkey and the other keys of r that have distinct hash
+// tags, since SLOTSMGRTTAGONE only moves keys sharing the tag of the given
+// one, while keys of the same slot are batched into a single request.
+func migrateKeys(r *Request, hkey []byte) [][]byte {
+	var keys = commandKeys(r.Multi, r.OpStr)
+	switch r.OpStr {
+	case "XREAD", "XREADGROUP":
+		keys = nil
+		if i, _, ok := parseStreams(r.Multi, r.OpStr); ok {
+			for _, m := range r.Multi[i+1 : i+1+(len(r.Multi)-i-1)/2] {
+				keys = append(keys, m.Value)
+			}
+		}
+	}
+	var tags = map[string]bool{string(hashTag(hkey)): true}
+	var result = [][]byte{hkey}
+	for _, key := range keys {
+		if tag := string(hashTag(key)); !tags[tag] {
+			tags[tag] = true
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// inspectOnTarget sends OBJECT or TYPE to the migration target, the reply is
+// nil if the key doesn't exist there.
+func (d *forwardHelper) inspectOnTarget(s *Slot, r *Request) (*redis.Resp, error) {
+	m := &Request{}
+	m.Multi = r.Multi
+	m.Batch = &sync.WaitGroup{}
+
+	s.backend.bc.BackendConn(r.Database, r.Seed16(), true).PushBack(m)
+
+	m.Batch.Wait()
+
+	if err := m.Err; err != nil {
+		return nil, err
+	}
+	switch resp := m.Resp; {
+	case resp == nil:
+		return nil, ErrRespIsRequired
+	case resp.IsBulkBytes() && resp.Value == nil:
+		return nil, nil
+	case resp.IsString() && string(resp.Value) == "none":
+		return nil, nil
+	default:
+		return resp, nil
+	}
+}
+
 func (d *forwardHelper) slotsmgrtExecWrapper(s *Slot, hkey []byte, database int32, seed uint, multi []*redis.Resp) (_ *redis.Resp, moved bool, _ error) {
 	m := &Request{}
 	m.Multi = make([]*redis.Resp, 0, 2+len(multi))
@@ -216,15 +311,118 @@ func (d *forwardHelper) slotsmgrtExecWrapper(s *Slot, hkey []byte, database int3
 func (d *forwardHelper) forward2(s *Slot, r *Request) *BackendConn {
 	var database, seed = r.Database, r.Seed16()
 	if s.migrate.bc == nil && !r.IsMasterOnly() && len(s.replicaGroups) != 0 {
-		for _, group := range s.replicaGroups {
-			var i = seed
-			for range group {
-				i = (i + 1) % uint(len(group))
-				if bc := group[i].BackendConn(database, seed, false); bc != nil {
-					return bc
-				}
+		switch r.ReadPreference {
+		case PreferReplica:
+			if bc := d.forwardReplica(s, database, seed); bc != nil {
+				return bc
+			}
+		case PreferMaster:
+			if bc := s.backend.bc.BackendConn(database, seed, false); bc != nil {
+				return bc
+			}
+			if bc := d.forwardReplica(s, database, seed); bc != nil {
+				return bc
+			}
+		case ReadRoundRobin:
+			if bc := d.forwardAny(s, database, seed, uint(s.roundrobin.Incr())); bc != nil {
+				return bc
+			}
+		case ReadRandom:
+			if bc := d.forwardAny(s, database, seed, seed); bc != nil {
+				return bc
 			}
 		}
 	}
 	return s.backend.bc.BackendConn(database, seed, true)
 }
+
+// forwardReplica picks a replica of the first group with one available in
+// weighted round-robin, the weights are those of the latest fillSlot.
+func (d *forwardHelper) forwardReplica(s *Slot, database int32, seed uint) *BackendConn {
+	for i, group := range s.replicaGroups {
+		var weights = s.replicaWeights[i]
+		var total int
+		for _, w := range weights {
+			total += w
+		}
+		if total == 0 {
+			continue
+		}
+		var j, n = 0, int(uint64(s.weighted.Incr()) % uint64(total))
+		for n >= weights[j] {
+			n -= weights[j]
+			j++
+		}
+		var best *BackendConn
+		var score = -1.0
+		for range group {
+			if weights[j] != 0 {
+				if bc := group[j].BackendConn(database, seed, false); bc != nil {
+					if x := group[j].health.Score(); x > score && group[j].health.IsHealthy(x) {
+						best, score = bc, x
+					}
+				}
+			}
+			j = (j + 1) % len(group)
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return nil
+}
+
+func (d *forwardHelper) forwardAny(s *Slot, database int32, seed uint, next uint) *BackendConn {
+	var candidates = make([]*sharedBackendConn, 0, 4)
+	candidates = append(candidates, s.backend.bc)
+	for _, group := range s.replicaGroups {
+		candidates = append(candidates, group...)
+	}
+	var i = next
+	for range candidates {
+		i = (i + 1) % uint(len(candidates))
+		if bc := candidates[i].BackendConn(database, seed, false); bc != nil {
+			return bc
+		}
+	}
+	return nil
+}
+
+type ReadPreference int
+
+const (
+	PreferReplica ReadPreference = iota
+	PreferMaster
+	ReadRoundRobin
+	ReadRandom
+)
+
+func ParseReadPreference(s string) (ReadPreference, bool) {
+	switch strings.ToUpper(s) {
+	default:
+		return PreferReplica, false
+	case "REPLICA":
+		return PreferReplica, true
+	case "MASTER":
+		return PreferMaster, true
+	case "ROUNDROBIN":
+		return ReadRoundRobin, true
+	case "RANDOM":
+		return ReadRandom, true
+	}
+}
+
+func (p ReadPreference) String() string {
+	switch p {
+	case PreferReplica:
+		return "replica"
+	case PreferMaster:
+		return "master"
+	case ReadRoundRobin:
+		return "roundrobin"
+	case ReadRandom:
+		return "random"
+	default:
+		return fmt.Sprintf("unknown-%d", int(p))
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestHashFuncs(t *testing.T) {
+	assert.Must(fnv1a32([]byte("")) == 0x811c9dc5)
+	assert.Must(fnv1a32([]byte("hello")) == 0x4f9f2cab)
+
+	assert.Must(murmur3([]byte("")) == 0)
+	assert.Must(murmur3([]byte("hello")) == 0x248bfa47)
+	assert.Must(murmur3([]byte("The quick brown fox jumps over the lazy dog")) == 0x2e4ff723)
+
+	assert.Must(xxhash64([]byte("")) == 0xef46db3751d8e999)
+	assert.Must(xxhash64([]byte("abc")) == 0x44bc2cf5ad770999)
+	assert.Must(xxhash64([]byte("Nobody inspects the spammish repetition")) == 0xfbcea83c8a378bf1)
+}
+
+func TestGetHashFunc(t *testing.T) {
+	for name := range hashFuncs {
+		fn := getHashFunc(name)
+		assert.Must(fn([]byte("{tag}1")) == fn([]byte("x{tag}2")))
+		assert.Must(fn([]byte("{tag}1")) == hashFuncs[name]([]byte("tag")))
+	}
+	assert.Must(getHashFunc("crc32")([]byte("key")) == Hash([]byte("key")))
+	assert.Must(getHashFunc("")([]byte("key")) == Hash([]byte("key")))
+	assert.Must(getHashFunc("murmur3")([]byte("key")) != Hash([]byte("key")))
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const healthLatencyBase = float64(time.Millisecond * 10)
+
+// healthScorer keeps moving averages of error rate and latency of a backend,
+// samples are weighted by time so both decay over window without traffic.
+type healthScorer struct {
+	mu sync.Mutex
+
+	window float64
+	min    float64
+
+	last    int64
+	errors  float64
+	latency float64
+}
+
+func newHealthScorer(config *Config) *healthScorer {
+	if config.BackendHealthScoreWindow <= 0 {
+		return nil
+	}
+	return &healthScorer{
+		window: float64(config.BackendHealthScoreWindow.Duration()),
+		min:    config.BackendHealthMinScore,
+		last:   time.Now().UnixNano(),
+	}
+}
+
+func (h *healthScorer) Record(r *Request, failed bool) {
+	if h == nil || r.UnixNano == 0 {
+		return
+	}
+	var now = time.Now().UnixNano()
+	var x float64
+	if failed {
+		x = 1
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var alpha = 1 - h.decay(now)
+	h.errors += alpha * (x - h.errors)
+	h.latency += alpha * (float64(now-r.UnixNano) - h.latency)
+	h.last = now
+}
+
+func (h *healthScorer) decay(now int64) float64 {
+	if now <= h.last {
+		return 1
+	}
+	return math.Exp(-float64(now-h.last) / h.window)
+}
+
+// Score returns (1 - errors) * base / (base + latency), base is 10ms. A
+// backend without samples in the window scores 1.
+func (h *healthScorer) Score() float64 {
+	if h == nil {
+		return 1
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var decay = h.decay(time.Now().UnixNano())
+	var errors, latency = h.errors * decay, h.latency * decay
+	return (1 - errors) * healthLatencyBase / (healthLatencyBase + latency)
+}
+
+func (h *healthScorer) IsHealthy(score float64) bool {
+	return h == nil || score >= h.min
+}
@@ -0,0 +1,32 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestHealthScorer(t *testing.T) {
+	config := NewDefaultConfig()
+	h := newHealthScorer(config)
+	assert.Must(h == nil && h.Score() == 1 && h.IsHealthy(0))
+	h.Record(&Request{UnixNano: 1}, true)
+
+	config.BackendHealthScoreWindow.Set(time.Millisecond * 100)
+	config.BackendHealthMinScore = 0.5
+	h = newHealthScorer(config)
+	assert.Must(h.Score() == 1 && h.IsHealthy(h.Score()))
+
+	time.Sleep(time.Millisecond * 100)
+	h.Record(&Request{UnixNano: time.Now().Add(-time.Millisecond * 10).UnixNano()}, true)
+	h.Record(&Request{}, false)
+	assert.Must(h.errors > 0.5 && h.latency > float64(time.Millisecond*5))
+	assert.Must(!h.IsHealthy(h.Score()))
+
+	time.Sleep(time.Millisecond * 300)
+	assert.Must(h.Score() > 0.9)
+}
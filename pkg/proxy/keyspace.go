@@ -0,0 +1,249 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+var keyspacePatterns = []string{"__keyspace@*__:*", "__keyevent@*__:*"}
+
+func isKeyspaceChannel(channel []byte) bool {
+	return bytes.HasPrefix(channel, []byte("__keyspace@")) ||
+		bytes.HasPrefix(channel, []byte("__keyevent@"))
+}
+
+type keyspaceSub struct {
+	tasks *RequestChan
+	resp3 bool
+
+	channels map[string]bool
+	patterns []string
+}
+
+type keyspaceHub struct {
+	mu sync.Mutex
+
+	subs  map[*pubsubConn]*keyspaceSub
+	fanin map[string]*keyspaceFanIn
+
+	config *Config
+	addrs  func() []string
+
+	running bool
+	closed  bool
+}
+
+func newKeyspaceHub(config *Config, addrs func() []string) *keyspaceHub {
+	return &keyspaceHub{
+		subs:   make(map[*pubsubConn]*keyspaceSub),
+		fanin:  make(map[string]*keyspaceFanIn),
+		config: config, addrs: addrs,
+	}
+}
+
+func (h *keyspaceHub) Update(pc *pubsubConn, tasks *RequestChan) {
+	var addrs = h.addrs()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.subs[pc] = newKeyspaceSub(pc, tasks)
+
+	if !h.running {
+		h.running = true
+		h.syncFanIn(addrs)
+		go h.loopRefresh()
+	}
+}
+
+func (h *keyspaceHub) Remove(pc *pubsubConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, pc)
+}
+
+func (h *keyspaceHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	h.subs = make(map[*pubsubConn]*keyspaceSub)
+	for addr, f := range h.fanin {
+		f.Close()
+		delete(h.fanin, addr)
+	}
+}
+
+func (h *keyspaceHub) loopRefresh() {
+	for {
+		time.Sleep(time.Second)
+		var addrs = h.addrs()
+
+		h.mu.Lock()
+		if h.closed || len(h.subs) == 0 {
+			for addr, f := range h.fanin {
+				f.Close()
+				delete(h.fanin, addr)
+			}
+			h.running = false
+			h.mu.Unlock()
+			return
+		}
+		h.syncFanIn(addrs)
+		h.mu.Unlock()
+	}
+}
+
+func (h *keyspaceHub) syncFanIn(addrs []string) {
+	var exists = make(map[string]bool)
+	for _, addr := range addrs {
+		exists[addr] = true
+		if h.fanin[addr] == nil {
+			f := &keyspaceFanIn{addr: addr, quit: make(chan struct{})}
+			h.fanin[addr] = f
+			go f.loop(h)
+		}
+	}
+	for addr, f := range h.fanin {
+		if !exists[addr] {
+			f.Close()
+			delete(h.fanin, addr)
+		}
+	}
+}
+
+func (h *keyspaceHub) publish(channel, message *redis.Resp) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, sub := range h.subs {
+		sub.publish(channel, message)
+	}
+}
+
+func newKeyspaceSub(pc *pubsubConn, tasks *RequestChan) *keyspaceSub {
+	sub := &keyspaceSub{tasks: tasks, resp3: pc.resp3, channels: make(map[string]bool)}
+	for channel := range pc.channels {
+		sub.channels[channel] = true
+	}
+	for pattern := range pc.patterns {
+		sub.patterns = append(sub.patterns, pattern)
+	}
+	return sub
+}
+
+// publish pushes message to the subscriber if it has subscribed to channel
+// or to any pattern matching it.
+func (sub *keyspaceSub) publish(channel, message *redis.Resp) {
+	if sub.channels[string(channel.Value)] {
+		sub.push(redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("message")), channel, message,
+		}))
+	}
+	for _, pattern := range sub.patterns {
+		if globMatch([]byte(pattern), channel.Value) {
+			sub.push(redis.NewArray([]*redis.Resp{
+				redis.NewBulkBytes([]byte("pmessage")),
+				redis.NewBulkBytes([]byte(pattern)), channel, message,
+			}))
+		}
+	}
+}
+
+func (sub *keyspaceSub) push(resp *redis.Resp) {
+	if sub.resp3 {
+		resp = convertPush(resp)
+	}
+	r := &Request{Resp: resp, Batch: &sync.WaitGroup{}}
+	r.UnixNano = time.Now().UnixNano()
+	sub.tasks.PushBack(r)
+}
+
+type keyspaceFanIn struct {
+	mu sync.Mutex
+
+	addr string
+	conn *redis.Conn
+	quit chan struct{}
+}
+
+func (f *keyspaceFanIn) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.quit:
+		return
+	default:
+		close(f.quit)
+	}
+	if f.conn != nil {
+		f.conn.Close()
+	}
+}
+
+func (f *keyspaceFanIn) loop(h *keyspaceHub) {
+	for {
+		err := f.subscribe(h)
+		select {
+		case <-f.quit:
+			return
+		case <-time.After(time.Second):
+		}
+		log.WarnErrorf(err, "keyspace fan-in to %s failed, reconnecting", f.addr)
+	}
+}
+
+func (f *keyspaceFanIn) subscribe(h *keyspaceHub) error {
+	c, err := dialBackend(f.addr, h.config)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	c.WriterTimeout = h.config.BackendSendTimeout.Duration()
+	c.SetKeepAlivePeriod(h.config.BackendKeepAlivePeriod.Duration())
+
+	if err := verifyAuth(c, h.config); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	select {
+	case <-f.quit:
+		f.mu.Unlock()
+		return nil
+	default:
+		f.conn = c
+	}
+	f.mu.Unlock()
+
+	var multi = []*redis.Resp{redis.NewBulkBytes([]byte("PSUBSCRIBE"))}
+	for _, pattern := range keyspacePatterns {
+		multi = append(multi, redis.NewBulkBytes([]byte(pattern)))
+	}
+	if err := c.EncodeMultiBulk(multi, true); err != nil {
+		return err
+	}
+	for {
+		resp, err := c.Decode()
+		if err != nil {
+			return err
+		}
+		switch {
+		case resp.IsError():
+			return fmt.Errorf("error resp: %s", resp.Value)
+		case !resp.IsArray() || len(resp.Array) != 4:
+			continue
+		case string(resp.Array[0].Value) == "pmessage":
+			h.publish(resp.Array[2], resp.Array[3])
+		}
+	}
+}
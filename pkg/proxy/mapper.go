@@ -22,8 +22,8 @@ func init() {
 			charmap[i] = c
 		case c >= 'a' && c <= 'z':
 			charmap[i] = c - 'a' + 'A'
-		case c == ':':
-			charmap[i] = ':'
+		case c == ':' || c == '_':
+			charmap[i] = c
 		}
 	}
 }
@@ -67,42 +67,56 @@ func init() {
 		{"BGSAVE", FlagNotAllow},
 		{"BITCOUNT", 0},
 		{"BITFIELD", FlagWrite},
-		{"BITOP", FlagWrite | FlagNotAllow},
+		{"BITFIELD_RO", 0},
+		{"BITOP", FlagWrite},
 		{"BITPOS", 0},
+		{"BLMPOP", FlagWrite | FlagNotAllow},
 		{"BLPOP", FlagWrite | FlagNotAllow},
 		{"BRPOP", FlagWrite | FlagNotAllow},
 		{"BRPOPLPUSH", FlagWrite | FlagNotAllow},
+		{"BZMPOP", FlagWrite | FlagNotAllow},
 		{"CLIENT", FlagNotAllow},
-		{"CLUSTER", FlagNotAllow},
+		{"CLUSTER", 0},
 		{"COMMAND", 0},
 		{"CONFIG", FlagNotAllow},
+		{"COPY", FlagWrite},
 		{"DBSIZE", FlagNotAllow},
-		{"DEBUG", FlagNotAllow},
+		{"DEBUG", FlagMasterOnly},
 		{"DECR", FlagWrite},
 		{"DECRBY", FlagWrite},
 		{"DEL", FlagWrite},
-		{"DISCARD", FlagNotAllow},
+		{"DISCARD", 0},
 		{"DUMP", 0},
 		{"ECHO", 0},
 		{"EVAL", FlagWrite},
 		{"EVALSHA", FlagWrite},
-		{"EXEC", FlagNotAllow},
+		{"EVALSHA_RO", 0},
+		{"EVAL_RO", 0},
+		{"EXEC", 0},
 		{"EXISTS", 0},
 		{"EXPIRE", FlagWrite},
 		{"EXPIREAT", FlagWrite},
+		{"FCALL", FlagWrite},
+		{"FCALL_RO", 0},
 		{"FLUSHALL", FlagWrite | FlagNotAllow},
 		{"FLUSHDB", FlagWrite | FlagNotAllow},
+		{"FUNCTION", FlagWrite},
 		{"GEOADD", FlagWrite},
 		{"GEODIST", 0},
 		{"GEOHASH", 0},
 		{"GEOPOS", 0},
 		{"GEORADIUS", FlagWrite},
 		{"GEORADIUSBYMEMBER", FlagWrite},
+		{"GEORADIUSBYMEMBER_RO", 0},
+		{"GEORADIUS_RO", 0},
+		{"GEOSEARCH", 0},
+		{"GEOSEARCHSTORE", FlagWrite},
 		{"GET", 0},
 		{"GETBIT", 0},
 		{"GETRANGE", 0},
 		{"GETSET", FlagWrite},
 		{"HDEL", FlagWrite},
+		{"HELLO", 0},
 		{"HEXISTS", 0},
 		{"HGET", 0},
 		{"HGETALL", 0},
@@ -128,7 +142,10 @@ func init() {
 		{"LINDEX", 0},
 		{"LINSERT", FlagWrite},
 		{"LLEN", 0},
+		{"LMPOP", FlagWrite},
+		{"LOLWUT", 0},
 		{"LPOP", FlagWrite},
+		{"LPOS", 0},
 		{"LPUSH", FlagWrite},
 		{"LPUSHX", FlagWrite},
 		{"LRANGE", 0},
@@ -140,9 +157,9 @@ func init() {
 		{"MONITOR", FlagNotAllow},
 		{"MOVE", FlagWrite | FlagNotAllow},
 		{"MSET", FlagWrite},
-		{"MSETNX", FlagWrite | FlagNotAllow},
-		{"MULTI", FlagNotAllow},
-		{"OBJECT", FlagNotAllow},
+		{"MSETNX", FlagWrite},
+		{"MULTI", 0},
+		{"OBJECT", 0},
 		{"PERSIST", FlagWrite},
 		{"PEXPIRE", FlagWrite},
 		{"PEXPIREAT", FlagWrite},
@@ -153,13 +170,14 @@ func init() {
 		{"PFSELFTEST", 0},
 		{"PING", 0},
 		{"POST", FlagNotAllow},
+		{"PROXY", 0},
 		{"PSETEX", FlagWrite},
-		{"PSUBSCRIBE", FlagNotAllow},
+		{"PSUBSCRIBE", 0},
 		{"PSYNC", FlagNotAllow},
 		{"PTTL", 0},
-		{"PUBLISH", FlagNotAllow},
+		{"PUBLISH", FlagMasterOnly},
 		{"PUBSUB", 0},
-		{"PUNSUBSCRIBE", FlagNotAllow},
+		{"PUNSUBSCRIBE", 0},
 		{"QUIT", 0},
 		{"RANDOMKEY", FlagNotAllow},
 		{"READONLY", FlagNotAllow},
@@ -167,7 +185,8 @@ func init() {
 		{"RENAME", FlagWrite | FlagNotAllow},
 		{"RENAMENX", FlagWrite | FlagNotAllow},
 		{"REPLCONF", FlagNotAllow},
-		{"RESTORE", FlagWrite | FlagNotAllow},
+		{"RESET", 0},
+		{"RESTORE", FlagWrite},
 		{"RESTORE-ASKING", FlagWrite | FlagNotAllow},
 		{"ROLE", 0},
 		{"RPOP", FlagWrite},
@@ -176,7 +195,7 @@ func init() {
 		{"RPUSHX", FlagWrite},
 		{"SADD", FlagWrite},
 		{"SAVE", FlagNotAllow},
-		{"SCAN", FlagMasterOnly | FlagNotAllow},
+		{"SCAN", FlagMasterOnly},
 		{"SCARD", 0},
 		{"SCRIPT", FlagNotAllow},
 		{"SDIFF", 0},
@@ -223,7 +242,7 @@ func init() {
 		{"SREM", FlagWrite},
 		{"SSCAN", FlagMasterOnly},
 		{"STRLEN", 0},
-		{"SUBSCRIBE", FlagNotAllow},
+		{"SUBSCRIBE", 0},
 		{"SUBSTR", 0},
 		{"SUNION", 0},
 		{"SUNIONSTORE", FlagWrite},
@@ -232,16 +251,20 @@ func init() {
 		{"TOUCH", FlagWrite},
 		{"TTL", 0},
 		{"TYPE", 0},
-		{"UNSUBSCRIBE", FlagNotAllow},
-		{"UNWATCH", FlagNotAllow},
-		{"WAIT", FlagNotAllow},
-		{"WATCH", FlagNotAllow},
+		{"UNLINK", FlagWrite},
+		{"UNSUBSCRIBE", 0},
+		{"UNWATCH", 0},
+		{"WAIT", FlagMasterOnly},
+		{"WATCH", 0},
+		{"XREAD", 0},
+		{"XREADGROUP", FlagWrite},
 		{"ZADD", FlagWrite},
 		{"ZCARD", 0},
 		{"ZCOUNT", 0},
 		{"ZINCRBY", FlagWrite},
 		{"ZINTERSTORE", FlagWrite},
 		{"ZLEXCOUNT", 0},
+		{"ZMPOP", FlagWrite},
 		{"ZRANGE", 0},
 		{"ZRANGEBYLEX", 0},
 		{"ZRANGEBYSCORE", 0},
@@ -295,6 +318,12 @@ func getOpInfo(multi []*redis.Resp) (string, OpFlag, error) {
 }
 
 func Hash(key []byte) uint32 {
+	return crc32.ChecksumIEEE(hashTag(key))
+}
+
+// hashTag returns the part of key between the first '{' and the next '}', or
+// key itself if there's no hash tag.
+func hashTag(key []byte) []byte {
 	const (
 		TagBeg = '{'
 		TagEnd = '}'
@@ -304,14 +333,20 @@ func Hash(key []byte) uint32 {
 			key = key[beg+1 : beg+1+end]
 		}
 	}
-	return crc32.ChecksumIEEE(key)
+	return key
 }
 
 func getHashKey(multi []*redis.Resp, opstr string) []byte {
 	var index = 1
 	switch opstr {
-	case "ZINTERSTORE", "ZUNIONSTORE", "EVAL", "EVALSHA":
+	case "ZINTERSTORE", "ZUNIONSTORE", "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
 		index = 3
+	case "LMPOP", "ZMPOP", "BITOP":
+		index = 2
+	case "OBJECT":
+		index = 2
+	case "XREAD", "XREADGROUP":
+		return getStreamsKey(multi, opstr)
 	}
 	if index < len(multi) {
 		return multi[index].Value
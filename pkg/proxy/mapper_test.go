@@ -4,6 +4,7 @@
 package proxy
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
@@ -142,6 +143,73 @@ func TestGetOpStrCmd(t *testing.T) {
 	}
 }
 
+func TestGeoCommands(t *testing.T) {
+	var m = map[string]bool{
+		"GEORADIUS":            true,
+		"GEORADIUSBYMEMBER":    true,
+		"GEORADIUS_RO":         false,
+		"GEORADIUSBYMEMBER_RO": false,
+		"GEOSEARCH":            false,
+		"GEOSEARCHSTORE":       true,
+	}
+	for k, v := range m {
+		var multi = []*redis.Resp{
+			redis.NewBulkBytes([]byte(strings.ToLower(k))),
+			redis.NewBulkBytes([]byte("key")),
+		}
+		s, flag, err := getOpInfo(multi)
+		assert.MustNoError(err)
+		assert.Must(s == k && flag.IsReadOnly() != v)
+		assert.Must(string(getHashKey(multi, s)) == "key")
+	}
+}
+
+func TestScriptCommands(t *testing.T) {
+	for k, v := range map[string]bool{
+		"EVAL": true, "EVALSHA": true, "EVAL_RO": false, "EVALSHA_RO": false,
+		"FCALL": true, "FCALL_RO": false,
+	} {
+		var multi = []*redis.Resp{
+			redis.NewBulkBytes([]byte(strings.ToLower(k))),
+			redis.NewBulkBytes([]byte("myfunc")),
+			redis.NewBulkBytes([]byte("1")),
+			redis.NewBulkBytes([]byte("key")),
+		}
+		s, flag, err := getOpInfo(multi)
+		assert.MustNoError(err)
+		assert.Must(s == k && flag.IsReadOnly() != v)
+		assert.Must(string(getHashKey(multi, s)) == "key")
+	}
+}
+
+func TestMPopCommands(t *testing.T) {
+	for _, op := range []string{"LMPOP", "ZMPOP"} {
+		var multi = []*redis.Resp{
+			redis.NewBulkBytes([]byte(op)),
+			redis.NewBulkBytes([]byte("1")),
+			redis.NewBulkBytes([]byte("key")),
+		}
+		s, flag, err := getOpInfo(multi)
+		assert.MustNoError(err)
+		assert.Must(s == op && !flag.IsReadOnly())
+		assert.Must(string(getHashKey(multi, s)) == "key")
+	}
+}
+
+func TestSetCountCommands(t *testing.T) {
+	for k, v := range map[string]bool{"SPOP": true, "SRANDMEMBER": false} {
+		var multi = []*redis.Resp{
+			redis.NewBulkBytes([]byte(k)),
+			redis.NewBulkBytes([]byte("key")),
+			redis.NewBulkBytes([]byte("3")),
+		}
+		s, flag, err := getOpInfo(multi)
+		assert.MustNoError(err)
+		assert.Must(s == k && flag.IsReadOnly() != v)
+		assert.Must(string(getHashKey(multi, s)) == "key")
+	}
+}
+
 func TestHashSlot(t *testing.T) {
 	var m = map[string]string{
 		"{abc}":           "abc",
@@ -163,3 +231,39 @@ func TestHashSlot(t *testing.T) {
 		assert.Must(i == j)
 	}
 }
+
+func TestBitOpCommand(t *testing.T) {
+	var multi = []*redis.Resp{
+		redis.NewBulkBytes([]byte("BITOP")),
+		redis.NewBulkBytes([]byte("AND")),
+		redis.NewBulkBytes([]byte("dest")),
+		redis.NewBulkBytes([]byte("src")),
+	}
+	s, flag, err := getOpInfo(multi)
+	assert.MustNoError(err)
+	assert.Must(s == "BITOP" && !flag.IsReadOnly() && !flag.IsNotAllowed())
+	assert.Must(string(getHashKey(multi, s)) == "dest")
+}
+
+func TestLPosCommand(t *testing.T) {
+	var multi = []*redis.Resp{
+		redis.NewBulkBytes([]byte("LPOS")),
+		redis.NewBulkBytes([]byte("key")),
+		redis.NewBulkBytes([]byte("element")),
+	}
+	s, flag, err := getOpInfo(multi)
+	assert.MustNoError(err)
+	assert.Must(s == "LPOS" && flag.IsReadOnly())
+	assert.Must(string(getHashKey(multi, s)) == "key")
+}
+
+func TestCommandTable(t *testing.T) {
+	for name, i := range opTable {
+		_, ok := commandTable[name]
+		assert.Must(ok == !i.Flag.IsNotAllowed())
+	}
+	for name := range commandTable {
+		_, ok := opTable[name]
+		assert.Must(ok)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	influxdbClient "github.com/influxdata/influxdb/client/v2"
 	statsdClient "gopkg.in/alexcesaro/statsd.v2"
 
+	"github.com/CodisLabs/codis/pkg/proxy/metrics"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/CodisLabs/codis/pkg/utils/math2"
@@ -98,6 +99,8 @@ func (p *Proxy) startMetricsInfluxdb() {
 			"ops_qps":                  stats.Ops.QPS,
 			"sessions_total":           stats.Sessions.Total,
 			"sessions_alive":           stats.Sessions.Alive,
+			"sessions_rejected":        stats.Sessions.Rejected,
+			"sessions_auth_failed":     stats.Sessions.AuthFailed,
 			"rusage_mem":               stats.Rusage.Mem,
 			"rusage_cpu":               stats.Rusage.CPU,
 			"runtime_gc_num":           stats.Runtime.GC.Num,
@@ -154,6 +157,8 @@ func (p *Proxy) startMetricsStatsd() {
 			"ops_qps":                  stats.Ops.QPS,
 			"sessions_total":           stats.Sessions.Total,
 			"sessions_alive":           stats.Sessions.Alive,
+			"sessions_rejected":        stats.Sessions.Rejected,
+			"sessions_auth_failed":     stats.Sessions.AuthFailed,
 			"rusage_mem":               stats.Rusage.Mem,
 			"rusage_cpu":               stats.Rusage.CPU,
 			"runtime_gc_num":           stats.Runtime.GC.Num,
@@ -172,3 +177,63 @@ func (p *Proxy) startMetricsStatsd() {
 		return nil
 	})
 }
+
+func (p *Proxy) MetricsSnapshot() *metrics.Snapshot {
+	if p.IsClosed() {
+		return nil
+	}
+	var s = &metrics.Snapshot{}
+
+	for _, m := range p.Slots() {
+		s.Slots = append(s.Slots, &metrics.Slot{
+			Id:          m.Id,
+			Locked:      m.Locked,
+			Migrating:   m.MigrateFrom != "",
+			BackendAddr: m.BackendAddr,
+		})
+	}
+	s.Backends = p.router.getBackendStats()
+
+	for _, l := range GetLatencyStatsAll() {
+		h := &metrics.Histogram{
+			Family: l.Family,
+			Count:  l.Calls,
+			Sum:    float64(l.Nsecs) / float64(time.Second),
+		}
+		for i := range l.Bounds {
+			h.Bounds = append(h.Bounds, l.Bounds[i].Seconds())
+			h.Counts = append(h.Counts, l.Counts[i])
+		}
+		s.Latency = append(s.Latency, h)
+	}
+
+	var commands = p.router.GetCommandStats()
+	for _, family := range commandFamilyNames {
+		c := commands[family]
+		h := &metrics.Histogram{
+			Family: c.Family,
+			Count:  c.Calls,
+			Sum:    float64(c.Usecs) / 1e6,
+		}
+		for i := range latencyBounds {
+			h.Bounds = append(h.Bounds, latencyBounds[i].Seconds())
+			h.Counts = append(h.Counts, c.Counts[i])
+		}
+		s.Commands = append(s.Commands, h)
+	}
+
+	var slotErrors int64
+	for _, m := range p.router.GetAllSlotStats() {
+		slotErrors += m.Errors
+	}
+	s.Errors = map[string]int64{
+		"fails": OpFails(),
+		"redis": OpRedisErrors(),
+		"slots": slotErrors,
+	}
+
+	servers, _ := p.GetSentinels()
+	s.Sentinel.Servers = len(servers)
+	s.Sentinel.Subscribed = p.ha.subscribed.IsTrue()
+	return s
+}
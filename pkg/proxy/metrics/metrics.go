@@ -0,0 +1,209 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type Slot struct {
+	Id          int
+	Locked      bool
+	Migrating   bool
+	BackendAddr string
+}
+
+type Backend struct {
+	Addr      string
+	Role      string
+	Conns     int
+	Connected int
+}
+
+type Histogram struct {
+	Family string
+	Bounds []float64
+	Counts []int64
+	Count  int64
+	Sum    float64
+}
+
+type Sentinel struct {
+	Servers    int
+	Subscribed bool
+}
+
+type Snapshot struct {
+	Slots    []*Slot
+	Backends []*Backend
+	Latency  []*Histogram
+	Commands []*Histogram
+	Errors   map[string]int64
+	Sentinel Sentinel
+}
+
+type Source interface {
+	MetricsSnapshot() *Snapshot
+}
+
+type Collector struct {
+	product string
+	proxy   string
+
+	source Source
+}
+
+func NewCollector(product, proxy string, source Source) *Collector {
+	return &Collector{product: product, proxy: proxy, source: source}
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusOK)
+	c.WriteTo(w)
+}
+
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	var p = &printer{w: bufio.NewWriter(w)}
+	p.labels = []string{"product", c.product, "proxy", c.proxy}
+
+	var s = c.source.MetricsSnapshot()
+
+	p.header("codis_proxy_up", "gauge", "Whether the proxy is serving.")
+	if s == nil {
+		p.sample("codis_proxy_up", 0)
+		return p.flush()
+	}
+	p.sample("codis_proxy_up", 1)
+
+	p.header("codis_proxy_slot_locked", "gauge", "Whether the slot is locked.")
+	for _, m := range s.Slots {
+		p.sample("codis_proxy_slot_locked", btof(m.Locked),
+			"slot", strconv.Itoa(m.Id), "backend_addr", m.BackendAddr)
+	}
+	p.header("codis_proxy_slot_migrating", "gauge", "Whether the slot is being migrated.")
+	for _, m := range s.Slots {
+		p.sample("codis_proxy_slot_migrating", btof(m.Migrating),
+			"slot", strconv.Itoa(m.Id), "backend_addr", m.BackendAddr)
+	}
+
+	p.header("codis_proxy_backend_conns", "gauge", "Number of connections in the backend pool.")
+	for _, m := range s.Backends {
+		p.sample("codis_proxy_backend_conns", float64(m.Conns),
+			"backend_addr", m.Addr, "role", m.Role)
+	}
+	p.header("codis_proxy_backend_conns_connected", "gauge", "Number of connected connections in the backend pool.")
+	for _, m := range s.Backends {
+		p.sample("codis_proxy_backend_conns_connected", float64(m.Connected),
+			"backend_addr", m.Addr, "role", m.Role)
+	}
+
+	p.header("codis_proxy_request_duration_seconds", "histogram", "Latency of requests by command family.")
+	for _, h := range s.Latency {
+		for i, bound := range h.Bounds {
+			p.sample("codis_proxy_request_duration_seconds_bucket", float64(h.Counts[i]),
+				"family", h.Family, "le", ftoa(bound))
+		}
+		p.sample("codis_proxy_request_duration_seconds_bucket", float64(h.Count),
+			"family", h.Family, "le", "+Inf")
+		p.sample("codis_proxy_request_duration_seconds_sum", h.Sum, "family", h.Family)
+		p.sample("codis_proxy_request_duration_seconds_count", float64(h.Count), "family", h.Family)
+	}
+
+	p.header("codis_proxy_command_duration_seconds", "histogram", "Latency of commands by data type.")
+	for _, h := range s.Commands {
+		for i, bound := range h.Bounds {
+			p.sample("codis_proxy_command_duration_seconds_bucket", float64(h.Counts[i]),
+				"family", h.Family, "le", ftoa(bound))
+		}
+		p.sample("codis_proxy_command_duration_seconds_bucket", float64(h.Count),
+			"family", h.Family, "le", "+Inf")
+		p.sample("codis_proxy_command_duration_seconds_sum", h.Sum, "family", h.Family)
+		p.sample("codis_proxy_command_duration_seconds_count", float64(h.Count), "family", h.Family)
+	}
+
+	p.header("codis_proxy_errors_total", "counter", "Number of errors by type.")
+	var types []string
+	for t := range s.Errors {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		p.sample("codis_proxy_errors_total", float64(s.Errors[t]), "type", t)
+	}
+
+	p.header("codis_proxy_sentinel_servers", "gauge", "Number of sentinel servers watched by the proxy.")
+	p.sample("codis_proxy_sentinel_servers", float64(s.Sentinel.Servers))
+	p.header("codis_proxy_sentinel_subscribed", "gauge", "Whether the proxy is subscribed to a majority of sentinels.")
+	p.sample("codis_proxy_sentinel_subscribed", btof(s.Sentinel.Subscribed))
+
+	return p.flush()
+}
+
+type printer struct {
+	w *bufio.Writer
+	n int64
+
+	err    error
+	labels []string
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += int64(n)
+	p.err = err
+}
+
+func (p *printer) header(name, typ, help string) {
+	p.printf("# HELP %s %s\n", name, help)
+	p.printf("# TYPE %s %s\n", name, typ)
+}
+
+func (p *printer) sample(name string, value float64, labels ...string) {
+	var pairs []string
+	for _, kv := range [][]string{p.labels, labels} {
+		for i := 0; i+1 < len(kv); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", kv[i], escaper.Replace(kv[i+1])))
+		}
+	}
+	p.printf("%s{%s} %s\n", name, strings.Join(pairs, ","), ftoa(value))
+}
+
+func (p *printer) flush() (int64, error) {
+	if p.err != nil {
+		return p.n, p.err
+	}
+	return p.n, p.w.Flush()
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func btof(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func ftoa(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,93 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+type source struct {
+	s *Snapshot
+}
+
+func (s *source) MetricsSnapshot() *Snapshot {
+	return s.s
+}
+
+func collect(s *Snapshot) string {
+	var b bytes.Buffer
+	c := NewCollector("demo", "token", &source{s})
+	n, err := c.WriteTo(&b)
+	assert.MustNoError(err)
+	assert.Must(n == int64(b.Len()))
+	return b.String()
+}
+
+func contains(out string, lines ...string) {
+	for _, line := range lines {
+		assert.Must(strings.Contains(out, line+"\n"))
+	}
+}
+
+func TestCollector(t *testing.T) {
+	out := collect(&Snapshot{
+		Slots: []*Slot{
+			{Id: 0, BackendAddr: "127.0.0.1:6379"},
+			{Id: 1, Locked: true, Migrating: true, BackendAddr: "127.0.0.1:6380"},
+		},
+		Backends: []*Backend{
+			{Addr: "127.0.0.1:6379", Role: "primary", Conns: 16, Connected: 15},
+		},
+		Latency: []*Histogram{
+			{Family: "read", Bounds: []float64{0.001, 0.01}, Counts: []int64{3, 5}, Count: 6, Sum: 0.5},
+		},
+		Commands: []*Histogram{
+			{Family: "hash", Bounds: []float64{0.001}, Counts: []int64{1}, Count: 2, Sum: 0.25},
+		},
+		Errors: map[string]int64{"redis": 2, "fails": 1},
+		Sentinel: Sentinel{
+			Servers: 3, Subscribed: true,
+		},
+	})
+	contains(out,
+		`# TYPE codis_proxy_up gauge`,
+		`codis_proxy_up{product="demo",proxy="token"} 1`,
+		`codis_proxy_slot_locked{product="demo",proxy="token",slot="0",backend_addr="127.0.0.1:6379"} 0`,
+		`codis_proxy_slot_locked{product="demo",proxy="token",slot="1",backend_addr="127.0.0.1:6380"} 1`,
+		`codis_proxy_slot_migrating{product="demo",proxy="token",slot="1",backend_addr="127.0.0.1:6380"} 1`,
+		`codis_proxy_backend_conns{product="demo",proxy="token",backend_addr="127.0.0.1:6379",role="primary"} 16`,
+		`codis_proxy_backend_conns_connected{product="demo",proxy="token",backend_addr="127.0.0.1:6379",role="primary"} 15`,
+		`# TYPE codis_proxy_request_duration_seconds histogram`,
+		`codis_proxy_request_duration_seconds_bucket{product="demo",proxy="token",family="read",le="0.001"} 3`,
+		`codis_proxy_request_duration_seconds_bucket{product="demo",proxy="token",family="read",le="0.01"} 5`,
+		`codis_proxy_request_duration_seconds_bucket{product="demo",proxy="token",family="read",le="+Inf"} 6`,
+		`codis_proxy_request_duration_seconds_sum{product="demo",proxy="token",family="read"} 0.5`,
+		`codis_proxy_request_duration_seconds_count{product="demo",proxy="token",family="read"} 6`,
+		`# TYPE codis_proxy_command_duration_seconds histogram`,
+		`codis_proxy_command_duration_seconds_bucket{product="demo",proxy="token",family="hash",le="0.001"} 1`,
+		`codis_proxy_command_duration_seconds_bucket{product="demo",proxy="token",family="hash",le="+Inf"} 2`,
+		`codis_proxy_command_duration_seconds_count{product="demo",proxy="token",family="hash"} 2`,
+		`codis_proxy_sentinel_servers{product="demo",proxy="token"} 3`,
+		`codis_proxy_sentinel_subscribed{product="demo",proxy="token"} 1`,
+	)
+	assert.Must(strings.Index(out, `type="fails"`) < strings.Index(out, `type="redis"`))
+}
+
+func TestCollectorClosed(t *testing.T) {
+	out := collect(nil)
+	contains(out, `codis_proxy_up{product="demo",proxy="token"} 0`)
+	assert.Must(!strings.Contains(out, "codis_proxy_slot_locked"))
+}
+
+func TestCollectorEscape(t *testing.T) {
+	c := NewCollector("a\"b\\c\nd", "token", &source{})
+	var b bytes.Buffer
+	_, err := c.WriteTo(&b)
+	assert.MustNoError(err)
+	contains(b.String(), `codis_proxy_up{product="a\"b\\c\nd",proxy="token"} 0`)
+}
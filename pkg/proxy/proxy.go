@@ -17,12 +17,14 @@ import (
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/admin"
 	"github.com/CodisLabs/codis/pkg/utils"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/CodisLabs/codis/pkg/utils/math2"
 	"github.com/CodisLabs/codis/pkg/utils/redis"
 	"github.com/CodisLabs/codis/pkg/utils/rpc"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
 	"github.com/CodisLabs/codis/pkg/utils/unsafe2"
 )
 
@@ -35,8 +37,10 @@ type Proxy struct {
 	exit struct {
 		C chan struct{}
 	}
-	online bool
-	closed bool
+	online   bool
+	closed   bool
+	draining bool
+	start    time.Time
 
 	config *Config
 	router *Router
@@ -45,15 +49,29 @@ type Proxy struct {
 	lproxy net.Listener
 	ladmin net.Listener
 
+	adminapi *admin.Server
+
 	ha struct {
-		monitor *redis.Sentinel
-		masters map[int]string
-		servers []string
+		monitors []*redis.Sentinel
+		masters  map[int]string
+		servers  []string
+		groups   []SentinelGroup
+
+		subscribed atomic2.Bool
 	}
 	jodis *Jodis
+
+	slots struct {
+		loader    func() ([]*models.Slot, error)
+		reloading bool
+	}
 }
 
-var ErrClosedProxy = errors.New("use of closed proxy")
+var (
+	ErrClosedProxy   = errors.New("use of closed proxy")
+	ErrDrainingProxy = errors.New("proxy is draining")
+	ErrNoSlotsLoader = errors.New("slots loader is not set")
+)
 
 func New(config *Config) (*Proxy, error) {
 	if err := config.Validate(); err != nil {
@@ -69,8 +87,9 @@ func New(config *Config) (*Proxy, error) {
 	s.router = NewRouter(config)
 	s.ignore = make([]byte, config.ProxyHeapPlaceholder.Int64())
 
+	s.start = time.Now()
 	s.model = &models.Proxy{
-		StartTime: time.Now().String(),
+		StartTime: s.start.String(),
 	}
 	s.model.ProductName = config.ProductName
 	s.model.DataCenter = config.ProxyDataCenter
@@ -95,6 +114,10 @@ func New(config *Config) (*Proxy, error) {
 	go s.serveAdmin()
 	go s.serveProxy()
 
+	if s.adminapi != nil {
+		go s.adminapi.Serve()
+	}
+
 	s.startMetricsJson()
 	s.startMetricsInfluxdb()
 	s.startMetricsStatsd()
@@ -141,6 +164,14 @@ func (s *Proxy) setup(config *Config) error {
 		s.model.Token,
 	)
 
+	if config.AdminApiAddr != "" {
+		srv, err := admin.New(config.AdminApiAddr, config.AdminToken, &adminRouter{s.router, s})
+		if err != nil {
+			return err
+		}
+		s.adminapi = srv
+	}
+
 	if config.JodisAddr != "" {
 		c, err := models.NewClient(config.JodisName, config.JodisAddr, config.JodisAuth, config.JodisTimeout.Duration())
 		if err != nil {
@@ -154,10 +185,23 @@ func (s *Proxy) setup(config *Config) error {
 		s.jodis = NewJodis(c, s.model)
 	}
 
+	if config.AccessLogFile != "" {
+		l, err := OpenAccessLog(config.AccessLogFile, config.AccessLogSampleRate)
+		if err != nil {
+			return err
+		}
+		s.router.accesslog = l
+	}
+
 	return nil
 }
 
 func (s *Proxy) Start() error {
+	if n := s.config.BackendWarmUpConcurrency; n != 0 && !s.IsOnline() {
+		if err := s.WarmUp(n); err != nil {
+			return err
+		}
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.closed {
@@ -174,6 +218,17 @@ func (s *Proxy) Start() error {
 	return nil
 }
 
+func (s *Proxy) WarmUp(concurrency int) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosedProxy
+	}
+	var router = s.router
+	s.mu.Unlock()
+	return router.WarmUp(concurrency)
+}
+
 func (s *Proxy) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -189,18 +244,64 @@ func (s *Proxy) Close() error {
 	if s.ladmin != nil {
 		s.ladmin.Close()
 	}
+	if s.adminapi != nil {
+		s.adminapi.Close()
+	}
 	if s.lproxy != nil {
 		s.lproxy.Close()
 	}
 	if s.router != nil {
-		s.router.Close()
+		if d := s.config.ProxyDrainTimeout.Duration(); d > 0 {
+			if err := s.router.GracefulClose(d); err != nil {
+				log.WarnErrorf(err, "[%p] drain router failed", s)
+			}
+		} else {
+			s.router.Close()
+		}
+	}
+	for _, p := range s.ha.monitors {
+		p.Cancel()
+	}
+	return nil
+}
+
+// Drain stops accepting new connections, waits for requests in flight and then
+// closes the proxy. Requests still in flight after timeout are dropped, and if
+// timeout is 0 the proxy is closed as proxy_drain_timeout says.
+func (s *Proxy) Drain(timeout time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosedProxy
 	}
-	if s.ha.monitor != nil {
-		s.ha.monitor.Cancel()
+	if s.draining {
+		return ErrDrainingProxy
 	}
+	s.draining = true
+	if s.lproxy != nil {
+		s.lproxy.Close()
+	}
+	log.Warnf("[%p] proxy start draining, timeout = %s", s, timeout)
+
+	go func() {
+		if timeout != 0 {
+			if err := s.router.GracefulClose(timeout); err != nil {
+				log.WarnErrorf(err, "[%p] drain router failed", s)
+			} else {
+				log.Warnf("[%p] proxy drain done", s)
+			}
+		}
+		s.Close()
+	}()
 	return nil
 }
 
+func (s *Proxy) IsDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
 func (s *Proxy) XAuth() string {
 	return s.xauth
 }
@@ -237,6 +338,12 @@ func (s *Proxy) Slots() []*models.Slot {
 	return s.router.GetSlots()
 }
 
+func (s *Proxy) PoolStats() map[string]*PoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.router.GetPoolStats()
+}
+
 func (s *Proxy) FillSlot(m *models.Slot) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -252,25 +359,90 @@ func (s *Proxy) FillSlots(slots []*models.Slot) error {
 	if s.closed {
 		return ErrClosedProxy
 	}
-	for _, m := range slots {
-		if err := s.router.FillSlot(m); err != nil {
-			return err
-		}
+	return s.router.FillSlots(slots)
+}
+
+// adminRouter serves the admin api from the router, but fills slots through the
+// proxy, so they're serialized with fillslots from the dashboard.
+type adminRouter struct {
+	*Router
+	proxy *Proxy
+}
+
+func (a *adminRouter) FillSlot(m *models.Slot) error {
+	return a.proxy.FillSlot(m)
+}
+
+// SetSlotsLoader sets how ReloadSlots fetches the full slot map, such as from
+// the dashboard that the proxy is onlined by.
+func (s *Proxy) SetSlotsLoader(fn func() ([]*models.Slot, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slots.loader = fn
+}
+
+// ReloadSlots fetches the full slot map and fills the slots in background,
+// it's a no-op if the previous reload is still in progress.
+func (s *Proxy) ReloadSlots() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosedProxy
 	}
+	if s.slots.loader == nil {
+		return ErrNoSlotsLoader
+	}
+	if s.slots.reloading {
+		return nil
+	}
+	s.slots.reloading = true
+
+	go func(loader func() ([]*models.Slot, error)) {
+		slots, err := loader()
+		if err == nil {
+			err = s.FillSlots(slots)
+		}
+		s.mu.Lock()
+		s.slots.reloading = false
+		s.mu.Unlock()
+		if err != nil {
+			log.WarnErrorf(err, "[%p] proxy reload slots failed", s)
+		} else {
+			log.Warnf("[%p] proxy reload slots done, %d slots filled", s, len(slots))
+		}
+	}(s.slots.loader)
 	return nil
 }
 
 func (s *Proxy) SwitchMasters(masters map[int]string) error {
+	return s.switchMasters(masters, nil)
+}
+
+// switchMasters replaces the masters of groups in gids, or all masters if gids
+// is empty, so groups no longer reported by sentinels are dropped. Masters of
+// groups watched by other sentinel groups are kept.
+func (s *Proxy) switchMasters(masters map[int]string, gids []int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.closed {
 		return ErrClosedProxy
 	}
+	if len(gids) != 0 {
+		var merged = make(map[int]string, len(s.ha.masters)+len(masters))
+		for gid, addr := range s.ha.masters {
+			merged[gid] = addr
+		}
+		for _, gid := range gids {
+			delete(merged, gid)
+		}
+		for gid, addr := range masters {
+			merged[gid] = addr
+		}
+		masters = merged
+	}
 	s.ha.masters = masters
 
-	if len(masters) != 0 {
-		s.router.SwitchMasters(masters)
-	}
+	s.router.SwitchMasters(masters)
 	return nil
 }
 
@@ -290,9 +462,50 @@ func (s *Proxy) SetSentinels(servers []string) error {
 		return ErrClosedProxy
 	}
 	s.ha.servers = servers
+	s.ha.groups = nil
 	log.Warnf("[%p] set sentinels = %v", s, s.ha.servers)
 
-	s.rewatchSentinels(s.ha.servers)
+	s.rewatchSentinels()
+	return nil
+}
+
+// SentinelGroup is a sentinel cluster that monitors a subset of groups, masters
+// are registered in sentinels under Name, or product_name if it's empty.
+// All groups are watched if GroupIds is empty.
+type SentinelGroup struct {
+	Name     string   `json:"name,omitempty"`
+	Servers  []string `json:"servers"`
+	GroupIds []int    `json:"group_ids,omitempty"`
+}
+
+func (s *Proxy) SetSentinelGroups(groups []SentinelGroup) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosedProxy
+	}
+	var servers []string
+	var watched = make(map[int]bool)
+	for _, g := range groups {
+		if len(g.Servers) == 0 {
+			return errors.Errorf("sentinel group [%s] has no servers", g.Name)
+		}
+		for _, gid := range g.GroupIds {
+			switch {
+			case gid <= 0 || gid > models.MaxGroupId:
+				return errors.Errorf("sentinel group [%s] has invalid group-[%d]", g.Name, gid)
+			case watched[gid]:
+				return errors.Errorf("group-[%d] is watched by more than one sentinel group", gid)
+			}
+			watched[gid] = true
+		}
+		servers = append(servers, g.Servers...)
+	}
+	s.ha.servers = servers
+	s.ha.groups = groups
+	log.Warnf("[%p] set sentinel groups = %v", s, s.ha.groups)
+
+	s.rewatchSentinels()
 	return nil
 }
 
@@ -304,69 +517,105 @@ func (s *Proxy) RewatchSentinels() error {
 	}
 	log.Warnf("[%p] rewatch sentinels = %v", s, s.ha.servers)
 
-	s.rewatchSentinels(s.ha.servers)
+	s.rewatchSentinels()
 	return nil
 }
 
-func (s *Proxy) rewatchSentinels(servers []string) {
-	if s.ha.monitor != nil {
-		s.ha.monitor.Cancel()
-		s.ha.monitor = nil
+func (s *Proxy) rewatchSentinels() {
+	if len(s.ha.monitors) != 0 {
+		for _, p := range s.ha.monitors {
+			p.Cancel()
+		}
+		s.ha.monitors = nil
 		s.ha.masters = nil
+		s.ha.subscribed.Set(false)
 	}
-	if len(servers) != 0 {
-		s.ha.monitor = redis.NewSentinel(s.config.ProductName, s.config.ProductAuth)
-		s.ha.monitor.LogFunc = log.Warnf
-		s.ha.monitor.ErrFunc = log.WarnErrorf
-		go func(p *redis.Sentinel) {
-			var trigger = make(chan struct{}, 1)
-			delayUntil := func(deadline time.Time) {
-				for !p.IsCanceled() {
-					var d = deadline.Sub(time.Now())
-					if d <= 0 {
-						return
-					}
-					time.Sleep(math2.MinDuration(d, time.Second))
+	switch {
+	case len(s.ha.groups) != 0:
+		for _, g := range s.ha.groups {
+			s.watchSentinels(g)
+		}
+	case len(s.ha.servers) != 0:
+		s.watchSentinels(SentinelGroup{Servers: s.ha.servers})
+	}
+	s.router.setSentinels(s.ha.servers, len(s.ha.monitors) != 0)
+}
+
+func (s *Proxy) watchSentinels(g SentinelGroup) {
+	var product, servers = g.Name, g.Servers
+	if product == "" {
+		product = s.config.ProductName
+	}
+	var monitor = redis.NewSentinel(product, s.config.ProductAuth)
+	monitor.LogFunc = log.Warnf
+	monitor.ErrFunc = log.WarnErrorf
+	s.ha.monitors = append(s.ha.monitors, monitor)
+
+	go func(p *redis.Sentinel) {
+		var trigger = make(chan struct{}, 1)
+		delayUntil := func(deadline time.Time) {
+			for !p.IsCanceled() {
+				var d = deadline.Sub(time.Now())
+				if d <= 0 {
+					return
 				}
+				time.Sleep(math2.MinDuration(d, time.Second))
 			}
-			go func() {
-				defer close(trigger)
-				callback := func() {
-					select {
-					case trigger <- struct{}{}:
-					default:
-					}
+		}
+		go func() {
+			defer close(trigger)
+			callback := func() {
+				if !p.IsCanceled() {
+					s.ha.subscribed.Set(true)
 				}
-				for !p.IsCanceled() {
-					timeout := time.Minute * 15
-					retryAt := time.Now().Add(time.Second * 10)
-					if !p.Subscribe(servers, timeout, callback) {
-						delayUntil(retryAt)
-					} else {
-						callback()
-					}
+				select {
+				case trigger <- struct{}{}:
+				default:
 				}
-			}()
-			go func() {
-				for range trigger {
-					var success int
-					for i := 0; i != 10 && !p.IsCanceled() && success != 2; i++ {
-						timeout := time.Second * 5
-						masters, err := p.Masters(servers, timeout)
-						if err != nil {
-							log.WarnErrorf(err, "[%p] fetch group masters failed", s)
-						} else {
-							if !p.IsCanceled() {
-								s.SwitchMasters(masters)
-							}
-							success += 1
+			}
+			for !p.IsCanceled() {
+				timeout := s.config.SentinelSubscribeExpiry.Duration()
+				retryAt := time.Now().Add(s.config.SentinelRetryInterval.Duration())
+				if !p.Subscribe(servers, timeout, callback) {
+					s.ha.subscribed.Set(false)
+					delayUntil(retryAt)
+				} else {
+					callback()
+				}
+			}
+		}()
+		go func() {
+			for range trigger {
+				var success int
+				for i := 0; i != 10 && !p.IsCanceled() && success != 2; i++ {
+					timeout := s.config.SentinelPollTimeout.Duration()
+					masters, err := p.Masters(servers, timeout)
+					if err != nil {
+						log.WarnErrorf(err, "[%p] fetch group masters failed", s)
+					} else {
+						if len(g.GroupIds) != 0 {
+							masters = filterMasters(masters, g.GroupIds)
 						}
-						delayUntil(time.Now().Add(time.Second * 5))
+						if !p.IsCanceled() {
+							s.switchMasters(masters, g.GroupIds)
+						}
+						success += 1
 					}
+					delayUntil(time.Now().Add(s.config.SentinelBackoffSleep.Duration()))
 				}
-			}()
-		}(s.ha.monitor)
+			}
+		}()
+	}(monitor)
+}
+
+func filterMasters(masters map[int]string, gids []int) map[int]string {
+	var filtered = make(map[int]string, len(gids))
+	for _, gid := range gids {
+		if addr, ok := masters[gid]; ok {
+			filtered[gid] = addr
+		}
 	}
+	return filtered
 }
 
 func (s *Proxy) serveAdmin() {
@@ -409,21 +658,34 @@ func (s *Proxy) serveProxy() {
 		for {
 			c, err := s.acceptConn(l)
 			if err != nil {
+				if s.IsDraining() {
+					return nil
+				}
 				return err
 			}
-			NewSession(c, s.config).Start(s.router)
+			x := NewSession(c, s.config)
+			x.proxy = s
+			x.Start(s.router)
 		}
 	}(s.lproxy)
 
 	if d := s.config.BackendPingPeriod.Duration(); d != 0 {
 		go s.keepAlive(d)
 	}
+	if d := s.config.BackendDNSRefreshInterval.Duration(); d != 0 {
+		go s.refreshDNS(d)
+	}
 
 	select {
 	case <-s.exit.C:
 		log.Warnf("[%p] proxy shutdown", s)
 	case err := <-eh:
-		log.ErrorErrorf(err, "[%p] proxy exit on error", s)
+		if err != nil {
+			log.ErrorErrorf(err, "[%p] proxy exit on error", s)
+			return
+		}
+		<-s.exit.C
+		log.Warnf("[%p] proxy shutdown after draining", s)
 	}
 }
 
@@ -440,6 +702,19 @@ func (s *Proxy) keepAlive(d time.Duration) {
 	}
 }
 
+func (s *Proxy) refreshDNS(d time.Duration) {
+	var ticker = time.NewTicker(math2.MaxDuration(d, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.exit.C:
+			return
+		case <-ticker.C:
+			s.router.RefreshDNS()
+		}
+	}
+}
+
 func (s *Proxy) acceptConn(l net.Listener) (net.Conn, error) {
 	var delay = &DelayExp2{
 		Min: 10, Max: 500,
@@ -485,11 +760,18 @@ type Stats struct {
 		} `json:"redis"`
 		QPS int64      `json:"qps"`
 		Cmd []*OpStats `json:"cmd,omitempty"`
+
+		Family map[string]*CommandStats `json:"family,omitempty"`
 	} `json:"ops"`
 
 	Sessions struct {
-		Total int64 `json:"total"`
-		Alive int64 `json:"alive"`
+		Total    int64 `json:"total"`
+		Alive    int64 `json:"alive"`
+		Rejected int64 `json:"rejected"`
+
+		AuthFailed int64 `json:"auth_failed"`
+
+		RateLimited map[string]int64 `json:"rate_limited,omitempty"`
 	} `json:"sessions"`
 
 	Rusage struct {
@@ -587,10 +869,14 @@ func (s *Proxy) Stats(flags StatsFlags) *Stats {
 
 	if flags.HasBit(StatsCmds) {
 		stats.Ops.Cmd = GetOpStatsAll()
+		stats.Ops.Family = s.router.GetCommandStats()
 	}
 
 	stats.Sessions.Total = SessionsTotal()
 	stats.Sessions.Alive = SessionsAlive()
+	stats.Sessions.Rejected = SessionsRejected()
+	stats.Sessions.AuthFailed = SessionsAuthFailed()
+	stats.Sessions.RateLimited = s.router.GetRateLimited()
 
 	if u := GetSysUsage(); u != nil {
 		stats.Rusage.Now = u.Now.String()
@@ -17,6 +17,7 @@ import (
 	"github.com/martini-contrib/render"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/metrics"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 	"github.com/CodisLabs/codis/pkg/utils/rpc"
@@ -56,9 +57,11 @@ func newApiServer(p *Proxy) http.Handler {
 	r.Get("/", func(r render.Render) {
 		r.Redirect("/proxy")
 	})
+	r.Get("/debug/pool", api.PoolStats)
 	r.Any("/debug/**", func(w http.ResponseWriter, req *http.Request) {
 		http.DefaultServeMux.ServeHTTP(w, req)
 	})
+	r.Get("/metrics", metrics.NewCollector(p.Config().ProductName, p.Model().Token, p).ServeHTTP)
 
 	r.Group("/proxy", func(r martini.Router) {
 		r.Get("", api.Overview)
@@ -80,6 +83,7 @@ func newApiServer(p *Proxy) http.Handler {
 		r.Put("/fillslots/:xauth", binding.Json([]*models.Slot{}), api.FillSlots)
 		r.Put("/sentinels/:xauth", binding.Json(models.Sentinel{}), api.SetSentinels)
 		r.Put("/sentinels/:xauth/rewatch", api.RewatchSentinels)
+		r.Put("/sentinels/:xauth/groups", binding.Json([]SentinelGroup{}), api.SetSentinelGroups)
 	})
 
 	m.MapTo(r, (*martini.Routes)(nil))
@@ -117,6 +121,10 @@ func (s *apiServer) SlotsNoXAuth() (int, string) {
 	return rpc.ApiResponseJson(s.proxy.Slots())
 }
 
+func (s *apiServer) PoolStats() (int, string) {
+	return rpc.ApiResponseJson(s.proxy.PoolStats())
+}
+
 func (s *apiServer) XPing(params martini.Params) (int, string) {
 	if err := s.verifyXAuth(params); err != nil {
 		return rpc.ApiResponseError(err)
@@ -225,6 +233,16 @@ func (s *apiServer) SetSentinels(sentinel models.Sentinel, params martini.Params
 	return rpc.ApiResponseJson("OK")
 }
 
+func (s *apiServer) SetSentinelGroups(groups []SentinelGroup, params martini.Params) (int, string) {
+	if err := s.verifyXAuth(params); err != nil {
+		return rpc.ApiResponseError(err)
+	}
+	if err := s.proxy.SetSentinelGroups(groups); err != nil {
+		return rpc.ApiResponseError(err)
+	}
+	return rpc.ApiResponseJson("OK")
+}
+
 func (s *apiServer) RewatchSentinels(params martini.Params) (int, string) {
 	if err := s.verifyXAuth(params); err != nil {
 		return rpc.ApiResponseError(err)
@@ -337,6 +355,11 @@ func (c *ApiClient) SetSentinels(sentinel *models.Sentinel) error {
 	return rpc.ApiPutJson(url, sentinel, nil)
 }
 
+func (c *ApiClient) SetSentinelGroups(groups ...SentinelGroup) error {
+	url := c.encodeURL("/api/proxy/sentinels/%s/groups", c.xauth)
+	return rpc.ApiPutJson(url, groups, nil)
+}
+
 func (c *ApiClient) RewatchSentinels() error {
 	url := c.encodeURL("/api/proxy/sentinels/%s/rewatch", c.xauth)
 	return rpc.ApiPutJson(url, nil, nil)
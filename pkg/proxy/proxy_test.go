@@ -4,9 +4,15 @@
 package proxy
 
 import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/metrics"
 	"github.com/CodisLabs/codis/pkg/utils/assert"
 	"github.com/CodisLabs/codis/pkg/utils/log"
 )
@@ -44,6 +50,18 @@ func TestModel(x *testing.T) {
 	assert.Must(p.ProductName == config.ProductName)
 }
 
+func TestAdminRouterFillSlot(x *testing.T) {
+	s, _ := openProxy()
+	defer s.Close()
+
+	var a = &adminRouter{s.router, s}
+	assert.MustNoError(a.FillSlot(&models.Slot{Id: 1}))
+	assert.Must(a.GetSlot(1).Id == 1)
+
+	s.Close()
+	assert.Must(a.FillSlot(&models.Slot{Id: 1}) == ErrClosedProxy)
+}
+
 func TestStats(x *testing.T) {
 	s, addr := openProxy()
 	defer s.Close()
@@ -138,3 +156,153 @@ func TestStartAndShutdown(x *testing.T) {
 	err3 := c.Start()
 	assert.Must(err3 != nil)
 }
+
+func TestStartWarmUp(x *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	s, _ := openProxy()
+	defer s.Close()
+
+	assert.MustNoError(s.FillSlots([]*models.Slot{{Id: 0, BackendAddr: b.Addr()}}))
+	assert.MustNoError(s.Start())
+	p := s.router.GetPoolStats()
+	assert.Must(p[b.Addr()].TotalConns == int(config.BackendNumberDatabases))
+}
+
+func TestMetrics(x *testing.T) {
+	s, addr := openProxy()
+	defer s.Close()
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	assert.MustNoError(err)
+	defer resp.Body.Close()
+	assert.Must(resp.StatusCode == http.StatusOK)
+	assert.Must(resp.Header.Get("Content-Type") == metrics.ContentType)
+
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.MustNoError(err)
+	assert.Must(strings.Contains(string(b), "codis_proxy_up{"))
+	assert.Must(strings.Contains(string(b), "codis_proxy_slot_locked{"))
+}
+
+func TestSentinelGroups(x *testing.T) {
+	s, addr := openProxy()
+	defer s.Close()
+
+	var c = NewApiClient(addr)
+	c.SetXAuth(config.ProductName, config.ProductAuth, s.Model().Token)
+
+	assert.Must(c.SetSentinelGroups(SentinelGroup{Name: "dc1"}) != nil)
+	assert.Must(c.SetSentinelGroups(
+		SentinelGroup{Name: "dc1", Servers: []string{"127.0.0.1:1"}, GroupIds: []int{1, 2}},
+		SentinelGroup{Name: "dc2", Servers: []string{"127.0.0.1:2"}, GroupIds: []int{2}},
+	) != nil)
+
+	assert.MustNoError(c.SetSentinelGroups(
+		SentinelGroup{Name: "dc1", Servers: []string{"127.0.0.1:1"}, GroupIds: []int{1}},
+		SentinelGroup{Name: "dc2", Servers: []string{"127.0.0.1:2"}, GroupIds: []int{2}},
+	))
+	monitors := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.ha.monitors)
+	}
+	servers, _ := s.GetSentinels()
+	assert.Must(len(servers) == 2 && monitors() == 2)
+
+	assert.MustNoError(s.switchMasters(map[int]string{1: "127.0.0.1:6379"}, []int{1}))
+	assert.MustNoError(s.switchMasters(map[int]string{2: "127.0.0.1:6380"}, []int{2}))
+	_, masters := s.GetSentinels()
+	assert.Must(len(masters) == 2 && masters[1] == "127.0.0.1:6379")
+
+	ha := s.router.GetHA()
+	assert.Must(len(ha.Sentinels) == 2 && ha.MonitorRunning)
+	assert.Must(len(ha.Masters) == 2 && ha.Masters[2] == "127.0.0.1:6380")
+
+	// Groups no longer reported by their sentinels are dropped.
+	assert.MustNoError(s.switchMasters(map[int]string{}, []int{2}))
+	_, masters = s.GetSentinels()
+	assert.Must(len(masters) == 1 && masters[1] == "127.0.0.1:6379")
+	assert.Must(len(s.router.GetHA().Masters) == 1)
+	assert.MustNoError(s.SwitchMasters(map[int]string{3: "127.0.0.1:6381"}))
+	_, masters = s.GetSentinels()
+	assert.Must(len(masters) == 1 && masters[3] == "127.0.0.1:6381")
+
+	assert.MustNoError(c.SetSentinels(&models.Sentinel{}))
+	assert.Must(monitors() == 0)
+	ha = s.router.GetHA()
+	assert.Must(len(ha.Sentinels) == 0 && len(ha.Masters) == 0 && !ha.MonitorRunning)
+}
+
+func TestProxyDrain(x *testing.T) {
+	s, _ := openProxy()
+	defer s.Close()
+
+	var addr = s.Model().ProxyAddr
+	c, err := net.Dial("tcp", addr)
+	assert.MustNoError(err)
+	c.Close()
+
+	assert.MustNoError(s.Drain(time.Second))
+	assert.Must(s.Drain(time.Second) == ErrDrainingProxy)
+	for i := 0; i < 100 && !s.IsClosed(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(s.IsClosed())
+	assert.Must(s.Drain(time.Second) == ErrClosedProxy)
+
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	assert.Must(err != nil)
+}
+
+func TestProxyReloadSlots(x *testing.T) {
+	s, _ := openProxy()
+	defer s.Close()
+
+	assert.Must(s.ReloadSlots() == ErrNoSlotsLoader)
+
+	var calls = make(chan struct{}, 1)
+	s.SetSlotsLoader(func() ([]*models.Slot, error) {
+		calls <- struct{}{}
+		return []*models.Slot{
+			{Id: 1, BackendAddr: "127.0.0.1:6379"},
+			{Id: 2, BackendAddr: "127.0.0.1:6380"},
+		}, nil
+	})
+	assert.MustNoError(s.ReloadSlots())
+	<-calls
+	for i := 0; i < 100 && s.Slots()[2].BackendAddr == ""; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	slots := s.Slots()
+	assert.Must(slots[1].BackendAddr == "127.0.0.1:6379" && slots[2].BackendAddr == "127.0.0.1:6380")
+	assert.Must(slots[0].BackendAddr == "")
+}
+
+func TestConfigValidateAll(x *testing.T) {
+	c := NewDefaultConfig()
+	assert.Must(len(c.ValidateAll()) == 0)
+	assert.MustNoError(c.Validate())
+
+	c.ProductName = ""
+	c.AdminAddr = "11080"
+	c.BackendRecvTimeout = -1
+	c.BackendTLSCertFile = "cert.pem"
+	errs := c.ValidateAll()
+	assert.Must(len(errs) == 4)
+	assert.Must(errs[0].Error() == "invalid admin_addr, should be host:port")
+	assert.Must(errs[1].Error() == "invalid product_name")
+
+	err := c.Validate()
+	assert.Must(err != nil && len(err.(ValidationErrors)) == 4)
+	assert.Must(strings.HasPrefix(err.Error(), "invalid admin_addr, should be host:port; invalid product_name; "))
+
+	c = NewDefaultConfig()
+	c.HashFunc = ""
+	assert.MustNoError(c.Validate())
+	c.HashFunc = "murmur3"
+	assert.Must(c.Validate() != nil)
+	c.ScanAggregation = false
+	assert.MustNoError(c.Validate())
+}
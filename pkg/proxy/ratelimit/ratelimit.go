@@ -0,0 +1,142 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package ratelimit
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MaxKeys is the max number of clients tracked, for both buckets and
+// rejection counters.
+const MaxKeys = 4096
+
+// RejectExpiry is how long a client's rejection counter is kept after its last
+// rejection, when there're too many of them.
+const RejectExpiry = time.Minute * 10
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+type rejects struct {
+	n    int64
+	last time.Time
+}
+
+type Limiter struct {
+	mu sync.Mutex
+
+	rate  float64
+	burst float64
+
+	buckets  map[string]*list.Element
+	lru      *list.List
+	rejected map[string]*rejects
+	total    int64
+
+	now func() time.Time
+}
+
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate: rate, burst: float64(burst),
+		buckets:  make(map[string]*list.Element),
+		lru:      list.New(),
+		rejected: make(map[string]*rejects),
+		now:      time.Now,
+	}
+}
+
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var now = l.now()
+
+	var b *bucket
+	if e := l.buckets[key]; e == nil {
+		if len(l.buckets) >= MaxKeys {
+			l.evict()
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	} else {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens += now.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		l.reject(key, now)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict drops the bucket of the least recently seen client, which is likely
+// full again. If not, the client gets a full burst when it's seen next.
+func (l *Limiter) evict() {
+	if e := l.lru.Back(); e != nil {
+		l.lru.Remove(e)
+		delete(l.buckets, e.Value.(*bucket).key)
+	}
+}
+
+func (l *Limiter) reject(key string, now time.Time) {
+	l.total++
+	r := l.rejected[key]
+	if r == nil {
+		if len(l.rejected) >= MaxKeys {
+			l.pruneRejected(now)
+		}
+		r = &rejects{}
+		l.rejected[key] = r
+	}
+	r.n++
+	r.last = now
+}
+
+// pruneRejected drops counters of clients not rejected for RejectExpiry, or
+// the least recently rejected one if all of them are still active.
+func (l *Limiter) pruneRejected(now time.Time) {
+	var oldest string
+	for key, r := range l.rejected {
+		if now.Sub(r.last) >= RejectExpiry {
+			delete(l.rejected, key)
+		} else if oldest == "" || r.last.Before(l.rejected[oldest].last) {
+			oldest = key
+		}
+	}
+	if len(l.rejected) >= MaxKeys {
+		delete(l.rejected, oldest)
+	}
+}
+
+// Rejected returns rejections of recently rejected clients.
+func (l *Limiter) Rejected() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var m = make(map[string]int64, len(l.rejected))
+	for key, r := range l.rejected {
+		m[key] = r.n
+	}
+	return m
+}
+
+// Total returns rejections of all clients, including the pruned ones.
+func (l *Limiter) Total() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	var now = time.Unix(0, 0)
+	l := New(10, 5)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		assert.Must(l.Allow("10.0.0.1"))
+	}
+	assert.Must(!l.Allow("10.0.0.1"))
+	assert.Must(!l.Allow("10.0.0.1"))
+	assert.Must(l.Allow("10.0.0.2"))
+
+	now = now.Add(time.Millisecond * 100)
+	assert.Must(l.Allow("10.0.0.1"))
+	assert.Must(!l.Allow("10.0.0.1"))
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 5; i++ {
+		assert.Must(l.Allow("10.0.0.1"))
+	}
+	assert.Must(!l.Allow("10.0.0.1"))
+
+	rejected := l.Rejected()
+	assert.Must(len(rejected) == 1 && rejected["10.0.0.1"] == 4)
+}
+
+func TestLimiterRejectedCap(t *testing.T) {
+	var now = time.Unix(0, 0)
+	l := New(0.001, 1)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < MaxKeys+10; i++ {
+		var key = strconv.Itoa(i)
+		assert.Must(l.Allow(key))
+		assert.Must(!l.Allow(key))
+		now = now.Add(time.Millisecond)
+	}
+	rejected := l.Rejected()
+	assert.Must(len(rejected) == MaxKeys && rejected["0"] == 0)
+	assert.Must(rejected[strconv.Itoa(MaxKeys+9)] == 1)
+	assert.Must(l.Total() == MaxKeys+10)
+
+	now = now.Add(RejectExpiry)
+	assert.Must(l.Allow("x") && !l.Allow("x"))
+	rejected = l.Rejected()
+	assert.Must(len(rejected) == 1 && rejected["x"] == 1)
+}
+
+func TestLimiterBucketsCap(t *testing.T) {
+	var now = time.Unix(0, 0)
+	l := New(0.001, 1)
+	l.now = func() time.Time { return now }
+
+	// None of the buckets is full, the least recently used ones are evicted.
+	for i := 0; i < MaxKeys+10; i++ {
+		assert.Must(l.Allow(strconv.Itoa(i)))
+		assert.Must(!l.Allow("0"))
+		now = now.Add(time.Millisecond)
+	}
+	assert.Must(len(l.buckets) == MaxKeys && l.lru.Len() == MaxKeys)
+	assert.Must(l.buckets["1"] == nil && l.buckets["10"] == nil && l.buckets["11"] != nil)
+	assert.Must(!l.Allow("0") && !l.Allow(strconv.Itoa(MaxKeys+9)))
+}
@@ -4,6 +4,7 @@
 package redis
 
 import (
+	"crypto/tls"
 	"net"
 	"time"
 
@@ -32,6 +33,15 @@ func DialTimeout(addr string, timeout time.Duration, rbuf, wbuf int) (*Conn, err
 	return NewConn(c, rbuf, wbuf), nil
 }
 
+func DialTLSTimeout(addr string, timeout time.Duration, rbuf, wbuf int, config *tls.Config) (*Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	c, err := tls.DialWithDialer(d, "tcp", addr, config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return NewConn(c, rbuf, wbuf), nil
+}
+
 func NewConn(sock net.Conn, rbuf, wbuf int) *Conn {
 	conn := &Conn{Sock: sock}
 	conn.Decoder = newConnDecoder(conn, rbuf)
@@ -59,7 +69,11 @@ func (c *Conn) CloseReader() error {
 }
 
 func (c *Conn) SetKeepAlivePeriod(d time.Duration) error {
-	if t, ok := c.Sock.(*net.TCPConn); ok {
+	var sock = c.Sock
+	if t, ok := sock.(*tls.Conn); ok {
+		sock = t.NetConn()
+	}
+	if t, ok := sock.(*net.TCPConn); ok {
 		if err := t.SetKeepAlive(d != 0); err != nil {
 			return errors.Trace(err)
 		}
@@ -172,6 +186,10 @@ func (p *FlushEncoder) NeedFlush() bool {
 	return false
 }
 
+func (p *FlushEncoder) Buffered() int {
+	return p.nbuffered
+}
+
 func (p *FlushEncoder) Flush(force bool) error {
 	if force || p.NeedFlush() {
 		if err := p.Conn.Flush(); err != nil {
@@ -125,12 +125,16 @@ func (d *Decoder) decodeResp() (*Resp, error) {
 	switch r.Type {
 	default:
 		return nil, errors.Errorf("bad resp type %s", r.Type)
-	case TypeString, TypeError, TypeInt:
+	case TypeString, TypeError, TypeInt, TypeDouble:
 		r.Value, err = d.decodeTextBytes()
 	case TypeBulkBytes:
 		r.Value, err = d.decodeBulkBytes()
-	case TypeArray:
+	case TypeArray, TypeSet, TypePush:
 		r.Array, err = d.decodeArray()
+	case TypeMap:
+		r.Array, err = d.decodeMap()
+	case TypeNull:
+		_, err = d.decodeTextBytes()
 	}
 	return r, err
 }
@@ -206,6 +210,28 @@ func (d *Decoder) decodeArray() ([]*Resp, error) {
 	return array, nil
 }
 
+func (d *Decoder) decodeMap() ([]*Resp, error) {
+	n, err := d.decodeInt()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case n < 0:
+		return nil, errors.Trace(ErrBadArrayLen)
+	case n > MaxArrayLen/2:
+		return nil, errors.Trace(ErrBadArrayLenTooLong)
+	}
+	array := make([]*Resp, n*2)
+	for i := range array {
+		r, err := d.decodeResp()
+		if err != nil {
+			return nil, err
+		}
+		array[i] = r
+	}
+	return array, nil
+}
+
 func (d *Decoder) decodeSingleLineMultiBulk() ([]*Resp, error) {
 	b, err := d.decodeTextBytes()
 	if err != nil {
@@ -101,6 +101,9 @@ func TestDecoder(t *testing.T) {
 		"-Error message\r\n",
 		"*2\r\n$1\r\n0\r\n*0\r\n",
 		"*3\r\n$4\r\nEVAL\r\n$31\r\nreturn {1,2,{3,'Hello World!'}}\r\n$1\r\n0\r\n",
+		"%2\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n_\r\n",
+		"~2\r\n$1\r\na\r\n$1\r\nb\r\n",
+		">2\r\n$7\r\nmessage\r\n,3.14\r\n",
 	}
 	for _, s := range test {
 		_, err := DecodeFromBytes([]byte(s))
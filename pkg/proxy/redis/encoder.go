@@ -116,12 +116,16 @@ func (e *Encoder) encodeResp(r *Resp) error {
 	switch r.Type {
 	default:
 		return errors.Errorf("bad resp type %s", r.Type)
-	case TypeString, TypeError, TypeInt:
+	case TypeString, TypeError, TypeInt, TypeDouble:
 		return e.encodeTextBytes(r.Value)
 	case TypeBulkBytes:
 		return e.encodeBulkBytes(r.Value)
-	case TypeArray:
+	case TypeArray, TypeSet, TypePush:
 		return e.encodeArray(r.Array)
+	case TypeMap:
+		return e.encodeMap(r.Array)
+	case TypeNull:
+		return e.encodeTextBytes(nil)
 	}
 }
 
@@ -182,3 +186,18 @@ func (e *Encoder) encodeArray(array []*Resp) error {
 		return nil
 	}
 }
+
+func (e *Encoder) encodeMap(array []*Resp) error {
+	if len(array)%2 != 0 {
+		return errors.Errorf("bad map length %d", len(array))
+	}
+	if err := e.encodeInt(int64(len(array) / 2)); err != nil {
+		return err
+	}
+	for _, r := range array {
+		if err := e.encodeResp(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -77,6 +77,20 @@ func TestEncodeArray(t *testing.T) {
 	testEncodeAndCheck(t, resp, []byte("*3\r\n:0\r\n$-1\r\n$4\r\ntest\r\n"))
 }
 
+func TestEncodeResp3(t *testing.T) {
+	testEncodeAndCheck(t, NewNull(), []byte("_\r\n"))
+	testEncodeAndCheck(t, NewDouble([]byte("1.5")), []byte(",1.5\r\n"))
+	resp := NewMap([]*Resp{NewBulkBytes([]byte("k")), NewInt([]byte("1"))})
+	testEncodeAndCheck(t, resp, []byte("%1\r\n$1\r\nk\r\n:1\r\n"))
+	resp = NewSet([]*Resp{NewBulkBytes([]byte("m"))})
+	testEncodeAndCheck(t, resp, []byte("~1\r\n$1\r\nm\r\n"))
+	resp = NewPush([]*Resp{NewBulkBytes([]byte("message"))})
+	testEncodeAndCheck(t, resp, []byte(">1\r\n$7\r\nmessage\r\n"))
+
+	_, err := EncodeToBytes(NewMap([]*Resp{NewBulkBytes(nil)}))
+	assert.Must(err != nil)
+}
+
 func testEncodeAndCheck(t *testing.T, resp *Resp, expect []byte) {
 	b, err := EncodeToBytes(resp)
 	assert.MustNoError(err)
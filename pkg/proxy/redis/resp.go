@@ -13,6 +13,12 @@ const (
 	TypeInt       RespType = ':'
 	TypeBulkBytes RespType = '$'
 	TypeArray     RespType = '*'
+
+	TypeMap    RespType = '%'
+	TypeSet    RespType = '~'
+	TypePush   RespType = '>'
+	TypeDouble RespType = ','
+	TypeNull   RespType = '_'
 )
 
 func (t RespType) String() string {
@@ -27,6 +33,16 @@ func (t RespType) String() string {
 		return "<bulkbytes>"
 	case TypeArray:
 		return "<array>"
+	case TypeMap:
+		return "<map>"
+	case TypeSet:
+		return "<set>"
+	case TypePush:
+		return "<push>"
+	case TypeDouble:
+		return "<double>"
+	case TypeNull:
+		return "<null>"
 	default:
 		return fmt.Sprintf("<unknown-0x%02x>", byte(t))
 	}
@@ -59,6 +75,14 @@ func (r *Resp) IsArray() bool {
 	return r.Type == TypeArray
 }
 
+func (r *Resp) IsMap() bool {
+	return r.Type == TypeMap
+}
+
+func (r *Resp) IsNull() bool {
+	return r.Type == TypeNull
+}
+
 func NewString(value []byte) *Resp {
 	r := &Resp{}
 	r.Type = TypeString
@@ -97,3 +121,38 @@ func NewArray(array []*Resp) *Resp {
 	r.Array = array
 	return r
 }
+
+// NewMap takes the key-value pairs flattened, as they're sent by RESP2.
+func NewMap(array []*Resp) *Resp {
+	r := &Resp{}
+	r.Type = TypeMap
+	r.Array = array
+	return r
+}
+
+func NewSet(array []*Resp) *Resp {
+	r := &Resp{}
+	r.Type = TypeSet
+	r.Array = array
+	return r
+}
+
+func NewPush(array []*Resp) *Resp {
+	r := &Resp{}
+	r.Type = TypePush
+	r.Array = array
+	return r
+}
+
+func NewDouble(value []byte) *Resp {
+	r := &Resp{}
+	r.Type = TypeDouble
+	r.Value = value
+	return r
+}
+
+func NewNull() *Resp {
+	r := &Resp{}
+	r.Type = TypeNull
+	return r
+}
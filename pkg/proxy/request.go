@@ -24,6 +24,16 @@ type Request struct {
 	Database int32
 	UnixNano int64
 
+	ReadPreference ReadPreference
+	RequestID      string
+
+	Resp3 bool
+
+	Slot *Slot
+
+	Backend string
+	Retries int
+
 	*redis.Resp
 	Err error
 
@@ -44,6 +54,8 @@ func (r *Request) MakeSubRequest(n int) []Request {
 		x.Broken = r.Broken
 		x.Database = r.Database
 		x.UnixNano = r.UnixNano
+		x.ReadPreference = r.ReadPreference
+		x.RequestID = r.RequestID
 	}
 	return sub
 }
@@ -4,13 +4,22 @@
 package proxy
 
 import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/admin"
+	"github.com/CodisLabs/codis/pkg/proxy/metrics"
+	"github.com/CodisLabs/codis/pkg/proxy/ratelimit"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/math2"
 	"github.com/CodisLabs/codis/pkg/utils/redis"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
 )
 
 const MaxSlotNum = models.MaxSlotNum
@@ -23,16 +32,68 @@ type Router struct {
 		replica *sharedBackendConnPool
 	}
 	slots [MaxSlotNum]Slot
+	hash  func(key []byte) uint32
 
 	config *Config
 	online bool
 	closed bool
+
+	draining atomic2.Bool
+	readonly atomic2.Bool
+
+	slowlog *SlowLog
+
+	accesslog *AccessLog
+
+	keyspace *keyspaceHub
+	fanout   *fanoutHub
+	events   *eventHub
+
+	encodings *encodingCache
+
+	limiter *ratelimit.Limiter
+
+	ttl struct {
+		sync.Mutex
+		queue   []*ttlCheck
+		running bool
+	}
+
+	ha admin.HAState
+
+	sessions struct {
+		sync.Mutex
+		m map[*Session]struct{}
+	}
 }
 
 func NewRouter(config *Config) *Router {
-	s := &Router{config: config}
+	s := newRouter(config)
+	go s.loopSlotStats()
+	if config.BackendMinPoolSize != 0 {
+		go s.loopPrewarm()
+	}
+	return s
+}
+
+// newRouter returns a router without its background loops.
+func newRouter(config *Config) *Router {
+	s := &Router{config: config, hash: getHashFunc(config.HashFunc)}
 	s.pool.primary = newSharedBackendConnPool(config, config.BackendPrimaryParallel)
 	s.pool.replica = newSharedBackendConnPool(config, config.BackendReplicaParallel)
+	s.sessions.m = make(map[*Session]struct{})
+	s.slowlog = NewSlowLog(config.SlowLogThreshold.Duration(), config.SlowLogMaxLen)
+	s.keyspace = newKeyspaceHub(config, s.getPrimaryAddrs)
+	s.fanout = newFanoutHub(config, s.getChannelAddr, s.getPrimaryAddrs)
+	s.events = newEventHub()
+	s.pool.primary.events = s.events
+	s.pool.replica.events = s.events
+	if config.EnableEncodingCache {
+		s.encodings = newEncodingCache(encodingCacheSize, s.hashSlot)
+	}
+	if config.ClientRateLimitRPS > 0 {
+		s.limiter = ratelimit.New(config.ClientRateLimitRPS, config.ClientRateLimitBurst)
+	}
 	for i := range s.slots {
 		s.slots[i].id = i
 		s.slots[i].method = &forwardSync{}
@@ -40,6 +101,46 @@ func NewRouter(config *Config) *Router {
 	return s
 }
 
+func (s *Router) WarmUp(concurrency int) error {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return ErrClosedRouter
+	}
+	var shared []*sharedBackendConn
+	for _, p := range []*sharedBackendConnPool{s.pool.primary, s.pool.replica} {
+		for _, bc := range p.pool {
+			shared = append(shared, bc)
+		}
+	}
+	s.mu.RUnlock()
+
+	var timeout = s.config.BackendConnectTimeout.Duration()
+	if timeout == 0 {
+		timeout = time.Second * 5
+	}
+	var jobs = make(chan *sharedBackendConn)
+	var wg sync.WaitGroup
+	for i := 0; i < math2.MaxInt(1, concurrency); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for bc := range jobs {
+				var total = len(bc.conns) * len(bc.conns[0])
+				if n := bc.WaitConnected(timeout); n != total {
+					log.Warnf("warm up backend %s failed, %d/%d conns connected", bc.Addr(), n, total)
+				}
+			}
+		}()
+	}
+	for _, bc := range shared {
+		jobs <- bc
+	}
+	close(jobs)
+	wg.Wait()
+	return nil
+}
+
 func (s *Router) Start() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -60,6 +161,109 @@ func (s *Router) Close() {
 	for i := range s.slots {
 		s.fillSlot(&models.Slot{Id: i}, false, nil)
 	}
+	s.keyspace.Close()
+	s.fanout.Close()
+	s.events.Close()
+	if s.accesslog != nil {
+		s.accesslog.Close()
+	}
+}
+
+func (s *Router) GracefulClose(timeout time.Duration) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.draining.Set(true)
+	s.mu.Unlock()
+
+	log.Warnf("router start draining, timeout = %s", timeout)
+
+	if s.waitForIdle(timeout) {
+		s.Close()
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	log.Warnf("router drain timeout, close with requests in flight")
+
+	for i := range s.slots {
+		slot := &s.slots[i]
+		slot.block()
+		slot.release()
+	}
+	s.keyspace.Close()
+	s.fanout.Close()
+	s.events.Close()
+	return ErrDrainTimeout
+}
+
+func (s *Router) waitForIdle(timeout time.Duration) bool {
+	var hold [MaxSlotNum]bool
+	s.mu.RLock()
+	for i := range s.slots {
+		hold[i] = s.slots[i].lock.hold
+	}
+	s.mu.RUnlock()
+
+	var done = make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range s.slots {
+			slot := &s.slots[i]
+			if !hold[i] {
+				slot.lock.Lock()
+				slot.lock.Unlock()
+			}
+			slot.refs.Wait()
+		}
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (s *Router) IsDraining() bool {
+	return s.draining.IsTrue()
+}
+
+// SetReadOnly switches the router to read-only mode, write commands are
+// rejected with READONLY and never reach backends.
+func (s *Router) SetReadOnly(readonly bool) {
+	if s.readonly.Swap(readonly) != readonly {
+		log.Warnf("router set read-only = %t", readonly)
+	}
+}
+
+func (s *Router) IsReadOnly() bool {
+	return s.readonly.IsTrue()
+}
+
+// SetLogLevel changes the level of the logger at runtime, level is one of
+// debug, info, warn and error.
+func (s *Router) SetLogLevel(level string) error {
+	var v log.LogLevel
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "error":
+		v.ParseFromString(level)
+	default:
+		return ErrInvalidLogLevel
+	}
+	if log.GetLevel() != v {
+		log.SetLevel(v)
+		log.Warnf("router set log level = %s", v)
+	}
+	return nil
 }
 
 func (s *Router) GetSlots() []*models.Slot {
@@ -82,6 +286,267 @@ func (s *Router) GetSlot(id int) *models.Slot {
 	return slot.snapshot()
 }
 
+func (s *Router) GetSlotStats(id int) *SlotStats {
+	if id < 0 || id >= MaxSlotNum {
+		return nil
+	}
+	return s.slots[id].stats.SlotStats(id)
+}
+
+func (s *Router) GetAllSlotStats() []*SlotStats {
+	stats := make([]*SlotStats, MaxSlotNum)
+	for i := range s.slots {
+		stats[i] = s.slots[i].stats.SlotStats(i)
+	}
+	return stats
+}
+
+func (s *Router) GetSlowLog() []SlowLogEntry {
+	return s.slowlog.Get(-1)
+}
+
+func (s *Router) GetPoolStats() map[string]*PoolStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var stats = make(map[string]*PoolStats)
+	for _, p := range []*sharedBackendConnPool{s.pool.primary, s.pool.replica} {
+		for addr, bc := range p.pool {
+			if stats[addr] == nil {
+				stats[addr] = &PoolStats{Addr: addr}
+			}
+			bc.collectStats(stats[addr])
+		}
+	}
+	return stats
+}
+
+// GetBackendAddrs returns the sorted addresses of all backends in the pools,
+// both primaries and replicas.
+func (s *Router) GetBackendAddrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var addrs []string
+	var exists = make(map[string]bool)
+	for _, p := range []*sharedBackendConnPool{s.pool.primary, s.pool.replica} {
+		for addr := range p.pool {
+			if !exists[addr] {
+				exists[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (s *Router) GetCommandStats() map[string]*CommandStats {
+	return GetCommandStatsAll()
+}
+
+func (s *Router) GetRateLimited() map[string]int64 {
+	if s.limiter == nil {
+		return nil
+	}
+	return s.limiter.Rejected()
+}
+
+func (s *Router) GetRateLimitedTotal() int64 {
+	if s.limiter == nil {
+		return 0
+	}
+	return s.limiter.Total()
+}
+
+func (s *Router) loopSlotStats() {
+	var ticker = time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var last = time.Now()
+	for now := range ticker.C {
+		s.mu.RLock()
+		closed := s.closed
+		s.mu.RUnlock()
+		if closed {
+			return
+		}
+		s.sampleSlotStats(now.Sub(last))
+		s.checkStaleLocks(now)
+		last = now
+	}
+}
+
+// sampleSlotStats samples the stats of all slots over the elapsed time, and
+// checks them for hot and quarantined slots.
+func (s *Router) sampleSlotStats(elapsed time.Duration) {
+	for i := range s.slots {
+		s.slots[i].stats.sample(elapsed)
+	}
+	s.detectHotSlots()
+	s.checkQuarantine()
+}
+
+func (s *Router) checkStaleLocks(now time.Time) {
+	var timeout = s.config.SlotLockTimeout.Duration()
+	if timeout == 0 {
+		return
+	}
+	var stale []int
+	s.mu.Lock()
+	for i := range s.slots {
+		slot := &s.slots[i]
+		if !slot.lock.hold || now.Sub(slot.lock.since) < timeout {
+			continue
+		}
+		log.Warnf("slot-[%04d] has been locked for %s, exceeds slot_lock_timeout = %s",
+			slot.id, now.Sub(slot.lock.since), timeout)
+		if s.config.AutoUnlockStaleLocks {
+			log.Warnf("slot-[%04d] stale lock is released", slot.id)
+			if slot.admin.busy {
+				slot.admin.locked = false
+			} else {
+				slot.unblock()
+			}
+		} else {
+			// Warn again after another timeout.
+			slot.lock.since = now
+		}
+		stale = append(stale, slot.id)
+	}
+	s.mu.Unlock()
+
+	if fn := s.config.OnSlotLockTimeout; fn != nil {
+		for _, id := range stale {
+			fn(id)
+		}
+	}
+}
+
+// checkQuarantine updates the quarantine state of slots by their backend
+// error rates, it's called after each sample of the slot stats.
+func (s *Router) checkQuarantine() {
+	var soft, hard = s.config.SlotSoftQuarantineThreshold, s.config.SlotHardQuarantineThreshold
+	if soft <= 0 && hard <= 0 {
+		return
+	}
+	var n = int(s.config.SlotErrorRateWindow.Duration() / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	for i := range s.slots {
+		stats := &s.slots[i].stats
+		rate := stats.errorRate(n, int64(s.config.SlotErrorRateMinCalls))
+
+		var state int64 = slotQuarantineNone
+		switch {
+		case hard > 0 && rate > hard:
+			state = slotQuarantineHard
+		case soft > 0 && rate > soft:
+			state = slotQuarantineSoft
+		}
+		last := stats.quarantine.Swap(state)
+		switch {
+		case state == last:
+			continue
+		case state == slotQuarantineNone:
+			log.Warnf("slot-[%04d] quarantine lifted, error rate = %.2f", i, rate)
+			continue
+		case state == slotQuarantineHard:
+			log.Warnf("slot-[%04d] hard quarantined, error rate = %.2f, threshold = %.2f", i, rate, hard)
+		case last == slotQuarantineNone:
+			log.Warnf("slot-[%04d] soft quarantined, error rate = %.2f, threshold = %.2f", i, rate, soft)
+		default:
+			log.Warnf("slot-[%04d] hard quarantine lifted, error rate = %.2f", i, rate)
+			continue
+		}
+		if fn := s.config.OnSlotQuarantine; fn != nil {
+			fn(i, rate, state == slotQuarantineHard)
+		}
+	}
+}
+
+// getChannelAddr returns the backend that PUBLISH to channel is forwarded to.
+func (s *Router) getChannelAddr(channel []byte) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.slots[s.hashSlot(channel)].backend.bc.Addr()
+}
+
+// getPrimaryAddrs returns the addresses of backends serving slots, in slot
+// order, which excludes replicas unlike GetBackendAddrs.
+func (s *Router) getPrimaryAddrs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var addrs []string
+	var exists = make(map[string]bool)
+	for i := range s.slots {
+		if addr := s.slots[i].backend.bc.Addr(); addr != "" && !exists[addr] {
+			exists[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func (s *Router) getBackendStats() []*metrics.Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var all []*metrics.Backend
+	for _, x := range []struct {
+		role string
+		pool *sharedBackendConnPool
+	}{
+		{"primary", s.pool.primary}, {"replica", s.pool.replica},
+	} {
+		var addrs []string
+		for addr := range x.pool.pool {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			m := &metrics.Backend{Addr: addr, Role: x.role}
+			for _, parallel := range x.pool.pool[addr].conns {
+				for _, bc := range parallel {
+					m.Conns++
+					if bc.IsConnected() {
+						m.Connected++
+					}
+				}
+			}
+			all = append(all, m)
+		}
+	}
+	return all
+}
+
+func (s *Router) detectHotSlots() {
+	var factor = s.config.HotSlotFactor
+	if factor <= 0 {
+		return
+	}
+	var total int64
+	for i := range s.slots {
+		total += s.slots[i].stats.rate.calls.Int64()
+	}
+	var mean = float64(total) / MaxSlotNum
+	var threshold = math.Max(mean*factor, float64(s.config.HotSlotMinRPS))
+
+	for i := range s.slots {
+		stats := &s.slots[i].stats
+		rps := float64(stats.rate.calls.Int64())
+		hot := rps > threshold
+		if stats.hot.Swap(hot) == hot {
+			continue
+		}
+		if !hot {
+			log.Warnf("hot slot %04d cooled down, rps = %.0f, mean = %.2f", i, rps, mean)
+			continue
+		}
+		log.Warnf("hot slot %04d detected, rps = %.0f, mean = %.2f, factor = %.2f", i, rps, mean, factor)
+		if fn := s.config.HotSlotCallback; fn != nil {
+			fn(i, rps)
+		}
+	}
+}
+
 func (s *Router) HasSwitched() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -94,11 +559,31 @@ func (s *Router) HasSwitched() bool {
 }
 
 var (
-	ErrClosedRouter  = errors.New("use of closed router")
-	ErrInvalidSlotId = errors.New("use of invalid slot id")
-	ErrInvalidMethod = errors.New("use of invalid forwarder method")
+	ErrClosedRouter   = errors.New("use of closed router")
+	ErrDrainingRouter = errors.New("router is draining")
+	ErrDrainTimeout   = errors.New("router drain timeout")
+	ErrInvalidSlotId  = errors.New("use of invalid slot id")
+	ErrInvalidMethod  = errors.New("use of invalid forwarder method")
+
+	ErrInvalidSnapshot = errors.New("use of invalid slots snapshot")
+
+	ErrSlotVersionStale = errors.New("slot version is stale")
+	ErrSlotNotMigrating = errors.New("slot is not migrating")
+	ErrSlotChanged      = errors.New("slot is filled again while moving keys")
+	ErrSlotLocked       = errors.New("slot is locked")
+	ErrSlotBusy         = errors.New("slot is busy with another admin operation")
+	ErrKeyChanged       = errors.New("key is changed while moving, retry later")
+
+	ErrInvalidLogLevel = errors.New("use of invalid log level")
 )
 
+// SlotSnapshot is a slot mapping with the version it's published at, see
+// FillSlotFromSnapshot.
+type SlotSnapshot struct {
+	models.Slot
+	Version uint64 `json:"version"`
+}
+
 func (s *Router) FillSlot(m *models.Slot) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -108,19 +593,215 @@ func (s *Router) FillSlot(m *models.Slot) error {
 	if m.Id < 0 || m.Id >= MaxSlotNum {
 		return ErrInvalidSlotId
 	}
-	var method forwardMethod
-	switch m.ForwardMethod {
-	default:
-		return ErrInvalidMethod
-	case models.ForwardSync:
-		method = &forwardSync{}
-	case models.ForwardSemiAsync:
-		method = &forwardSemiAsync{}
+	method, err := newForwardMethod(m.ForwardMethod)
+	if err != nil {
+		return err
 	}
 	s.fillSlot(m, false, method)
 	return nil
 }
 
+// FillSlotFromSnapshot fills slot id unless it has been filled from a snapshot
+// of the same or a newer version, so replayed updates are skipped without
+// blocking the slot. FillSlot doesn't change the version of slots.
+func (s *Router) FillSlotFromSnapshot(id int, snap *SlotSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosedRouter
+	}
+	if id < 0 || id >= MaxSlotNum || snap.Id != id {
+		return ErrInvalidSlotId
+	}
+	if s.slots[id].version >= snap.Version {
+		return ErrSlotVersionStale
+	}
+	method, err := newForwardMethod(snap.ForwardMethod)
+	if err != nil {
+		return err
+	}
+	s.fillSlot(&snap.Slot, false, method)
+	s.slots[id].version = snap.Version
+	return nil
+}
+
+// AbortMigration rolls back the migration of slot id: keys already moved to the
+// target are restored to the source and removed from the target, and then the
+// slot is served by the source again. Only the slot is blocked while keys are
+// moved back, it's left migrating if any of them fails. It fails with
+// ErrSlotBusy if another admin operation is moving keys of the slot.
+func (s *Router) AbortMigration(id int) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosedRouter
+	}
+	if id < 0 || id >= MaxSlotNum {
+		s.mu.Unlock()
+		return ErrInvalidSlotId
+	}
+	slot := &s.slots[id]
+	if slot.migrate.bc == nil {
+		s.mu.Unlock()
+		return ErrSlotNotMigrating
+	}
+	if err := slot.beginAdmin(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	var m = slot.snapshot()
+	var target, source = slot.backend.bc.Retain(), slot.migrate.bc.Retain()
+	s.mu.Unlock()
+
+	err := slot.rollbackMigration(target, source, s.config.BackendNumberDatabases)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer slot.endAdmin()
+	target.Release()
+	source.Release()
+	switch {
+	case s.closed:
+		return ErrClosedRouter
+	case !slot.isMigrating(m.MigrateFrom, m.BackendAddr):
+		log.Warnf("slot-[%04d] abort migration failed: %s", id, ErrSlotChanged)
+		return ErrSlotChanged
+	case err != nil:
+		log.WarnErrorf(err, "slot-[%04d] abort migration failed", id)
+		return err
+	}
+	log.Warnf("slot-[%04d] migration from %s to %s aborted", id, m.MigrateFrom, m.BackendAddr)
+
+	s.fillSlot(&models.Slot{
+		Id:                 id,
+		Locked:             slot.admin.locked,
+		BackendAddr:        m.MigrateFrom,
+		BackendAddrGroupId: m.MigrateFromGroupId,
+	}, false, nil)
+	return nil
+}
+
+// MigrateKey moves key of slot id from the migration source to the target,
+// which helps a migration stuck on a large key, see moveKeyWatched. The slot is
+// blocked while moving, so clients of the proxy never see the key on both or
+// neither backends. It returns false if the key doesn't exist on the source,
+// and fails with ErrSlotBusy like AbortMigration.
+func (s *Router) MigrateKey(id int, database int32, key []byte) (bool, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false, ErrClosedRouter
+	}
+	if id < 0 || id >= MaxSlotNum || s.hashSlot(key) != id {
+		s.mu.Unlock()
+		return false, ErrInvalidSlotId
+	}
+	slot := &s.slots[id]
+	if slot.migrate.bc == nil {
+		s.mu.Unlock()
+		return false, ErrSlotNotMigrating
+	}
+	if err := slot.beginAdmin(); err != nil {
+		s.mu.Unlock()
+		return false, err
+	}
+	var from, to = slot.migrate.bc.Addr(), slot.backend.bc.Addr()
+	s.mu.Unlock()
+
+	moved, err := moveKeyWatched(s.config, from, to, database, key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot.endAdmin()
+	if moved && slot.isMigrating(from, to) {
+		slot.migrated.Add(1)
+	}
+	if err != nil {
+		log.WarnErrorf(err, "slot-[%04d] migrate key '%s' failed", id, key)
+		return false, err
+	}
+	return moved, nil
+}
+
+func (s *Router) FillSlots(slots []*models.Slot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosedRouter
+	}
+	var methods = make([]forwardMethod, len(slots))
+	for i, m := range slots {
+		if m.Id < 0 || m.Id >= MaxSlotNum {
+			return ErrInvalidSlotId
+		}
+		method, err := newForwardMethod(m.ForwardMethod)
+		if err != nil {
+			return err
+		}
+		methods[i] = method
+	}
+	for _, m := range slots {
+		s.slots[m.Id].blockAndWait()
+	}
+	for i, m := range slots {
+		s.fillSlot(m, false, methods[i])
+	}
+	return nil
+}
+
+// FillSlotRange fills slots in [start, end] with template, they're filled
+// under a single acquisition of the router lock, as FillSlots does.
+func (s *Router) FillSlotRange(start, end int, template *models.Slot) error {
+	if start < 0 || end >= MaxSlotNum || start > end {
+		return ErrInvalidSlotId
+	}
+	var slots = make([]*models.Slot, 0, end-start+1)
+	for id := start; id <= end; id++ {
+		m := *template
+		m.Id = id
+		slots = append(slots, &m)
+	}
+	return s.FillSlots(slots)
+}
+
+// Snapshot encodes the whole slot mapping, which can be loaded later with
+// Restore when the dashboard is not available.
+func (s *Router) Snapshot() ([]byte, error) {
+	b, err := json.Marshal(s.GetSlots())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return b, nil
+}
+
+func (s *Router) Restore(b []byte) error {
+	var slots []*models.Slot
+	if err := json.Unmarshal(b, &slots); err != nil {
+		return errors.Trace(err)
+	}
+	if len(slots) != MaxSlotNum {
+		return ErrInvalidSnapshot
+	}
+	var filled [MaxSlotNum]bool
+	for _, m := range slots {
+		if m == nil || m.Id < 0 || m.Id >= MaxSlotNum || filled[m.Id] {
+			return ErrInvalidSnapshot
+		}
+		filled[m.Id] = true
+	}
+	return s.FillSlots(slots)
+}
+
+func newForwardMethod(id int) (forwardMethod, error) {
+	switch id {
+	case models.ForwardSync:
+		return &forwardSync{}, nil
+	case models.ForwardSemiAsync:
+		return &forwardSemiAsync{}, nil
+	}
+	return nil, ErrInvalidMethod
+}
+
 func (s *Router) KeepAlive() error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -132,18 +813,244 @@ func (s *Router) KeepAlive() error {
 	return nil
 }
 
+func (s *Router) loopPrewarm() {
+	var ticker = time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.Prewarm(); err != nil {
+			return
+		}
+	}
+}
+
+// Prewarm connects idle backend connections, so that each backend server
+// has at least backend_min_pool_size connections connected.
+func (s *Router) Prewarm() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosedRouter
+	}
+	var min = s.config.BackendMinPoolSize
+	if n := s.pool.primary.Prewarm(min) + s.pool.replica.Prewarm(min); n != 0 {
+		log.Debugf("router prewarm %d backend connections", n)
+	}
+	return nil
+}
+
+func (s *Router) addSession(x *Session) {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	s.sessions.m[x] = struct{}{}
+}
+
+func (s *Router) delSession(x *Session) {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	delete(s.sessions.m, x)
+}
+
+func (s *Router) ListClients() []*admin.ClientInfo {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	var now = time.Now().Unix()
+	var clients = make([]*admin.ClientInfo, 0, len(s.sessions.m))
+	for x := range s.sessions.m {
+		clients = append(clients, x.ClientInfo(now))
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Addr < clients[j].Addr
+	})
+	return clients
+}
+
+// closeIdlestSession closes the session which has been idle for the longest time.
+func (s *Router) closeIdlestSession() *Session {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	var idlest *Session
+	var lastop int64
+	for x := range s.sessions.m {
+		x.info.Lock()
+		var t = x.info.lastop
+		x.info.Unlock()
+		if t == 0 {
+			t = x.CreateUnix
+		}
+		if idlest == nil || t < lastop {
+			idlest, lastop = x, t
+		}
+	}
+	if idlest != nil {
+		idlest.CloseWithError(ErrClientKilled)
+		delete(s.sessions.m, idlest)
+	}
+	return idlest
+}
+
+// KillClient closes sessions of clients from addr.
+func (s *Router) KillClient(addr string) bool {
+	s.sessions.Lock()
+	defer s.sessions.Unlock()
+	var found bool
+	for x := range s.sessions.m {
+		if x.Conn.RemoteAddr() == addr {
+			x.CloseWithError(ErrClientKilled)
+			delete(s.sessions.m, x)
+			found = true
+		}
+	}
+	return found
+}
+
+// ResetBackend reconnects all connections to the backend, requests already
+// queued are sent before the connections are closed.
+func (s *Router) ResetBackend(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	var found bool
+	for _, p := range []*sharedBackendConnPool{s.pool.primary, s.pool.replica} {
+		if bc := p.Get(addr); bc != nil {
+			bc.Reconnect()
+			found = true
+		}
+	}
+	return found
+}
+
+// RefreshDNS resolves addresses of all backends, connections to backends
+// which are resolved to different ips are reconnected.
+func (s *Router) RefreshDNS() error {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return ErrClosedRouter
+	}
+	var addrs = make(map[string]string)
+	for _, p := range []*sharedBackendConnPool{s.pool.primary, s.pool.replica} {
+		for addr := range p.pool {
+			addrs[addr] = ""
+		}
+	}
+	s.mu.RUnlock()
+
+	for addr := range addrs {
+		ips, err := resolveBackendAddr(addr)
+		if err != nil {
+			log.WarnErrorf(err, "resolve backend %s failed", addr)
+			delete(addrs, addr)
+		} else {
+			addrs[addr] = ips
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosedRouter
+	}
+	for _, p := range []*sharedBackendConnPool{s.pool.primary, s.pool.replica} {
+		for addr, bc := range p.pool {
+			if ips, ok := addrs[addr]; ok {
+				bc.setResolved(ips)
+			}
+		}
+	}
+	return nil
+}
+
 func (s *Router) isOnline() bool {
 	return s.online && !s.closed
 }
 
 func (s *Router) dispatch(r *Request) error {
+	if s.draining.IsTrue() {
+		return ErrDrainingRouter
+	}
 	hkey := getHashKey(r.Multi, r.OpStr)
-	var id = Hash(hkey) % MaxSlotNum
-	slot := &s.slots[id]
+	slot := &s.slots[s.hashSlot(hkey)]
 	return slot.forward(r, hkey)
 }
 
+// acquireTxnSlots migrates keys of a transaction pinned to addr, and holds
+// references on their slots so they can't be switched before release is
+// called once EXEC is replied. Slots are taken in order of id, like the
+// requests batched by forwardSync.
+func (s *Router) acquireTxnSlots(addr string, database int32, keys [][]byte) (func(), error) {
+	var slots = make(map[int][][]byte)
+	var ids []int
+	for _, key := range keys {
+		id := s.hashSlot(key)
+		if _, ok := slots[id]; !ok {
+			ids = append(ids, id)
+		}
+		slots[id] = append(slots[id], key)
+	}
+	sort.Ints(ids)
+
+	// Slots are never waited on while refs of others are held: a fill blocked
+	// on refs holds Router.mu, which the fill unlocking the slot waited on
+	// needs too. All read locks are tried first, and refs are added once all
+	// of them are acquired.
+	var locked []*Slot
+	var unlock = func() {
+		for _, slot := range locked {
+			slot.lock.RUnlock()
+		}
+	}
+	defer unlock()
+	for _, id := range ids {
+		slot := &s.slots[id]
+		if !slot.lock.TryRLock() {
+			return nil, ErrSlotLocked
+		}
+		locked = append(locked, slot)
+	}
+	var helper forwardHelper
+	for _, slot := range locked {
+		if slot.backend.bc == nil || slot.backend.bc.Addr() != addr {
+			return nil, ErrSlotChanged
+		}
+		if slot.migrate.bc == nil {
+			continue
+		}
+		var tags = make(map[string]bool)
+		for _, key := range slots[slot.id] {
+			if tag := string(hashTag(key)); !tags[tag] {
+				tags[tag] = true
+				if err := helper.slotsmgrt(slot, key, database, 0); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for _, slot := range locked {
+		slot.refs.Add(1)
+	}
+	var acquired = append([]*Slot(nil), locked...)
+	return func() {
+		for _, slot := range acquired {
+			slot.refs.Done()
+		}
+	}, nil
+}
+
+func (s *Router) hashSlot(hkey []byte) int {
+	if fn := s.config.SlotAffinityFunc; fn != nil {
+		if id := fn(hkey); id >= 0 && id < MaxSlotNum {
+			return id
+		}
+	}
+	return int(s.hash(hkey) % MaxSlotNum)
+}
+
 func (s *Router) dispatchSlot(r *Request, id int) error {
+	if s.draining.IsTrue() {
+		return ErrDrainingRouter
+	}
 	if id < 0 || id >= MaxSlotNum {
 		return ErrInvalidSlotId
 	}
@@ -168,20 +1075,12 @@ func (s *Router) dispatchAddr(r *Request, addr string) bool {
 func (s *Router) fillSlot(m *models.Slot, switched bool, method forwardMethod) {
 	slot := &s.slots[m.Id]
 	slot.blockAndWait()
+	var migrating = slot.migrate.bc.Addr()
+	slot.release()
 
-	slot.backend.bc.Release()
-	slot.backend.bc = nil
-	slot.backend.id = 0
-	slot.migrate.bc.Release()
-	slot.migrate.bc = nil
-	slot.migrate.id = 0
-	for i := range slot.replicaGroups {
-		for _, bc := range slot.replicaGroups[i] {
-			bc.Release()
-		}
+	if s.encodings != nil {
+		s.encodings.purgeSlot(slot.id)
 	}
-	slot.replicaGroups = nil
-
 	slot.switched = switched
 
 	if addr := m.BackendAddr; len(addr) != 0 {
@@ -191,24 +1090,34 @@ func (s *Router) fillSlot(m *models.Slot, switched bool, method forwardMethod) {
 	if from := m.MigrateFrom; len(from) != 0 {
 		slot.migrate.bc = s.pool.primary.Retain(from)
 		slot.migrate.id = m.MigrateFromGroupId
+		if migrating != from {
+			slot.migrated.Set(0)
+			slot.migrateAt = time.Now()
+		}
 	}
 	if !s.config.BackendPrimaryOnly {
 		for i := range m.ReplicaGroups {
 			var group []*sharedBackendConn
-			for _, addr := range m.ReplicaGroups[i] {
+			var weights []int
+			for j, addr := range m.ReplicaGroups[i] {
 				group = append(group, s.pool.replica.Retain(addr))
+				weights = append(weights, replicaWeight(m, i, j))
 			}
 			if len(group) == 0 {
 				continue
 			}
 			slot.replicaGroups = append(slot.replicaGroups, group)
+			slot.replicaWeights = append(slot.replicaWeights, weights)
 		}
 	}
 	if method != nil {
 		slot.method = method
 	}
 
-	if !m.Locked {
+	switch {
+	case slot.admin.busy:
+		slot.admin.locked = m.Locked
+	case !m.Locked:
 		slot.unblock()
 	}
 	if !s.closed {
@@ -229,7 +1138,24 @@ func (s *Router) fillSlot(m *models.Slot, switched bool, method forwardMethod) {
 					slot.id, slot.backend.bc.Addr(), slot.lock.hold)
 			}
 		}
+		if fn := s.config.OnSlotFill; fn != nil {
+			fn(slot.id, slot.backend.bc.Addr())
+		}
+		s.events.Publish("slot_fill", map[string]interface{}{
+			"slot_id": slot.id, "backend_addr": slot.backend.bc.Addr(), "migrate_from": slot.migrate.bc.Addr(),
+			"locked": slot.lock.hold, "switched": switched,
+		})
+	}
+}
+
+func replicaWeight(m *models.Slot, i, j int) int {
+	if i >= len(m.ReplicaWeights) || j >= len(m.ReplicaWeights[i]) {
+		return 1
+	}
+	if w := m.ReplicaWeights[i][j]; w > 0 {
+		return w
 	}
+	return 0
 }
 
 func (s *Router) SwitchMasters(masters map[int]string) error {
@@ -238,16 +1164,96 @@ func (s *Router) SwitchMasters(masters map[int]string) error {
 	if s.closed {
 		return ErrClosedRouter
 	}
+	username, auth := s.config.BackendAuth()
 	cache := &redis.InfoCache{
-		Auth: s.config.ProductAuth, Timeout: time.Millisecond * 100,
+		Username: username, Auth: auth, Timeout: time.Millisecond * 100,
 	}
+	var switched = make(map[int]string)
 	for i := range s.slots {
-		s.trySwitchMaster(i, masters, cache)
+		s.trySwitchMaster(i, masters, cache, switched)
+	}
+	if fn := s.config.OnMasterSwitch; fn != nil {
+		for gid, from := range switched {
+			fn(gid, from, masters[gid])
+		}
+	}
+	for gid, from := range switched {
+		s.events.Publish("master_switch", map[string]interface{}{
+			"group_id": gid, "old_addr": from, "new_addr": masters[gid],
+		})
+	}
+	s.ha.Masters = make(map[int]string, len(masters))
+	for gid, addr := range masters {
+		s.ha.Masters[gid] = addr
 	}
 	return nil
 }
 
-func (s *Router) trySwitchMaster(id int, masters map[int]string, cache *redis.InfoCache) {
+func (s *Router) GetHA() admin.HAState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var ha = admin.HAState{
+		Sentinels:      s.ha.Sentinels,
+		Masters:        make(map[int]string, len(s.ha.Masters)),
+		MonitorRunning: s.ha.MonitorRunning,
+	}
+	for gid, addr := range s.ha.Masters {
+		ha.Masters[gid] = addr
+	}
+	return ha
+}
+
+// GetMigrationProgress returns the migrating slots. Keys remaining are read
+// from the sources with SLOTSINFO, -1 if they couldn't be fetched.
+func (s *Router) GetMigrationProgress() []*admin.MigrationState {
+	var states []*admin.MigrationState
+	var sources []*sharedBackendConn
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return states
+	}
+	for i := range s.slots {
+		slot := &s.slots[i]
+		if slot.migrate.bc == nil {
+			continue
+		}
+		states = append(states, &admin.MigrationState{
+			SlotId:        slot.id,
+			FromAddr:      slot.migrate.bc.Addr(),
+			ToAddr:        slot.backend.bc.Addr(),
+			KeysMigrated:  slot.migrated.Int64(),
+			KeysRemaining: -1,
+			StartedAt:     slot.migrateAt,
+		})
+		sources = append(sources, slot.migrate.bc.Retain())
+	}
+	s.mu.Unlock()
+
+	for i, bc := range sources {
+		if n, err := bc.SlotKeys(states[i].SlotId); err != nil {
+			log.WarnErrorf(err, "slot-%04d get keys remaining from %s failed", states[i].SlotId, bc.Addr())
+		} else {
+			states[i].KeysRemaining = n
+		}
+	}
+
+	s.mu.Lock()
+	for _, bc := range sources {
+		bc.Release()
+	}
+	s.mu.Unlock()
+	return states
+}
+
+func (s *Router) setSentinels(servers []string, running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ha = admin.HAState{Sentinels: servers, MonitorRunning: running}
+}
+
+func (s *Router) trySwitchMaster(id int, masters map[int]string, cache *redis.InfoCache, switchedFrom map[int]string) {
 	var switched bool
 	var m = s.slots[id].snapshot()
 
@@ -262,11 +1268,13 @@ func (s *Router) trySwitchMaster(id int, masters map[int]string, cache *redis.In
 
 	if addr := masters[m.BackendAddrGroupId]; addr != "" {
 		if !hasSameRunId(addr, m.BackendAddr) {
+			switchedFrom[m.BackendAddrGroupId] = m.BackendAddr
 			m.BackendAddr, switched = addr, true
 		}
 	}
 	if addr := masters[m.MigrateFromGroupId]; addr != "" {
 		if !hasSameRunId(addr, m.MigrateFrom) {
+			switchedFrom[m.MigrateFromGroupId] = m.MigrateFrom
 			m.MigrateFrom, switched = addr, true
 		}
 	}
@@ -0,0 +1,84 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"testing"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// newDiscardBackendConn returns a shared backend conn that never touches the
+// network, requests are answered at once: +OK, or :1 for SLOTSMGRTTAGONE.
+func newDiscardBackendConn(d *Router, addr string) *sharedBackendConn {
+	bc := &BackendConn{addr: addr, config: d.config, input: make(chan *Request, 1024)}
+	go func() {
+		for r := range bc.input {
+			if r.OpStr == "" && string(r.Multi[0].Value) == "SLOTSMGRTTAGONE" {
+				bc.setResponse(r, redis.NewInt([]byte("1")), nil)
+			} else {
+				bc.setResponse(r, RespOK, nil)
+			}
+		}
+	}()
+	return &sharedBackendConn{
+		addr: addr, owner: d.pool.primary, refcnt: 1,
+		single: []*BackendConn{bc},
+	}
+}
+
+func newBenchRouter(migrating bool) (*Router, func()) {
+	d := NewRouter(config)
+	slot := &d.slots[d.hashSlot([]byte("hot"))]
+	slot.backend.bc = newDiscardBackendConn(d, "127.0.0.1:6379")
+	var conns = []*sharedBackendConn{slot.backend.bc}
+	if migrating {
+		slot.migrate.bc = newDiscardBackendConn(d, "127.0.0.1:6380")
+		conns = append(conns, slot.migrate.bc)
+	}
+	return d, func() {
+		d.Close()
+		for _, s := range conns {
+			s.single[0].Close()
+		}
+	}
+}
+
+func benchmarkRouterDispatch(b *testing.B, migrating bool) {
+	d, cleanup := newBenchRouter(migrating)
+	defer cleanup()
+
+	r := newRequest("GET", "hot")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := d.dispatch(r); err != nil {
+			b.Fatal(err)
+		}
+		r.Batch.Wait()
+	}
+}
+
+func BenchmarkRouterDispatch(b *testing.B)          { benchmarkRouterDispatch(b, false) }
+func BenchmarkRouterDispatchMigrating(b *testing.B) { benchmarkRouterDispatch(b, true) }
+
+// BenchmarkRouterDispatchConcurrent sends all requests to the same slot, so
+// they contend on its lock, stats and backend connection.
+func BenchmarkRouterDispatchConcurrent(b *testing.B) {
+	d, cleanup := newBenchRouter(false)
+	defer cleanup()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := newRequest("GET", "hot")
+		for pb.Next() {
+			if err := d.dispatch(r); err != nil {
+				b.Error(err)
+				return
+			}
+			r.Batch.Wait()
+		}
+	})
+}
@@ -0,0 +1,921 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+	"github.com/CodisLabs/codis/pkg/utils/timesize"
+)
+
+func newRequest(args ...string) *Request {
+	r := &Request{Batch: &sync.WaitGroup{}}
+	for _, arg := range args {
+		r.Multi = append(r.Multi, redis.NewBulkBytes([]byte(arg)))
+	}
+	opstr, flag, err := getOpInfo(r.Multi)
+	assert.MustNoError(err)
+	r.OpStr, r.OpFlag = opstr, flag
+	return r
+}
+
+func TestSlotStats(t *testing.T) {
+	s := NewRouter(config)
+	defer s.Close()
+
+	var id = int(Hash([]byte("key")) % MaxSlotNum)
+
+	for i := 0; i < 4; i++ {
+		assert.Must(s.dispatch(newRequest("GET", "key")) == ErrSlotIsNotReady)
+	}
+	stats := s.GetSlotStats(id)
+	assert.Must(stats.Id == id)
+	assert.Must(stats.Calls == 4)
+	assert.Must(stats.Errors == 4)
+	assert.Must(stats.BytesIn == 4*int64(len("GET")+len("key")))
+	assert.Must(stats.BytesOut == 0)
+
+	assert.Must(s.GetSlotStats(-1) == nil)
+	assert.Must(s.GetSlotStats(MaxSlotNum) == nil)
+
+	all := s.GetAllSlotStats()
+	assert.Must(len(all) == MaxSlotNum)
+	for i := range all {
+		if i != id {
+			assert.Must(all[i].Calls == 0)
+		}
+	}
+}
+
+func TestRouterHashFunc(t *testing.T) {
+	c := *config
+	c.HashFunc = "murmur3"
+	s := NewRouter(&c)
+	defer s.Close()
+
+	var id = int(murmur3([]byte("key")) % MaxSlotNum)
+	assert.Must(s.hashSlot([]byte("key")) == id)
+	assert.Must(s.hashSlot([]byte("{key}1")) == id)
+	assert.Must(s.dispatch(newRequest("GET", "key")) == ErrSlotIsNotReady)
+	assert.Must(s.GetSlotStats(id).Calls == 1)
+}
+
+func TestRouterGracefulClose(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+	b.delay = time.Millisecond * 200
+
+	d := newTestRouter(b)
+	waitConnected(d)
+
+	r := newRequest("GET", "key")
+	assert.MustNoError(d.dispatch(r))
+
+	var done = make(chan error, 1)
+	go func() {
+		done <- d.GracefulClose(time.Second * 5)
+	}()
+	for !d.IsDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Must(d.dispatch(newRequest("GET", "key")) == ErrDrainingRouter)
+	assert.Must(d.dispatchSlot(newRequest("GET", "key"), 0) == ErrDrainingRouter)
+
+	assert.MustNoError(<-done)
+	r.Batch.Wait()
+	assert.MustNoError(r.Err)
+	assert.Must(r.Resp != nil)
+	assert.Must(d.FillSlot(&models.Slot{Id: 0}) == ErrClosedRouter)
+}
+
+func TestRouterGracefulCloseTimeout(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+	b.delay = time.Millisecond * 500
+
+	d := newTestRouter(b)
+	waitConnected(d)
+
+	r := newRequest("GET", "key")
+	assert.MustNoError(d.dispatch(r))
+
+	start := time.Now()
+	assert.Must(d.GracefulClose(time.Millisecond*50) == ErrDrainTimeout)
+	assert.Must(time.Since(start) < time.Millisecond*400)
+	assert.Must(d.FillSlot(&models.Slot{Id: 0}) == ErrClosedRouter)
+
+	r.Batch.Wait()
+}
+
+func TestHotSlots(t *testing.T) {
+	var hot = make(map[int]float64)
+
+	c := *config
+	c.HotSlotFactor = 10
+	c.HotSlotMinRPS = 100
+	c.HotSlotCallback = func(slotID int, rps float64) {
+		hot[slotID] = rps
+	}
+	s := newRouter(&c)
+	defer s.Close()
+
+	var sample = func(rates map[int]int64) {
+		for i := range s.slots {
+			if n, ok := rates[i]; ok {
+				s.slots[i].stats.calls.Add(n)
+			} else {
+				s.slots[i].stats.calls.Add(10)
+			}
+		}
+		s.sampleSlotStats(time.Second)
+	}
+
+	sample(map[int]int64{3: 5000, 7: 50})
+	assert.Must(len(hot) == 1 && hot[3] == 5000)
+	assert.Must(s.GetSlotStats(3).Hot)
+	assert.Must(!s.GetSlotStats(7).Hot)
+
+	sample(map[int]int64{3: 5000, 7: 50})
+	assert.Must(len(hot) == 1)
+
+	sample(nil)
+	assert.Must(!s.GetSlotStats(3).Hot)
+
+	delete(hot, 3)
+	sample(map[int]int64{3: 5000})
+	assert.Must(len(hot) == 1 && hot[3] == 5000)
+}
+
+func TestRouterEventHooks(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	var mu sync.Mutex
+	var events []string
+	record := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf(format, args...))
+	}
+
+	c := *config
+	c.OnSlotFill = func(slotID int, backendAddr string) {
+		record("fill %d %s", slotID, backendAddr)
+	}
+	c.OnMasterSwitch = func(groupID int, oldAddr, newAddr string) {
+		record("switch %d %s %s", groupID, oldAddr, newAddr)
+	}
+	c.OnBackendConnect = func(addr string) {
+		record("connect %s", addr)
+	}
+	c.OnBackendDisconnect = func(addr string, err error) {
+		record("disconnect %s", addr)
+	}
+	d := NewRouter(&c)
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: 1, BackendAddr: b0.Addr(), BackendAddrGroupId: 1}))
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: 2, BackendAddr: b0.Addr(), BackendAddrGroupId: 1}))
+	d.Start()
+	waitConnected(d)
+
+	assert.MustNoError(d.SwitchMasters(map[int]string{1: b1.Addr()}))
+	assert.Must(d.GetSlot(1).BackendAddr == b1.Addr())
+	waitConnected(d)
+	d.Close()
+
+	contains := func(event string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		var n int
+		for _, e := range events {
+			if e == event {
+				n++
+			}
+		}
+		return n
+	}
+	assert.Must(contains("fill 1 "+b0.Addr()) == 1)
+	assert.Must(contains("fill 1 "+b1.Addr()) == 1)
+	assert.Must(contains(fmt.Sprintf("switch 1 %s %s", b0.Addr(), b1.Addr())) == 1)
+	assert.Must(contains("connect "+b0.Addr()) != 0)
+	for i := 0; i < 100 && contains("disconnect "+b1.Addr()) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(contains("disconnect "+b1.Addr()) != 0)
+}
+
+func TestRouterStaleLocks(t *testing.T) {
+	var stale []int
+	c := *config
+	c.SlotLockTimeout = timesize.Duration(time.Minute)
+	c.OnSlotLockTimeout = func(slotID int) {
+		stale = append(stale, slotID)
+	}
+	s := NewRouter(&c)
+	defer s.Close()
+
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 1, Locked: true}))
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 2}))
+
+	s.checkStaleLocks(time.Now())
+	assert.Must(len(stale) == 0)
+
+	var now = time.Now().Add(time.Minute * 2)
+	s.checkStaleLocks(now)
+	assert.Must(len(stale) == 1 && stale[0] == 1)
+	assert.Must(s.GetSlot(1).Locked)
+	s.checkStaleLocks(now)
+	assert.Must(len(stale) == 1)
+
+	c.AutoUnlockStaleLocks = true
+	s.checkStaleLocks(now.Add(time.Minute * 2))
+	assert.Must(len(stale) == 2 && stale[1] == 1)
+	assert.Must(!s.GetSlot(1).Locked)
+}
+
+func TestRouterSlotQuarantine(t *testing.T) {
+	type event struct {
+		slot int
+		hard bool
+	}
+	var events []event
+	c := *config
+	c.SlotErrorRateWindow = timesize.Duration(time.Second * 2)
+	c.SlotSoftQuarantineThreshold = 0.1
+	c.SlotHardQuarantineThreshold = 0.5
+	c.OnSlotQuarantine = func(slotID int, errorRate float64, hard bool) {
+		events = append(events, event{slotID, hard})
+	}
+	s := newRouter(&c)
+	defer s.Close()
+
+	var sample = func(calls, errors int64) {
+		s.slots[5].stats.calls.Add(calls)
+		for i := int64(0); i < errors; i++ {
+			s.slots[5].stats.incrResponse(nil, ErrBackendOverloaded)
+		}
+		s.sampleSlotStats(time.Second)
+	}
+
+	sample(100, 5)
+	assert.Must(len(events) == 0 && s.GetSlotStats(5).Quarantine == "")
+
+	// Error replies of commands are not backend errors.
+	for i := 0; i < 100; i++ {
+		s.slots[5].stats.incrResponse(redis.NewErrorf("WRONGTYPE Operation against a key holding the wrong kind of value"), nil)
+	}
+	sample(0, 0)
+	assert.Must(len(events) == 0 && s.GetSlotStats(5).Quarantine == "")
+	assert.Must(s.GetSlotStats(5).Errors == 105)
+
+	// Quiet slots are never quarantined.
+	sample(0, 0)
+	sample(0, 0)
+	sample(10, 10)
+	assert.Must(len(events) == 0 && s.GetSlotStats(5).Quarantine == "")
+	sample(0, 0)
+	sample(0, 0)
+
+	sample(100, 35)
+	assert.Must(len(events) == 1 && events[0] == event{5, false})
+	assert.Must(s.GetSlotStats(5).Quarantine == "soft")
+
+	sample(100, 100)
+	assert.Must(len(events) == 2 && events[1] == event{5, true})
+	assert.Must(s.GetSlotStats(5).Quarantine == "hard")
+	assert.Must(s.dispatchSlot(newRequest("PING"), 5) == ErrSlotQuarantined)
+
+	sample(0, 0)
+	assert.Must(s.GetSlotStats(5).Quarantine == "hard")
+	sample(0, 0)
+	assert.Must(len(events) == 2 && s.GetSlotStats(5).Quarantine == "")
+	assert.Must(s.dispatchSlot(newRequest("PING"), 5) != ErrSlotQuarantined)
+}
+
+func TestRouterFillSlotFromSnapshot(t *testing.T) {
+	var fills int
+	c := *config
+	c.OnSlotFill = func(slotID int, backendAddr string) {
+		fills++
+	}
+	s := NewRouter(&c)
+	defer s.Close()
+
+	var snap = &SlotSnapshot{Version: 2}
+	snap.Id, snap.BackendAddr = 1, "127.0.0.1:6379"
+	assert.MustNoError(s.FillSlotFromSnapshot(1, snap))
+	assert.Must(fills == 1 && s.GetSlot(1).BackendAddr == "127.0.0.1:6379")
+
+	assert.Must(s.FillSlotFromSnapshot(1, snap) == ErrSlotVersionStale)
+	var old = &SlotSnapshot{Version: 1}
+	old.Id, old.BackendAddr = 1, "127.0.0.1:6380"
+	assert.Must(s.FillSlotFromSnapshot(1, old) == ErrSlotVersionStale)
+	assert.Must(fills == 1 && s.GetSlot(1).BackendAddr == "127.0.0.1:6379")
+
+	old.Version = 3
+	assert.MustNoError(s.FillSlotFromSnapshot(1, old))
+	assert.Must(fills == 2 && s.GetSlot(1).BackendAddr == "127.0.0.1:6380")
+
+	assert.Must(s.FillSlotFromSnapshot(2, old) == ErrInvalidSlotId)
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 1}))
+	assert.Must(s.FillSlotFromSnapshot(1, old) == ErrSlotVersionStale)
+}
+
+func TestRouterFillSlotRange(t *testing.T) {
+	s := NewRouter(config)
+	defer s.Close()
+
+	var template = &models.Slot{Id: 7, BackendAddr: "127.0.0.1:6379", BackendAddrGroupId: 2, Locked: true}
+	assert.MustNoError(s.FillSlotRange(500, 599, template))
+	assert.Must(template.Id == 7)
+	for i := 0; i < MaxSlotNum; i++ {
+		m := s.GetSlot(i)
+		assert.Must(m.Id == i)
+		if i >= 500 && i <= 599 {
+			assert.Must(m.BackendAddr == "127.0.0.1:6379" && m.BackendAddrGroupId == 2 && m.Locked)
+		} else {
+			assert.Must(m.BackendAddr == "" && !m.Locked)
+		}
+	}
+	assert.MustNoError(s.FillSlotRange(0, 0, &models.Slot{}))
+
+	assert.Must(s.FillSlotRange(10, 9, template) == ErrInvalidSlotId)
+	assert.Must(s.FillSlotRange(-1, 9, template) == ErrInvalidSlotId)
+	assert.Must(s.FillSlotRange(0, MaxSlotNum, template) == ErrInvalidSlotId)
+	assert.Must(s.FillSlotRange(0, 9, &models.Slot{ForwardMethod: 100}) != nil)
+	assert.Must(s.GetSlot(0).BackendAddr == "")
+}
+
+func TestRouterAbortMigration(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	var id = int(Hash([]byte("key")) % MaxSlotNum)
+	b0.data["key"] = "old"
+	b1.data["key"] = "new"
+	b1.data["{key}1"] = "v1"
+	b1.data["other"] = "v2"
+
+	d := NewRouter(config)
+	defer d.Close()
+	d.Start()
+
+	assert.Must(d.AbortMigration(id) == ErrSlotNotMigrating)
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(), MigrateFromGroupId: 1}))
+
+	// The router is not locked while keys are moved, only the slot is.
+	var locked atomic2.Int64
+	b1.Lock()
+	b1.hooks = map[string]func(){"DUMP": func() {
+		if d.GetSlot(id).Locked {
+			locked.Incr()
+		}
+	}}
+	b1.Unlock()
+	assert.MustNoError(d.AbortMigration(id))
+	assert.Must(locked.Int64() == 2)
+
+	m := d.GetSlot(id)
+	assert.Must(m.BackendAddr == b0.Addr() && m.BackendAddrGroupId == 1 && m.MigrateFrom == "" && !m.Locked)
+	b0.Lock()
+	assert.Must(len(b0.data) == 2 && b0.data["key"] == "new" && b0.data["{key}1"] == "v1")
+	b0.Unlock()
+	b1.Lock()
+	assert.Must(len(b1.data) == 1 && b1.data["other"] == "v2")
+	b1.Unlock()
+
+	assert.Must(d.AbortMigration(id) == ErrSlotNotMigrating)
+	assert.Must(d.AbortMigration(MaxSlotNum) == ErrInvalidSlotId)
+}
+
+func TestRouterMigrateKey(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	var id = int(Hash([]byte("key")) % MaxSlotNum)
+	b0.data["key"] = "large"
+	b0.data["{key}1"] = "v1"
+
+	d := NewRouter(config)
+	defer d.Close()
+	d.Start()
+
+	_, err := d.MigrateKey(id, 0, []byte("key"))
+	assert.Must(err == ErrSlotNotMigrating)
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr()}))
+	_, err = d.MigrateKey(id+1, 0, []byte("key"))
+	assert.Must(err == ErrInvalidSlotId)
+
+	moved, err := d.MigrateKey(id, 0, []byte("key"))
+	assert.Must(moved && err == nil)
+	moved, err = d.MigrateKey(id, 0, []byte("key"))
+	assert.Must(!moved && err == nil)
+
+	b0.Lock()
+	assert.Must(len(b0.data) == 1 && b0.data["{key}1"] == "v1")
+	b0.Unlock()
+	b1.Lock()
+	assert.Must(len(b1.data) == 1 && b1.data["key"] == "large")
+	b1.Unlock()
+
+	m := d.GetSlot(id)
+	assert.Must(m.MigrateFrom == b0.Addr() && !m.Locked)
+	assert.Must(d.GetMigrationProgress()[0].KeysMigrated == 1)
+
+	// The key is written on the target by others after being read from the
+	// source, the RESTORE is discarded.
+	b0.Lock()
+	b0.data["{key}1"] = "v2"
+	b0.hooks = map[string]func(){"DUMP": func() {
+		b1.Lock()
+		b1.data["{key}1"] = "v3"
+		b1.Unlock()
+	}}
+	b0.Unlock()
+	_, err = d.MigrateKey(id, 0, []byte("{key}1"))
+	assert.Must(err == ErrKeyChanged)
+
+	// The key is written on the source before being deleted, the DEL is
+	// discarded and the key is left for migration as usual.
+	b0.Lock()
+	b0.hooks = map[string]func(){"MULTI": func() {
+		b0.Lock()
+		b0.data["{key}1"] = "v4"
+		b0.Unlock()
+	}}
+	b0.Unlock()
+	_, err = d.MigrateKey(id, 0, []byte("{key}1"))
+	assert.Must(err == ErrKeyChanged)
+	b0.Lock()
+	assert.Must(b0.data["{key}1"] == "v4")
+	b0.Unlock()
+	b1.Lock()
+	_, ok := b1.data["{key}1"]
+	assert.Must(!ok)
+	b1.Unlock()
+	assert.Must(!d.GetSlot(id).Locked && d.GetMigrationProgress()[0].KeysMigrated == 1)
+}
+
+func TestRouterSlotAdminBusy(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	var id = int(Hash([]byte("key")) % MaxSlotNum)
+	b0.data["key"] = "v1"
+	b1.data["{key}1"] = "v2"
+
+	d := NewRouter(config)
+	defer d.Close()
+	d.Start()
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr()}))
+
+	// Other admin operations fail while a key is moved, and fills keep the
+	// slot blocked until it's done.
+	var errs []error
+	var locked bool
+	b0.Lock()
+	b0.hooks = map[string]func(){"DUMP": func() {
+		errs = append(errs, d.AbortMigration(id))
+		_, err := d.MigrateKey(id, 0, []byte("key"))
+		errs = append(errs, err)
+		errs = append(errs, d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr()}))
+		locked = d.GetSlot(id).Locked
+	}}
+	b0.Unlock()
+	moved, err := d.MigrateKey(id, 0, []byte("key"))
+	assert.Must(moved && err == nil)
+	assert.Must(len(errs) == 3 && errs[0] == ErrSlotBusy && errs[1] == ErrSlotBusy && errs[2] == nil)
+	assert.Must(locked && !d.GetSlot(id).Locked)
+
+	// A fill asking for the lock keeps it after the operation.
+	b0.Lock()
+	b0.hooks = nil
+	b0.Unlock()
+	var once sync.Once
+	b1.Lock()
+	b1.hooks = map[string]func(){"SLOTSSCAN": func() {
+		once.Do(func() {
+			_, err := d.MigrateKey(id, 0, []byte("key"))
+			errs = append(errs, err)
+			errs = append(errs, d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(), Locked: true}))
+		})
+	}}
+	b1.Unlock()
+	assert.MustNoError(d.AbortMigration(id))
+	assert.Must(len(errs) == 5 && errs[3] == ErrSlotBusy && errs[4] == nil)
+	m := d.GetSlot(id)
+	assert.Must(m.Locked && m.BackendAddr == b0.Addr() && m.MigrateFrom == "")
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b0.Addr()}))
+	assert.Must(!d.GetSlot(id).Locked)
+}
+
+func TestRouterFillSlotWaitMigrating(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	var id = int(Hash([]byte("key")) % MaxSlotNum)
+	d := NewRouter(config)
+	defer d.Close()
+	d.Start()
+
+	// Ending the migration waits for requests in flight, while keys are
+	// migrated from the source and once they're forwarded to the target.
+	for _, x := range []struct {
+		b     *fakeBackend
+		opstr string
+	}{
+		{b0, "SLOTSMGRTTAGONE"}, {b1, "GET"},
+	} {
+		assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr()}))
+
+		var started, release = make(chan struct{}), make(chan struct{})
+		x.b.Lock()
+		x.b.hooks = map[string]func(){x.opstr: func() {
+			close(started)
+			<-release
+		}}
+		x.b.Unlock()
+
+		var done = make(chan *redis.Resp, 1)
+		go func() {
+			done <- execRequest(newTestSession(), d, "GET", "key")
+		}()
+		<-started
+
+		var filled = make(chan error, 1)
+		go func() {
+			filled <- d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr()})
+		}()
+		select {
+		case <-filled:
+			assert.Must(false)
+		case <-time.After(time.Millisecond * 100):
+		}
+		close(release)
+		assert.MustNoError(<-filled)
+		assert.Must(!(<-done).IsError())
+		assert.Must(d.GetSlot(id).MigrateFrom == "")
+
+		x.b.Lock()
+		x.b.hooks = nil
+		x.b.Unlock()
+	}
+}
+
+func TestRouterSlotAffinity(t *testing.T) {
+	c := *config
+	c.SlotAffinityFunc = func(key []byte) int {
+		switch {
+		case bytes.HasPrefix(key, []byte("hot:")):
+			return 1000
+		case bytes.HasPrefix(key, []byte("bad:")):
+			return MaxSlotNum
+		}
+		return -1
+	}
+	s := NewRouter(&c)
+	defer s.Close()
+
+	assert.Must(s.hashSlot([]byte("hot:1")) == 1000)
+	assert.Must(s.hashSlot([]byte("hot:2")) == 1000)
+	assert.Must(s.hashSlot([]byte("bad:1")) == int(Hash([]byte("bad:1"))%MaxSlotNum))
+	assert.Must(s.hashSlot([]byte("key")) == int(Hash([]byte("key"))%MaxSlotNum))
+}
+
+func TestRouterFillSlots(t *testing.T) {
+	s := NewRouter(config)
+	defer s.Close()
+
+	var slots []*models.Slot
+	for i := 0; i < 4; i++ {
+		slots = append(slots, &models.Slot{Id: i, BackendAddr: "127.0.0.1:6379"})
+	}
+	assert.Must(s.FillSlots(append(slots, &models.Slot{Id: MaxSlotNum})) == ErrInvalidSlotId)
+	for i := range slots {
+		assert.Must(s.GetSlot(i).BackendAddr == "")
+	}
+
+	slots[3].Locked = true
+	assert.MustNoError(s.FillSlots(slots))
+	for i := range slots {
+		m := s.GetSlot(i)
+		assert.Must(m.BackendAddr == "127.0.0.1:6379")
+		assert.Must(m.Locked == (i == 3))
+	}
+}
+
+func TestRouterSwitchMastersAuth(t *testing.T) {
+	// Both backends are the same redis behind ACL auth, INFO is only served
+	// to authenticated connections.
+	var listen = func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.MustNoError(err)
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func(conn *redis.Conn) {
+					defer conn.Close()
+					var authed bool
+					for {
+						multi, err := conn.DecodeMultiBulk()
+						if err != nil {
+							return
+						}
+						var resp = redis.NewString([]byte("OK"))
+						switch string(multi[0].Value) {
+						case "AUTH":
+							authed = len(multi) == 3 && string(multi[1].Value) == "user" && string(multi[2].Value) == "secret"
+							if !authed {
+								resp = redis.NewErrorf("WRONGPASS invalid username-password pair")
+							}
+						case "INFO":
+							resp = redis.NewErrorf("NOAUTH Authentication required.")
+							if authed {
+								resp = redis.NewBulkBytes([]byte("# Server\r\nrun_id:abc\r\n"))
+							}
+						}
+						conn.Encode(resp, true)
+					}
+				}(redis.NewConn(c, 1024, 1024))
+			}
+		}()
+		return l
+	}
+	l0, l1 := listen(), listen()
+	defer l0.Close()
+	defer l1.Close()
+
+	c := *config
+	c.BackendUsername = "user"
+	c.BackendPassword = "secret"
+	s := NewRouter(&c)
+	defer s.Close()
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 1, BackendAddr: l0.Addr().String(), BackendAddrGroupId: 1}))
+
+	assert.MustNoError(s.SwitchMasters(map[int]string{1: l1.Addr().String()}))
+	assert.Must(s.GetSlot(1).BackendAddr == l0.Addr().String())
+}
+
+func TestRouterSetLogLevel(t *testing.T) {
+	s := NewRouter(config)
+	defer s.Close()
+
+	defer log.SetLevel(log.GetLevel())
+	assert.MustNoError(s.SetLogLevel("debug"))
+	assert.Must(log.GetLevel() == log.LevelDebug)
+	assert.MustNoError(s.SetLogLevel("WARN"))
+	assert.Must(log.GetLevel() == log.LevelWarn)
+	for _, level := range []string{"", "none", "verbose"} {
+		assert.Must(s.SetLogLevel(level) == ErrInvalidLogLevel)
+	}
+	assert.Must(log.GetLevel() == log.LevelWarn)
+}
+
+func TestRouterGetBackendAddrs(t *testing.T) {
+	s := NewRouter(config)
+	defer s.Close()
+	assert.Must(len(s.GetBackendAddrs()) == 0)
+
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 1, BackendAddr: "127.0.0.1:6380"}))
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 2, BackendAddr: "127.0.0.1:6379",
+		ReplicaGroups: [][]string{{"127.0.0.1:6381", "127.0.0.1:6380"}}}))
+	var addrs = s.GetBackendAddrs()
+	assert.Must(len(addrs) == 3)
+	assert.Must(addrs[0] == "127.0.0.1:6379" && addrs[1] == "127.0.0.1:6380" && addrs[2] == "127.0.0.1:6381")
+
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 2}))
+	addrs = s.GetBackendAddrs()
+	assert.Must(len(addrs) == 1 && addrs[0] == "127.0.0.1:6380")
+}
+
+func TestRouterSnapshot(t *testing.T) {
+	s := NewRouter(config)
+	defer s.Close()
+
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 1, BackendAddr: "127.0.0.1:6379", BackendAddrGroupId: 1}))
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 2, BackendAddr: "127.0.0.1:6380", MigrateFrom: "127.0.0.1:6379", Locked: true}))
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 3, BackendAddr: "127.0.0.1:6379",
+		ReplicaGroups: [][]string{{"127.0.0.1:6381"}}, ForwardMethod: models.ForwardSemiAsync}))
+	b, err := s.Snapshot()
+	assert.MustNoError(err)
+
+	x := NewRouter(config)
+	defer x.Close()
+	assert.Must(x.Restore(b[:len(b)/2]) != nil)
+	assert.Must(x.Restore([]byte("[]")) == ErrInvalidSnapshot)
+	assert.MustNoError(x.Restore(b))
+
+	c, err := x.Snapshot()
+	assert.MustNoError(err)
+	assert.Must(bytes.Equal(b, c))
+	m := x.GetSlot(2)
+	assert.Must(m.Locked && m.MigrateFrom == "127.0.0.1:6379")
+	m = x.GetSlot(3)
+	assert.Must(len(m.ReplicaGroups) == 1 && m.ForwardMethod == models.ForwardSemiAsync)
+}
+
+func TestRouterRefreshDNS(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+	waitConnected(d)
+
+	assert.MustNoError(d.RefreshDNS())
+	shared := d.pool.primary.Get(b.Addr())
+	assert.Must(shared.resolved == "127.0.0.1")
+
+	d.mu.Lock()
+	shared.resolved = "10.0.0.1"
+	d.mu.Unlock()
+	assert.MustNoError(d.RefreshDNS())
+	assert.Must(shared.resolved == "127.0.0.1")
+
+	bc := shared.BackendConn(0, 0, true)
+	for bc.state.Int64() != stateIdle {
+		time.Sleep(time.Millisecond * 10)
+	}
+	s := newTestSession()
+	resp := execRequest(s, d, "SET", "a", "1")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	assert.Must(bc.state.Int64() == stateConnected)
+
+	addr, err := resolveBackendAddr("localhost:6379")
+	assert.MustNoError(err)
+	assert.Must(addr != "")
+	_, err = resolveBackendAddr("localhost")
+	assert.Must(err != nil)
+}
+
+func TestRouterPrewarm(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	c := *config
+	d := NewRouter(&c)
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: 0, BackendAddr: b.Addr()}))
+	waitConnected(d)
+
+	shared := d.pool.primary.Get(b.Addr())
+	count := func(state int64) int {
+		var n int
+		for _, parallel := range shared.conns {
+			for _, bc := range parallel {
+				if bc.state.Int64() == state {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	var total = len(shared.conns) * len(shared.conns[0])
+	assert.Must(total > 2)
+
+	shared.Reconnect()
+	for count(stateIdle) != total {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	c.BackendMinPoolSize = 2
+	shared.breaker = &circuitBreaker{}
+	shared.breaker.state.Set(circuitOpen)
+	assert.Must(shared.Prewarm(c.BackendMinPoolSize) == 0)
+	shared.breaker = nil
+
+	assert.Must(shared.Prewarm(c.BackendMinPoolSize) == 2)
+	for count(stateConnected) != 2 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.MustNoError(d.Prewarm())
+	assert.Must(count(stateConnected) == 2)
+	assert.Must(shared.Prewarm(c.BackendMinPoolSize) == 0)
+
+	// Connections kept by backend_min_pool_size are never closed for being
+	// idle, while the others are.
+	assert.Must(shared.Prewarm(3) == 1)
+	for count(stateConnected) != 3 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	c.BackendMaxIdleTime = timesize.Duration(time.Millisecond)
+	time.Sleep(time.Millisecond * 10)
+	for i := 0; i < 3; i++ {
+		shared.KeepAlive()
+		for count(stateConnected) != 2 {
+			time.Sleep(time.Millisecond * 10)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(count(stateConnected) == 2 && count(stateIdle) == total-2)
+}
+
+func TestRouterMigrationProgress(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+	assert.Must(len(d.GetMigrationProgress()) == 0)
+
+	s := newTestSession()
+	for _, key := range []string{"{x}1", "{x}2", "{x}3"} {
+		execRequest(s, d, "SET", key, "value")
+	}
+	var id = d.hashSlot([]byte("{x}"))
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr()}))
+	waitConnected(d)
+
+	execRequest(s, d, "GET", "{x}1")
+	execRequest(s, d, "GET", "{x}4")
+
+	states := d.GetMigrationProgress()
+	assert.Must(len(states) == 1)
+	m := states[0]
+	assert.Must(m.SlotId == id && m.FromAddr == b0.Addr() && m.ToAddr == b1.Addr())
+	assert.Must(m.KeysMigrated == 1 && m.KeysRemaining == 2)
+	assert.Must(!m.StartedAt.IsZero())
+
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr()}))
+	assert.Must(d.GetMigrationProgress()[0].StartedAt == m.StartedAt)
+
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr()}))
+	assert.Must(len(d.GetMigrationProgress()) == 0)
+}
+
+func TestRouterPoolStats(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+	waitConnected(d)
+
+	var total = d.pool.primary.parallel * int(config.BackendNumberDatabases)
+	stats := d.GetPoolStats()
+	p := stats[b.Addr()]
+	assert.Must(len(stats) == 1 && p.Addr == b.Addr())
+	assert.Must(p.TotalConns == total && p.IdleConns == total && p.ActiveConns == 0 && p.TotalErrors == 0)
+
+	b.Lock()
+	b.delay = time.Millisecond * 100
+	b.Unlock()
+	s := newTestSession()
+	r := newRequest("GET", "key")
+	assert.MustNoError(s.handleRequest(r, d))
+	p = d.GetPoolStats()[b.Addr()]
+	assert.Must(p.ActiveConns == 1 && p.IdleConns == total-1)
+	_, err := s.handleResponse(r)
+	assert.MustNoError(err)
+
+	b.Lock()
+	b.delay, b.drops = 0, 1
+	b.Unlock()
+	r = newRequest("GET", "key")
+	assert.MustNoError(s.handleRequest(r, d))
+	_, err = s.handleResponse(r)
+	assert.Must(err != nil)
+	assert.Must(d.GetPoolStats()[b.Addr()].TotalErrors == 1)
+}
+
+func TestRouterWarmUp(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	c := *config
+	c.BackendConnectTimeout.Set(time.Millisecond * 200)
+
+	s := NewRouter(&c)
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 0, BackendAddr: b.Addr()}))
+	assert.MustNoError(s.FillSlot(&models.Slot{Id: 1, BackendAddr: "127.0.0.1:1"}))
+
+	start := time.Now()
+	assert.MustNoError(s.WarmUp(4))
+	assert.Must(time.Since(start) < time.Second*2)
+
+	p := s.GetPoolStats()
+	assert.Must(p[b.Addr()].TotalConns == int(c.BackendNumberDatabases))
+	assert.Must(p["127.0.0.1:1"].TotalConns == 0)
+
+	s.Close()
+	assert.Must(s.WarmUp(4) == ErrClosedRouter)
+}
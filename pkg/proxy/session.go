@@ -4,14 +4,18 @@
 package proxy
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/admin"
 	"github.com/CodisLabs/codis/pkg/proxy/redis"
 	"github.com/CodisLabs/codis/pkg/utils/errors"
 	"github.com/CodisLabs/codis/pkg/utils/log"
@@ -28,6 +32,13 @@ type Session struct {
 
 	database int32
 
+	readPreference ReadPreference
+	requestID      string
+
+	resp3 bool
+
+	lastWriteSlot int
+
 	quit bool
 	exit sync.Once
 
@@ -44,8 +55,23 @@ type Session struct {
 
 	broken atomic2.Bool
 	config *Config
+	proxy  *Proxy
+	pubsub *pubsubConn
+	txn    *txnState
 
 	authorized bool
+	admin      bool
+
+	ip string
+
+	info struct {
+		sync.Mutex
+		cmd      string
+		database int32
+		flags    string
+		lastop   int64
+		user     string
+	}
 }
 
 func (s *Session) String() string {
@@ -75,11 +101,24 @@ func NewSession(sock net.Conn, config *Config) *Session {
 		Conn: c, config: config,
 		CreateUnix: time.Now().Unix(),
 	}
+	s.readPreference, _ = ParseReadPreference(config.BackendReadPreference)
 	s.stats.opmap = make(map[string]*opStats, 16)
 	log.Infof("session [%p] create: %s", s, s)
 	return s
 }
 
+func (s *Session) remoteIP() string {
+	if s.ip == "" && s.Conn != nil {
+		addr := s.Conn.RemoteAddr()
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			s.ip = host
+		} else {
+			s.ip = addr
+		}
+	}
+	return s.ip
+}
+
 func (s *Session) CloseReaderWithError(err error) error {
 	s.exit.Do(func() {
 		if err != nil {
@@ -107,20 +146,46 @@ var (
 	ErrRouterNotOnline          = errors.New("router is not online")
 	ErrTooManySessions          = errors.New("too many sessions")
 	ErrTooManyPipelinedRequests = errors.New("too many pipelined requests")
+	ErrClientKilled             = errors.New("client killed")
 )
 
-var RespOK = redis.NewString([]byte("OK"))
+var (
+	RespOK        = redis.NewString([]byte("OK"))
+	RespCrossSlot = redis.NewErrorf("CROSSSLOT Keys in request don't hash to the same slot")
+	RespReadOnly  = redis.NewErrorf("READONLY You can't write against a read only instance")
+	RespBlocked   = redis.NewErrorf("ERR key is blocked")
+)
 
 func (s *Session) Start(d *Router) {
 	s.start.Do(func() {
-		if int(incrSessions()) > s.config.ProxyMaxClients {
+		var n = int(incrSessions())
+		var evicted bool
+		if limit := s.config.ProxyMaxClientsHardLimit; limit != 0 && n > limit {
+			if x := d.closeIdlestSession(); x != nil {
+				log.Warnf("session [%p] exceeds hard limit of clients %d, close idle session [%p] %s",
+					s, limit, x, x.Conn.RemoteAddr())
+				evicted = true
+			}
+		}
+		// The evicted session is still counted until its writer exits, the
+		// new one takes its place anyway. Rejected sessions are counted until
+		// they're closed, so a burst of them above the soft limit reaches the
+		// hard limit and idle sessions are evicted for new ones.
+		var rejected = !evicted && n > s.config.ProxyMaxClients
+		if limit := s.config.ProxyMaxClientsSoftLimit; !evicted && limit != 0 && n > limit {
+			log.Warnf("session [%p] exceeds soft limit of clients %d, reject %s",
+				s, limit, s.Conn.RemoteAddr())
+			rejected = true
+		}
+		if rejected {
+			incrSessionsRejected()
 			go func() {
 				s.Conn.Encode(redis.NewErrorf("ERR max number of clients reached"), true)
 				s.CloseWithError(ErrTooManySessions)
 				s.incrOpFails(nil, nil)
 				s.flushOpStats(true)
+				decrSessions()
 			}()
-			decrSessions()
 			return
 		}
 
@@ -137,8 +202,11 @@ func (s *Session) Start(d *Router) {
 
 		tasks := NewRequestChanBuffer(1024)
 
+		d.addSession(s)
+
 		go func() {
-			s.loopWriter(tasks)
+			s.loopWriter(tasks, d)
+			d.delSession(s)
 			decrSessions()
 		}()
 
@@ -152,6 +220,12 @@ func (s *Session) Start(d *Router) {
 func (s *Session) loopReader(tasks *RequestChan, d *Router) (err error) {
 	defer func() {
 		s.CloseReaderWithError(err)
+		s.resetTxn()
+		if s.pubsub != nil {
+			s.pubsub.quit.Set(true)
+			s.pubsub.Close()
+			s.leavePubSub()
+		}
 	}()
 
 	var (
@@ -182,13 +256,22 @@ func (s *Session) loopReader(tasks *RequestChan, d *Router) (err error) {
 		r.Batch = &sync.WaitGroup{}
 		r.Database = s.database
 		r.UnixNano = start.UnixNano()
+		r.ReadPreference = s.readPreference
+		r.RequestID = s.requestID
 
-		if err := s.handleRequest(r, d); err != nil {
+		err = s.handleRequest(r, d)
+		r.Resp3 = s.resp3
+		s.updateInfo(r.OpStr, s.LastOpUnix)
+		if err != nil {
 			r.Resp = redis.NewErrorf("ERR handle request, %s", err)
 			tasks.PushBack(r)
 			if breakOnFailure {
 				return err
 			}
+		} else if s.pubsub != nil && r.Resp == nil {
+			if err := s.forwardPubSub(r, tasks); err != nil {
+				return s.incrOpFails(r, err)
+			}
 		} else {
 			tasks.PushBack(r)
 		}
@@ -196,7 +279,41 @@ func (s *Session) loopReader(tasks *RequestChan, d *Router) (err error) {
 	return nil
 }
 
-func (s *Session) loopWriter(tasks *RequestChan) (err error) {
+func (s *Session) updateInfo(opstr string, lastop int64) {
+	var flags = "N"
+	switch {
+	case s.pubsub != nil:
+		flags = "P"
+	case s.txn != nil && s.txn.multi:
+		flags = "x"
+	}
+	s.info.Lock()
+	s.info.cmd = opstr
+	s.info.database = s.database
+	s.info.flags = flags
+	s.info.lastop = lastop
+	s.info.Unlock()
+}
+
+func (s *Session) ClientInfo(now int64) *admin.ClientInfo {
+	s.info.Lock()
+	defer s.info.Unlock()
+	var c = &admin.ClientInfo{
+		Addr:     s.Conn.RemoteAddr(),
+		Database: int(s.info.database),
+		Command:  strings.ToLower(s.info.cmd),
+		Age:      now - s.CreateUnix,
+		Flags:    s.info.flags,
+	}
+	if s.info.lastop != 0 {
+		c.Idle = now - s.info.lastop
+	} else {
+		c.Idle, c.Command, c.Flags = c.Age, "NULL", "N"
+	}
+	return c
+}
+
+func (s *Session) loopWriter(tasks *RequestChan, d *Router) (err error) {
 	defer func() {
 		s.CloseWithError(err)
 		tasks.PopFrontAllVoid(func(r *Request) {
@@ -216,12 +333,25 @@ func (s *Session) loopWriter(tasks *RequestChan) (err error) {
 
 	return tasks.PopFrontAll(func(r *Request) error {
 		resp, err := s.handleResponse(r)
+		if err == ErrBackendOverloaded {
+			resp, err = redis.NewErrorf("ERR %s", err), nil
+		}
 		if err != nil {
 			resp = redis.NewErrorf("ERR handle response, %s", err)
 			if breakOnFailure {
 				s.Conn.Encode(resp, true)
 				return s.incrOpFails(r, err)
 			}
+		} else if r.Resp3 {
+			resp = convertResp3(r.OpStr, resp)
+		}
+		latency := time.Duration(time.Now().UnixNano() - r.UnixNano)
+		if d.slowlog.IsSlow(latency) {
+			d.slowlog.Record(r, s.Conn.RemoteAddr(), latency)
+		}
+		d.enforceTTL(r, resp)
+		if d.accesslog != nil && r.OpStr != "" {
+			d.accesslog.Record(r, s.Conn.RemoteAddr(), s.authUser(), latency, resp)
 		}
 		if err := p.Encode(resp); err != nil {
 			return s.incrOpFails(r, err)
@@ -229,7 +359,7 @@ func (s *Session) loopWriter(tasks *RequestChan) (err error) {
 		fflush := tasks.IsEmpty()
 		if err := p.Flush(fflush); err != nil {
 			return s.incrOpFails(r, err)
-		} else {
+		} else if r.OpStr != "" {
 			s.incrOpStats(r, resp.Type)
 		}
 		if fflush {
@@ -264,6 +394,9 @@ func (s *Session) handleRequest(r *Request, d *Router) error {
 	r.Broken = &s.broken
 
 	if flag.IsNotAllowed() {
+		if s.txn != nil && s.txn.multi {
+			s.txn.dirty = true
+		}
 		return fmt.Errorf("command '%s' is not allowed", opstr)
 	}
 
@@ -272,16 +405,69 @@ func (s *Session) handleRequest(r *Request, d *Router) error {
 		return s.handleQuit(r)
 	case "AUTH":
 		return s.handleAuth(r)
+	case "HELLO":
+		return s.handleRequestHello(r)
+	case "RESET":
+		return s.handleReset(r)
 	}
 
 	if !s.authorized {
-		if s.config.SessionAuth != "" {
+		if s.authRequired() {
 			r.Resp = redis.NewErrorf("NOAUTH Authentication required")
 			return nil
 		}
 		s.authorized = true
 	}
 
+	if d.limiter != nil && !d.limiter.Allow(s.remoteIP()) {
+		r.Resp = redis.NewErrorf("ERR rate limit exceeded")
+		return nil
+	}
+
+	if s.pubsub != nil {
+		if !s.pubsub.leaving {
+			return s.handlePubSub(r)
+		}
+		s.leavePubSub()
+	}
+
+	if !flag.IsReadOnly() && d.IsReadOnly() {
+		if s.txn != nil && s.txn.multi {
+			s.txn.dirty = true
+		}
+		r.Resp = RespReadOnly
+		return nil
+	}
+
+	if opstr == "DEBUG" {
+		if resp := s.limitDebug(r); resp != nil {
+			if s.txn != nil && s.txn.multi {
+				s.txn.dirty = true
+			}
+			r.Resp = resp
+			return nil
+		}
+	}
+
+	if !flag.IsReadOnly() && s.isKeyBlocked(r) {
+		if s.txn != nil && s.txn.multi {
+			s.txn.dirty = true
+		}
+		r.Resp = RespBlocked
+		return nil
+	}
+
+	if d.encodings != nil {
+		if resp := d.encodings.Observe(r); resp != nil && (s.txn == nil || !s.txn.multi) {
+			r.Resp = resp
+			return nil
+		}
+	}
+
+	if s.txn != nil && s.txn.multi {
+		return s.handleRequestTxn(r, d)
+	}
+
 	switch opstr {
 	case "SELECT":
 		return s.handleSelect(r)
@@ -289,49 +475,235 @@ func (s *Session) handleRequest(r *Request, d *Router) error {
 		return s.handleRequestPing(r, d)
 	case "INFO":
 		return s.handleRequestInfo(r, d)
+	case "WAIT":
+		return s.handleRequestWait(r, d)
+	case "DEBUG":
+		return d.dispatchSlot(r, s.config.AnyBackendSlot)
 	case "MGET":
 		return s.handleRequestMGet(r, d)
 	case "MSET":
 		return s.handleRequestMSet(r, d)
-	case "DEL":
-		return s.handleRequestDel(r, d)
-	case "EXISTS":
-		return s.handleRequestExists(r, d)
+	case "MSETNX":
+		return s.handleRequestMSetNX(r, d)
+	case "DEL", "EXISTS", "UNLINK":
+		return s.handleRequestKeysSum(r, d)
+	case "COPY":
+		return s.handleRequestCopy(r, d)
+	case "GEOSEARCHSTORE":
+		return s.handleRequestGeoSearchStore(r, d)
+	case "BITOP":
+		return s.handleRequestBitOp(r, d)
+	case "GEORADIUS", "GEORADIUSBYMEMBER":
+		return s.handleRequestGeoRadius(r, d)
+	case "SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE":
+		return s.handleRequestSetStore(r, d)
+	case "SINTER", "SUNION":
+		return s.handleRequestSetRead(r, d)
+	case "XREAD", "XREADGROUP":
+		return s.handleRequestXRead(r, d)
+	case "FUNCTION":
+		return s.handleRequestFunction(r, d)
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		return s.handleRequestEval(r, d)
+	case "LMPOP", "ZMPOP":
+		return s.handleRequestNumKeys(r, d, 1)
 	case "SLOTSINFO":
 		return s.handleRequestSlotsInfo(r, d)
 	case "SLOTSSCAN":
 		return s.handleRequestSlotsScan(r, d)
+	case "SCAN":
+		return s.handleRequestScan(r, d)
 	case "SLOTSMAPPING":
 		return s.handleRequestSlotsMapping(r, d)
+	case "PROXY":
+		return s.handleRequestProxy(r, d)
+	case "CLUSTER":
+		return s.handleRequestCluster(r, d)
+	case "COMMAND":
+		return s.handleRequestCommand(r, d)
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		return s.handleRequestSubscribe(r, d)
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		return s.handleRequestUnsubscribe(r)
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH":
+		return s.handleRequestTxn(r, d)
 	default:
+		if getCommandType(r.Multi, opstr) == commandAnyBackend {
+			if opstr == "OBJECT" {
+				return s.handleRequestObjectHelp(r, d)
+			}
+			return d.dispatchSlot(r, s.config.AnyBackendSlot)
+		}
+		if !flag.IsReadOnly() {
+			s.lastWriteSlot = d.hashSlot(getHashKey(r.Multi, opstr))
+		}
+		if s.config.BackendMaxRetries != 0 {
+			return s.dispatchWithRetry(r, d)
+		}
 		return d.dispatch(r)
 	}
 }
 
+func (s *Session) dispatchWithRetry(r *Request, d *Router) error {
+	var sent = true
+	if err := d.dispatch(r); err != nil {
+		r.Err, sent = err, false
+	}
+	r.Coalesce = func() error {
+		for s.isRetryable(r, sent) {
+			r.Retries++
+			time.Sleep(s.config.BackendRetryBackoff.Duration())
+			r.Resp, r.Err, sent = nil, nil, true
+			if err := d.dispatch(r); err != nil {
+				r.Err, sent = err, false
+			} else {
+				r.Batch.Wait()
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+func (s *Session) isRetryable(r *Request, sent bool) bool {
+	switch {
+	case r.Err == nil || r.Retries >= s.config.BackendMaxRetries:
+		return false
+	case r.IsBroken():
+		return false
+	}
+	switch r.Err {
+	case ErrCircuitOpen, ErrRequestIsBroken, ErrClosedRouter, ErrDrainingRouter:
+		return false
+	case ErrRequestNotSent:
+		return true
+	}
+	return !sent || r.OpFlag.IsReadOnly()
+}
+
 func (s *Session) handleQuit(r *Request) error {
 	s.quit = true
 	r.Resp = RespOK
 	return nil
 }
 
-func (s *Session) handleAuth(r *Request) error {
-	if len(r.Multi) != 2 {
-		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'AUTH' command")
+func (s *Session) handleReset(r *Request) error {
+	if len(r.Multi) != 1 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'RESET' command")
 		return nil
 	}
-	switch {
-	case s.config.SessionAuth == "":
-		r.Resp = redis.NewErrorf("ERR Client sent AUTH, but no password is set")
-	case s.config.SessionAuth != string(r.Multi[1].Value):
-		s.authorized = false
-		r.Resp = redis.NewErrorf("ERR invalid password")
+	// The dedicated connection of WATCH or MULTI is closed rather than reset,
+	// so RESET never reaches the backends.
+	s.resetTxn()
+	if s.pubsub != nil {
+		s.pubsub.quit.Set(true)
+		s.pubsub.Close()
+		s.leavePubSub()
+	}
+	s.database = 0
+	s.resp3 = false
+	s.lastWriteSlot = 0
+	s.readPreference, _ = ParseReadPreference(s.config.BackendReadPreference)
+	s.requestID = ""
+	s.authorized = !s.authRequired()
+	s.admin = false
+	s.setAuthUser("")
+	r.Resp = redis.NewString([]byte("RESET"))
+	return nil
+}
+
+func (s *Session) handleAuth(r *Request) error {
+	switch len(r.Multi) {
+	case 2:
+		switch {
+		case !s.authRequired():
+			r.Resp = redis.NewErrorf("ERR Client sent AUTH, but no password is set")
+		case !s.authenticate("", string(r.Multi[1].Value)):
+			r.Resp = redis.NewErrorf("ERR invalid password")
+		default:
+			r.Resp = RespOK
+		}
+	case 3:
+		if !s.authenticate(string(r.Multi[1].Value), string(r.Multi[2].Value)) {
+			r.Resp = redis.NewErrorf("WRONGPASS invalid username-password pair")
+		} else {
+			r.Resp = RespOK
+		}
 	default:
-		s.authorized = true
-		r.Resp = RespOK
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'AUTH' command")
 	}
 	return nil
 }
 
+const authFailureDelay = time.Millisecond * 100
+
+// isKeyBlocked returns true if any key of r, or its hash tag if there is
+// one, starts with one of blocked_key_prefixes.
+func (s *Session) isKeyBlocked(r *Request) bool {
+	if len(s.config.BlockedKeyPrefixes) == 0 {
+		return false
+	}
+	for _, key := range commandKeys(r.Multi, r.OpStr) {
+		var tag = hashTag(key)
+		for _, prefix := range s.config.BlockedKeyPrefixes {
+			if bytes.HasPrefix(key, []byte(prefix)) || bytes.HasPrefix(tag, []byte(prefix)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *Session) authRequired() bool {
+	return s.config.SessionAuth != "" || len(s.config.SessionUsers) != 0
+}
+
+// authenticate checks the password of username against session_auth, which
+// is the password of the default user, and session_users. Failures are
+// delayed to slow down brute force attacks.
+func (s *Session) authenticate(username, password string) bool {
+	var ok bool
+	switch username {
+	case "", "default":
+		username = "default"
+		ok = s.config.SessionAuth != "" && equalSecret(s.config.SessionAuth, password)
+	default:
+		for _, u := range s.config.SessionUsers {
+			if i := strings.IndexByte(u, ':'); i > 0 && u[:i] == username {
+				ok = equalSecret(u[i+1:], password)
+				break
+			}
+		}
+	}
+	if !ok {
+		s.authorized = false
+		incrSessionsAuthFailed()
+		time.Sleep(authFailureDelay)
+		return false
+	}
+	s.authorized = true
+	s.setAuthUser(username)
+	return true
+}
+
+// equalSecret compares password to secret in constant time, so the secret
+// can't be guessed from how long failures take.
+func equalSecret(secret, password string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(password)) == 1
+}
+
+func (s *Session) setAuthUser(user string) {
+	s.info.Lock()
+	s.info.user = user
+	s.info.Unlock()
+}
+
+func (s *Session) authUser() string {
+	s.info.Lock()
+	defer s.info.Unlock()
+	return s.info.user
+}
+
 func (s *Session) handleSelect(r *Request) error {
 	if len(r.Multi) != 2 {
 		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'SELECT' command")
@@ -342,6 +714,8 @@ func (s *Session) handleSelect(r *Request) error {
 		r.Resp = redis.NewErrorf("ERR invalid DB index")
 	case db < 0 || db >= int(s.config.BackendNumberDatabases):
 		r.Resp = redis.NewErrorf("ERR invalid DB index, only accept DB [0,%d)", s.config.BackendNumberDatabases)
+	case db != 0 && !s.config.AllowSelect:
+		r.Resp = redis.NewErrorf("ERR SELECT is disabled, only accept DB 0")
 	default:
 		r.Resp = RespOK
 		s.database = int32(db)
@@ -387,6 +761,100 @@ func (s *Session) handleRequestInfo(r *Request, d *Router) error {
 	return nil
 }
 
+func (s *Session) handleRequestWait(r *Request, d *Router) error {
+	if len(r.Multi) != 3 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'WAIT' command")
+		return nil
+	}
+	numreplicas, err := strconv.ParseInt(string(r.Multi[1].Value), 10, 64)
+	if err != nil {
+		r.Resp = redis.NewErrorf("ERR value is not an integer or out of range")
+		return nil
+	}
+	timeout, err := strconv.ParseInt(string(r.Multi[2].Value), 10, 64)
+	if err != nil || timeout < 0 {
+		r.Resp = redis.NewErrorf("ERR timeout is not an integer or out of range")
+		return nil
+	}
+	if max := int64(s.config.WaitTimeout.Duration() / time.Millisecond); max > 0 {
+		if timeout == 0 || timeout > max {
+			r.Multi[2] = redis.NewBulkBytes([]byte(strconv.FormatInt(max, 10)))
+		}
+	}
+	// Replicas of all replica groups are attached to the slot's primary,
+	// so its reply already counts acknowledgements across groups.
+	if err := d.dispatchSlot(r, s.lastWriteSlot); err != nil {
+		return err
+	}
+	r.Coalesce = func() error {
+		if r.Resp == nil || !r.Resp.IsInt() {
+			return nil
+		}
+		n, err := strconv.ParseInt(string(r.Resp.Value), 10, 64)
+		if err == nil && numreplicas >= 0 && n > numreplicas {
+			r.Resp = redis.NewInt(strconv.AppendInt(nil, numreplicas, 10))
+		}
+		return nil
+	}
+	return nil
+}
+
+// limitDebug caps the duration of DEBUG SLEEP to debug_sleep_max_duration, it
+// returns an error reply for other subcommands or if DEBUG SLEEP is disabled.
+func (s *Session) limitDebug(r *Request) *redis.Resp {
+	if len(r.Multi) < 2 || strings.ToUpper(string(r.Multi[1].Value)) != "SLEEP" {
+		return redis.NewErrorf("ERR DEBUG subcommand is not allowed")
+	}
+	var max = s.config.DebugSleepMaxDuration.Duration()
+	switch {
+	case max == 0:
+		return redis.NewErrorf("ERR DEBUG SLEEP is disabled")
+	case len(r.Multi) != 3:
+		return redis.NewErrorf("ERR wrong number of arguments for 'DEBUG SLEEP' command")
+	}
+	// ParseFloat accepts "nan" and "inf", comparisons are written so that NaN
+	// fails the range check instead of slipping through.
+	seconds, err := strconv.ParseFloat(string(r.Multi[2].Value), 64)
+	switch {
+	case err != nil || !(seconds >= 0):
+		return redis.NewErrorf("ERR value is not a valid float")
+	case !(seconds <= max.Seconds()):
+		r.Multi[2] = redis.NewBulkBytes([]byte(strconv.FormatFloat(max.Seconds(), 'f', -1, 64)))
+	}
+	return nil
+}
+
+func (s *Session) groupKeysBySlot(r *Request, d *Router, step int) [][]int {
+	var groups [][]int
+	var index = make(map[int]int)
+	for i := 1; i < len(r.Multi); i += step {
+		id := d.hashSlot(r.Multi[i].Value)
+		if g, ok := index[id]; ok {
+			groups[g] = append(groups[g], i)
+		} else {
+			index[id] = len(groups)
+			groups = append(groups, []int{i})
+		}
+	}
+	return groups
+}
+
+func (s *Session) dispatchKeysBySlot(r *Request, d *Router, groups [][]int, step int) ([]Request, error) {
+	var sub = r.MakeSubRequest(len(groups))
+	for i, group := range groups {
+		multi := make([]*redis.Resp, 0, 1+len(group)*step)
+		multi = append(multi, r.Multi[0])
+		for _, j := range group {
+			multi = append(multi, r.Multi[j:j+step]...)
+		}
+		sub[i].Multi = multi
+		if err := d.dispatch(&sub[i]); err != nil {
+			return nil, err
+		}
+	}
+	return sub, nil
+}
+
 func (s *Session) handleRequestMGet(r *Request, d *Router) error {
 	var nkeys = len(r.Multi) - 1
 	switch {
@@ -396,18 +864,16 @@ func (s *Session) handleRequestMGet(r *Request, d *Router) error {
 	case nkeys == 1:
 		return d.dispatch(r)
 	}
-	var sub = r.MakeSubRequest(nkeys)
-	for i := range sub {
-		sub[i].Multi = []*redis.Resp{
-			r.Multi[0],
-			r.Multi[i+1],
-		}
-		if err := d.dispatch(&sub[i]); err != nil {
-			return err
-		}
+	var groups = s.groupKeysBySlot(r, d, 1)
+	if len(groups) == 1 {
+		return d.dispatch(r)
+	}
+	sub, err := s.dispatchKeysBySlot(r, d, groups, 1)
+	if err != nil {
+		return err
 	}
 	r.Coalesce = func() error {
-		var array = make([]*redis.Resp, len(sub))
+		var array = make([]*redis.Resp, nkeys)
 		for i := range sub {
 			if err := sub[i].Err; err != nil {
 				return err
@@ -415,8 +881,10 @@ func (s *Session) handleRequestMGet(r *Request, d *Router) error {
 			switch resp := sub[i].Resp; {
 			case resp == nil:
 				return ErrRespIsRequired
-			case resp.IsArray() && len(resp.Array) == 1:
-				array[i] = resp.Array[0]
+			case resp.IsArray() && len(resp.Array) == len(groups[i]):
+				for j, k := range groups[i] {
+					array[k-1] = resp.Array[j]
+				}
 			default:
 				return fmt.Errorf("bad mget resp: %s array.len = %d", resp.Type, len(resp.Array))
 			}
@@ -436,16 +904,13 @@ func (s *Session) handleRequestMSet(r *Request, d *Router) error {
 	case nblks == 2:
 		return d.dispatch(r)
 	}
-	var sub = r.MakeSubRequest(nblks / 2)
-	for i := range sub {
-		sub[i].Multi = []*redis.Resp{
-			r.Multi[0],
-			r.Multi[i*2+1],
-			r.Multi[i*2+2],
-		}
-		if err := d.dispatch(&sub[i]); err != nil {
-			return err
-		}
+	var groups = s.groupKeysBySlot(r, d, 2)
+	if len(groups) == 1 {
+		return d.dispatch(r)
+	}
+	sub, err := s.dispatchKeysBySlot(r, d, groups, 2)
+	if err != nil {
+		return err
 	}
 	r.Coalesce = func() error {
 		for i := range sub {
@@ -466,27 +931,41 @@ func (s *Session) handleRequestMSet(r *Request, d *Router) error {
 	return nil
 }
 
-func (s *Session) handleRequestDel(r *Request, d *Router) error {
+func (s *Session) handleRequestMSetNX(r *Request, d *Router) error {
+	var nblks = len(r.Multi) - 1
+	switch {
+	case nblks == 0 || nblks%2 != 0:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'MSETNX' command")
+		return nil
+	case nblks == 2:
+		return d.dispatch(r)
+	}
+	if len(s.groupKeysBySlot(r, d, 2)) != 1 {
+		r.Resp = RespCrossSlot
+		return nil
+	}
+	return d.dispatch(r)
+}
+
+func (s *Session) handleRequestKeysSum(r *Request, d *Router) error {
 	var nkeys = len(r.Multi) - 1
 	switch {
 	case nkeys == 0:
-		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'DEL' command")
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for '%s' command", r.OpStr)
 		return nil
 	case nkeys == 1:
 		return d.dispatch(r)
 	}
-	var sub = r.MakeSubRequest(nkeys)
-	for i := range sub {
-		sub[i].Multi = []*redis.Resp{
-			r.Multi[0],
-			r.Multi[i+1],
-		}
-		if err := d.dispatch(&sub[i]); err != nil {
-			return err
-		}
+	var groups = s.groupKeysBySlot(r, d, 1)
+	if len(groups) == 1 {
+		return d.dispatch(r)
+	}
+	sub, err := s.dispatchKeysBySlot(r, d, groups, 1)
+	if err != nil {
+		return err
 	}
 	r.Coalesce = func() error {
-		var n int
+		var n int64
 		for i := range sub {
 			if err := sub[i].Err; err != nil {
 				return err
@@ -494,57 +973,213 @@ func (s *Session) handleRequestDel(r *Request, d *Router) error {
 			switch resp := sub[i].Resp; {
 			case resp == nil:
 				return ErrRespIsRequired
-			case resp.IsInt() && len(resp.Value) == 1:
-				n += int(resp.Value[0] - '0')
+			case resp.IsInt():
+				v, err := redis.Btoi64(resp.Value)
+				if err != nil {
+					return fmt.Errorf("bad %s resp: %s", strings.ToLower(r.OpStr), err)
+				}
+				n += v
 			default:
-				return fmt.Errorf("bad del resp: %s value.len = %d", resp.Type, len(resp.Value))
+				return fmt.Errorf("bad %s resp: %s value.len = %d", strings.ToLower(r.OpStr), resp.Type, len(resp.Value))
 			}
 		}
-		r.Resp = redis.NewInt(strconv.AppendInt(nil, int64(n), 10))
+		r.Resp = redis.NewInt(strconv.AppendInt(nil, n, 10))
 		return nil
 	}
 	return nil
 }
 
-func (s *Session) handleRequestExists(r *Request, d *Router) error {
-	var nkeys = len(r.Multi) - 1
+func (s *Session) handleRequestGeoSearchStore(r *Request, d *Router) error {
+	if len(r.Multi) < 3 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'GEOSEARCHSTORE' command")
+		return nil
+	}
+	if d.hashSlot(r.Multi[1].Value) != d.hashSlot(r.Multi[2].Value) {
+		r.Resp = RespCrossSlot
+		return nil
+	}
+	return d.dispatch(r)
+}
+
+func (s *Session) handleRequestBitOp(r *Request, d *Router) error {
+	if len(r.Multi) < 4 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'bitop' command")
+		return nil
+	}
+	var keys = r.Multi[2:]
+	for _, key := range keys {
+		if d.hashSlot(key.Value) != d.hashSlot(keys[0].Value) {
+			r.Resp = RespCrossSlot
+			return nil
+		}
+	}
+	s.lastWriteSlot = d.hashSlot(keys[0].Value)
+	return d.dispatch(r)
+}
+
+func (s *Session) handleRequestEval(r *Request, d *Router) error {
+	return s.handleRequestNumKeys(r, d, 2)
+}
+
+// handleRequestNumKeys handles commands like EVAL or LMPOP, whose keys follow
+// the number of keys at r.Multi[i]. All of the keys must be in the same slot.
+func (s *Session) handleRequestNumKeys(r *Request, d *Router, i int) error {
+	if len(r.Multi) <= i {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for '%s' command", strings.ToLower(r.OpStr))
+		return nil
+	}
+	numkeys, err := strconv.Atoi(string(r.Multi[i].Value))
 	switch {
-	case nkeys == 0:
-		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'EXISTS' command")
+	case err != nil:
+		r.Resp = redis.NewErrorf("ERR value is not an integer or out of range")
+		return nil
+	case numkeys < 0:
+		r.Resp = redis.NewErrorf("ERR Number of keys can't be negative")
+		return nil
+	case numkeys > len(r.Multi)-i-1:
+		r.Resp = redis.NewErrorf("ERR Number of keys can't be greater than number of args")
 		return nil
-	case nkeys == 1:
-		return d.dispatch(r)
 	}
-	var sub = r.MakeSubRequest(nkeys)
-	for i := range sub {
-		sub[i].Multi = []*redis.Resp{
-			r.Multi[0],
-			r.Multi[i+1],
+	var keys = r.Multi[i+1 : i+1+numkeys]
+	for _, key := range keys {
+		if d.hashSlot(key.Value) != d.hashSlot(keys[0].Value) {
+			r.Resp = RespCrossSlot
+			return nil
 		}
-		if err := d.dispatch(&sub[i]); err != nil {
-			return err
+	}
+	if !r.OpFlag.IsReadOnly() {
+		s.lastWriteSlot = d.hashSlot(getHashKey(r.Multi, r.OpStr))
+	}
+	return d.dispatch(r)
+}
+
+func (s *Session) handleRequestGeoRadius(r *Request, d *Router) error {
+	// Options follow "key longitude latitude radius unit" for GEORADIUS, and
+	// "key member radius unit" for GEORADIUSBYMEMBER.
+	var i = 6
+	if r.OpStr == "GEORADIUSBYMEMBER" {
+		i = 5
+	}
+	if len(r.Multi) < i {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for '%s' command", strings.ToLower(r.OpStr))
+		return nil
+	}
+	var id = d.hashSlot(r.Multi[1].Value)
+	for ; i < len(r.Multi); i++ {
+		switch strings.ToUpper(string(r.Multi[i].Value)) {
+		case "STORE", "STOREDIST":
+			if i+1 < len(r.Multi) && d.hashSlot(r.Multi[i+1].Value) != id {
+				r.Resp = RespCrossSlot
+				return nil
+			}
+			i++
 		}
 	}
-	r.Coalesce = func() error {
-		var n int
-		for i := range sub {
-			if err := sub[i].Err; err != nil {
-				return err
+	s.lastWriteSlot = id
+	return d.dispatch(r)
+}
+
+func (s *Session) handleRequestCopy(r *Request, d *Router) error {
+	if len(r.Multi) < 3 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'COPY' command")
+		return nil
+	}
+	var database, selected, replace = r.Database, false, false
+	for i := 3; i < len(r.Multi); i++ {
+		switch strings.ToUpper(string(r.Multi[i].Value)) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 == len(r.Multi) {
+				r.Resp = redis.NewErrorf("ERR syntax error")
+				return nil
 			}
-			switch resp := sub[i].Resp; {
-			case resp == nil:
-				return ErrRespIsRequired
-			case resp.IsInt() && len(resp.Value) == 1:
-				if resp.Value[0] != '0' {
-					n++
-				}
-			default:
-				return fmt.Errorf("bad exists resp: %s value.len = %d", resp.Type, len(resp.Value))
+			i++
+			db, err := strconv.Atoi(string(r.Multi[i].Value))
+			if err != nil || db < 0 || db >= int(s.config.BackendNumberDatabases) {
+				r.Resp = redis.NewErrorf("ERR invalid DB index")
+				return nil
 			}
+			database, selected = int32(db), true
+		default:
+			r.Resp = redis.NewErrorf("ERR syntax error")
+			return nil
+		}
+	}
+	if d.hashSlot(r.Multi[1].Value) == d.hashSlot(r.Multi[2].Value) {
+		return d.dispatch(r)
+	}
+	if selected && !s.config.AllowSelect {
+		r.Resp = redis.NewErrorf("ERR COPY with DB option across slots is not allowed")
+		return nil
+	}
+
+	// Keys of different slots are copied with DUMP and RESTORE, which is not
+	// atomic: the source may be changed or expire in between. The source is
+	// always read from the master, so the copy is never older than a write
+	// acknowledged before COPY.
+	var sub = r.MakeSubRequest(2)
+	for i, opstr := range []string{"DUMP", "PTTL"} {
+		sub[i].Multi = []*redis.Resp{redis.NewBulkBytes([]byte(opstr)), r.Multi[1]}
+		sub[i].OpStr, sub[i].OpFlag = opstr, opTable[opstr].Flag|FlagMasterOnly
+		if err := d.dispatch(&sub[i]); err != nil {
+			return err
+		}
+	}
+	// The copy is finished before the next request of the session is
+	// handled, so that pipelined requests reading the target see it.
+	r.Batch.Wait()
+
+	for i := range sub {
+		if err := sub[i].Err; err != nil {
+			return err
 		}
-		r.Resp = redis.NewInt(strconv.AppendInt(nil, int64(n), 10))
+		switch resp := sub[i].Resp; {
+		case resp == nil:
+			return ErrRespIsRequired
+		case resp.IsError():
+			r.Resp = resp
+			return nil
+		}
+	}
+	var dump, pttl = sub[0].Resp, sub[1].Resp
+	if dump.Value == nil {
+		r.Resp = redis.NewInt([]byte("0"))
 		return nil
 	}
+	var ttl = pttl.Value
+	if len(ttl) == 0 || ttl[0] == '-' {
+		ttl = []byte("0")
+	}
+
+	var x = &r.MakeSubRequest(1)[0]
+	x.Multi = []*redis.Resp{
+		redis.NewBulkBytes([]byte("RESTORE")), r.Multi[2],
+		redis.NewBulkBytes(ttl), dump,
+	}
+	if replace {
+		x.Multi = append(x.Multi, redis.NewBulkBytes([]byte("REPLACE")))
+	}
+	x.OpStr, x.OpFlag = "RESTORE", opTable["RESTORE"].Flag
+	x.Batch = &sync.WaitGroup{}
+	x.Database = database
+	if err := d.dispatch(x); err != nil {
+		return err
+	}
+	x.Batch.Wait()
+
+	switch resp := x.Resp; {
+	case x.Err != nil:
+		return x.Err
+	case resp == nil:
+		return ErrRespIsRequired
+	case resp.IsError() && strings.HasPrefix(string(resp.Value), "BUSYKEY"):
+		r.Resp = redis.NewInt([]byte("0"))
+	case resp.IsError():
+		r.Resp = resp
+	default:
+		r.Resp = redis.NewInt([]byte("1"))
+	}
 	return nil
 }
 
@@ -649,7 +1284,10 @@ func (s *Session) getOpStats(opstr string) *opStats {
 func (s *Session) incrOpStats(r *Request, t redis.RespType) {
 	e := s.getOpStats(r.OpStr)
 	e.calls.Incr()
-	e.nsecs.Add(time.Now().UnixNano() - r.UnixNano)
+	d := time.Now().UnixNano() - r.UnixNano
+	e.nsecs.Add(d)
+	e.incrLatency(time.Duration(d))
+	incrCommandStats(r.OpStr, time.Duration(d))
 	switch t {
 	case redis.TypeError:
 		e.redis.errors.Incr()
@@ -0,0 +1,129 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// Redis Cluster clients hash keys with crc16 into 16384 slots, which can't be
+// mapped onto codis slots, so the proxy presents itself as a single master
+// that serves all of them and routes keys as usual.
+const clusterSlots = 16384
+
+func (s *Session) handleRequestCluster(r *Request, d *Router) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'CLUSTER' command")
+		return nil
+	}
+	var subcmd = strings.ToUpper(string(r.Multi[1].Value))
+	var nargs = 2
+	if subcmd == "KEYSLOT" {
+		nargs = 3
+	}
+	if len(r.Multi) != nargs {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'CLUSTER|%s' command", subcmd)
+		return nil
+	}
+	var addr = s.clusterAddr()
+	switch subcmd {
+	case "INFO":
+		r.Resp = redis.NewBulkBytes(clusterInfo(d))
+	case "NODES":
+		r.Resp = redis.NewBulkBytes([]byte(fmt.Sprintf("%s %s@0 myself,master - 0 0 0 connected 0-%d\n",
+			clusterNodeId(addr), addr, clusterSlots-1)))
+	case "MYID":
+		r.Resp = redis.NewBulkBytes([]byte(clusterNodeId(addr)))
+	case "SLOTS":
+		host, port, _ := net.SplitHostPort(addr)
+		r.Resp = redis.NewArray([]*redis.Resp{
+			redis.NewArray([]*redis.Resp{
+				redis.NewInt([]byte("0")),
+				redis.NewInt([]byte(strconv.Itoa(clusterSlots - 1))),
+				redis.NewArray([]*redis.Resp{
+					redis.NewBulkBytes([]byte(host)),
+					redis.NewInt([]byte(port)),
+					redis.NewBulkBytes([]byte(clusterNodeId(addr))),
+				}),
+			}),
+		})
+	case "KEYSLOT":
+		var slot = crc16(hashTag(r.Multi[2].Value)) % clusterSlots
+		r.Resp = redis.NewInt(strconv.AppendUint(nil, uint64(slot), 10))
+	default:
+		r.Resp = redis.NewErrorf("ERR unknown subcommand '%s' for 'CLUSTER' command", r.Multi[1].Value)
+	}
+	return nil
+}
+
+// clusterAddr returns the address clients should connect to, which is the
+// one registered for the proxy rather than the one the session happened to
+// reach, since that may be behind NAT or bound to an unspecified ip.
+func (s *Session) clusterAddr() string {
+	if p := s.proxy; p != nil {
+		if addr := p.Model().ProxyAddr; addr != "" {
+			return addr
+		}
+	}
+	if s.Conn != nil {
+		return s.Conn.LocalAddr()
+	}
+	return ""
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum used by Redis Cluster.
+func crc16(buf []byte) uint16 {
+	var crc uint16
+	for _, b := range buf {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func clusterNodeId(addr string) string {
+	var sum = sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+func clusterInfo(d *Router) []byte {
+	var assigned int
+	for _, m := range d.GetSlots() {
+		if m.BackendAddr != "" {
+			assigned++
+		}
+	}
+	var state = "ok"
+	if assigned != MaxSlotNum {
+		state = "fail"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "cluster_enabled:1\r\n")
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", clusterSlots)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", clusterSlots)
+	fmt.Fprintf(&b, "cluster_slots_pfail:0\r\n")
+	fmt.Fprintf(&b, "cluster_slots_fail:0\r\n")
+	fmt.Fprintf(&b, "cluster_known_nodes:1\r\n")
+	fmt.Fprintf(&b, "cluster_size:1\r\n")
+	fmt.Fprintf(&b, "cluster_current_epoch:0\r\n")
+	fmt.Fprintf(&b, "cluster_my_epoch:0\r\n")
+	fmt.Fprintf(&b, "codis_slots:%d\r\n", MaxSlotNum)
+	fmt.Fprintf(&b, "codis_slots_assigned:%d\r\n", assigned)
+	return b.Bytes()
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// handleRequestCommand serves COMMAND, COMMAND COUNT, INFO and DOCS from the
+// commandTable, so clients only see the commands the proxy accepts. Other
+// subcommands like GETKEYS are sent to the backend of any_backend_slot.
+func (s *Session) handleRequestCommand(r *Request, d *Router) error {
+	if len(r.Multi) == 1 {
+		var names []string
+		for name := range commandTable {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		r.Resp = redis.NewArray(commandInfoReplies(names))
+		return nil
+	}
+	switch strings.ToUpper(string(r.Multi[1].Value)) {
+	case "COUNT":
+		r.Resp = redis.NewInt(strconv.AppendInt(nil, int64(len(commandTable)), 10))
+	case "INFO":
+		var names []string
+		for _, arg := range r.Multi[2:] {
+			names = append(names, strings.ToUpper(string(arg.Value)))
+		}
+		r.Resp = redis.NewArray(commandInfoReplies(names))
+	case "DOCS":
+		var array []*redis.Resp
+		for _, arg := range r.Multi[2:] {
+			name := strings.ToUpper(string(arg.Value))
+			info, ok := commandTable[name]
+			if !ok {
+				continue
+			}
+			var docs = []*redis.Resp{
+				redis.NewBulkBytes([]byte("summary")), redis.NewBulkBytes([]byte(info.Summary)),
+			}
+			if info.Since != "" {
+				docs = append(docs,
+					redis.NewBulkBytes([]byte("since")), redis.NewBulkBytes([]byte(info.Since)))
+			}
+			docs = append(docs,
+				redis.NewBulkBytes([]byte("group")), redis.NewBulkBytes([]byte(getCommandFamily(name).String())))
+			if s.resp3 {
+				array = append(array, redis.NewBulkBytes([]byte(strings.ToLower(name))), redis.NewMap(docs))
+			} else {
+				array = append(array, redis.NewBulkBytes([]byte(strings.ToLower(name))), redis.NewArray(docs))
+			}
+		}
+		if s.resp3 {
+			r.Resp = redis.NewMap(array)
+		} else {
+			r.Resp = redis.NewArray(array)
+		}
+	default:
+		return d.dispatchSlot(r, s.config.AnyBackendSlot)
+	}
+	return nil
+}
+
+// objectHelpNotes are appended to the reply of OBJECT HELP from the backend,
+// so operators can tell the subcommands answered by the proxy from the ones
+// answered by backends.
+var objectHelpNotes = []string{
+	"(codis-proxy) Subcommands handled by the proxy:",
+	"ENCODING <key>",
+	"    Answered from the proxy's encoding cache if enable_encoding_cache is set and the key",
+	"    has a hint, inferred from SET/GET or given by PROXY HINT ENCODING; otherwise by the backend.",
+	"(codis-proxy) Subcommands handled by backends:",
+	"FREQ|IDLETIME|REFCOUNT|ENCODING <key>",
+	"    Sent to the backend of the key's slot. While the slot is migrating, the migration target",
+	"    is asked first and then the source, the key is never migrated by OBJECT.",
+}
+
+func (s *Session) handleRequestObjectHelp(r *Request, d *Router) error {
+	if err := d.dispatchSlot(r, s.config.AnyBackendSlot); err != nil {
+		return err
+	}
+	r.Coalesce = func() error {
+		if r.Resp == nil || !r.Resp.IsArray() {
+			return nil
+		}
+		var array = append([]*redis.Resp(nil), r.Resp.Array...)
+		for _, line := range objectHelpNotes {
+			array = append(array, redis.NewString([]byte(line)))
+		}
+		r.Resp = redis.NewArray(array)
+		return nil
+	}
+	return nil
+}
+
+// commandInfoReplies returns the COMMAND INFO reply of each command, or a
+// nil array if the command is unknown.
+func commandInfoReplies(names []string) []*redis.Resp {
+	var array = make([]*redis.Resp, len(names))
+	for i, name := range names {
+		info, ok := commandTable[name]
+		if !ok {
+			array[i] = redis.NewArray(nil)
+			continue
+		}
+		var flags []*redis.Resp
+		for _, flag := range commandFlags(name) {
+			flags = append(flags, redis.NewString([]byte(flag)))
+		}
+		array[i] = redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte(strings.ToLower(name))),
+			redis.NewInt(strconv.AppendInt(nil, int64(info.Arity), 10)),
+			redis.NewArray(flags),
+			redis.NewInt(strconv.AppendInt(nil, int64(info.FirstKey), 10)),
+			redis.NewInt(strconv.AppendInt(nil, int64(info.LastKey), 10)),
+			redis.NewInt(strconv.AppendInt(nil, int64(info.Step), 10)),
+		})
+	}
+	return array
+}
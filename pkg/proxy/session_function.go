@@ -0,0 +1,60 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+func (s *Session) handleRequestFunction(r *Request, d *Router) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'function' command")
+		return nil
+	}
+	switch strings.ToUpper(string(r.Multi[1].Value)) {
+	case "LIST", "STATS", "HELP":
+		return d.dispatchSlot(r, s.config.AnyBackendSlot)
+	case "LOAD", "FLUSH", "DELETE", "DUMP", "RESTORE":
+		return s.broadcastRequest(r, d)
+	default:
+		r.Resp = redis.NewErrorf("ERR FUNCTION %s is not supported by proxy", r.Multi[1].Value)
+		return nil
+	}
+}
+
+// broadcastRequest sends r to every primary backend, the reply of the first
+// backend is returned unless any of them fails.
+func (s *Session) broadcastRequest(r *Request, d *Router) error {
+	var addrs = d.getPrimaryAddrs()
+	if len(addrs) == 0 {
+		r.Resp = redis.NewErrorf("ERR no backend available")
+		return nil
+	}
+	var sub = r.MakeSubRequest(len(addrs))
+	for i, addr := range addrs {
+		sub[i].Multi = r.Multi
+		if !d.dispatchAddr(&sub[i], addr) {
+			sub[i].Resp = redis.NewErrorf("ERR backend server '%s' not found", addr)
+		}
+	}
+	r.Coalesce = func() error {
+		for i := range sub {
+			if err := sub[i].Err; err != nil {
+				return err
+			}
+			switch resp := sub[i].Resp; {
+			case resp == nil:
+				return ErrRespIsRequired
+			case resp.IsError():
+				r.Resp = resp
+				return nil
+			}
+		}
+		r.Resp = sub[0].Resp
+		return nil
+	}
+	return nil
+}
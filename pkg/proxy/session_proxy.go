@@ -0,0 +1,461 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+func (s *Session) handleRequestProxy(r *Request, d *Router) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY' command")
+		return nil
+	}
+	var subcmd = strings.ToUpper(string(r.Multi[1].Value))
+	if isProxyAdminCommand(subcmd, r.Multi) && !s.admin {
+		if !s.config.EnableProxyAdminCommands {
+			r.Resp = redis.NewErrorf("ERR 'PROXY %s' is disabled, see enable_proxy_admin_commands", subcmd)
+		} else {
+			r.Resp = redis.NewErrorf("NOPERM 'PROXY %s' requires PROXY AUTH", subcmd)
+		}
+		return nil
+	}
+	switch subcmd {
+	case "AUTH":
+		return s.handleProxyAuth(r, d)
+	case "READ":
+		return s.handleProxyRead(r, d)
+	case "SLOWLOG":
+		return s.handleProxySlowLog(r, d)
+	case "INFO":
+		return s.handleProxyInfo(r, d)
+	case "STATS":
+		return s.handleProxyStats(r, d)
+	case "RESET-BACKEND":
+		return s.handleProxyResetBackend(r, d)
+	case "KILL":
+		return s.handleProxyKill(r, d)
+	case "DRAIN":
+		return s.handleProxyDrain(r, d)
+	case "REQUEST-ID":
+		return s.handleProxyRequestID(r, d)
+	case "SLOTS-RELOAD":
+		return s.handleProxySlotsReload(r, d)
+	case "VERSION":
+		return s.handleProxyVersion(r, d)
+	case "HINT":
+		return s.handleProxyHint(r, d)
+	case "MIGRATE-KEY":
+		return s.handleProxyMigrateKey(r, d)
+	case "LOGLEVEL":
+		return s.handleProxyLogLevel(r, d)
+	default:
+		r.Resp = redis.NewErrorf("ERR unknown subcommand '%s' for 'PROXY' command", r.Multi[1].Value)
+		return nil
+	}
+}
+
+// isProxyAdminCommand returns true if PROXY subcmd changes the state of the
+// proxy rather than of the session, which requires PROXY AUTH.
+func isProxyAdminCommand(subcmd string, multi []*redis.Resp) bool {
+	switch subcmd {
+	case "DRAIN", "KILL", "RESET-BACKEND", "SLOTS-RELOAD", "MIGRATE-KEY":
+		return true
+	case "LOGLEVEL":
+		return len(multi) > 2
+	case "STATS", "SLOWLOG":
+		return len(multi) > 2 && strings.ToUpper(string(multi[2].Value)) == "RESET"
+	}
+	return false
+}
+
+// handleProxyAuth handles PROXY AUTH <product_auth>, which grants the session
+// the PROXY subcommands that change the state of the proxy.
+func (s *Session) handleProxyAuth(r *Request, d *Router) error {
+	switch {
+	case len(r.Multi) != 3:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY AUTH' command")
+	case !s.config.EnableProxyAdminCommands:
+		r.Resp = redis.NewErrorf("ERR 'PROXY AUTH' is disabled, see enable_proxy_admin_commands")
+	case s.config.ProductAuth == "":
+		r.Resp = redis.NewErrorf("ERR Client sent PROXY AUTH, but product_auth is not set")
+	case !equalSecret(s.config.ProductAuth, string(r.Multi[2].Value)):
+		s.admin = false
+		incrSessionsAuthFailed()
+		time.Sleep(authFailureDelay)
+		r.Resp = redis.NewErrorf("ERR invalid password")
+	default:
+		s.admin = true
+		r.Resp = RespOK
+	}
+	return nil
+}
+
+func (s *Session) handleProxyRead(r *Request, d *Router) error {
+	switch len(r.Multi) {
+	case 2:
+		r.Resp = redis.NewBulkBytes([]byte(s.readPreference.String()))
+	case 3:
+		if p, ok := ParseReadPreference(string(r.Multi[2].Value)); !ok {
+			r.Resp = redis.NewErrorf("ERR invalid read preference '%s'", r.Multi[2].Value)
+		} else {
+			s.readPreference = p
+			r.Resp = RespOK
+		}
+	default:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY READ' command")
+	}
+	return nil
+}
+
+func (s *Session) handleProxyLogLevel(r *Request, d *Router) error {
+	switch len(r.Multi) {
+	case 2:
+		r.Resp = redis.NewBulkBytes([]byte(strings.ToLower(log.GetLevel().String())))
+	case 3:
+		if err := d.SetLogLevel(string(r.Multi[2].Value)); err != nil {
+			r.Resp = redis.NewErrorf("ERR invalid log level '%s'", r.Multi[2].Value)
+		} else {
+			r.Resp = RespOK
+		}
+	default:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY LOGLEVEL' command")
+	}
+	return nil
+}
+
+func (s *Session) handleProxyRequestID(r *Request, d *Router) error {
+	switch len(r.Multi) {
+	case 2:
+		r.Resp = redis.NewBulkBytes([]byte(s.requestID))
+	case 3:
+		var id = string(r.Multi[2].Value)
+		if strings.ContainsAny(id, " \t\r\n") {
+			r.Resp = redis.NewErrorf("ERR request id cannot contain spaces or newlines")
+			return nil
+		}
+		s.requestID = id
+		r.Resp = RespOK
+	default:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY REQUEST-ID' command")
+	}
+	return nil
+}
+
+func (s *Session) handleProxySlowLog(r *Request, d *Router) error {
+	if len(r.Multi) < 3 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY SLOWLOG' command")
+		return nil
+	}
+	switch strings.ToUpper(string(r.Multi[2].Value)) {
+	case "GET":
+		var n = 10
+		switch len(r.Multi) {
+		case 3:
+		case 4:
+			v, err := strconv.Atoi(string(r.Multi[3].Value))
+			if err != nil {
+				r.Resp = redis.NewErrorf("ERR value is not an integer or out of range")
+				return nil
+			}
+			n = v
+		default:
+			r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY SLOWLOG GET' command")
+			return nil
+		}
+		var array = []*redis.Resp{}
+		for _, e := range d.slowlog.Get(n) {
+			var command []*redis.Resp
+			for _, arg := range e.Command {
+				command = append(command, redis.NewBulkBytes([]byte(arg)))
+			}
+			array = append(array, redis.NewArray([]*redis.Resp{
+				redis.NewInt(strconv.AppendInt(nil, e.Id, 10)),
+				redis.NewInt(strconv.AppendInt(nil, e.Timestamp.Unix(), 10)),
+				redis.NewInt(strconv.AppendInt(nil, int64(e.Latency/time.Microsecond), 10)),
+				redis.NewArray(command),
+				redis.NewBulkBytes([]byte(e.Client)),
+				redis.NewBulkBytes([]byte(e.Key)),
+				redis.NewBulkBytes([]byte(e.Backend)),
+				redis.NewInt(strconv.AppendInt(nil, int64(e.Retries), 10)),
+			}))
+		}
+		r.Resp = redis.NewArray(array)
+	case "LEN":
+		r.Resp = redis.NewInt(strconv.AppendInt(nil, int64(d.slowlog.Len()), 10))
+	case "RESET":
+		d.slowlog.Reset()
+		r.Resp = RespOK
+	default:
+		r.Resp = redis.NewErrorf("ERR unknown subcommand '%s' for 'PROXY SLOWLOG' command", r.Multi[2].Value)
+	}
+	return nil
+}
+
+func (s *Session) handleProxyStats(r *Request, d *Router) error {
+	if len(r.Multi) != 3 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY STATS' command")
+		return nil
+	}
+	switch strings.ToUpper(string(r.Multi[2].Value)) {
+	case "RESET":
+		ResetStats()
+		r.Resp = RespOK
+	default:
+		r.Resp = redis.NewErrorf("ERR unknown subcommand '%s' for 'PROXY STATS' command", r.Multi[2].Value)
+	}
+	return nil
+}
+
+func (s *Session) handleProxyResetBackend(r *Request, d *Router) error {
+	if len(r.Multi) != 3 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY RESET-BACKEND' command")
+		return nil
+	}
+	if !d.ResetBackend(string(r.Multi[2].Value)) {
+		r.Resp = redis.NewErrorf("ERR backend server '%s' not found", r.Multi[2].Value)
+		return nil
+	}
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) handleProxyKill(r *Request, d *Router) error {
+	if len(r.Multi) != 4 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY KILL' command")
+		return nil
+	}
+	switch strings.ToUpper(string(r.Multi[2].Value)) {
+	case "CLIENT":
+		if d.KillClient(string(r.Multi[3].Value)) {
+			r.Resp = redis.NewInt([]byte("1"))
+		} else {
+			r.Resp = redis.NewInt([]byte("0"))
+		}
+	default:
+		r.Resp = redis.NewErrorf("ERR unknown subcommand '%s' for 'PROXY KILL' command", r.Multi[2].Value)
+	}
+	return nil
+}
+
+func (s *Session) handleProxyDrain(r *Request, d *Router) error {
+	var timeout = s.config.ProxyDrainTimeout.Duration()
+	switch {
+	case len(r.Multi) == 2:
+	case len(r.Multi) == 4 && strings.ToUpper(string(r.Multi[2].Value)) == "TIMEOUT":
+		n, err := strconv.Atoi(string(r.Multi[3].Value))
+		if err != nil || n <= 0 {
+			r.Resp = redis.NewErrorf("ERR invalid timeout '%s'", r.Multi[3].Value)
+			return nil
+		}
+		timeout = time.Duration(n) * time.Second
+	default:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY DRAIN' command")
+		return nil
+	}
+	if s.proxy == nil {
+		r.Resp = redis.NewErrorf("ERR proxy is not available")
+		return nil
+	}
+	if err := s.proxy.Drain(timeout); err != nil {
+		r.Resp = redis.NewErrorf("ERR %s", err)
+		return nil
+	}
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) handleProxySlotsReload(r *Request, d *Router) error {
+	if len(r.Multi) != 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY SLOTS-RELOAD' command")
+		return nil
+	}
+	if s.proxy == nil {
+		r.Resp = redis.NewErrorf("ERR proxy is not available")
+		return nil
+	}
+	if err := s.proxy.ReloadSlots(); err != nil {
+		r.Resp = redis.NewErrorf("ERR %s", err)
+		return nil
+	}
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) handleProxyMigrateKey(r *Request, d *Router) error {
+	if len(r.Multi) != 4 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY MIGRATE-KEY' command")
+		return nil
+	}
+	id, err := strconv.Atoi(string(r.Multi[2].Value))
+	if err != nil {
+		r.Resp = redis.NewErrorf("ERR invalid slot id '%s'", r.Multi[2].Value)
+		return nil
+	}
+	moved, err := d.MigrateKey(id, s.database, r.Multi[3].Value)
+	switch {
+	case err != nil:
+		r.Resp = redis.NewErrorf("ERR %s", err)
+	case !moved:
+		r.Resp = redis.NewString([]byte("NOKEY"))
+	default:
+		r.Resp = RespOK
+	}
+	return nil
+}
+
+func (s *Session) handleProxyVersion(r *Request, d *Router) error {
+	if len(r.Multi) != 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY VERSION' command")
+		return nil
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "version:%s\r\n", utils.Version)
+	fmt.Fprintf(&b, "compile:%s\r\n", utils.Compile)
+	fmt.Fprintf(&b, "go_version:%s\r\n", runtime.Version())
+	r.Resp = redis.NewBulkBytes(b.Bytes())
+	return nil
+}
+
+func (s *Session) handleProxyInfo(r *Request, d *Router) error {
+	var section = "all"
+	switch len(r.Multi) {
+	case 2:
+	case 3:
+		section = strings.ToLower(string(r.Multi[2].Value))
+	default:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY INFO' command")
+		return nil
+	}
+
+	var b bytes.Buffer
+	var sections = []struct {
+		name  string
+		title string
+		info  func(w io.Writer)
+	}{
+		{"proxy", "Proxy", func(w io.Writer) {
+			fmt.Fprintf(w, "version:%s\r\n", utils.Version)
+			fmt.Fprintf(w, "compile:%s\r\n", utils.Compile)
+			fmt.Fprintf(w, "process_id:%d\r\n", os.Getpid())
+			if p := s.proxy; p != nil {
+				uptime := int64(time.Since(p.start) / time.Second)
+				fmt.Fprintf(w, "uptime_in_seconds:%d\r\n", uptime)
+				fmt.Fprintf(w, "uptime_in_days:%d\r\n", uptime/86400)
+				fmt.Fprintf(w, "product_name:%s\r\n", p.Model().ProductName)
+				fmt.Fprintf(w, "token:%s\r\n", p.Model().Token)
+				fmt.Fprintf(w, "proxy_addr:%s\r\n", p.Model().ProxyAddr)
+				fmt.Fprintf(w, "admin_addr:%s\r\n", p.Model().AdminAddr)
+				fmt.Fprintf(w, "online:%d\r\n", btoi(p.IsOnline()))
+			}
+			fmt.Fprintf(w, "read_only:%d\r\n", btoi(d.IsReadOnly()))
+			fmt.Fprintf(w, "log_level:%s\r\n", strings.ToLower(log.GetLevel().String()))
+		}},
+		{"slots", "Slots", func(w io.Writer) {
+			var locked, migrating, offline int
+			for _, m := range d.GetSlots() {
+				if m.Locked {
+					locked++
+				}
+				if m.MigrateFrom != "" {
+					migrating++
+				}
+				if m.BackendAddr == "" {
+					offline++
+				}
+			}
+			fmt.Fprintf(w, "slots:%d\r\n", MaxSlotNum)
+			fmt.Fprintf(w, "slots_locked:%d\r\n", locked)
+			fmt.Fprintf(w, "slots_migrating:%d\r\n", migrating)
+			fmt.Fprintf(w, "slots_offline:%d\r\n", offline)
+		}},
+		{"backends", "Backends", func(w io.Writer) {
+			var servers = make(map[string]int)
+			var conns, connected int
+			for _, m := range d.getBackendStats() {
+				servers[m.Role]++
+				conns += m.Conns
+				connected += m.Connected
+			}
+			fmt.Fprintf(w, "primary_servers:%d\r\n", servers["primary"])
+			fmt.Fprintf(w, "replica_servers:%d\r\n", servers["replica"])
+			fmt.Fprintf(w, "total_connections:%d\r\n", conns)
+			fmt.Fprintf(w, "connected_connections:%d\r\n", connected)
+		}},
+		{"ha", "HA", func(w io.Writer) {
+			if s.proxy == nil {
+				return
+			}
+			servers, masters := s.proxy.GetSentinels()
+			fmt.Fprintf(w, "sentinels:%s\r\n", strings.Join(servers, ","))
+			var gids []int
+			for gid := range masters {
+				gids = append(gids, gid)
+			}
+			sort.Ints(gids)
+			for _, gid := range gids {
+				fmt.Fprintf(w, "master_group_%d:%s\r\n", gid, masters[gid])
+			}
+			fmt.Fprintf(w, "switched:%d\r\n", btoi(d.HasSwitched()))
+		}},
+		{"clients", "Clients", func(w io.Writer) {
+			fmt.Fprintf(w, "connected_clients:%d\r\n", SessionsAlive())
+			fmt.Fprintf(w, "total_connections_received:%d\r\n", SessionsTotal())
+			fmt.Fprintf(w, "rejected_connections:%d\r\n", SessionsRejected())
+			fmt.Fprintf(w, "blocked_clients:0\r\n")
+			fmt.Fprintf(w, "rate_limited_requests:%d\r\n", d.GetRateLimitedTotal())
+		}},
+	}
+	for _, x := range sections {
+		if section != "all" && section != "default" && section != x.name {
+			continue
+		}
+		if b.Len() != 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", x.title)
+		x.info(&b)
+	}
+	r.Resp = redis.NewBulkBytes(b.Bytes())
+	return nil
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// handleProxyHint handles PROXY HINT ENCODING <key> <encoding>, OBJECT ENCODING
+// of the key is answered by the hint until the key is written.
+func (s *Session) handleProxyHint(r *Request, d *Router) error {
+	if len(r.Multi) != 5 || strings.ToUpper(string(r.Multi[2].Value)) != "ENCODING" {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'PROXY HINT' command")
+		return nil
+	}
+	var hint = strings.ToLower(string(r.Multi[4].Value))
+	switch {
+	case d.encodings == nil:
+		r.Resp = redis.NewErrorf("ERR encoding cache is disabled")
+	case !objectEncodings[hint]:
+		r.Resp = redis.NewErrorf("ERR invalid encoding '%s'", r.Multi[4].Value)
+	default:
+		d.encodings.set(s.database, string(r.Multi[3].Value), hint)
+		r.Resp = RespOK
+	}
+	return nil
+}
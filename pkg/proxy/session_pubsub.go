@@ -0,0 +1,453 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
+)
+
+type pubsubConn struct {
+	*redis.Conn
+
+	addr string
+
+	// peers are subscribed on the other backends, since PUBLISH is routed
+	// by channel and patterns may match channels of any slot. Only messages
+	// are forwarded from them, replies are taken from Conn.
+	peers []*pubsubPeer
+	waits sync.WaitGroup
+
+	keyspace *keyspaceHub
+	fanout   *fanoutHub
+	events   *eventHub
+
+	channels map[string]bool
+	patterns map[string]bool
+
+	started bool
+	leaving bool
+	resp3   bool
+
+	done    chan struct{}
+	closing atomic2.Int64
+	quit    atomic2.Bool
+}
+
+type pubsubPeer struct {
+	*redis.Conn
+
+	addr string
+}
+
+func newPubSubConn(addrs []string, config *Config) (*pubsubConn, error) {
+	var peers []*pubsubPeer
+	for _, addr := range addrs {
+		c, err := dialPubSub(addr, config)
+		if err != nil {
+			for _, p := range peers {
+				p.Close()
+			}
+			return nil, err
+		}
+		peers = append(peers, &pubsubPeer{Conn: c, addr: addr})
+	}
+	return &pubsubConn{
+		Conn: peers[0].Conn, addr: peers[0].addr, peers: peers[1:],
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func dialPubSub(addr string, config *Config) (*redis.Conn, error) {
+	c, err := dialBackend(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	c.WriterTimeout = config.BackendSendTimeout.Duration()
+	c.SetKeepAlivePeriod(config.BackendKeepAlivePeriod.Duration())
+
+	if err := verifyAuth(c, config); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (pc *pubsubConn) Close() error {
+	switch {
+	case pc.keyspace != nil:
+		pc.keyspace.Remove(pc)
+		return nil
+	case pc.fanout != nil:
+		pc.fanout.Remove(pc)
+		return nil
+	case pc.events != nil:
+		pc.events.Remove(pc)
+		return nil
+	}
+	for _, p := range pc.peers {
+		p.Close()
+	}
+	return pc.Conn.Close()
+}
+
+// IsLocal returns true if the subscriptions are served by a hub of the router
+// rather than a dedicated backend connection.
+func (pc *pubsubConn) IsLocal() bool {
+	return pc.keyspace != nil || pc.fanout != nil || pc.events != nil
+}
+
+func (pc *pubsubConn) Count() int {
+	return len(pc.channels) + len(pc.patterns)
+}
+
+func (pc *pubsubConn) track(opstr string, args []*redis.Resp) {
+	var set = pc.channels
+	switch opstr {
+	case "PSUBSCRIBE", "PUNSUBSCRIBE":
+		set = pc.patterns
+	}
+	switch opstr {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		for _, m := range args {
+			set[string(m.Value)] = true
+		}
+		return
+	}
+	if pc.Count() == 0 {
+		return
+	}
+	// The backend replies with a zero subscription count once for each
+	// argument processed after the last subscription is dropped, the
+	// reader uses it to consume exactly the replies that are left.
+	var zeros int64
+	if len(args) == 0 {
+		for k := range set {
+			delete(set, k)
+		}
+		if pc.Count() == 0 {
+			zeros = 1
+		}
+	} else {
+		for _, m := range args {
+			delete(set, string(m.Value))
+			if pc.Count() == 0 {
+				zeros++
+			}
+		}
+	}
+	if zeros != 0 {
+		pc.leaving = true
+		pc.closing.Set(zeros)
+	}
+}
+
+func (s *Session) handleRequestSubscribe(r *Request, d *Router) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for '%s' command", strings.ToLower(r.OpStr))
+		return nil
+	}
+	if isKeyspaceChannel(r.Multi[1].Value) {
+		s.pubsub = &pubsubConn{
+			keyspace: d.keyspace,
+			resp3:    s.resp3,
+			channels: make(map[string]bool),
+			patterns: make(map[string]bool),
+			done:     make(chan struct{}),
+		}
+		s.Conn.ReaderTimeout = 0
+		return s.handlePubSub(r)
+	}
+	if s.isEventChannel(r.Multi[1].Value) {
+		s.pubsub = &pubsubConn{
+			events:   d.events,
+			resp3:    s.resp3,
+			channels: make(map[string]bool),
+			patterns: make(map[string]bool),
+			done:     make(chan struct{}),
+		}
+		s.Conn.ReaderTimeout = 0
+		return s.handlePubSub(r)
+	}
+	if s.config.EnablePubSubFanout {
+		s.pubsub = &pubsubConn{
+			fanout:   d.fanout,
+			resp3:    s.resp3,
+			channels: make(map[string]bool),
+			patterns: make(map[string]bool),
+			done:     make(chan struct{}),
+		}
+		s.Conn.ReaderTimeout = 0
+		return s.handlePubSub(r)
+	}
+	var addrs = d.getPrimaryAddrs()
+	if len(addrs) == 0 {
+		r.Resp = redis.NewErrorf("ERR no backend available")
+		return nil
+	}
+	pc, err := newPubSubConn(addrs, s.config)
+	if err != nil {
+		return err
+	}
+	pc.resp3 = s.resp3
+	s.pubsub = pc
+	s.Conn.ReaderTimeout = 0
+	return s.handlePubSub(r)
+}
+
+// isEventChannel returns true if channel is served by the event hub of the
+// router rather than backends.
+func (s *Session) isEventChannel(channel []byte) bool {
+	return s.config.EnableInternalEventChannel && string(channel) == eventChannel
+}
+
+func (s *Session) handleRequestUnsubscribe(r *Request) error {
+	var channel = redis.NewBulkBytes(nil)
+	if len(r.Multi) > 1 {
+		channel = r.Multi[1]
+	}
+	r.Resp = redis.NewArray([]*redis.Resp{
+		redis.NewBulkBytes([]byte(strings.ToLower(r.OpStr))),
+		channel,
+		redis.NewInt([]byte("0")),
+	})
+	return nil
+}
+
+func (s *Session) handlePubSub(r *Request) error {
+	switch r.OpStr {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(r.Multi) < 2 {
+			r.Resp = redis.NewErrorf("ERR wrong number of arguments for '%s' command", strings.ToLower(r.OpStr))
+			return nil
+		}
+		for _, m := range r.Multi[1:] {
+			if isKeyspaceChannel(m.Value) != (s.pubsub.keyspace != nil) {
+				r.Resp = redis.NewErrorf("ERR keyspace notifications can't be subscribed together with other channels")
+				return nil
+			}
+			if s.isEventChannel(m.Value) != (s.pubsub.events != nil) {
+				r.Resp = redis.NewErrorf("ERR %s can't be subscribed together with other channels", eventChannel)
+				return nil
+			}
+		}
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING":
+	default:
+		r.Resp = redis.NewErrorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(r.OpStr))
+		return nil
+	}
+	if !s.pubsub.IsLocal() {
+		s.pubsub.track(r.OpStr, r.Multi[1:])
+	}
+	return nil
+}
+
+func (s *Session) leavePubSub() {
+	if s.pubsub.started {
+		<-s.pubsub.done
+	}
+	s.pubsub.Close()
+	s.pubsub = nil
+	s.Conn.ReaderTimeout = s.config.SessionRecvTimeout.Duration()
+}
+
+func (s *Session) forwardPubSub(r *Request, tasks *RequestChan) error {
+	var pc = s.pubsub
+	if pc.IsLocal() {
+		return s.forwardLocal(r, tasks)
+	}
+	if !pc.started {
+		pc.started = true
+		for _, p := range pc.peers {
+			pc.waits.Add(1)
+			go s.loopPubSubPeer(pc, p, tasks)
+		}
+		go s.loopPubSub(pc, tasks)
+	}
+	s.incrOpStats(r, redis.TypeArray)
+	for _, p := range pc.peers {
+		if err := p.EncodeMultiBulk(r.Multi, true); err != nil {
+			return err
+		}
+	}
+	return pc.EncodeMultiBulk(r.Multi, true)
+}
+
+func (s *Session) forwardLocal(r *Request, tasks *RequestChan) error {
+	var pc = s.pubsub
+	for _, resp := range pc.apply(r.OpStr, r.Multi[1:]) {
+		if pc.resp3 {
+			resp = convertPush(resp)
+		}
+		x := &Request{Resp: resp, Batch: &sync.WaitGroup{}}
+		x.UnixNano = time.Now().UnixNano()
+		tasks.PushBack(x)
+	}
+	s.incrOpStats(r, redis.TypeArray)
+
+	switch {
+	case pc.Count() == 0:
+		s.leavePubSub()
+	case pc.keyspace != nil:
+		pc.keyspace.Update(pc, tasks)
+	case pc.events != nil:
+		pc.events.Update(pc, tasks)
+	default:
+		pc.fanout.Update(pc, tasks)
+	}
+	return nil
+}
+
+func (pc *pubsubConn) apply(opstr string, args []*redis.Resp) []*redis.Resp {
+	if opstr == "PING" {
+		var message = redis.NewBulkBytes([]byte(""))
+		if len(args) != 0 {
+			message = args[0]
+		}
+		return []*redis.Resp{redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte("pong")), message,
+		})}
+	}
+	var set = pc.channels
+	switch opstr {
+	case "PSUBSCRIBE", "PUNSUBSCRIBE":
+		set = pc.patterns
+	}
+	var replies []*redis.Resp
+	var reply = func(channel *redis.Resp) {
+		replies = append(replies, redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte(strings.ToLower(opstr))), channel,
+			redis.NewInt([]byte(strconv.Itoa(pc.Count()))),
+		}))
+	}
+	switch opstr {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		for _, m := range args {
+			set[string(m.Value)] = true
+			reply(m)
+		}
+		return replies
+	}
+	if len(args) == 0 {
+		var keys []string
+		for k := range set {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			delete(set, k)
+			reply(redis.NewBulkBytes([]byte(k)))
+		}
+		if len(keys) == 0 {
+			reply(redis.NewBulkBytes(nil))
+		}
+		return replies
+	}
+	for _, m := range args {
+		delete(set, string(m.Value))
+		reply(m)
+	}
+	return replies
+}
+
+func (s *Session) loopPubSub(pc *pubsubConn, tasks *RequestChan) (err error) {
+	defer func() {
+		if err == nil {
+			pc.quit.Set(true)
+		}
+		pc.Close()
+		pc.waits.Wait()
+		close(pc.done)
+		if err != nil && pc.quit.IsFalse() {
+			log.WarnErrorf(err, "session [%p] pubsub backend %s exit", s, pc.addr)
+			s.CloseWithError(err)
+		}
+	}()
+	for {
+		resp, err := pc.Decode()
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return ErrRespIsRequired
+		}
+		if pc.resp3 {
+			resp = convertPush(resp)
+		}
+		r := &Request{Resp: resp, Batch: &sync.WaitGroup{}}
+		r.UnixNano = time.Now().UnixNano()
+		tasks.PushBack(r)
+
+		if pc.closing.Int64() > 0 && isLastUnsubscribe(resp) && pc.closing.Decr() == 0 {
+			return nil
+		}
+	}
+}
+
+// loopPubSubPeer forwards messages received from one of the other backends,
+// the replies to (P)SUBSCRIBE, (P)UNSUBSCRIBE and PING are dropped.
+func (s *Session) loopPubSubPeer(pc *pubsubConn, p *pubsubPeer, tasks *RequestChan) (err error) {
+	defer func() {
+		pc.waits.Done()
+		if err != nil && pc.quit.IsFalse() {
+			log.WarnErrorf(err, "session [%p] pubsub backend %s exit", s, p.addr)
+			s.CloseWithError(err)
+		}
+	}()
+	for {
+		resp, err := p.Decode()
+		if err != nil {
+			return err
+		}
+		if resp == nil {
+			return ErrRespIsRequired
+		}
+		if !isPubSubMessage(resp) {
+			continue
+		}
+		if pc.resp3 {
+			resp = convertPush(resp)
+		}
+		r := &Request{Resp: resp, Batch: &sync.WaitGroup{}}
+		r.UnixNano = time.Now().UnixNano()
+		tasks.PushBack(r)
+	}
+}
+
+func isPubSubMessage(resp *redis.Resp) bool {
+	if !resp.IsArray() || len(resp.Array) < 3 {
+		return false
+	}
+	switch kind := resp.Array[0].Value; {
+	case bytes.Equal(kind, []byte("message")):
+	case bytes.Equal(kind, []byte("pmessage")):
+	default:
+		return false
+	}
+	return true
+}
+
+func isLastUnsubscribe(resp *redis.Resp) bool {
+	if !resp.IsArray() || len(resp.Array) != 3 {
+		return false
+	}
+	switch kind := resp.Array[0].Value; {
+	case bytes.Equal(kind, []byte("unsubscribe")):
+	case bytes.Equal(kind, []byte("punsubscribe")):
+	default:
+		return false
+	}
+	n, err := strconv.Atoi(string(resp.Array[2].Value))
+	return err == nil && n == 0
+}
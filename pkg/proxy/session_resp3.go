@@ -0,0 +1,112 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils"
+)
+
+func (s *Session) handleRequestHello(r *Request) error {
+	var resp3 = s.resp3
+	if len(r.Multi) > 1 {
+		switch string(r.Multi[1].Value) {
+		case "2":
+			resp3 = false
+		case "3":
+			resp3 = true
+		default:
+			r.Resp = redis.NewErrorf("NOPROTO unsupported protocol version")
+			return nil
+		}
+	}
+	var user, auth *redis.Resp
+	for i := 2; i < len(r.Multi); i++ {
+		switch opt := strings.ToUpper(string(r.Multi[i].Value)); {
+		case opt == "AUTH" && i+2 < len(r.Multi):
+			user, auth = r.Multi[i+1], r.Multi[i+2]
+			i += 2
+		case opt == "SETNAME" && i+1 < len(r.Multi):
+			i += 1
+		default:
+			r.Resp = redis.NewErrorf("ERR Syntax error in HELLO option '%s'", r.Multi[i].Value)
+			return nil
+		}
+	}
+	switch {
+	case auth != nil && s.authRequired():
+		if !s.authenticate(string(user.Value), string(auth.Value)) {
+			r.Resp = redis.NewErrorf("WRONGPASS invalid username-password pair")
+			return nil
+		}
+	case !s.authorized && s.authRequired():
+		r.Resp = redis.NewErrorf("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return nil
+	}
+	s.resp3 = resp3
+
+	var proto = "2"
+	if resp3 {
+		proto = "3"
+	}
+	var array = []*redis.Resp{
+		redis.NewBulkBytes([]byte("server")), redis.NewBulkBytes([]byte("codis-proxy")),
+		redis.NewBulkBytes([]byte("version")), redis.NewBulkBytes([]byte(utils.Version)),
+		redis.NewBulkBytes([]byte("proto")), redis.NewInt([]byte(proto)),
+		redis.NewBulkBytes([]byte("mode")), redis.NewBulkBytes([]byte("proxy")),
+		redis.NewBulkBytes([]byte("role")), redis.NewBulkBytes([]byte("master")),
+		redis.NewBulkBytes([]byte("modules")), redis.NewArray([]*redis.Resp{}),
+	}
+	if resp3 {
+		r.Resp = redis.NewMap(array)
+	} else {
+		r.Resp = redis.NewArray(array)
+	}
+	return nil
+}
+
+// Backends always speak RESP2, replies are translated to the RESP3 types
+// that redis-server would have used for the same command.
+func convertResp3(opstr string, resp *redis.Resp) *redis.Resp {
+	switch resp.Type {
+	case redis.TypeBulkBytes:
+		switch {
+		case resp.Value == nil:
+			return redis.NewNull()
+		// INCRBYFLOAT and HINCRBYFLOAT reply bulk strings in RESP3 too.
+		case opstr == "ZSCORE" || opstr == "ZINCRBY":
+			if _, err := strconv.ParseFloat(string(resp.Value), 64); err == nil {
+				return redis.NewDouble(resp.Value)
+			}
+		}
+	case redis.TypeArray:
+		if resp.Array == nil {
+			return redis.NewNull()
+		}
+		var array = make([]*redis.Resp, len(resp.Array))
+		for i := range resp.Array {
+			array[i] = convertResp3("", resp.Array[i])
+		}
+		switch opstr {
+		case "HGETALL":
+			if len(array)%2 == 0 {
+				return redis.NewMap(array)
+			}
+		case "SMEMBERS", "SINTER", "SUNION", "SDIFF":
+			return redis.NewSet(array)
+		}
+		return redis.NewArray(array)
+	}
+	return resp
+}
+
+func convertPush(resp *redis.Resp) *redis.Resp {
+	if !resp.IsArray() || resp.Array == nil {
+		return resp
+	}
+	return redis.NewPush(convertResp3("", resp).Array)
+}
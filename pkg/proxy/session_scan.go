@@ -0,0 +1,174 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/errors"
+)
+
+var ErrBadScanResp = errors.New("bad slotsscan resp")
+
+func (s *Session) handleRequestScan(r *Request, d *Router) error {
+	if !s.config.ScanAggregation {
+		return fmt.Errorf("command '%s' is not allowed", r.OpStr)
+	}
+	var nblks = len(r.Multi) - 1
+	if nblks < 1 || nblks%2 != 1 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'SCAN' command")
+		return nil
+	}
+	cursor, err := strconv.ParseUint(string(r.Multi[1].Value), 10, 64)
+	if err != nil {
+		r.Resp = redis.NewErrorf("ERR invalid cursor")
+		return nil
+	}
+	var slot = int(cursor % MaxSlotNum)
+
+	var count, match []byte
+	for i := 2; i < len(r.Multi); i += 2 {
+		switch strings.ToUpper(string(r.Multi[i].Value)) {
+		case "COUNT":
+			count = r.Multi[i+1].Value
+		case "MATCH":
+			match = r.Multi[i+1].Value
+		default:
+			r.Resp = redis.NewErrorf("ERR syntax error")
+			return nil
+		}
+	}
+
+	r.Multi = []*redis.Resp{
+		redis.NewBulkBytes([]byte("SLOTSSCAN")),
+		redis.NewBulkBytes([]byte(strconv.Itoa(slot))),
+		redis.NewBulkBytes([]byte(strconv.FormatUint(cursor/MaxSlotNum, 10))),
+	}
+	if count != nil {
+		r.Multi = append(r.Multi,
+			redis.NewBulkBytes([]byte("COUNT")),
+			redis.NewBulkBytes(count),
+		)
+	}
+	if err := d.dispatchSlot(r, slot); err != nil {
+		return err
+	}
+
+	r.Coalesce = func() error {
+		if err := r.Err; err != nil {
+			return err
+		}
+		switch resp := r.Resp; {
+		case resp == nil:
+			return ErrRespIsRequired
+		case resp.IsError():
+			return nil
+		case !resp.IsArray() || len(resp.Array) != 2 || !resp.Array[1].IsArray():
+			return ErrBadScanResp
+		}
+		next, err := strconv.ParseUint(string(r.Resp.Array[0].Value), 10, 64)
+		if err != nil || next > (math.MaxUint64-MaxSlotNum)/MaxSlotNum {
+			return ErrBadScanResp
+		}
+		switch {
+		case next != 0:
+			cursor = next*MaxSlotNum + uint64(slot)
+		case slot+1 < MaxSlotNum:
+			cursor = uint64(slot + 1)
+		default:
+			cursor = 0
+		}
+		var keys = r.Resp.Array[1].Array
+		if match != nil {
+			var filtered = make([]*redis.Resp, 0, len(keys))
+			for _, key := range keys {
+				if globMatch(match, key.Value) {
+					filtered = append(filtered, key)
+				}
+			}
+			keys = filtered
+		}
+		r.Resp = redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte(strconv.FormatUint(cursor, 10))),
+			redis.NewArray(keys),
+		})
+		return nil
+	}
+	return nil
+}
+
+func globMatch(pattern, s []byte) bool {
+	for len(pattern) != 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			var not = len(pattern) != 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			var match bool
+			for len(pattern) != 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					match = match || pattern[0] == s[0]
+				case len(pattern) >= 3 && pattern[1] == '-':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (s[0] >= lo && s[0] <= hi)
+					pattern = pattern[2:]
+				default:
+					match = match || pattern[0] == s[0]
+				}
+				pattern = pattern[1:]
+			}
+			if match == not {
+				return false
+			}
+			s = s[1:]
+			if len(pattern) == 0 {
+				return len(s) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+func (s *Session) handleRequestSetStore(r *Request, d *Router) error {
+	if len(r.Multi) < 3 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for '%s' command", strings.ToLower(r.OpStr))
+		return nil
+	}
+	var id = d.hashSlot(r.Multi[1].Value)
+	var cross bool
+	for _, key := range r.Multi[2:] {
+		if d.hashSlot(key.Value) != id {
+			cross = true
+			break
+		}
+	}
+	if !cross {
+		return d.dispatch(r)
+	}
+	if !s.config.AllowCrossSlotSetOps {
+		r.Resp = RespCrossSlot
+		return nil
+	}
+
+	var sub, err = dispatchSMembers(r, d, r.Multi[2:])
+	if err != nil {
+		return err
+	}
+	// The store is finished before the next request of the session is
+	// handled, so that pipelined requests reading the destination see it.
+	r.Batch.Wait()
+
+	sets, err := collectSets(r, sub)
+	if err != nil || sets == nil {
+		return err
+	}
+	var members = computeSetOp(r.OpStr, sets)
+
+	// The destination is replaced in two steps, DEL and then SADD, both
+	// are sent and waited in sequence since they may use different
+	// backend connections of the same slot.
+	var store = [][]*redis.Resp{
+		{redis.NewBulkBytes([]byte("DEL")), r.Multi[1]},
+	}
+	if len(members) != 0 {
+		var multi = []*redis.Resp{redis.NewBulkBytes([]byte("SADD")), r.Multi[1]}
+		store = append(store, append(multi, members...))
+	}
+	for _, multi := range store {
+		var x = &r.MakeSubRequest(1)[0]
+		x.Multi = multi
+		x.OpStr = string(multi[0].Value)
+		x.OpFlag = opTable[x.OpStr].Flag
+		x.Batch = &sync.WaitGroup{}
+		if err := d.dispatch(x); err != nil {
+			return err
+		}
+		x.Batch.Wait()
+
+		switch resp := x.Resp; {
+		case x.Err != nil:
+			return x.Err
+		case resp == nil:
+			return ErrRespIsRequired
+		case resp.IsError():
+			r.Resp = resp
+			return nil
+		}
+	}
+	r.Resp = redis.NewInt(strconv.AppendInt(nil, int64(len(members)), 10))
+	return nil
+}
+
+// handleRequestSetRead handles SINTER and SUNION, keys across slots are
+// fetched with SMEMBERS in parallel and the result is computed by the proxy.
+func (s *Session) handleRequestSetRead(r *Request, d *Router) error {
+	if len(r.Multi) < 2 {
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for '%s' command", strings.ToLower(r.OpStr))
+		return nil
+	}
+	var id = d.hashSlot(r.Multi[1].Value)
+	var cross bool
+	for _, key := range r.Multi[2:] {
+		if d.hashSlot(key.Value) != id {
+			cross = true
+			break
+		}
+	}
+	if !cross || !s.config.AllowCrossSlotReadOps {
+		return d.dispatch(r)
+	}
+
+	var sub, err = dispatchSMembers(r, d, r.Multi[1:])
+	if err != nil {
+		return err
+	}
+	r.Coalesce = func() error {
+		sets, err := collectSets(r, sub)
+		if err != nil || sets == nil {
+			return err
+		}
+		r.Resp = redis.NewArray(computeSetOp(r.OpStr, sets))
+		return nil
+	}
+	return nil
+}
+
+// dispatchSMembers sends SMEMBERS of each key as sub requests of r. They're
+// sent to masters if r is, so the sets stored by *STORE are never computed
+// from stale replicas.
+func dispatchSMembers(r *Request, d *Router, keys []*redis.Resp) ([]Request, error) {
+	var sub = r.MakeSubRequest(len(keys))
+	for i := range sub {
+		sub[i].Multi = []*redis.Resp{redis.NewBulkBytes([]byte("SMEMBERS")), keys[i]}
+		sub[i].OpStr, sub[i].OpFlag = "SMEMBERS", opTable["SMEMBERS"].Flag
+		if r.OpFlag.IsMasterOnly() {
+			sub[i].OpFlag |= FlagMasterOnly
+		}
+		if err := d.dispatch(&sub[i]); err != nil {
+			return nil, err
+		}
+	}
+	return sub, nil
+}
+
+// collectSets returns the members replied to the sub requests, or nil if r.Resp
+// has been set to an error reply of them.
+func collectSets(r *Request, sub []Request) ([][]*redis.Resp, error) {
+	var sets = make([][]*redis.Resp, len(sub))
+	for i := range sub {
+		if err := sub[i].Err; err != nil {
+			return nil, err
+		}
+		switch resp := sub[i].Resp; {
+		case resp == nil:
+			return nil, ErrRespIsRequired
+		case resp.IsError():
+			r.Resp = resp
+			return nil, nil
+		case resp.IsArray():
+			sets[i] = resp.Array
+		default:
+			return nil, fmt.Errorf("bad smembers resp: %s array.len = %d", resp.Type, len(resp.Array))
+		}
+	}
+	return sets, nil
+}
+
+// computeSetOp returns the result of SINTER, SUNION or SDIFF over sets,
+// members are kept in the order they first appear.
+func computeSetOp(opstr string, sets [][]*redis.Resp) []*redis.Resp {
+	var result = append([]*redis.Resp(nil), sets[0]...)
+	var exists = make(map[string]bool)
+	for _, m := range result {
+		exists[string(m.Value)] = true
+	}
+	for _, set := range sets[1:] {
+		switch opstr {
+		case "SUNION", "SUNIONSTORE":
+			for _, m := range set {
+				if !exists[string(m.Value)] {
+					exists[string(m.Value)] = true
+					result = append(result, m)
+				}
+			}
+		default:
+			var in = make(map[string]bool, len(set))
+			for _, m := range set {
+				in[string(m.Value)] = true
+			}
+			var keep = result[:0]
+			for _, m := range result {
+				if in[string(m.Value)] == (opstr == "SINTER" || opstr == "SINTERSTORE") {
+					keep = append(keep, m)
+				}
+			}
+			result = keep
+		}
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+// parseStreams returns the index of the STREAMS keyword of XREAD or
+// XREADGROUP, and whether the command is a blocking one.
+func parseStreams(multi []*redis.Resp, opstr string) (streams int, block bool, ok bool) {
+	for i := 1; i < len(multi); i++ {
+		switch strings.ToUpper(string(multi[i].Value)) {
+		case "STREAMS":
+			return i, block, true
+		case "BLOCK":
+			block = true
+			i++
+		case "COUNT":
+			i++
+		case "GROUP":
+			if opstr != "XREADGROUP" {
+				return 0, false, false
+			}
+			i += 2
+		case "NOACK":
+			if opstr != "XREADGROUP" {
+				return 0, false, false
+			}
+		default:
+			return 0, false, false
+		}
+	}
+	return 0, false, false
+}
+
+func getStreamsKey(multi []*redis.Resp, opstr string) []byte {
+	if i, _, ok := parseStreams(multi, opstr); ok && i+1 < len(multi) {
+		return multi[i+1].Value
+	}
+	return nil
+}
+
+func (s *Session) handleRequestXRead(r *Request, d *Router) error {
+	streams, block, ok := parseStreams(r.Multi, r.OpStr)
+	if !ok {
+		r.Resp = redis.NewErrorf("ERR syntax error")
+		return nil
+	}
+	// A blocked request would stall every other request pipelined on the
+	// shared backend connection, like BLPOP and friends.
+	if block {
+		r.Resp = redis.NewErrorf("ERR blocking '%s' is not supported", r.OpStr)
+		return nil
+	}
+	var nblks = len(r.Multi) - streams - 1
+	if nblks == 0 || nblks%2 != 0 {
+		r.Resp = redis.NewErrorf("ERR Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.", strings.ToLower(r.OpStr))
+		return nil
+	}
+	var nkeys = nblks / 2
+
+	var groups [][]int
+	var index = make(map[int]int)
+	for i := 0; i < nkeys; i++ {
+		id := d.hashSlot(r.Multi[streams+1+i].Value)
+		if g, ok := index[id]; ok {
+			groups[g] = append(groups[g], i)
+		} else {
+			index[id] = len(groups)
+			groups = append(groups, []int{i})
+		}
+	}
+	if len(groups) == 1 {
+		return d.dispatch(r)
+	}
+
+	var sub = r.MakeSubRequest(len(groups))
+	for i, group := range groups {
+		multi := make([]*redis.Resp, 0, streams+1+len(group)*2)
+		multi = append(multi, r.Multi[:streams+1]...)
+		for _, k := range group {
+			multi = append(multi, r.Multi[streams+1+k])
+		}
+		for _, k := range group {
+			multi = append(multi, r.Multi[streams+1+nkeys+k])
+		}
+		sub[i].Multi = multi
+		if err := d.dispatch(&sub[i]); err != nil {
+			return err
+		}
+	}
+	r.Coalesce = func() error {
+		var array = make([][]*redis.Resp, nkeys)
+		for i := range sub {
+			if err := sub[i].Err; err != nil {
+				return err
+			}
+			switch resp := sub[i].Resp; {
+			case resp == nil:
+				return ErrRespIsRequired
+			case resp.IsError():
+				r.Resp = resp
+				return nil
+			case resp.IsArray():
+				for _, e := range resp.Array {
+					if e == nil || !e.IsArray() || len(e.Array) != 2 {
+						return fmt.Errorf("bad %s resp: bad stream entry", strings.ToLower(r.OpStr))
+					}
+					for _, k := range groups[i] {
+						if string(r.Multi[streams+1+k].Value) == string(e.Array[0].Value) {
+							array[k] = append(array[k], e)
+							break
+						}
+					}
+				}
+			default:
+				return fmt.Errorf("bad %s resp: %s", strings.ToLower(r.OpStr), resp.Type)
+			}
+		}
+		var merged []*redis.Resp
+		for _, entries := range array {
+			merged = append(merged, entries...)
+		}
+		r.Resp = redis.NewArray(merged)
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,3577 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/admin"
+	"github.com/CodisLabs/codis/pkg/proxy/ratelimit"
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils"
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+)
+
+type fakeBackend struct {
+	sync.Mutex
+	l net.Listener
+
+	data  map[string]string
+	hash  map[string]map[string]string
+	calls []string
+	delay time.Duration
+	drops int
+
+	subs  map[*redis.Conn]map[string]bool
+	psubs map[*redis.Conn][]string
+
+	// hooks are called before commands of the same name are handled.
+	hooks map[string]func()
+}
+
+func newFakeBackend() *fakeBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	b := &fakeBackend{l: l, data: make(map[string]string)}
+	b.hash = make(map[string]map[string]string)
+	b.subs = make(map[*redis.Conn]map[string]bool)
+	b.psubs = make(map[*redis.Conn][]string)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(redis.NewConn(c, 1024*16, 1024*16))
+		}
+	}()
+	return b
+}
+
+func (b *fakeBackend) Addr() string {
+	return b.l.Addr().String()
+}
+
+func (b *fakeBackend) Close() {
+	b.l.Close()
+}
+
+func (b *fakeBackend) Calls() []string {
+	b.Lock()
+	defer b.Unlock()
+	return append([]string(nil), b.calls...)
+}
+
+func (b *fakeBackend) serve(c *redis.Conn) {
+	defer c.Close()
+	defer func() {
+		b.Lock()
+		delete(b.subs, c)
+		delete(b.psubs, c)
+		b.Unlock()
+	}()
+	var txn [][]*redis.Resp
+	var watched map[string]string
+	for {
+		multi, err := c.DecodeMultiBulk()
+		if err != nil {
+			return
+		}
+		if b.handlePubSub(c, multi) {
+			continue
+		}
+		if b.drop(multi) {
+			return
+		}
+		b.Lock()
+		hook := b.hooks[strings.ToUpper(string(multi[0].Value))]
+		b.Unlock()
+		if hook != nil {
+			hook()
+		}
+		var resp *redis.Resp
+		switch op := strings.ToUpper(string(multi[0].Value)); {
+		case op == "MULTI":
+			txn, resp = [][]*redis.Resp{}, redis.NewString([]byte("OK"))
+		case op == "EXEC":
+			var array []*redis.Resp
+			if b.isWatchedChanged(watched) {
+				txn = nil
+			}
+			for _, m := range txn {
+				array = append(array, b.handle(m))
+			}
+			txn, watched, resp = nil, nil, redis.NewArray(array)
+		case op == "WATCH":
+			watched = b.watch(watched, multi[1:])
+			resp = redis.NewString([]byte("OK"))
+		case op == "SLOTSMGRT-EXEC-WRAPPER":
+			resp = b.execWrapper(multi)
+		case txn != nil:
+			txn, resp = append(txn, multi), redis.NewString([]byte("QUEUED"))
+		default:
+			resp = b.handle(multi)
+		}
+		if err := c.Encode(resp, true); err != nil {
+			return
+		}
+	}
+}
+
+// watch records the string values of keys, which are compared on EXEC.
+func (b *fakeBackend) watch(watched map[string]string, keys []*redis.Resp) map[string]string {
+	b.Lock()
+	defer b.Unlock()
+	if watched == nil {
+		watched = make(map[string]string)
+	}
+	for _, key := range keys {
+		v, ok := b.data[string(key.Value)]
+		watched[string(key.Value)] = v + strconv.FormatBool(ok)
+	}
+	return watched
+}
+
+func (b *fakeBackend) isWatchedChanged(watched map[string]string) bool {
+	b.Lock()
+	defer b.Unlock()
+	for key, last := range watched {
+		if v, ok := b.data[key]; v+strconv.FormatBool(ok) != last {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *fakeBackend) execWrapper(multi []*redis.Resp) *redis.Resp {
+	b.Lock()
+	_, ok := b.data[string(multi[1].Value)]
+	b.Unlock()
+	if !ok {
+		return redis.NewArray([]*redis.Resp{
+			redis.NewInt([]byte("0")), redis.NewBulkBytes(nil),
+		})
+	}
+	return redis.NewArray([]*redis.Resp{
+		redis.NewInt([]byte("2")), b.handle(multi[2:]),
+	})
+}
+
+func (b *fakeBackend) notify(event, key string) {
+	var channel = "__keyevent@0__:" + event
+	for c, patterns := range b.psubs {
+		for _, pattern := range patterns {
+			if globMatch([]byte(pattern), []byte(channel)) {
+				c.Encode(redis.NewArray([]*redis.Resp{
+					redis.NewBulkBytes([]byte("pmessage")),
+					redis.NewBulkBytes([]byte(pattern)),
+					redis.NewBulkBytes([]byte(channel)),
+					redis.NewBulkBytes([]byte(key)),
+				}), true)
+			}
+		}
+	}
+}
+
+func (b *fakeBackend) drop(multi []*redis.Resp) bool {
+	b.Lock()
+	defer b.Unlock()
+	switch strings.ToUpper(string(multi[0].Value)) {
+	case "GET", "SET", "UNLINK":
+		if b.drops > 0 {
+			b.drops--
+			return true
+		}
+	}
+	return false
+}
+
+func (b *fakeBackend) handlePubSub(c *redis.Conn, multi []*redis.Resp) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	var op = strings.ToUpper(string(multi[0].Value))
+	switch op {
+	case "SUBSCRIBE", "UNSUBSCRIBE", "PUBLISH", "PSUBSCRIBE":
+	default:
+		return false
+	}
+	b.calls = append(b.calls, op)
+
+	reply := func(kind string, channel *redis.Resp) {
+		c.Encode(redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte(kind)), channel,
+			redis.NewInt([]byte(strconv.Itoa(len(b.subs[c]) + len(b.psubs[c])))),
+		}), true)
+	}
+	switch op {
+	case "PSUBSCRIBE":
+		for _, m := range multi[1:] {
+			b.psubs[c] = append(b.psubs[c], string(m.Value))
+			reply("psubscribe", m)
+		}
+	case "SUBSCRIBE":
+		if b.subs[c] == nil {
+			b.subs[c] = make(map[string]bool)
+		}
+		for _, m := range multi[1:] {
+			b.subs[c][string(m.Value)] = true
+			reply("subscribe", m)
+		}
+	case "UNSUBSCRIBE":
+		if len(multi) == 1 {
+			var channels []string
+			for channel := range b.subs[c] {
+				channels = append(channels, channel)
+			}
+			if len(channels) == 0 {
+				reply("unsubscribe", redis.NewBulkBytes(nil))
+			}
+			for _, channel := range channels {
+				delete(b.subs[c], channel)
+				reply("unsubscribe", redis.NewBulkBytes([]byte(channel)))
+			}
+		}
+		for _, m := range multi[1:] {
+			delete(b.subs[c], string(m.Value))
+			reply("unsubscribe", m)
+		}
+	case "PUBLISH":
+		var n int
+		for sub, channels := range b.subs {
+			if channels[string(multi[1].Value)] {
+				sub.Encode(redis.NewArray([]*redis.Resp{
+					redis.NewBulkBytes([]byte("message")), multi[1], multi[2],
+				}), true)
+				n++
+			}
+		}
+		for sub, patterns := range b.psubs {
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, string(multi[1].Value)); ok {
+					sub.Encode(redis.NewArray([]*redis.Resp{
+						redis.NewBulkBytes([]byte("pmessage")), redis.NewBulkBytes([]byte(pattern)), multi[1], multi[2],
+					}), true)
+					n++
+				}
+			}
+		}
+		c.Encode(redis.NewInt([]byte(strconv.Itoa(n))), true)
+	}
+	return true
+}
+
+func (b *fakeBackend) handle(multi []*redis.Resp) *redis.Resp {
+	b.Lock()
+	defer b.Unlock()
+
+	var args []string
+	for _, m := range multi {
+		args = append(args, string(m.Value))
+	}
+	var op = strings.ToUpper(args[0])
+
+	switch op {
+	case "AUTH", "SELECT", "PING":
+		return redis.NewString([]byte("OK"))
+	}
+	b.calls = append(b.calls, op+" "+strings.Join(args[1:], " "))
+
+	if b.delay != 0 {
+		time.Sleep(b.delay)
+	}
+
+	switch op {
+	case "GET":
+		if v, ok := b.data[args[1]]; ok {
+			return redis.NewBulkBytes([]byte(v))
+		}
+		return redis.NewBulkBytes(nil)
+	case "SET":
+		b.data[args[1]] = args[2]
+		b.notify("set", args[1])
+		return redis.NewString([]byte("OK"))
+	case "MGET":
+		var array []*redis.Resp
+		for _, key := range args[1:] {
+			if v, ok := b.data[key]; ok {
+				array = append(array, redis.NewBulkBytes([]byte(v)))
+			} else {
+				array = append(array, redis.NewBulkBytes(nil))
+			}
+		}
+		return redis.NewArray(array)
+	case "MSET":
+		for i := 1; i < len(args); i += 2 {
+			b.data[args[i]] = args[i+1]
+		}
+		return redis.NewString([]byte("OK"))
+	case "MSETNX":
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := b.data[args[i]]; ok {
+				return redis.NewInt([]byte("0"))
+			}
+		}
+		for i := 1; i < len(args); i += 2 {
+			b.data[args[i]] = args[i+1]
+		}
+		return redis.NewInt([]byte("1"))
+	case "DEL", "UNLINK", "EXISTS":
+		var n int
+		for _, key := range args[1:] {
+			if _, ok := b.data[key]; ok {
+				n++
+				if op != "EXISTS" {
+					delete(b.data, key)
+				}
+			}
+			if _, ok := b.hash[key]; ok {
+				n++
+				if op != "EXISTS" {
+					delete(b.hash, key)
+				}
+			}
+		}
+		return redis.NewInt([]byte(strconv.Itoa(n)))
+	case "HSET":
+		if b.hash[args[1]] == nil {
+			b.hash[args[1]] = make(map[string]string)
+		}
+		b.hash[args[1]][args[2]] = args[3]
+		return redis.NewInt([]byte("1"))
+	case "HGETALL":
+		var fields []string
+		for field := range b.hash[args[1]] {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		var array = []*redis.Resp{}
+		for _, field := range fields {
+			array = append(array,
+				redis.NewBulkBytes([]byte(field)),
+				redis.NewBulkBytes([]byte(b.hash[args[1]][field])),
+			)
+		}
+		return redis.NewArray(array)
+	case "TYPE":
+		switch {
+		case b.hash[args[1]] != nil:
+			return redis.NewString([]byte("hash"))
+		case b.data[args[1]] != "":
+			return redis.NewString([]byte("string"))
+		}
+		return redis.NewString([]byte("none"))
+	case "SADD":
+		if b.hash[args[1]] == nil {
+			b.hash[args[1]] = make(map[string]string)
+		}
+		var n int
+		for _, member := range args[2:] {
+			if _, ok := b.hash[args[1]][member]; !ok {
+				b.hash[args[1]][member] = ""
+				n++
+			}
+		}
+		return redis.NewInt([]byte(strconv.Itoa(n)))
+	case "SMEMBERS":
+		var members []string
+		for member := range b.hash[args[1]] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		var array = []*redis.Resp{}
+		for _, member := range members {
+			array = append(array, redis.NewBulkBytes([]byte(member)))
+		}
+		return redis.NewArray(array)
+	case "SPOP", "SRANDMEMBER":
+		var members []string
+		for member := range b.hash[args[1]] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		var count = 1
+		if len(args) == 3 {
+			count, _ = strconv.Atoi(args[2])
+		}
+		if count < len(members) {
+			members = members[:count]
+		}
+		if op == "SPOP" {
+			for _, member := range members {
+				delete(b.hash[args[1]], member)
+			}
+		}
+		if len(args) == 2 {
+			if len(members) == 0 {
+				return redis.NewBulkBytes(nil)
+			}
+			return redis.NewBulkBytes([]byte(members[0]))
+		}
+		var array = []*redis.Resp{}
+		for _, member := range members {
+			array = append(array, redis.NewBulkBytes([]byte(member)))
+		}
+		return redis.NewArray(array)
+	case "RPUSH":
+		var list []string
+		if v, ok := b.data[args[1]]; ok {
+			list = strings.Split(v, ",")
+		}
+		list = append(list, args[2:]...)
+		b.data[args[1]] = strings.Join(list, ",")
+		return redis.NewInt([]byte(strconv.Itoa(len(list))))
+	case "LPOS":
+		if v, ok := b.data[args[1]]; ok {
+			for i, e := range strings.Split(v, ",") {
+				if e == args[2] {
+					return redis.NewInt([]byte(strconv.Itoa(i)))
+				}
+			}
+		}
+		return redis.NewBulkBytes(nil)
+	case "LOLWUT":
+		return redis.NewBulkBytes([]byte("Redis ver. 6.0.0"))
+	case "COMMAND":
+		return redis.NewInt([]byte("240"))
+	case "BITFIELD", "BITFIELD_RO":
+		return redis.NewArray([]*redis.Resp{redis.NewInt([]byte("0"))})
+	case "OBJECT":
+		if len(args) == 2 {
+			return redis.NewArray([]*redis.Resp{redis.NewString([]byte("OBJECT <subcommand> key"))})
+		}
+		if _, ok := b.data[args[2]]; !ok {
+			return redis.NewBulkBytes(nil)
+		}
+		switch strings.ToUpper(args[1]) {
+		case "ENCODING":
+			return redis.NewBulkBytes([]byte("embstr"))
+		default:
+			return redis.NewInt([]byte("1"))
+		}
+	case "CLIENT", "DEBUG":
+		return redis.NewString([]byte("OK"))
+	case "WAIT":
+		return redis.NewInt([]byte("2"))
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		return redis.NewBulkBytes([]byte(b.data[args[3]]))
+	case "FUNCTION":
+		switch strings.ToUpper(args[1]) {
+		case "LOAD":
+			return redis.NewBulkBytes([]byte("mylib"))
+		case "LIST":
+			return redis.NewArray(nil)
+		default:
+			return redis.NewString([]byte("OK"))
+		}
+	case "XREAD", "XREADGROUP":
+		var i = 1
+		for strings.ToUpper(args[i]) != "STREAMS" {
+			i++
+		}
+		var keys = args[i+1 : i+1+(len(args)-i-1)/2]
+		var array []*redis.Resp
+		for _, key := range keys {
+			if v, ok := b.data[key]; ok {
+				array = append(array, redis.NewArray([]*redis.Resp{
+					redis.NewBulkBytes([]byte(key)),
+					redis.NewArray([]*redis.Resp{redis.NewArray([]*redis.Resp{
+						redis.NewBulkBytes([]byte("1-0")),
+						redis.NewArray([]*redis.Resp{
+							redis.NewBulkBytes([]byte("v")), redis.NewBulkBytes([]byte(v)),
+						}),
+					})}),
+				}))
+			}
+		}
+		return redis.NewArray(array)
+	case "PTTL", "TTL":
+		if _, ok := b.data[args[1]]; ok {
+			return redis.NewInt([]byte("-1"))
+		}
+		return redis.NewInt([]byte("-2"))
+	case "EXPIRE":
+		if _, ok := b.data[args[1]]; ok {
+			return redis.NewInt([]byte("1"))
+		}
+		return redis.NewInt([]byte("0"))
+	case "COPY":
+		v, ok := b.data[args[1]]
+		if !ok {
+			return redis.NewInt([]byte("0"))
+		}
+		b.data[args[2]] = v
+		return redis.NewInt([]byte("1"))
+	case "SLOTSMGRTTAGONE":
+		if _, ok := b.data[args[4]]; ok {
+			delete(b.data, args[4])
+			return redis.NewInt([]byte("1"))
+		}
+		return redis.NewInt([]byte("0"))
+	case "SLOTSINFO":
+		slot, _ := strconv.Atoi(args[1])
+		var n int
+		for key := range b.data {
+			if int(Hash([]byte(key))%MaxSlotNum) == slot {
+				n++
+			}
+		}
+		return redis.NewArray([]*redis.Resp{
+			redis.NewArray([]*redis.Resp{
+				redis.NewInt([]byte(args[1])), redis.NewInt([]byte(strconv.Itoa(n))),
+			}),
+		})
+	case "DUMP":
+		if v, ok := b.data[args[1]]; ok {
+			return redis.NewBulkBytes([]byte("dump:" + v))
+		}
+		return redis.NewBulkBytes(nil)
+	case "RESTORE":
+		if _, ok := b.data[args[1]]; ok && !(len(args) > 4 && strings.ToUpper(args[4]) == "REPLACE") {
+			return redis.NewError([]byte("BUSYKEY Target key name already exists."))
+		}
+		b.data[args[1]] = strings.TrimPrefix(args[3], "dump:")
+		return redis.NewString([]byte("OK"))
+	case "SLOTSSCAN":
+		slot, _ := strconv.Atoi(args[1])
+		cursor, _ := strconv.Atoi(args[2])
+		count := 10
+		if len(args) == 5 {
+			count, _ = strconv.Atoi(args[4])
+		}
+		var keys []string
+		for key := range b.data {
+			if int(Hash([]byte(key))%MaxSlotNum) == slot {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		var array []*redis.Resp
+		for i := cursor; i < len(keys) && i < cursor+count; i++ {
+			array = append(array, redis.NewBulkBytes([]byte(keys[i])))
+		}
+		next := cursor + count
+		if next >= len(keys) {
+			next = 0
+		}
+		return redis.NewArray([]*redis.Resp{
+			redis.NewBulkBytes([]byte(strconv.Itoa(next))),
+			redis.NewArray(array),
+		})
+	default:
+		return redis.NewErrorf("ERR unknown command '%s'", op)
+	}
+}
+
+func newTestRouter(backends ...*fakeBackend) *Router {
+	d := NewRouter(config)
+	for i := 0; i < MaxSlotNum; i++ {
+		b := backends[i%len(backends)]
+		assert.MustNoError(d.FillSlot(&models.Slot{Id: i, BackendAddr: b.Addr()}))
+	}
+	d.Start()
+	return d
+}
+
+func newTestSession() *Session {
+	s := &Session{config: config}
+	s.stats.opmap = make(map[string]*opStats)
+	return s
+}
+
+func execRequest(s *Session, d *Router, args ...string) *redis.Resp {
+	r := newRequest(args...)
+	r.Database = s.database
+	r.ReadPreference = s.readPreference
+	r.RequestID = s.requestID
+	assert.MustNoError(s.handleRequest(r, d))
+	resp, err := s.handleResponse(r)
+	assert.MustNoError(err)
+	return resp
+}
+
+func TestSessionMultiKeys(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+
+	var keys = []string{"{a}0", "{b}0", "{a}1", "{b}1", "{a}2", "{b}2"}
+	assert.Must(d.hashSlot([]byte("a")) != d.hashSlot([]byte("b")))
+
+	var mset = []string{"MSET"}
+	for _, key := range keys {
+		mset = append(mset, key, "v"+key)
+	}
+	resp := execRequest(s, d, mset...)
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+
+	var calls = append(b0.Calls(), b1.Calls()...)
+	assert.Must(len(calls) == 2)
+	for _, call := range calls {
+		assert.Must(call == "MSET {a}0 v{a}0 {a}1 v{a}1 {a}2 v{a}2" ||
+			call == "MSET {b}0 v{b}0 {b}1 v{b}1 {b}2 v{b}2")
+	}
+
+	resp = execRequest(s, d, append([]string{"MGET"}, keys...)...)
+	assert.Must(resp.IsArray() && len(resp.Array) == len(keys))
+	for i, key := range keys {
+		assert.Must(string(resp.Array[i].Value) == "v"+key)
+	}
+
+	resp = execRequest(s, d, "EXISTS", keys[0], keys[1], keys[0], "nokey")
+	assert.Must(resp.IsInt() && string(resp.Value) == "3")
+
+	resp = execRequest(s, d, "UNLINK", keys[0], keys[1])
+	assert.Must(resp.IsInt() && string(resp.Value) == "2")
+
+	resp = execRequest(s, d, append([]string{"DEL"}, keys...)...)
+	assert.Must(resp.IsInt() && string(resp.Value) == strconv.Itoa(len(keys)-2))
+
+	resp = execRequest(s, d, "MSETNX", keys[0], "x", keys[1], "y")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "CROSSSLOT"))
+
+	resp = execRequest(s, d, "MSETNX", keys[0], "x", keys[2], "y")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+}
+
+func TestSessionUnlink(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	var keys = []string{"{a}0", "{a}1", "{b}0", "{b}1"}
+	for _, key := range keys[:3] {
+		execRequest(s, d, "SET", key, "v")
+	}
+	var n = len(b0.Calls()) + len(b1.Calls())
+
+	resp := execRequest(s, d, append([]string{"UNLINK"}, keys...)...)
+	assert.Must(resp.IsInt() && string(resp.Value) == "3")
+	var calls = append(b0.Calls(), b1.Calls()...)[n:]
+	sort.Strings(calls)
+	assert.Must(strings.Join(calls, ",") == "UNLINK {a}0 {a}1,UNLINK {b}0 {b}1")
+
+	resp = execRequest(s, d, "UNLINK")
+	assert.Must(resp.IsError())
+}
+
+func TestSessionUnlinkPrimaryOnly(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := NewRouter(config)
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(&models.Slot{
+			Id: i, BackendAddr: b0.Addr(), ReplicaGroups: [][]string{{b1.Addr()}},
+		}))
+	}
+	waitConnected(d)
+
+	s := newTestSession()
+	s.config = NewDefaultConfig()
+	s.config.BackendMaxRetries = 2
+	s.config.BackendRetryBackoff.Set(time.Millisecond)
+	s.readPreference = PreferReplica
+
+	execRequest(s, d, "UNLINK", "{a}0", "{b}0")
+	execRequest(s, d, "UNLINK", "{a}0")
+	assert.Must(len(b1.Calls()) == 0)
+
+	// Never retried, the key might have been removed already.
+	b0.Lock()
+	b0.drops = 1
+	b0.Unlock()
+	r := newRequest("UNLINK", "{a}0")
+	assert.MustNoError(s.handleRequest(r, d))
+	_, err := s.handleResponse(r)
+	assert.Must(err != nil && r.Retries == 0)
+}
+
+func waitConnected(d *Router) {
+	for i := 0; i < 100; i++ {
+		var connected = true
+		for _, p := range []*sharedBackendConnPool{d.pool.primary, d.pool.replica} {
+			for _, bc := range p.pool {
+				connected = connected && bc.BackendConn(0, 0, false) != nil
+			}
+		}
+		if connected {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(false)
+}
+
+func TestSessionReadPreference(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := NewRouter(config)
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(&models.Slot{
+			Id: i, BackendAddr: b0.Addr(), ReplicaGroups: [][]string{{b1.Addr()}},
+		}))
+	}
+	waitConnected(d)
+
+	s := newTestSession()
+
+	resp := execRequest(s, d, "PROXY", "READ")
+	assert.Must(string(resp.Value) == "replica")
+	execRequest(s, d, "GET", "key")
+	assert.Must(len(b0.Calls()) == 0 && len(b1.Calls()) == 1)
+
+	resp = execRequest(s, d, "PROXY", "READ", "master")
+	assert.Must(resp.IsString())
+	execRequest(s, d, "GET", "key")
+	assert.Must(len(b0.Calls()) == 1 && len(b1.Calls()) == 1)
+
+	resp = execRequest(s, d, "PROXY", "READ", "roundrobin")
+	assert.Must(resp.IsString())
+	for i := 0; i < 4; i++ {
+		execRequest(s, d, "GET", "key")
+	}
+	assert.Must(len(b0.Calls()) == 3 && len(b1.Calls()) == 3)
+
+	execRequest(s, d, "SET", "key", "value")
+	assert.Must(len(b0.Calls()) == 4 && len(b1.Calls()) == 3)
+
+	resp = execRequest(s, d, "PROXY", "READ", "nearest")
+	assert.Must(resp.IsError())
+}
+
+func TestSessionReplicaWeights(t *testing.T) {
+	b0, b1, b2 := newFakeBackend(), newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+	defer b2.Close()
+
+	d := NewRouter(config)
+	defer d.Close()
+	fill := func(w1, w2 int) {
+		assert.MustNoError(d.FillSlot(&models.Slot{
+			Id: d.hashSlot([]byte("key")), BackendAddr: b0.Addr(),
+			ReplicaGroups:  [][]string{{b1.Addr(), b2.Addr()}},
+			ReplicaWeights: [][]int{{w1, w2}},
+		}))
+		waitConnected(d)
+	}
+	fill(3, 1)
+
+	// Reads of the slot are spread by weight, whichever session sends them.
+	s0, s1 := newTestSession(), newTestSession()
+	for i := 0; i < 4; i++ {
+		execRequest(s0, d, "GET", "key")
+		execRequest(s1, d, "GET", "key")
+	}
+	assert.Must(len(b0.Calls()) == 0 && len(b1.Calls()) == 6 && len(b2.Calls()) == 2)
+
+	fill(0, 1)
+	for i := 0; i < 4; i++ {
+		execRequest(s0, d, "GET", "key")
+	}
+	assert.Must(len(b0.Calls()) == 0 && len(b1.Calls()) == 6 && len(b2.Calls()) == 6)
+
+	m := d.GetSlot(d.hashSlot([]byte("key")))
+	assert.Must(len(m.ReplicaWeights) == 1 && m.ReplicaWeights[0][0] == 0 && m.ReplicaWeights[0][1] == 1)
+	m.ReplicaWeights[0][0] = 5
+	assert.Must(d.GetSlot(d.hashSlot([]byte("key"))).ReplicaWeights[0][0] == 0)
+}
+
+func TestSessionReplicaHealth(t *testing.T) {
+	b0, b1, b2 := newFakeBackend(), newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+	defer b2.Close()
+
+	c := *config
+	c.BackendHealthScoreWindow.Set(time.Minute)
+	c.BackendHealthMinScore = 0.5
+
+	d := NewRouter(&c)
+	defer d.Close()
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: d.hashSlot([]byte("key")), BackendAddr: b0.Addr(),
+		ReplicaGroups: [][]string{{b1.Addr(), b2.Addr()}},
+	}))
+	waitConnected(d)
+
+	// Pretend samples are from the future, so they don't decay or change.
+	var fail = func(b *fakeBackend, errors float64) {
+		h := d.pool.replica.Get(b.Addr()).health
+		h.mu.Lock()
+		h.errors, h.last = errors, time.Now().Add(time.Hour).UnixNano()
+		h.mu.Unlock()
+	}
+
+	s := newTestSession()
+	fail(b1, 0.2)
+	for i := 0; i < 4; i++ {
+		execRequest(s, d, "GET", "key")
+	}
+	assert.Must(len(b0.Calls()) == 0 && len(b1.Calls()) == 0 && len(b2.Calls()) == 4)
+
+	fail(b2, 0.6)
+	for i := 0; i < 4; i++ {
+		execRequest(s, d, "GET", "key")
+	}
+	assert.Must(len(b0.Calls()) == 0 && len(b1.Calls()) == 4 && len(b2.Calls()) == 4)
+
+	fail(b1, 0.8)
+	for i := 0; i < 4; i++ {
+		execRequest(s, d, "GET", "key")
+	}
+	assert.Must(len(b0.Calls()) == 4 && len(b1.Calls()) == 4 && len(b2.Calls()) == 4)
+}
+
+func TestSessionFunction(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	waitConnected(d)
+
+	s := newTestSession()
+	resp := execRequest(s, d, "FUNCTION", "LOAD", "#!lua name=mylib")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "mylib")
+	resp = execRequest(s, d, "FUNCTION", "DELETE", "mylib")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	for _, b := range []*fakeBackend{b0, b1} {
+		calls := b.Calls()
+		assert.Must(len(calls) == 2)
+		assert.Must(calls[0] == "FUNCTION LOAD #!lua name=mylib")
+		assert.Must(calls[1] == "FUNCTION DELETE mylib")
+	}
+
+	resp = execRequest(s, d, "FUNCTION", "LIST")
+	assert.Must(resp.IsArray())
+	assert.Must(len(b0.Calls())+len(b1.Calls()) == 5)
+	assert.Must(execRequest(s, d, "FUNCTION", "KILL").IsError())
+	assert.Must(execRequest(s, d, "FUNCTION").IsError())
+
+	execRequest(s, d, "SET", "a", "1")
+	resp = execRequest(s, d, "FCALL_RO", "myfunc", "1", "a")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "1")
+	resp = execRequest(s, d, "FCALL", "myfunc", "1", "a")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "1")
+	calls := b1.Calls()
+	assert.Must(calls[len(calls)-1] == "FCALL myfunc 1 a")
+}
+
+func TestSessionEval(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SET", "{a}1", "x")
+	for _, op := range []string{"EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO"} {
+		resp := execRequest(s, d, op, "script", "2", "{a}1", "{a}2", "arg")
+		assert.Must(resp.IsBulkBytes() && string(resp.Value) == "x")
+		calls := b1.Calls()
+		assert.Must(calls[len(calls)-1] == op+" script 2 {a}1 {a}2 arg")
+
+		resp = execRequest(s, d, op, "script", "2", "a", "d")
+		assert.Must(resp.IsError() && string(resp.Value) == string(RespCrossSlot.Value))
+	}
+	assert.Must(len(b1.Calls()) == 5)
+
+	// Arguments after the keys are not checked.
+	resp := execRequest(s, d, "EVAL", "script", "1", "a", "d")
+	assert.Must(resp.IsBulkBytes())
+	for _, args := range [][]string{
+		{"EVAL", "script"},
+		{"EVAL", "script", "x"},
+		{"EVAL", "script", "-1"},
+		{"EVAL", "script", "2", "a"},
+	} {
+		assert.Must(execRequest(s, d, args...).IsError())
+	}
+	assert.Must(len(b0.Calls()) == 0 && len(b1.Calls()) == 6)
+}
+
+func TestSessionMPop(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "LMPOP", "2", "{a}1", "{a}2", "LEFT", "COUNT", "2")
+	execRequest(s, d, "ZMPOP", "1", "a", "MIN")
+	calls := b1.Calls()
+	assert.Must(len(calls) == 2)
+	assert.Must(calls[0] == "LMPOP 2 {a}1 {a}2 LEFT COUNT 2")
+	assert.Must(calls[1] == "ZMPOP 1 a MIN")
+
+	for _, op := range []string{"LMPOP", "ZMPOP"} {
+		resp := execRequest(s, d, op, "2", "a", "d", "MAX")
+		assert.Must(resp.IsError() && string(resp.Value) == string(RespCrossSlot.Value))
+		assert.Must(execRequest(s, d, op, "3", "a", "MAX").IsError())
+		assert.Must(execRequest(s, d, op).IsError())
+	}
+	assert.Must(len(b0.Calls()) == 0 && len(b1.Calls()) == 2)
+}
+
+func TestSessionBitOp(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "BITOP", "AND", "{a}dest", "a", "{a}1")
+	execRequest(s, d, "BITOP", "OR", "{a}dest", "a", "{a}1", "{a}2")
+	execRequest(s, d, "BITOP", "XOR", "{a}dest", "a")
+	execRequest(s, d, "BITOP", "NOT", "{a}dest", "a")
+	calls := b1.Calls()
+	assert.Must(len(calls) == 4)
+	assert.Must(calls[0] == "BITOP AND {a}dest a {a}1")
+	assert.Must(calls[3] == "BITOP NOT {a}dest a")
+
+	for _, args := range [][]string{
+		{"BITOP", "AND", "a", "d"},
+		{"BITOP", "OR", "a", "{a}1", "d"},
+		{"BITOP", "XOR", "d", "a", "{a}1"},
+		{"BITOP", "NOT", "d", "a"},
+	} {
+		resp := execRequest(s, d, args...)
+		assert.Must(resp.IsError() && string(resp.Value) == string(RespCrossSlot.Value))
+	}
+	assert.Must(execRequest(s, d, "BITOP", "NOT", "a").IsError())
+	assert.Must(len(b0.Calls()) == 0 && len(b1.Calls()) == 4)
+}
+
+func TestSessionBitField(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := NewRouter(config)
+	defer d.Close()
+	var id = d.hashSlot([]byte("{x}"))
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: id, BackendAddr: b0.Addr(), ReplicaGroups: [][]string{{b1.Addr()}},
+	}))
+	waitConnected(d)
+
+	s := newTestSession()
+	resp := execRequest(s, d, "BITFIELD", "{x}1", "OVERFLOW", "SAT", "INCRBY", "u8", "0", "1")
+	assert.Must(resp.IsArray() && len(resp.Array) == 1)
+	resp = execRequest(s, d, "BITFIELD_RO", "{x}1", "GET", "u8", "0")
+	assert.Must(resp.IsArray() && len(resp.Array) == 1)
+	assert.Must(len(b0.Calls()) == 1 && strings.HasPrefix(b0.Calls()[0], "BITFIELD {x}1"))
+	assert.Must(len(b1.Calls()) == 1 && strings.HasPrefix(b1.Calls()[0], "BITFIELD_RO {x}1"))
+
+	// The key has been migrated already, so it's handled by the target.
+	for _, method := range []int{models.ForwardSync, models.ForwardSemiAsync} {
+		assert.MustNoError(d.FillSlot(&models.Slot{
+			Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(), ForwardMethod: method,
+		}))
+		execRequest(s, d, "SET", "{x}2", "value")
+		resp = execRequest(s, d, "BITFIELD", "{x}2", "OVERFLOW", "FAIL", "SET", "u8", "0", "1")
+		assert.Must(resp.IsArray() && len(resp.Array) == 1)
+		calls := b1.Calls()
+		assert.Must(calls[len(calls)-1] == "BITFIELD {x}2 OVERFLOW FAIL SET u8 0 1")
+		for _, call := range b0.Calls() {
+			assert.Must(!strings.HasPrefix(call, "BITFIELD {x}2"))
+		}
+	}
+}
+
+func TestSessionLPos(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+	waitConnected(d)
+
+	s := newTestSession()
+	execRequest(s, d, "RPUSH", "{x}1", "a", "b", "c")
+	resp := execRequest(s, d, "LPOS", "{x}1", "c", "RANK", "1")
+	assert.Must(resp.IsInt() && string(resp.Value) == "2")
+	assert.Must(b0.Calls()[1] == "LPOS {x}1 c RANK 1")
+
+	var id = d.hashSlot([]byte("{x}"))
+	for _, method := range []int{models.ForwardSync, models.ForwardSemiAsync} {
+		assert.MustNoError(d.FillSlot(&models.Slot{
+			Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(), ForwardMethod: method,
+		}))
+		waitConnected(d)
+
+		// The key has been migrated already, so it's handled by the target.
+		execRequest(s, d, "RPUSH", "{x}2", "a", "b")
+		resp = execRequest(s, d, "LPOS", "{x}2", "b")
+		assert.Must(resp.IsInt() && string(resp.Value) == "1")
+		calls := b1.Calls()
+		assert.Must(calls[len(calls)-1] == "LPOS {x}2 b")
+
+		resp = execRequest(s, d, "LPOS", "{x}2", "z")
+		assert.Must(resp.IsBulkBytes() && resp.Value == nil)
+		execRequest(s, d, "DEL", "{x}2")
+	}
+	for _, call := range b0.Calls() {
+		assert.Must(!strings.HasPrefix(call, "LPOS {x}2"))
+	}
+}
+
+func TestSessionSlowLog(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+	d.slowlog = NewSlowLog(time.Millisecond, 16)
+
+	s := newTestSession()
+	s.admin = true
+
+	for i := 0; i < 3; i++ {
+		r := newRequest("GET", "key"+strconv.Itoa(i))
+		r.Backend = b.Addr()
+		d.slowlog.Record(r, "127.0.0.1:10000", time.Millisecond*20)
+	}
+	assert.Must(len(d.GetSlowLog()) == 3)
+
+	resp := execRequest(s, d, "PROXY", "SLOWLOG", "LEN")
+	assert.Must(resp.IsInt() && string(resp.Value) == "3")
+
+	resp = execRequest(s, d, "PROXY", "SLOWLOG", "GET", "2")
+	assert.Must(resp.IsArray() && len(resp.Array) == 2)
+	e := resp.Array[0].Array
+	assert.Must(string(e[0].Value) == "2")
+	assert.Must(string(e[2].Value) == "20000")
+	assert.Must(len(e[3].Array) == 2 && string(e[3].Array[1].Value) == "key2")
+	assert.Must(string(e[4].Value) == "127.0.0.1:10000")
+	assert.Must(string(e[5].Value) == "key2")
+	assert.Must(string(e[6].Value) == b.Addr())
+
+	resp = execRequest(s, d, "PROXY", "SLOWLOG", "GET", "x")
+	assert.Must(resp.IsError())
+
+	resp = execRequest(s, d, "PROXY", "SLOWLOG", "RESET")
+	assert.Must(resp.IsString())
+	resp = execRequest(s, d, "PROXY", "SLOWLOG", "GET")
+	assert.Must(resp.IsArray() && len(resp.Array) == 0)
+}
+
+func scanAll(s *Session, d *Router, args ...string) ([]string, int) {
+	var keys []string
+	var cursor, calls = "0", 0
+	for {
+		resp := execRequest(s, d, append([]string{"SCAN", cursor}, args...)...)
+		assert.Must(resp.IsArray() && len(resp.Array) == 2)
+		for _, key := range resp.Array[1].Array {
+			keys = append(keys, string(key.Value))
+		}
+		calls++
+		if cursor = string(resp.Array[0].Value); cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(keys)
+	return keys, calls
+}
+
+func TestSessionScan(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+
+	var expect []string
+	for i := 0; i < 64; i++ {
+		key := "key" + strconv.Itoa(i)
+		execRequest(s, d, "SET", key, "value")
+		expect = append(expect, key)
+	}
+	for i := 0; i < 8; i++ {
+		key := "{tag}" + strconv.Itoa(i)
+		execRequest(s, d, "SET", key, "value")
+		expect = append(expect, key)
+	}
+	sort.Strings(expect)
+
+	keys, calls := scanAll(s, d, "COUNT", "2")
+	assert.Must(strings.Join(keys, ",") == strings.Join(expect, ","))
+	assert.Must(calls > MaxSlotNum)
+
+	keys, _ = scanAll(s, d, "MATCH", "key1*")
+	assert.Must(len(keys) == 11)
+	for _, key := range keys {
+		assert.Must(strings.HasPrefix(key, "key1"))
+	}
+
+	resp := execRequest(s, d, "SCAN", "x")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "SCAN", "0", "TYPE", "string")
+	assert.Must(resp.IsError())
+
+	c := *config
+	c.ScanAggregation = false
+	s.config = &c
+	assert.Must(s.handleRequest(newRequest("SCAN", "0"), d) != nil)
+}
+
+func TestSessionSelect(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	s := newTestSession()
+	resp := execRequest(s, d, "SELECT", "2")
+	assert.Must(resp.IsString() && s.database == 2)
+	r := newRequest("SET", "key", "value")
+	r.Database = s.database
+	assert.MustNoError(s.handleRequest(r, d))
+	_, err := s.handleResponse(r)
+	assert.MustNoError(err)
+	assert.Must(r.Database == 2 && r.Backend == b.Addr())
+	assert.Must(d.pool.primary.Get(b.Addr()).BackendConn(2, 0, false) != nil)
+
+	resp = execRequest(s, d, "SELECT", "16")
+	assert.Must(resp.IsError() && s.database == 2)
+
+	c := *config
+	c.AllowSelect = false
+	s.config = &c
+	resp = execRequest(s, d, "SELECT", "1")
+	assert.Must(resp.IsError() && s.database == 2)
+	resp = execRequest(s, d, "SELECT", "0")
+	assert.Must(resp.IsString() && s.database == 0)
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, x := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a[bc]d", "acd", true},
+		{"a[^bc]d", "acd", false},
+		{"a[a-c]d", "abd", true},
+		{"a[a-c]d", "add", false},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"key:{*}", "key:{1}", true},
+	} {
+		assert.Must(globMatch([]byte(x.pattern), []byte(x.s)) == x.match)
+	}
+}
+
+func TestSessionXRead(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	var keys []string
+	for i := 0; len(keys) < 4; i++ {
+		key := "stream" + strconv.Itoa(i)
+		if len(keys) == 0 || d.hashSlot([]byte(key))%2 != d.hashSlot([]byte(keys[len(keys)-1]))%2 {
+			keys = append(keys, key)
+		}
+	}
+
+	s := newTestSession()
+	resp := execRequest(s, d, "XREAD", "COUNT", "10", "STREAMS", keys[0], keys[1], "0", "0")
+	assert.Must(resp.IsArray() && resp.Array == nil)
+
+	for _, key := range []string{keys[0], keys[1], keys[3]} {
+		execRequest(s, d, "SET", key, "value-"+key)
+	}
+	resp = execRequest(s, d, "XREAD", "COUNT", "10", "STREAMS", keys[3], keys[2], keys[1], keys[0], "0", "0", "0", "0")
+	assert.Must(len(resp.Array) == 3)
+	for i, key := range []string{keys[3], keys[1], keys[0]} {
+		e := resp.Array[i]
+		assert.Must(string(e.Array[0].Value) == key)
+		assert.Must(string(e.Array[1].Array[0].Array[1].Array[1].Value) == "value-"+key)
+	}
+	assert.Must(b0.Calls()[len(b0.Calls())-1] != b1.Calls()[len(b1.Calls())-1])
+
+	resp = execRequest(s, d, "XREADGROUP", "GROUP", "g", "c", "NOACK", "STREAMS", keys[0], keys[1], ">", ">")
+	assert.Must(len(resp.Array) == 2 && string(resp.Array[0].Array[0].Value) == keys[0])
+
+	resp = execRequest(s, d, "XREAD", "BLOCK", "100", "STREAMS", keys[0], "$")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "XREAD", "BLOCK", "100", "STREAMS", keys[0], keys[1], "$", "$")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "XREAD", "STREAMS", keys[0], keys[1], "0")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "XREAD", "NOACK", "STREAMS", keys[0], "0")
+	assert.Must(resp.IsError())
+}
+
+func TestSessionCommandStats(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	c := newTestAdminClient(d)
+	defer c.Close()
+
+	execCommand(c, "PROXY", "STATS", "RESET")
+	readReply(c)
+	for i := 0; i < 3; i++ {
+		execCommand(c, "SET", "key", "value")
+		readReply(c)
+	}
+	execCommand(c, "HSET", "hash", "field", "value")
+	readReply(c)
+	execCommand(c, "PING")
+	readReply(c)
+
+	var stats map[string]*CommandStats
+	for i := 0; i < 100; i++ {
+		stats = d.GetCommandStats()
+		if stats["server"].Calls == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(len(stats) == numCommandFamilies)
+	assert.Must(stats["string"].Calls == 3 && stats["hash"].Calls == 1 && stats["server"].Calls == 2)
+	assert.Must(stats["string"].Counts[len(latencyBounds)-1] == 3)
+	assert.Must(stats["string"].P50 != 0 && stats["string"].P50 <= stats["string"].P999)
+	assert.Must(stats["zset"].Calls == 0 && stats["zset"].P99 == 0)
+
+	execCommand(c, "PROXY", "STATS", "RESET")
+	readReply(c)
+	assert.Must(d.GetCommandStats()["string"].Calls == 0)
+
+	execCommand(c, "PROXY", "STATS", "CLEAR")
+	assert.Must(readReply(c).IsError())
+}
+
+func TestCommandStatsPercentile(t *testing.T) {
+	var s commandStats
+	for i := 0; i < 1000; i++ {
+		s.incrLatency(time.Microsecond * 50)
+	}
+	s.incrLatency(time.Millisecond * 3)
+	s.incrLatency(time.Second * 3)
+	o := s.CommandStats("list")
+	assert.Must(o.Calls == 1002 && o.P50 == 100 && o.P99 == 100)
+	assert.Must(o.P999 == 5000)
+	s.incrLatency(time.Second * 2)
+	s.incrLatency(time.Second * 2)
+	o = s.CommandStats("list")
+	assert.Must(o.P999 == 3000000)
+
+	assert.Must(getCommandFamily("HGETALL") == commandFamilyHash)
+	assert.Must(getCommandFamily("HELLO") == commandFamilyServer)
+	assert.Must(getCommandFamily("SET") == commandFamilyString)
+	assert.Must(getCommandFamily("SADD") == commandFamilySet)
+	assert.Must(getCommandFamily("GEOADD") == commandFamilyZSet)
+	assert.Must(getCommandFamily("XADD") == commandFamilyStream)
+	assert.Must(getCommandFamily("DEL") == commandFamilyServer)
+}
+
+func TestSessionProxyResetBackend(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+	waitConnected(d)
+
+	s := newTestSession()
+	s.admin = true
+	resp := execRequest(s, d, "PROXY", "RESET-BACKEND", b.Addr())
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+
+	bc := d.pool.primary.Get(b.Addr()).BackendConn(0, 0, true)
+	for bc.state.Int64() != stateIdle {
+		time.Sleep(time.Millisecond * 10)
+	}
+	resp = execRequest(s, d, "SET", "a", "1")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+
+	resp = execRequest(s, d, "PROXY", "RESET-BACKEND", "127.0.0.1:1")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "PROXY", "RESET-BACKEND")
+	assert.Must(resp.IsError())
+}
+
+func TestSessionProxyKillClient(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	c1 := newTestClient(d)
+	defer c1.Close()
+	c2 := newTestAdminClient(d)
+	defer c2.Close()
+
+	execCommand(c2, "PROXY", "KILL", "CLIENT", c1.LocalAddr())
+	resp := readReply(c2)
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	execCommand(c2, "PROXY", "KILL", "CLIENT", c1.LocalAddr())
+	resp = readReply(c2)
+	assert.Must(resp.IsInt() && string(resp.Value) == "0")
+	execCommand(c2, "PROXY", "KILL", "CLIENT")
+	assert.Must(readReply(c2).IsError())
+
+	_, err := c1.Decode()
+	assert.Must(err != nil)
+
+	execCommand(c2, "SET", "a", "1")
+	resp = readReply(c2)
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+}
+
+func waitSessionsClosed() {
+	for i := 0; i < 100 && SessionsAlive() != 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Must(SessionsAlive() == 0)
+}
+
+func TestSessionMaxClientsLimit(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	waitSessionsClosed()
+
+	c := *config
+	c.ProxyMaxClientsSoftLimit = 1
+	c1 := newTestClientConfig(d, &c)
+	defer c1.Close()
+	execCommand(c1, "SET", "a", "1")
+	assert.Must(readReply(c1).IsString())
+
+	var rejected = SessionsRejected()
+	c2 := newTestClientConfig(d, &c)
+	defer c2.Close()
+	resp, err := c2.Decode()
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR max number of clients reached")
+	assert.Must(SessionsRejected() == rejected+1)
+
+	c.ProxyMaxClientsSoftLimit = 0
+	c.ProxyMaxClientsHardLimit = 1
+	c3 := newTestClientConfig(d, &c)
+	defer c3.Close()
+	execCommand(c3, "SET", "a", "2")
+	assert.Must(readReply(c3).IsString())
+	_, err = c1.Decode()
+	assert.Must(err != nil)
+	assert.Must(SessionsRejected() == rejected+1)
+
+	// Evicting a session makes room even if the other limits are reached.
+	c.ProxyMaxClients = 1
+	c.ProxyMaxClientsSoftLimit = 1
+	c4 := newTestClientConfig(d, &c)
+	defer c4.Close()
+	execCommand(c4, "SET", "a", "3")
+	assert.Must(readReply(c4).IsString())
+	_, err = c3.Decode()
+	assert.Must(err != nil)
+	assert.Must(SessionsRejected() == rejected+1)
+}
+
+func TestSessionMaxClientsSoftAndHardLimit(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	waitSessionsClosed()
+
+	c := *config
+	c.ProxyMaxClients = 3
+	c.ProxyMaxClientsSoftLimit = 1
+	c.ProxyMaxClientsHardLimit = 2
+	assert.MustNoError(c.Validate())
+	c1 := newTestClientConfig(d, &c)
+	defer c1.Close()
+	execCommand(c1, "SET", "a", "1")
+	assert.Must(readReply(c1).IsString())
+
+	// The refused session is counted until its reply is read.
+	var rejected = SessionsRejected()
+	client, sock := net.Pipe()
+	defer client.Close()
+	NewSession(sock, &c).Start(d)
+	for SessionsRejected() != rejected+1 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Must(SessionsAlive() == 2)
+
+	// Past the hard limit, the idlest session is closed for the new one.
+	c3 := newTestClientConfig(d, &c)
+	defer c3.Close()
+	execCommand(c3, "SET", "a", "3")
+	assert.Must(readReply(c3).IsString())
+	_, err := c1.Decode()
+	assert.Must(err != nil)
+
+	resp, err := redis.NewConn(client, 1024, 1024).Decode()
+	assert.MustNoError(err)
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR max number of clients reached")
+	assert.Must(SessionsRejected() == rejected+1)
+
+	c.ProxyMaxClientsSoftLimit = 3
+	assert.Must(c.Validate() != nil)
+	c.ProxyMaxClientsSoftLimit = 1
+	c.ProxyMaxClientsHardLimit = 4
+	assert.Must(c.Validate() != nil)
+}
+
+func TestRouterListClients(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	c1 := newTestClient(d)
+	defer c1.Close()
+	c2 := newTestClient(d)
+	defer c2.Close()
+
+	execCommand(c1, "SET", "a", "1")
+	assert.Must(readReply(c1).IsString())
+	execCommand(c2, "MULTI")
+	assert.Must(readReply(c2).IsString())
+
+	clients := d.ListClients()
+	assert.Must(len(clients) == 2)
+	var infos = make(map[string]*admin.ClientInfo)
+	for _, c := range clients {
+		infos[c.Addr] = c
+	}
+	assert.Must(infos[c1.LocalAddr()].Command == "set" && infos[c1.LocalAddr()].Flags == "N")
+	assert.Must(infos[c2.LocalAddr()].Command == "multi" && infos[c2.LocalAddr()].Flags == "x")
+
+	assert.Must(d.KillClient(c1.LocalAddr()))
+	assert.Must(!d.KillClient(c1.LocalAddr()))
+	assert.Must(len(d.ListClients()) == 1)
+}
+
+func TestSessionProxyAuth(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	s := newTestSession()
+	resp := execRequest(s, d, "PROXY", "RESET-BACKEND", b.Addr())
+	assert.Must(resp.IsError() && strings.Contains(string(resp.Value), "disabled"))
+	assert.Must(execRequest(s, d, "PROXY", "AUTH", "").IsError())
+
+	c := *config
+	c.EnableProxyAdminCommands = true
+	s.config = &c
+	assert.Must(execRequest(s, d, "PROXY", "AUTH", "").IsError())
+
+	c.ProductAuth = "admin"
+	for _, args := range [][]string{
+		{"PROXY", "DRAIN"},
+		{"PROXY", "KILL", "CLIENT", "127.0.0.1:1"},
+		{"PROXY", "RESET-BACKEND", b.Addr()},
+		{"PROXY", "SLOTS-RELOAD"},
+		{"PROXY", "MIGRATE-KEY", "0", "a"},
+		{"PROXY", "LOGLEVEL", "debug"},
+		{"PROXY", "STATS", "RESET"},
+		{"PROXY", "SLOWLOG", "RESET"},
+	} {
+		resp := execRequest(s, d, args...)
+		assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "NOPERM"))
+	}
+	resp = execRequest(s, d, "PROXY", "LOGLEVEL")
+	assert.Must(resp.IsBulkBytes())
+	resp = execRequest(s, d, "PROXY", "SLOWLOG", "LEN")
+	assert.Must(resp.IsInt())
+	resp = execRequest(s, d, "PROXY", "STATS", "LATENCY")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "ERR unknown subcommand"))
+	resp = execRequest(s, d, "PROXY", "HINT", "ENCODING", "a", "raw")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR encoding cache is disabled")
+
+	assert.Must(execRequest(s, d, "PROXY", "AUTH", "x").IsError())
+	assert.Must(!s.admin)
+	resp = execRequest(s, d, "PROXY", "AUTH", "admin")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "PROXY", "RESET-BACKEND", b.Addr())
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+
+	execRequest(s, d, "RESET")
+	resp = execRequest(s, d, "PROXY", "RESET-BACKEND", b.Addr())
+	assert.Must(resp.IsError())
+}
+
+func TestSessionProxyDrain(t *testing.T) {
+	p, _ := openProxy()
+	defer p.Close()
+
+	s := newTestSession()
+	s.admin = true
+	for _, args := range [][]string{
+		{"PROXY", "DRAIN", "TIMEOUT"},
+		{"PROXY", "DRAIN", "TIMEOUT", "0"},
+		{"PROXY", "DRAIN", "DEADLINE", "1"},
+		{"PROXY", "DRAIN"},
+	} {
+		assert.Must(execRequest(s, p.router, args...).IsError())
+	}
+
+	s.proxy = p
+	resp := execRequest(s, p.router, "PROXY", "DRAIN", "TIMEOUT", "1")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	assert.Must(p.IsDraining())
+	assert.Must(execRequest(s, p.router, "PROXY", "DRAIN").IsError())
+}
+
+func TestSessionProxySlotsReload(t *testing.T) {
+	p, _ := openProxy()
+	defer p.Close()
+
+	s := newTestSession()
+	s.admin = true
+	assert.Must(execRequest(s, p.router, "PROXY", "SLOTS-RELOAD").IsError())
+
+	s.proxy = p
+	resp := execRequest(s, p.router, "PROXY", "SLOTS-RELOAD")
+	assert.Must(resp.IsError() && strings.Contains(string(resp.Value), ErrNoSlotsLoader.Error()))
+
+	var done = make(chan struct{})
+	p.SetSlotsLoader(func() ([]*models.Slot, error) {
+		defer close(done)
+		return []*models.Slot{}, nil
+	})
+	resp = execRequest(s, p.router, "PROXY", "SLOTS-RELOAD")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	<-done
+	assert.Must(execRequest(s, p.router, "PROXY", "SLOTS-RELOAD", "NOW").IsError())
+}
+
+func TestSessionProxyVersion(t *testing.T) {
+	d := NewRouter(config)
+	defer d.Close()
+
+	s := newTestSession()
+	resp := execRequest(s, d, "PROXY", "VERSION")
+	assert.Must(resp.IsBulkBytes())
+	var lines = strings.Split(strings.TrimSpace(string(resp.Value)), "\r\n")
+	assert.Must(len(lines) == 3)
+	assert.Must(lines[0] == "version:"+utils.Version)
+	assert.Must(lines[1] == "compile:"+utils.Compile)
+	assert.Must(lines[2] == "go_version:"+runtime.Version())
+
+	assert.Must(execRequest(s, d, "PROXY", "VERSION", "x").IsError())
+}
+
+func TestSessionProxyLogLevel(t *testing.T) {
+	d := NewRouter(config)
+	defer d.Close()
+
+	defer log.SetLevel(log.GetLevel())
+	s := newTestSession()
+	s.admin = true
+	resp := execRequest(s, d, "PROXY", "LOGLEVEL", "error")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "PROXY", "LOGLEVEL")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "error")
+	resp = execRequest(s, d, "PROXY", "INFO", "proxy")
+	assert.Must(strings.Contains(string(resp.Value), "log_level:error\r\n"))
+
+	assert.Must(execRequest(s, d, "PROXY", "LOGLEVEL", "x").IsError())
+	assert.Must(execRequest(s, d, "PROXY", "LOGLEVEL", "info", "x").IsError())
+	assert.Must(log.GetLevel() == log.LevelError)
+}
+
+func TestSessionReadOnly(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SET", "a", "1")
+
+	d.SetReadOnly(true)
+	for _, args := range [][]string{
+		{"SET", "a", "2"}, {"DEL", "a"}, {"INCR", "a"}, {"LPUSH", "l", "x"}, {"ZADD", "z", "1", "m"},
+	} {
+		resp := execRequest(s, d, args...)
+		assert.Must(resp.IsError() && string(resp.Value) == string(RespReadOnly.Value))
+	}
+	resp := execRequest(s, d, "GET", "a")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "1")
+	resp = execRequest(s, d, "PROXY", "INFO", "proxy")
+	assert.Must(strings.Contains(string(resp.Value), "read_only:1\r\n"))
+	assert.Must(len(b.Calls()) == 2)
+
+	d.SetReadOnly(false)
+	resp = execRequest(s, d, "SET", "a", "2")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "PROXY", "INFO", "proxy")
+	assert.Must(strings.Contains(string(resp.Value), "read_only:0\r\n"))
+}
+
+func TestSessionBlockedKeyPrefixes(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	c := *config
+	c.BlockedKeyPrefixes = []string{"__codis__:"}
+	s := newTestSession()
+	s.config = &c
+
+	b.Lock()
+	b.data["__codis__:x"] = "1"
+	b.Unlock()
+
+	for _, args := range [][]string{
+		{"SET", "__codis__:x", "2"}, {"DEL", "__codis__:x"}, {"SET", "{__codis__:migrate}:foo", "1"},
+		{"MSET", "a", "1", "__codis__:y", "2"}, {"DEL", "a", "__codis__:x"},
+		{"SET", "__codis__:{a}x", "1"},
+	} {
+		resp := execRequest(s, d, args...)
+		assert.Must(resp.IsError() && string(resp.Value) == string(RespBlocked.Value))
+	}
+	assert.Must(len(b.Calls()) == 0)
+
+	resp := execRequest(s, d, "GET", "__codis__:x")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "1")
+	resp = execRequest(s, d, "SET", "{a}__codis__:x", "1")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+
+	c.BlockedKeyPrefixes = []string{""}
+	assert.Must(c.Validate() != nil)
+}
+
+func TestSessionRequestID(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	c := *config
+	c.EnableRequestIDPropagation = true
+	d := NewRouter(&c)
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(&models.Slot{Id: i, BackendAddr: b.Addr()}))
+	}
+	d.Start()
+
+	s := newTestSession()
+	resp := execRequest(s, d, "PROXY", "REQUEST-ID", "bad id")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "PROXY", "REQUEST-ID", "trace-1")
+	assert.Must(resp.IsString() && s.requestID == "trace-1")
+	resp = execRequest(s, d, "PROXY", "REQUEST-ID")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "trace-1")
+
+	execRequest(s, d, "SET", "a", "1")
+	execRequest(s, d, "GET", "a")
+	execRequest(s, d, "PROXY", "REQUEST-ID", "trace-2")
+	resp = execRequest(s, d, "GET", "a")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "1")
+
+	var calls = b.Calls()
+	assert.Must(len(calls) == 5)
+	assert.Must(calls[0] == "CLIENT SETNAME trace-1" && calls[1] == "SET a 1" && calls[2] == "GET a")
+	assert.Must(calls[3] == "CLIENT SETNAME trace-2" && calls[4] == "GET a")
+
+	assert.Must(d.pool.primary.Get(b.Addr()).BackendConn(0, 0, false).pending.Int64() == 0)
+}
+
+func TestSessionProxyInfo(t *testing.T) {
+	p, _ := openProxy()
+	defer p.Close()
+
+	d := p.router
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: 0, Locked: true}))
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: 1, BackendAddr: "127.0.0.1:1", MigrateFrom: "127.0.0.1:2"}))
+
+	s := newTestSession()
+	s.proxy = p
+
+	resp := execRequest(s, d, "PROXY", "INFO")
+	assert.Must(resp.IsBulkBytes())
+	info := string(resp.Value)
+	for _, line := range []string{
+		"# Proxy", "# Slots", "# Backends", "# HA", "# Clients",
+		"process_id:" + strconv.Itoa(os.Getpid()),
+		"token:" + p.Model().Token,
+		"slots_locked:1",
+		"slots_migrating:1",
+		"slots_offline:1023",
+		"primary_servers:2",
+		"connected_clients:",
+	} {
+		assert.Must(strings.Contains(info, line))
+	}
+
+	resp = execRequest(s, d, "PROXY", "INFO", "SLOTS")
+	info = string(resp.Value)
+	assert.Must(strings.HasPrefix(info, "# Slots\r\n"))
+	assert.Must(!strings.Contains(info, "# Proxy"))
+
+	resp = execRequest(s, d, "PROXY", "INFO", "nothing")
+	assert.Must(resp.IsBulkBytes() && len(resp.Value) == 0)
+
+	resp = execRequest(s, d, "PROXY", "INFO", "slots", "ha")
+	assert.Must(resp.IsError())
+}
+
+func newTestClient(d *Router) *redis.Conn {
+	return newTestClientConfig(d, config)
+}
+
+// newTestAdminClient returns a client that has been granted the PROXY
+// subcommands changing the state of the proxy.
+func newTestAdminClient(d *Router) *redis.Conn {
+	c := *config
+	c.EnableProxyAdminCommands = true
+	c.ProductAuth = "admin"
+	conn := newTestClientConfig(d, &c)
+	execCommand(conn, "PROXY", "AUTH", "admin")
+	resp := readReply(conn)
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	return conn
+}
+
+func newTestClientConfig(d *Router, config *Config) *redis.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.MustNoError(err)
+	defer l.Close()
+
+	c, err := redis.DialTimeout(l.Addr().String(), time.Second, 1024, 1024)
+	assert.MustNoError(err)
+	c.ReaderTimeout = time.Second * 5
+
+	sock, err := l.Accept()
+	assert.MustNoError(err)
+	NewSession(sock, config).Start(d)
+	return c
+}
+
+func execCommand(c *redis.Conn, args ...string) {
+	var multi []*redis.Resp
+	for _, arg := range args {
+		multi = append(multi, redis.NewBulkBytes([]byte(arg)))
+	}
+	assert.MustNoError(c.EncodeMultiBulk(multi, true))
+}
+
+func readReply(c *redis.Conn, values ...string) *redis.Resp {
+	resp, err := c.Decode()
+	assert.MustNoError(err)
+	if len(values) != 0 {
+		assert.Must(resp.Array != nil && len(resp.Array) == len(values))
+		for i, v := range values {
+			assert.Must(string(resp.Array[i].Value) == v)
+		}
+	}
+	return resp
+}
+
+func TestSessionPubSub(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	sub := newTestClient(d)
+	defer sub.Close()
+	pub := newTestClient(d)
+	defer pub.Close()
+
+	execCommand(sub, "SUBSCRIBE", "{a}news", "{a}sports")
+	readReply(sub, "subscribe", "{a}news", "1")
+	readReply(sub, "subscribe", "{a}sports", "2")
+
+	execCommand(sub, "GET", "key")
+	assert.Must(readReply(sub).IsError())
+
+	execCommand(pub, "PUBLISH", "{a}news", "hello")
+	resp := readReply(pub)
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	readReply(sub, "message", "{a}news", "hello")
+
+	execCommand(sub, "UNSUBSCRIBE", "{a}news", "{a}sports", "{a}other")
+	readReply(sub, "unsubscribe", "{a}news", "1")
+	readReply(sub, "unsubscribe", "{a}sports", "0")
+	readReply(sub, "unsubscribe", "{a}other", "0")
+
+	execCommand(sub, "SET", "key", "value")
+	resp = readReply(sub)
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+
+	execCommand(pub, "PUBLISH", "{a}news", "hello")
+	resp = readReply(pub)
+	assert.Must(resp.IsInt() && string(resp.Value) == "0")
+
+	execCommand(sub, "UNSUBSCRIBE")
+	readReply(sub, "unsubscribe", "", "0")
+}
+
+func TestSessionPubSubAllBackends(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	var channels = make(map[string]string)
+	for i := 0; len(channels) != 2; i++ {
+		channel := "news" + strconv.Itoa(i)
+		addr := d.GetSlot(d.hashSlot([]byte(channel))).BackendAddr
+		if channels[addr] == "" {
+			channels[addr] = channel
+		}
+	}
+	var ch0, ch1 = channels[b0.Addr()], channels[b1.Addr()]
+
+	sub := newTestClient(d)
+	defer sub.Close()
+	pub := newTestClient(d)
+	defer pub.Close()
+
+	execCommand(sub, "SUBSCRIBE", ch0)
+	readReply(sub, "subscribe", ch0, "1")
+	execCommand(sub, "SUBSCRIBE", ch1)
+	readReply(sub, "subscribe", ch1, "2")
+	execCommand(sub, "PSUBSCRIBE", "sports*")
+	readReply(sub, "psubscribe", "sports*", "3")
+
+	for _, channel := range []string{ch0, ch1} {
+		execCommand(pub, "PUBLISH", channel, "hello")
+		resp := readReply(pub)
+		assert.Must(resp.IsInt() && string(resp.Value) == "1")
+		readReply(sub, "message", channel, "hello")
+	}
+	for i := 0; i < 8; i++ {
+		channel := "sports" + strconv.Itoa(i)
+		execCommand(pub, "PUBLISH", channel, "goal")
+		readReply(pub)
+		readReply(sub, "pmessage", "sports*", channel, "goal")
+	}
+}
+
+func TestSessionPubSubFanout(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	c := *config
+	c.EnablePubSubFanout = true
+	sub1 := newTestClientConfig(d, &c)
+	defer sub1.Close()
+	sub2 := newTestClientConfig(d, &c)
+	defer sub2.Close()
+	pub := newTestClient(d)
+	defer pub.Close()
+
+	var subscribers = func(channel string) int {
+		b1.Lock()
+		defer b1.Unlock()
+		var n int
+		for _, channels := range b1.subs {
+			if channels[channel] {
+				n++
+			}
+		}
+		return n
+	}
+	var waitSubscribers = func(channel string, n int) {
+		for i := 0; subscribers(channel) != n; i++ {
+			assert.Must(i < 100)
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	execCommand(sub1, "SUBSCRIBE", "{a}news")
+	readReply(sub1, "subscribe", "{a}news", "1")
+	execCommand(sub2, "SUBSCRIBE", "{a}sports", "{a}news")
+	readReply(sub2, "subscribe", "{a}sports", "1")
+	readReply(sub2, "subscribe", "{a}news", "2")
+	waitSubscribers("{a}news", 1)
+	waitSubscribers("{a}sports", 1)
+
+	execCommand(pub, "PUBLISH", "{a}news", "hello")
+	resp := readReply(pub)
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	readReply(sub1, "message", "{a}news", "hello")
+	readReply(sub2, "message", "{a}news", "hello")
+
+	execCommand(sub1, "UNSUBSCRIBE")
+	readReply(sub1, "unsubscribe", "{a}news", "0")
+	execCommand(sub1, "GET", "key")
+	assert.Must(readReply(sub1).IsBulkBytes())
+
+	execCommand(pub, "PUBLISH", "{a}news", "again")
+	readReply(pub)
+	readReply(sub2, "message", "{a}news", "again")
+
+	execCommand(sub2, "UNSUBSCRIBE", "{a}news")
+	readReply(sub2, "unsubscribe", "{a}news", "1")
+	waitSubscribers("{a}news", 0)
+	waitSubscribers("{a}sports", 1)
+
+	var n int
+	for _, call := range b1.Calls() {
+		if call == "SUBSCRIBE" {
+			n++
+		}
+	}
+	assert.Must(n <= 2)
+}
+
+func TestSessionPubSubFanoutPatterns(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	c := *config
+	c.EnablePubSubFanout = true
+	sub := newTestClientConfig(d, &c)
+	defer sub.Close()
+	pub := newTestClient(d)
+	defer pub.Close()
+
+	execCommand(sub, "PSUBSCRIBE", "sports*")
+	readReply(sub, "psubscribe", "sports*", "1")
+
+	for _, b := range []*fakeBackend{b0, b1} {
+		for i := 0; ; i++ {
+			assert.Must(i < 100)
+			b.Lock()
+			var n = len(b.psubs)
+			b.Unlock()
+			if n == 1 {
+				break
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	var addrs = make(map[string]bool)
+	for i := 0; i < 8; i++ {
+		channel := "sports" + strconv.Itoa(i)
+		addrs[d.GetSlot(d.hashSlot([]byte(channel))).BackendAddr] = true
+		execCommand(pub, "PUBLISH", channel, "goal")
+		resp := readReply(pub)
+		assert.Must(resp.IsInt() && string(resp.Value) == "1")
+		readReply(sub, "pmessage", "sports*", channel, "goal")
+	}
+	assert.Must(len(addrs) == 2)
+}
+
+func TestSessionKeyspaceNotify(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	sub := newTestClient(d)
+	defer sub.Close()
+
+	execCommand(sub, "SUBSCRIBE", "__keyevent@0__:set", "news")
+	assert.Must(readReply(sub).IsError())
+
+	execCommand(sub, "SUBSCRIBE", "__keyevent@0__:set")
+	readReply(sub, "subscribe", "__keyevent@0__:set", "1")
+	execCommand(sub, "PSUBSCRIBE", "__keyevent@*__:s*")
+	readReply(sub, "psubscribe", "__keyevent@*__:s*", "2")
+
+	for _, b := range []*fakeBackend{b0, b1} {
+		for i := 0; ; i++ {
+			b.Lock()
+			n := len(b.psubs)
+			b.Unlock()
+			if n != 0 {
+				break
+			}
+			assert.Must(i < 100)
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	s := newTestSession()
+	execRequest(s, d, "SET", "a", "x")
+	execRequest(s, d, "SET", "d", "y")
+
+	var keys []string
+	for i := 0; i < 4; i++ {
+		resp := readReply(sub)
+		assert.Must(resp.IsArray())
+		keys = append(keys, string(resp.Array[len(resp.Array)-1].Value))
+	}
+	sort.Strings(keys)
+	assert.Must(strings.Join(keys, ",") == "a,a,d,d")
+
+	execCommand(sub, "UNSUBSCRIBE")
+	readReply(sub, "unsubscribe", "__keyevent@0__:set", "1")
+	execCommand(sub, "PUNSUBSCRIBE")
+	readReply(sub, "punsubscribe", "__keyevent@*__:s*", "0")
+
+	execCommand(sub, "GET", "a")
+	resp := readReply(sub)
+	assert.Must(string(resp.Value) == "x")
+}
+
+func TestSessionEventChannel(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	c := *config
+	c.EnableInternalEventChannel = true
+	sub := newTestClientConfig(d, &c)
+	defer sub.Close()
+
+	execCommand(sub, "SUBSCRIBE", eventChannel, "news")
+	assert.Must(readReply(sub).IsError())
+	execCommand(sub, "SUBSCRIBE", eventChannel)
+	readReply(sub, "subscribe", eventChannel, "1")
+	execCommand(sub, "SUBSCRIBE", "news")
+	for {
+		// Skip events of backends connecting.
+		if resp := readReply(sub); !resp.IsArray() {
+			assert.Must(resp.IsError())
+			break
+		}
+	}
+
+	var next = func(event string) map[string]interface{} {
+		for {
+			resp := readReply(sub)
+			assert.Must(resp.IsArray() && len(resp.Array) == 3)
+			assert.Must(string(resp.Array[1].Value) == eventChannel)
+			var m map[string]interface{}
+			assert.MustNoError(json.Unmarshal(resp.Array[2].Value, &m))
+			if m["event"] == event {
+				return m
+			}
+		}
+	}
+
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: 1, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr()}))
+	m := next("slot_fill")
+	assert.Must(m["slot_id"] == float64(1) && m["backend_addr"] == b1.Addr() && m["migrate_from"] == b0.Addr())
+	m = next("backend_connect")
+	assert.Must(m["addr"] == b1.Addr())
+
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: 1, BackendAddr: b0.Addr()}))
+	m = next("backend_disconnect")
+	assert.Must(m["addr"] == b1.Addr())
+
+	breaker := &circuitBreaker{addr: b1.Addr(), threshold: 1, timeout: time.Minute, events: d.events}
+	breaker.Failure()
+	m = next("circuit_breaker")
+	assert.Must(m["addr"] == b1.Addr() && m["state"] == "open")
+
+	execCommand(sub, "UNSUBSCRIBE")
+	for {
+		resp := readReply(sub)
+		if string(resp.Array[0].Value) == "unsubscribe" {
+			break
+		}
+	}
+	execCommand(sub, "GET", "key")
+	assert.Must(readReply(sub).IsBulkBytes())
+
+	// Not intercepted if disabled.
+	sub2 := newTestClient(d)
+	defer sub2.Close()
+	execCommand(sub2, "SUBSCRIBE", eventChannel, "news")
+	readReply(sub2, "subscribe", eventChannel, "1")
+}
+
+func TestSessionWait(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+
+	var b = b0
+	if d.GetSlot(d.hashSlot([]byte("a"))).BackendAddr == b1.Addr() {
+		b = b1
+	}
+	execRequest(s, d, "SET", "{a}0", "x")
+	resp := execRequest(s, d, "WAIT", "1", "0")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	resp = execRequest(s, d, "WAIT", "3", "500")
+	assert.Must(resp.IsInt() && string(resp.Value) == "2")
+
+	calls := b.Calls()
+	assert.Must(len(calls) == 3)
+	assert.Must(calls[1] == "WAIT 1 1000")
+	assert.Must(calls[2] == "WAIT 3 500")
+
+	resp = execRequest(s, d, "WAIT", "1", "-1")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "WAIT", "1")
+	assert.Must(resp.IsError())
+}
+
+func TestSessionDebugSleep(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	s := newTestSession()
+	resp := execRequest(s, d, "DEBUG", "SLEEP", "1")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR DEBUG SLEEP is disabled")
+
+	c := *config
+	c.DebugSleepMaxDuration.Set(time.Millisecond * 500)
+	s.config = &c
+
+	for _, args := range [][]string{
+		{"DEBUG", "SEGFAULT"}, {"DEBUG"}, {"DEBUG", "SLEEP"}, {"DEBUG", "SLEEP", "x"},
+		{"DEBUG", "SLEEP", "nan"}, {"DEBUG", "SLEEP", "-1"}, {"DEBUG", "SLEEP", "-inf"},
+	} {
+		resp = execRequest(s, d, args...)
+		assert.Must(resp.IsError())
+	}
+	assert.Must(len(b.Calls()) == 0)
+
+	resp = execRequest(s, d, "DEBUG", "SLEEP", "0.1")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "DEBUG", "sleep", "3600")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "DEBUG", "SLEEP", "inf")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	assert.Must(strings.Join(b.Calls(), ",") == "DEBUG SLEEP 0.1,DEBUG sleep 0.5,DEBUG SLEEP 0.5")
+}
+
+func TestSessionRetry(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+	waitConnected(d)
+
+	s := newTestSession()
+	s.config = NewDefaultConfig()
+	s.config.BackendMaxRetries = 2
+	s.config.BackendRetryBackoff.Set(time.Millisecond)
+
+	execRequest(s, d, "SET", "key", "value")
+
+	b.Lock()
+	b.drops = 1
+	b.Unlock()
+	resp := execRequest(s, d, "GET", "key")
+	assert.Must(string(resp.Value) == "value")
+
+	b.Lock()
+	b.drops = 1
+	b.Unlock()
+	r := newRequest("SET", "key", "value2")
+	assert.MustNoError(s.handleRequest(r, d))
+	_, err := s.handleResponse(r)
+	assert.Must(err != nil && r.Retries == 0)
+
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: d.hashSlot([]byte("key"))}))
+	r = newRequest("SET", "key", "value2")
+	assert.MustNoError(s.handleRequest(r, d))
+	_, err = s.handleResponse(r)
+	assert.Must(err == ErrSlotIsNotReady && r.Retries == 2)
+}
+
+func TestSessionRateLimit(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+	d.limiter = ratelimit.New(0.001, 2)
+
+	s := newTestSession()
+	for i := 0; i < 2; i++ {
+		resp := execRequest(s, d, "GET", "key")
+		assert.Must(!resp.IsError())
+	}
+	resp := execRequest(s, d, "GET", "key")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR rate limit exceeded")
+	assert.Must(len(b.Calls()) == 2)
+	assert.Must(d.GetRateLimited()[""] == 1)
+}
+
+func TestSessionTxn(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	defer s.resetTxn()
+
+	assert.Must(d.GetSlot(d.hashSlot([]byte("a"))).BackendAddr != d.GetSlot(d.hashSlot([]byte("d"))).BackendAddr)
+
+	resp := execRequest(s, d, "EXEC")
+	assert.Must(resp.IsError())
+
+	resp = execRequest(s, d, "MULTI")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "SET", "{a}0", "x")
+	assert.Must(resp.IsString() && string(resp.Value) == "QUEUED")
+	resp = execRequest(s, d, "PING")
+	assert.Must(resp.IsString() && string(resp.Value) == "QUEUED")
+	resp = execRequest(s, d, "GET", "{a}0")
+	assert.Must(resp.IsString() && string(resp.Value) == "QUEUED")
+	resp = execRequest(s, d, "EXEC")
+	assert.Must(resp.IsArray() && len(resp.Array) == 3)
+	assert.Must(string(resp.Array[2].Value) == "x")
+
+	resp = execRequest(s, d, "MULTI")
+	assert.Must(resp.IsString())
+	resp = execRequest(s, d, "MULTI")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "SET", "{a}1", "x")
+	assert.Must(resp.IsString() && string(resp.Value) == "QUEUED")
+	resp = execRequest(s, d, "SET", "{d}1", "y")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "EXEC")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "EXECABORT"))
+	assert.Must(s.txn == nil)
+
+	resp = execRequest(s, d, "WATCH", "{d}2")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "WATCH", "{a}2")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "MULTI")
+	assert.Must(resp.IsString())
+	resp = execRequest(s, d, "SET", "{d}2", "z")
+	assert.Must(resp.IsString() && string(resp.Value) == "QUEUED")
+	resp = execRequest(s, d, "DISCARD")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	assert.Must(s.txn == nil)
+
+	resp = execRequest(s, d, "GET", "{d}2")
+	assert.Must(resp.IsBulkBytes() && resp.Value == nil)
+	resp = execRequest(s, d, "GET", "{a}1")
+	assert.Must(resp.IsBulkBytes() && resp.Value == nil)
+}
+
+func TestSessionTxnMigrating(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	var id = d.hashSlot([]byte("{x}"))
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(),
+	}))
+	waitConnected(d)
+
+	b0.Lock()
+	b0.data["{x}1"] = "1"
+	b0.Unlock()
+
+	// The slot can't be filled again before EXEC is replied.
+	var filled = make(chan error, 1)
+	var blocked bool
+	b1.Lock()
+	b1.hooks = map[string]func(){
+		"EXEC": func() {
+			go func() {
+				filled <- d.FillSlot(&models.Slot{Id: id, BackendAddr: b1.Addr()})
+			}()
+			select {
+			case <-filled:
+			case <-time.After(time.Millisecond * 50):
+				blocked = true
+			}
+		},
+	}
+	b1.Unlock()
+
+	s := newTestSession()
+	defer s.resetTxn()
+
+	execRequest(s, d, "MULTI")
+	resp := execRequest(s, d, "SET", "{x}1", "2")
+	assert.Must(resp.IsString() && string(resp.Value) == "QUEUED")
+	resp = execRequest(s, d, "EXEC")
+	assert.Must(resp.IsArray() && len(resp.Array) == 1)
+	assert.MustNoError(<-filled)
+	assert.Must(blocked)
+
+	var migrated bool
+	for _, call := range b0.Calls() {
+		if strings.HasPrefix(call, "SLOTSMGRTTAGONE ") && strings.HasSuffix(call, " {x}1") {
+			migrated = true
+		}
+	}
+	assert.Must(migrated)
+
+	// The transaction is aborted if the slot is moved after being queued.
+	execRequest(s, d, "MULTI")
+	execRequest(s, d, "SET", "{x}1", "3")
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b0.Addr()}))
+	resp = execRequest(s, d, "EXEC")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "EXECABORT"))
+
+	// A locked slot aborts the transaction instead of being waited on, and no
+	// other slot is left referenced.
+	var other = d.hashSlot([]byte("a"))
+	assert.Must(other != id)
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b0.Addr(), Locked: true}))
+	execRequest(s, d, "MULTI")
+	execRequest(s, d, "SET", "a", "1")
+	execRequest(s, d, "SET", "{x}1", "4")
+	resp = execRequest(s, d, "EXEC")
+	assert.Must(resp.IsError() && string(resp.Value) == "EXECABORT Transaction discarded, "+ErrSlotLocked.Error())
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: other, BackendAddr: b0.Addr()}))
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: id, BackendAddr: b0.Addr()}))
+}
+
+func TestSessionReset(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	c := newTestClient(d)
+	defer c.Close()
+
+	execCommand(c, "PROXY", "READ")
+	var preference = string(readReply(c).Value)
+
+	for _, args := range [][]string{
+		{"SELECT", "1"}, {"PROXY", "READ", "random"}, {"HELLO", "3"},
+		{"WATCH", "key"}, {"MULTI"}, {"SET", "key", "value"},
+	} {
+		execCommand(c, args...)
+		assert.Must(!readReply(c).IsError())
+	}
+	execCommand(c, "RESET")
+	resp := readReply(c)
+	assert.Must(resp.IsString() && string(resp.Value) == "RESET")
+	for _, call := range b.Calls() {
+		assert.Must(!strings.HasPrefix(call, "RESET"))
+	}
+
+	execCommand(c, "EXEC")
+	assert.Must(readReply(c).IsError())
+	execCommand(c, "PROXY", "READ")
+	assert.Must(string(readReply(c).Value) == preference)
+	execCommand(c, "GET", "key")
+	resp = readReply(c)
+	assert.Must(resp.IsBulkBytes() && resp.Value == nil)
+
+	execCommand(c, "SUBSCRIBE", "news")
+	readReply(c, "subscribe", "news", "1")
+	execCommand(c, "RESET")
+	resp = readReply(c)
+	assert.Must(resp.IsString() && string(resp.Value) == "RESET")
+	execCommand(c, "SET", "key", "value")
+	resp = readReply(c)
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+
+	execCommand(c, "RESET", "now")
+	assert.Must(readReply(c).IsError())
+}
+
+func TestSessionQuit(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	c := newTestClient(d)
+	defer c.Close()
+
+	for _, args := range [][]string{
+		{"SET", "key", "value"}, {"GET", "key"}, {"QUIT"}, {"GET", "key"},
+	} {
+		var multi []*redis.Resp
+		for _, arg := range args {
+			multi = append(multi, redis.NewBulkBytes([]byte(arg)))
+		}
+		assert.MustNoError(c.EncodeMultiBulk(multi, false))
+	}
+	assert.MustNoError(c.Flush())
+
+	assert.Must(string(readReply(c).Value) == "OK")
+	assert.Must(string(readReply(c).Value) == "value")
+	resp := readReply(c)
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	_, err := c.Decode()
+	assert.Must(err != nil)
+
+	assert.Must(len(b.Calls()) == 2)
+}
+
+func TestSessionResp3(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	c := newTestClient(d)
+	defer c.Close()
+
+	execCommand(c, "HELLO", "4")
+	assert.Must(readReply(c).IsError())
+
+	execCommand(c, "HELLO", "3")
+	resp := readReply(c)
+	assert.Must(resp.IsMap() && string(resp.Array[4].Value) == "proto" && string(resp.Array[5].Value) == "3")
+
+	execCommand(c, "GET", "key")
+	assert.Must(readReply(c).IsNull())
+
+	execCommand(c, "HSET", "key", "field", "value")
+	readReply(c)
+	execCommand(c, "HGETALL", "key")
+	resp = readReply(c, "field", "value")
+	assert.Must(resp.IsMap())
+
+	execCommand(c, "MGET", "key", "nokey")
+	resp = readReply(c)
+	assert.Must(resp.IsArray() && len(resp.Array) == 2 && resp.Array[1].IsNull())
+
+	execCommand(c, "HELLO", "2")
+	resp = readReply(c)
+	assert.Must(resp.IsArray() && string(resp.Array[5].Value) == "2")
+
+	execCommand(c, "GET", "key")
+	resp = readReply(c)
+	assert.Must(resp.IsBulkBytes() && resp.Value == nil)
+
+	execCommand(c, "HELLO", "3")
+	readReply(c)
+	execCommand(c, "SUBSCRIBE", "news")
+	resp = readReply(c)
+	assert.Must(resp.Type == redis.TypePush && string(resp.Array[0].Value) == "subscribe")
+
+	resp = convertResp3("ZSCORE", redis.NewBulkBytes([]byte("1.5")))
+	assert.Must(resp.Type == redis.TypeDouble && string(resp.Value) == "1.5")
+	for _, opstr := range []string{"INCRBYFLOAT", "HINCRBYFLOAT"} {
+		resp = convertResp3(opstr, redis.NewBulkBytes([]byte("1.5")))
+		assert.Must(resp.IsBulkBytes() && string(resp.Value) == "1.5")
+	}
+}
+
+func TestSessionAuthUsers(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	c := *config
+	c.SessionAuth = "secret"
+	c.SessionUsers = []string{"alice:wonderland", "bob:builder"}
+	assert.MustNoError(c.Validate())
+
+	s := newTestSession()
+	s.config = &c
+	resp := execRequest(s, d, "GET", "key")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "NOAUTH"))
+
+	var failed = SessionsAuthFailed()
+	start := time.Now()
+	resp = execRequest(s, d, "AUTH", "alice", "builder")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "WRONGPASS"))
+	assert.Must(time.Since(start) >= authFailureDelay)
+	resp = execRequest(s, d, "HELLO", "3", "AUTH", "bob", "wonderland")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "WRONGPASS"))
+	assert.Must(SessionsAuthFailed() == failed+2)
+	assert.Must(!s.authorized && s.authUser() == "")
+
+	resp = execRequest(s, d, "AUTH", "alice", "wonderland")
+	assert.Must(resp.IsString() && s.authorized && s.authUser() == "alice")
+	assert.Must(!execRequest(s, d, "GET", "key").IsError())
+
+	resp = execRequest(s, d, "HELLO", "2", "AUTH", "default", "secret")
+	assert.Must(resp.IsArray() && s.authUser() == "default")
+	resp = execRequest(s, d, "AUTH", "secret")
+	assert.Must(resp.IsString() && s.authUser() == "default")
+
+	execRequest(s, d, "RESET")
+	assert.Must(!s.authorized && s.authUser() == "")
+
+	c.SessionUsers = []string{"nopassword"}
+	assert.Must(c.Validate() != nil)
+}
+
+func TestSessionObject(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SET", "{x}1", "value")
+	resp := execRequest(s, d, "OBJECT", "ENCODING", "{x}1")
+	assert.Must(string(resp.Value) == "embstr")
+
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: d.hashSlot([]byte("{x}")), BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(),
+		ForwardMethod: models.ForwardSemiAsync,
+	}))
+	waitConnected(d)
+
+	resp = execRequest(s, d, "OBJECT", "ENCODING", "{x}1")
+	assert.Must(string(resp.Value) == "embstr")
+	resp = execRequest(s, d, "OBJECT", "ENCODING", "{x}2")
+	assert.Must(resp.IsBulkBytes() && resp.Value == nil)
+
+	var calls = b0.Calls()
+	assert.Must(calls[len(calls)-1] == "OBJECT ENCODING {x}1")
+	assert.Must(len(b1.Calls()) == 1 && b1.Calls()[0] == "OBJECT ENCODING {x}2")
+}
+
+func TestSessionObjectFreq(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SET", "{x}1", "value")
+
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: d.hashSlot([]byte("{x}")), BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(),
+	}))
+	waitConnected(d)
+
+	resp := execRequest(s, d, "OBJECT", "FREQ", "{x}1")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	var calls = b0.Calls()
+	assert.Must(calls[len(calls)-1] == "OBJECT FREQ {x}1")
+	assert.Must(len(b1.Calls()) == 1 && b1.Calls()[0] == "OBJECT FREQ {x}1")
+
+	execRequest(s, d, "SET", "{x}2", "value")
+	resp = execRequest(s, d, "OBJECT", "FREQ", "{x}2")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	calls = b1.Calls()
+	assert.Must(calls[len(calls)-1] == "OBJECT FREQ {x}2")
+	for _, call := range b0.Calls() {
+		assert.Must(!strings.HasPrefix(call, "SLOTSMGRTTAGONE") || strings.HasSuffix(call, "{x}2"))
+	}
+}
+
+func TestSessionObjectIdleTime(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SET", "{x}1", "value")
+
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: d.hashSlot([]byte("{x}")), BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(),
+	}))
+	waitConnected(d)
+
+	// Not migrated yet, falls back to the source.
+	resp := execRequest(s, d, "OBJECT", "IDLETIME", "{x}1")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	assert.Must(len(b1.Calls()) == 1 && b1.Calls()[0] == "OBJECT IDLETIME {x}1")
+	var calls = b0.Calls()
+	assert.Must(calls[len(calls)-1] == "OBJECT IDLETIME {x}1")
+
+	// Migrated already, answered by the target.
+	execRequest(s, d, "SET", "{x}2", "value")
+	var n = len(b0.Calls())
+	resp = execRequest(s, d, "OBJECT", "IDLETIME", "{x}2")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	calls = b1.Calls()
+	assert.Must(calls[len(calls)-1] == "OBJECT IDLETIME {x}2")
+	assert.Must(len(b0.Calls()) == n)
+
+	// Missing on both.
+	resp = execRequest(s, d, "OBJECT", "IDLETIME", "{x}3")
+	assert.Must(resp.IsBulkBytes() && resp.Value == nil)
+	calls = b0.Calls()
+	assert.Must(calls[len(calls)-1] == "OBJECT IDLETIME {x}3")
+}
+
+func TestSessionObjectRefCount(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SET", "{x}1", "value")
+	b1.Lock()
+	b1.data["{x}2"] = "value"
+	b1.Unlock()
+
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: d.hashSlot([]byte("{x}")), BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(),
+	}))
+	waitConnected(d)
+
+	// Not migrated yet, falls back to the source.
+	resp := execRequest(s, d, "OBJECT", "REFCOUNT", "{x}1")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	assert.Must(len(b1.Calls()) == 1 && b1.Calls()[0] == "OBJECT REFCOUNT {x}1")
+	var calls = b0.Calls()
+	assert.Must(calls[len(calls)-1] == "OBJECT REFCOUNT {x}1")
+
+	// Migrated already, answered by the target.
+	var n = len(b0.Calls())
+	resp = execRequest(s, d, "OBJECT", "REFCOUNT", "{x}2")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	calls = b1.Calls()
+	assert.Must(calls[len(calls)-1] == "OBJECT REFCOUNT {x}2")
+	assert.Must(len(b0.Calls()) == n)
+
+	// Missing on both.
+	resp = execRequest(s, d, "OBJECT", "REFCOUNT", "{x}3")
+	assert.Must(resp.IsBulkBytes() && resp.Value == nil)
+
+	// Keys are never moved by OBJECT.
+	for _, call := range append(b0.Calls(), b1.Calls()...) {
+		assert.Must(!strings.HasPrefix(call, "SLOTSMGRT"))
+	}
+}
+
+func TestSessionMultiKeysMigrating(t *testing.T) {
+	for _, method := range []int{models.ForwardSync, models.ForwardSemiAsync} {
+		b0, b1 := newFakeBackend(), newFakeBackend()
+
+		d := newTestRouter(b0)
+
+		// Keys of distinct hash tags in the same slot are batched together,
+		// each tag must be migrated before the request is forwarded.
+		var id = d.hashSlot([]byte("{x}1"))
+		var key string
+		for i := 0; key == ""; i++ {
+			if k := "k" + strconv.Itoa(i); d.hashSlot([]byte(k)) == id {
+				key = k
+			}
+		}
+		s := newTestSession()
+		execRequest(s, d, "SET", "{x}1", "1")
+		execRequest(s, d, "SET", key, "2")
+
+		assert.MustNoError(d.FillSlot(&models.Slot{
+			Id: id, BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(), ForwardMethod: method,
+		}))
+		waitConnected(d)
+
+		execRequest(s, d, "MGET", "{x}1", key, "{y}")
+		var migrated = make(map[string]bool)
+		for _, call := range b0.Calls() {
+			if strings.HasPrefix(call, "SLOTSMGRTTAGONE ") {
+				migrated[call[strings.LastIndexByte(call, ' ')+1:]] = true
+			}
+		}
+		assert.Must(migrated["{x}1"] && migrated[key])
+
+		b1.Lock()
+		b1.data["{x}1"], b1.data[key] = "1", "2"
+		b1.Unlock()
+		resp := execRequest(s, d, "MGET", key, "{x}1")
+		assert.Must(resp.IsArray() && len(resp.Array) == 2)
+		assert.Must(string(resp.Array[0].Value) == "2" && string(resp.Array[1].Value) == "1")
+
+		d.Close()
+		b0.Close()
+		b1.Close()
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	var keys = func(hkey string, args ...string) []string {
+		var s []string
+		for _, key := range migrateKeys(newRequest(args...), []byte(hkey)) {
+			s = append(s, string(key))
+		}
+		return s
+	}
+	assert.Must(strings.Join(keys("a", "GET", "a"), ",") == "a")
+	assert.Must(strings.Join(keys("{a}1", "MGET", "{a}1", "{a}2", "b", "{a}3"), ",") == "{a}1,b")
+	assert.Must(strings.Join(keys("a", "MSET", "a", "1", "b", "2"), ",") == "a,b")
+	assert.Must(strings.Join(keys("a", "XREAD", "COUNT", "1", "STREAMS", "a", "{a}1", "b", "0", "0", "0"), ",") == "a,b")
+}
+
+func TestSessionTypeMigrating(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SET", "{x}1", "value")
+	resp := execRequest(s, d, "TYPE", "{x}1")
+	assert.Must(resp.IsString() && string(resp.Value) == "string")
+
+	execRequest(s, d, "HSET", "{x}2", "f", "v")
+	b0.Lock()
+	h := b0.hash["{x}2"]
+	delete(b0.hash, "{x}2")
+	b0.Unlock()
+	b1.Lock()
+	b1.hash["{x}2"] = h
+	b1.Unlock()
+
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: d.hashSlot([]byte("{x}")), BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(),
+	}))
+	waitConnected(d)
+
+	// Not migrated yet, falls back to the source.
+	resp = execRequest(s, d, "TYPE", "{x}1")
+	assert.Must(resp.IsString() && string(resp.Value) == "string")
+	assert.Must(strings.Join(b1.Calls(), ",") == "TYPE {x}1")
+	var calls = b0.Calls()
+	assert.Must(calls[len(calls)-1] == "TYPE {x}1")
+
+	// Migrated already, answered by the target.
+	var n = len(b0.Calls())
+	resp = execRequest(s, d, "TYPE", "{x}2")
+	assert.Must(resp.IsString() && string(resp.Value) == "hash")
+	assert.Must(len(b0.Calls()) == n)
+
+	// Missing on both.
+	resp = execRequest(s, d, "TYPE", "{x}3")
+	assert.Must(resp.IsString() && string(resp.Value) == "none")
+	calls = b0.Calls()
+	assert.Must(calls[len(calls)-1] == "TYPE {x}3")
+
+	for _, call := range append(b0.Calls(), b1.Calls()...) {
+		assert.Must(!strings.HasPrefix(call, "SLOTSMGRT"))
+	}
+}
+
+func TestSessionEncodingCache(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	c := *config
+	c.EnableEncodingCache = true
+	d := NewRouter(&c)
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(&models.Slot{Id: i, BackendAddr: b.Addr()}))
+	}
+	d.Start()
+
+	cli := newTestClientConfig(d, &c)
+	defer cli.Close()
+
+	encoding := func(key string) string {
+		execCommand(cli, "OBJECT", "ENCODING", key)
+		resp := readReply(cli)
+		assert.Must(resp.IsBulkBytes())
+		return string(resp.Value)
+	}
+	objects := func() int {
+		var n int
+		for _, call := range b.Calls() {
+			if strings.HasPrefix(call, "OBJECT") {
+				n++
+			}
+		}
+		return n
+	}
+
+	execCommand(cli, "SET", "a", "12345")
+	readReply(cli)
+	assert.Must(encoding("a") == "int" && objects() == 0)
+
+	execCommand(cli, "SET", "b", strings.Repeat("x", 64))
+	readReply(cli)
+	assert.Must(encoding("b") == "raw" && objects() == 0)
+
+	// The fake backend always replies embstr.
+	execCommand(cli, "APPEND", "a", "x")
+	readReply(cli)
+	assert.Must(encoding("a") == "embstr" && objects() == 1)
+
+	// GET can't tell whether the value was appended to.
+	execCommand(cli, "GET", "a")
+	readReply(cli)
+	encoding("a")
+	assert.Must(objects() == 2)
+
+	execCommand(cli, "SET", "c", "12345")
+	readReply(cli)
+	execCommand(cli, "SELECT", "1")
+	readReply(cli)
+	execCommand(cli, "SET", "c", strings.Repeat("x", 64))
+	readReply(cli)
+	execCommand(cli, "DEL", "c")
+	readReply(cli)
+	encoding("c")
+	assert.Must(objects() == 3)
+	execCommand(cli, "SELECT", "0")
+	readReply(cli)
+	assert.Must(encoding("c") == "int" && objects() == 3)
+	execCommand(cli, "DEL", "c")
+	readReply(cli)
+	encoding("c")
+	assert.Must(objects() == 4)
+}
+
+func TestSessionProxyMigrateKey(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	s := newTestSession()
+	s.admin = true
+	execRequest(s, d, "SET", "{x}1", "value")
+
+	var id = strconv.Itoa(d.hashSlot([]byte("{x}")))
+	resp := execRequest(s, d, "PROXY", "MIGRATE-KEY", id, "{x}1")
+	assert.Must(resp.IsError() && string(resp.Value) == "ERR "+ErrSlotNotMigrating.Error())
+	resp = execRequest(s, d, "PROXY", "MIGRATE-KEY", "x", "{x}1")
+	assert.Must(resp.IsError())
+
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: d.hashSlot([]byte("{x}")), BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(),
+	}))
+	waitConnected(d)
+
+	resp = execRequest(s, d, "PROXY", "MIGRATE-KEY", id, "{x}1")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "PROXY", "MIGRATE-KEY", id, "{x}1")
+	assert.Must(resp.IsString() && string(resp.Value) == "NOKEY")
+	assert.Must(strings.Join(b1.Calls(), ",") == "RESTORE {x}1 0 dump:value REPLACE")
+}
+
+func TestSessionProxyHint(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	c := *config
+	c.EnableEncodingCache = true
+	d := NewRouter(&c)
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(&models.Slot{Id: i, BackendAddr: b.Addr()}))
+	}
+	d.Start()
+
+	s := newTestSession()
+	resp := execRequest(s, d, "PROXY", "HINT", "ENCODING", "l", "nothing")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "PROXY", "HINT", "ENCODING", "l")
+	assert.Must(resp.IsError())
+
+	resp = execRequest(s, d, "PROXY", "HINT", "ENCODING", "l", "listpack")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "OBJECT", "ENCODING", "l")
+	assert.Must(string(resp.Value) == "listpack")
+	assert.Must(len(b.Calls()) == 0)
+
+	// Writes drop the hint.
+	execRequest(s, d, "RPUSH", "l", "x")
+	execRequest(s, d, "OBJECT", "ENCODING", "l")
+	assert.Must(len(b.Calls()) == 2)
+
+	// So does refilling the slot.
+	execRequest(s, d, "PROXY", "HINT", "ENCODING", "z", "skiplist")
+	execRequest(s, d, "PROXY", "HINT", "ENCODING", "l", "quicklist")
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: d.hashSlot([]byte("z")), BackendAddr: b.Addr()}))
+	resp = execRequest(s, d, "OBJECT", "ENCODING", "l")
+	assert.Must(string(resp.Value) == "quicklist" && len(b.Calls()) == 2)
+	execRequest(s, d, "OBJECT", "ENCODING", "z")
+	assert.Must(len(b.Calls()) == 3)
+
+	d = newTestRouter(b)
+	defer d.Close()
+	resp = execRequest(s, d, "PROXY", "HINT", "ENCODING", "l", "listpack")
+	assert.Must(resp.IsError())
+}
+
+func TestSessionMaxTTLRules(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	c := *config
+	_, err := toml.Decode(`max_ttl_rules = ["cache:*=1h", "{user}:*=30s"]`, &c)
+	assert.MustNoError(err)
+	assert.MustNoError(c.Validate())
+	assert.Must(len(c.MaxTTLRules) == 2 && c.MaxTTLRules[1].Pattern == "{user}:*" && c.MaxTTLRules[1].MaxTTL == time.Second*30)
+
+	d := NewRouter(&c)
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(&models.Slot{Id: i, BackendAddr: b.Addr()}))
+	}
+	d.Start()
+
+	cli := newTestClientConfig(d, &c)
+	defer cli.Close()
+
+	called := func(call string) bool {
+		for i := 0; i < 100; i++ {
+			for _, x := range b.Calls() {
+				if x == call {
+					return true
+				}
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return false
+	}
+
+	execCommand(cli, "GET", "cache:a")
+	readReply(cli)
+	execCommand(cli, "SET", "key", "1")
+	readReply(cli)
+	execCommand(cli, "MSET", "cache:a", "1", "{user}:b", "2")
+	readReply(cli)
+	assert.Must(called("EXPIRE cache:a 3600"))
+	assert.Must(called("EXPIRE {user}:b 30"))
+	var ttls []string
+	for _, call := range b.Calls() {
+		if strings.HasPrefix(call, "TTL") {
+			ttls = append(ttls, call)
+		}
+	}
+	sort.Strings(ttls)
+	assert.Must(strings.Join(ttls, ",") == "TTL cache:a,TTL {user}:b")
+
+	execCommand(cli, "MULTI")
+	execCommand(cli, "SET", "cache:x", "v")
+	execCommand(cli, "EXEC")
+	readReply(cli)
+	readReply(cli)
+	readReply(cli, "OK")
+	assert.Must(called("EXPIRE cache:x 3600"))
+
+	c.MaxTTLRules = []TTLRule{{Pattern: "cache:*", MaxTTL: time.Millisecond}}
+	assert.Must(c.Validate() != nil)
+}
+
+func TestSessionMaxTTLRulesPrimaryOnly(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	c := *config
+	c.MaxTTLRules = []TTLRule{{Pattern: "cache:*", MaxTTL: time.Hour}}
+
+	d := NewRouter(&c)
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(&models.Slot{
+			Id: i, BackendAddr: b0.Addr(), ReplicaGroups: [][]string{{b1.Addr()}},
+		}))
+	}
+	waitConnected(d)
+
+	s := newTestSession()
+	s.config = &c
+	s.readPreference = PreferReplica
+	for i := 0; i < 10; i++ {
+		execRequest(s, d, "SET", "cache:"+strconv.Itoa(i), "1")
+		d.enforceTTL(newRequest("SET", "cache:"+strconv.Itoa(i), "1"), RespOK)
+	}
+	for i := 0; ; i++ {
+		assert.Must(i < 100)
+		d.ttl.Lock()
+		var running = d.ttl.running
+		d.ttl.Unlock()
+		if !running {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	var expires int
+	for _, call := range b0.Calls() {
+		if strings.HasPrefix(call, "EXPIRE ") {
+			expires++
+		}
+	}
+	assert.Must(expires == 10 && len(b1.Calls()) == 0)
+}
+
+func TestSessionDumpRestore(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SET", "{x}1", "value")
+	resp := execRequest(s, d, "DUMP", "{x}1")
+	assert.Must(string(resp.Value) == "dump:value")
+
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: d.hashSlot([]byte("{x}")), BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(),
+	}))
+	waitConnected(d)
+
+	// The key is migrated before being dumped, so the payload is never read
+	// from a source that may be written to concurrently.
+	b0.Lock()
+	b0.hooks = map[string]func(){"SLOTSMGRTTAGONE": func() {
+		b1.Lock()
+		b1.data["{x}1"] = "value"
+		b1.Unlock()
+	}}
+	b0.Unlock()
+	resp = execRequest(s, d, "DUMP", "{x}1")
+	assert.Must(string(resp.Value) == "dump:value")
+	assert.Must(strings.Join(b1.Calls(), ",") == "DUMP {x}1")
+
+	resp = execRequest(s, d, "RESTORE", "{x}1", "0", "dump:other", "REPLACE")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+	resp = execRequest(s, d, "RESTORE", "{x}1", "0", "dump:again")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "RESTORE", "{x}1", "0", "dump:again", "REPLACE")
+	assert.Must(resp.IsString() && string(resp.Value) == "OK")
+
+	var calls = b0.Calls()
+	assert.Must(strings.HasPrefix(calls[len(calls)-1], "SLOTSMGRTTAGONE "+strings.Replace(b1.Addr(), ":", " ", 1)))
+	calls = b1.Calls()
+	assert.Must(len(calls) == 4 && calls[3] == "RESTORE {x}1 0 dump:again REPLACE")
+}
+
+func TestSessionSPopCount(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SADD", "{x}1", "m1", "m2", "m3", "m4")
+	resp := execRequest(s, d, "SRANDMEMBER", "{x}1", "3")
+	assert.Must(resp.IsArray() && len(resp.Array) == 3)
+	resp = execRequest(s, d, "SRANDMEMBER", "{x}1")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "m1")
+	resp = execRequest(s, d, "SPOP", "{x}1", "2")
+	assert.Must(resp.IsArray() && len(resp.Array) == 2)
+	resp = execRequest(s, d, "SPOP", "{x}1")
+	assert.Must(resp.IsBulkBytes() && string(resp.Value) == "m3")
+
+	var calls = b0.Calls()
+	assert.Must(len(calls) == 5)
+	assert.Must(calls[1] == "SRANDMEMBER {x}1 3" && calls[2] == "SRANDMEMBER {x}1")
+	assert.Must(calls[3] == "SPOP {x}1 2" && calls[4] == "SPOP {x}1")
+
+	// The key is migrated before the command is sent to the target, the
+	// count must not be taken as a key.
+	assert.MustNoError(d.FillSlot(&models.Slot{
+		Id: d.hashSlot([]byte("{x}")), BackendAddr: b1.Addr(), MigrateFrom: b0.Addr(),
+	}))
+	waitConnected(d)
+
+	for _, op := range []string{"SRANDMEMBER", "SPOP"} {
+		execRequest(s, d, op, "{x}2", "5")
+		calls = b0.Calls()
+		assert.Must(strings.HasPrefix(calls[len(calls)-1], "SLOTSMGRTTAGONE "))
+		assert.Must(strings.HasSuffix(calls[len(calls)-1], " {x}2"))
+		calls = b1.Calls()
+		assert.Must(calls[len(calls)-1] == op+" {x}2 5")
+	}
+}
+
+func TestSessionCopy(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	assert.Must(d.GetSlot(d.hashSlot([]byte("a"))).BackendAddr != d.GetSlot(d.hashSlot([]byte("d"))).BackendAddr)
+
+	execRequest(s, d, "SET", "a", "value")
+	resp := execRequest(s, d, "COPY", "a", "{a}1")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+
+	resp = execRequest(s, d, "COPY", "a", "d")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	resp = execRequest(s, d, "GET", "d")
+	assert.Must(string(resp.Value) == "value")
+
+	execRequest(s, d, "SET", "a", "other")
+	resp = execRequest(s, d, "COPY", "a", "d")
+	assert.Must(resp.IsInt() && string(resp.Value) == "0")
+	resp = execRequest(s, d, "COPY", "a", "d", "REPLACE")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	resp = execRequest(s, d, "GET", "d")
+	assert.Must(string(resp.Value) == "other")
+	var calls = b0.Calls()
+	assert.Must(calls[len(calls)-2] == "RESTORE d 0 dump:other REPLACE")
+	resp = execRequest(s, d, "COPY", "nokey", "d")
+	assert.Must(resp.IsInt() && string(resp.Value) == "0")
+
+	resp = execRequest(s, d, "COPY", "a", "d", "DB", "1", "REPLACE")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	resp = execRequest(s, d, "COPY", "a", "d", "DB")
+	assert.Must(resp.IsError())
+
+	c := *config
+	c.AllowSelect = false
+	s.config = &c
+	resp = execRequest(s, d, "COPY", "a", "d", "DB", "1", "REPLACE")
+	assert.Must(resp.IsError())
+	resp = execRequest(s, d, "COPY", "a", "{a}2", "DB", "1")
+	assert.Must(resp.IsInt())
+}
+
+func TestSessionCopyPipeline(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	conn := newTestClient(d)
+	defer conn.Close()
+
+	execCommand(conn, "SET", "a", "value")
+	readReply(conn)
+
+	// The target read in the same pipeline sees the copy.
+	execCommand(conn, "COPY", "a", "d")
+	execCommand(conn, "GET", "d")
+	resp := readReply(conn)
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	resp = readReply(conn)
+	assert.Must(string(resp.Value) == "value")
+}
+
+func TestSessionCopyPrimaryOnly(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := NewRouter(config)
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(&models.Slot{
+			Id: i, BackendAddr: b0.Addr(), ReplicaGroups: [][]string{{b1.Addr()}},
+		}))
+	}
+	waitConnected(d)
+
+	s := newTestSession()
+	s.readPreference = PreferReplica
+	execRequest(s, d, "SET", "a", "value")
+	resp := execRequest(s, d, "COPY", "a", "d")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	assert.Must(len(b1.Calls()) == 0)
+}
+
+func TestSessionSetStore(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SADD", "a", "x", "y", "z")
+	execRequest(s, d, "SADD", "d", "y", "z", "w")
+
+	execRequest(s, d, "SINTERSTORE", "{a}1", "a", "{a}2")
+	calls := b1.Calls()
+	assert.Must(calls[len(calls)-1] == "SINTERSTORE {a}1 a {a}2")
+	resp := execRequest(s, d, "SUNIONSTORE", "{a}1", "a", "d")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "CROSSSLOT"))
+
+	c := *config
+	c.AllowCrossSlotSetOps = true
+	s.config = &c
+
+	var members = func(key string) []string {
+		var list []string
+		for _, m := range execRequest(s, d, "SMEMBERS", key).Array {
+			list = append(list, string(m.Value))
+		}
+		return list
+	}
+
+	resp = execRequest(s, d, "SUNIONSTORE", "{d}1", "a", "d")
+	assert.Must(resp.IsInt() && string(resp.Value) == "4")
+	assert.Must(strings.Join(members("{d}1"), " ") == "w x y z")
+
+	resp = execRequest(s, d, "SINTERSTORE", "{d}1", "a", "d")
+	assert.Must(resp.IsInt() && string(resp.Value) == "2")
+	assert.Must(strings.Join(members("{d}1"), " ") == "y z")
+
+	resp = execRequest(s, d, "SDIFFSTORE", "{a}1", "d", "a")
+	assert.Must(resp.IsInt() && string(resp.Value) == "1")
+	assert.Must(strings.Join(members("{a}1"), " ") == "w")
+
+	resp = execRequest(s, d, "SDIFFSTORE", "{a}1", "a", "a", "d")
+	assert.Must(resp.IsInt() && string(resp.Value) == "0")
+	assert.Must(len(members("{a}1")) == 0)
+
+	resp = execRequest(s, d, "SUNIONSTORE", "{a}1")
+	assert.Must(resp.IsError())
+}
+
+func TestSessionSetStorePipeline(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	c := *config
+	c.AllowCrossSlotSetOps = true
+	conn := newTestClientConfig(d, &c)
+	defer conn.Close()
+
+	execCommand(conn, "SADD", "a", "x", "y")
+	execCommand(conn, "SADD", "d", "y", "z")
+	execCommand(conn, "SADD", "{d}1", "old")
+	for i := 0; i < 3; i++ {
+		readReply(conn)
+	}
+
+	// The destination read in the same pipeline sees the stored set.
+	execCommand(conn, "SUNIONSTORE", "{d}1", "a", "d")
+	execCommand(conn, "SMEMBERS", "{d}1")
+	resp := readReply(conn)
+	assert.Must(resp.IsInt() && string(resp.Value) == "3")
+	readReply(conn, "x", "y", "z")
+}
+
+func TestSessionSetStorePrimaryOnly(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := NewRouter(config)
+	defer d.Close()
+	for i := 0; i < MaxSlotNum; i++ {
+		assert.MustNoError(d.FillSlot(&models.Slot{
+			Id: i, BackendAddr: b0.Addr(), ReplicaGroups: [][]string{{b1.Addr()}},
+		}))
+	}
+	waitConnected(d)
+
+	c := *config
+	c.AllowCrossSlotSetOps = true
+	s := newTestSession()
+	s.config = &c
+	s.readPreference = PreferReplica
+	execRequest(s, d, "SADD", "a", "x", "y")
+	execRequest(s, d, "SADD", "d", "y", "z")
+	for _, opstr := range []string{"SINTERSTORE", "SUNIONSTORE", "SDIFFSTORE"} {
+		resp := execRequest(s, d, opstr, "{d}1", "a", "d")
+		assert.Must(resp.IsInt())
+	}
+	assert.Must(len(b1.Calls()) == 0)
+}
+
+func TestSessionSetRead(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "SADD", "a", "x", "y", "z")
+	execRequest(s, d, "SADD", "d", "y", "z", "w")
+
+	execRequest(s, d, "SUNION", "a", "d")
+	calls := b1.Calls()
+	assert.Must(calls[len(calls)-1] == "SUNION a d")
+
+	c := *config
+	c.AllowCrossSlotReadOps = true
+	s.config = &c
+
+	var members = func(resp *redis.Resp) string {
+		assert.Must(resp.IsArray())
+		var list []string
+		for _, m := range resp.Array {
+			list = append(list, string(m.Value))
+		}
+		sort.Strings(list)
+		return strings.Join(list, " ")
+	}
+	assert.Must(members(execRequest(s, d, "SUNION", "a", "d")) == "w x y z")
+	assert.Must(members(execRequest(s, d, "SINTER", "a", "d")) == "y z")
+	assert.Must(members(execRequest(s, d, "SINTER", "a", "d", "nosuchkey")) == "")
+	assert.Must(members(execRequest(s, d, "SUNION", "a", "a", "nosuchkey")) == "x y z")
+
+	calls = b1.Calls()
+	execRequest(s, d, "SINTER", "a", "{a}1")
+	assert.Must(b1.Calls()[len(calls)] == "SINTER a {a}1")
+
+	resp := execRequest(s, d, "SUNIONSTORE", "{a}1", "a", "d")
+	assert.Must(resp.IsError() && strings.HasPrefix(string(resp.Value), "CROSSSLOT"))
+	assert.Must(execRequest(s, d, "SINTER").IsError())
+}
+
+func TestSessionGeoSearchStore(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "GEOSEARCHSTORE", "{a}1", "a", "FROMMEMBER", "m", "BYRADIUS", "1", "km")
+	calls := b1.Calls()
+	assert.Must(calls[len(calls)-1] == "GEOSEARCHSTORE {a}1 a FROMMEMBER m BYRADIUS 1 km")
+
+	resp := execRequest(s, d, "GEOSEARCHSTORE", "d", "a", "FROMMEMBER", "m", "BYRADIUS", "1", "km")
+	assert.Must(resp.IsError() && string(resp.Value) == string(RespCrossSlot.Value))
+	resp = execRequest(s, d, "GEOSEARCHSTORE", "d")
+	assert.Must(resp.IsError())
+}
+
+func TestSessionGeoRadiusStore(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	execRequest(s, d, "GEORADIUS", "a", "15", "37", "200", "km", "STORE", "{a}1")
+	execRequest(s, d, "GEORADIUSBYMEMBER", "a", "m", "200", "km", "ASC", "STOREDIST", "{a}2")
+	execRequest(s, d, "GEORADIUS_RO", "a", "15", "37", "200", "km")
+	calls := b1.Calls()
+	assert.Must(len(calls) == 3)
+	assert.Must(calls[0] == "GEORADIUS a 15 37 200 km STORE {a}1")
+	assert.Must(calls[1] == "GEORADIUSBYMEMBER a m 200 km ASC STOREDIST {a}2")
+
+	resp := execRequest(s, d, "GEORADIUS", "a", "15", "37", "200", "km", "STORE", "d")
+	assert.Must(resp.IsError() && string(resp.Value) == string(RespCrossSlot.Value))
+	resp = execRequest(s, d, "GEORADIUSBYMEMBER", "a", "STORE", "200", "km", "STOREDIST", "d")
+	assert.Must(resp.IsError() && string(resp.Value) == string(RespCrossSlot.Value))
+	resp = execRequest(s, d, "GEORADIUS", "a", "15", "37")
+	assert.Must(resp.IsError())
+	assert.Must(len(b0.Calls()) == 0 && len(b1.Calls()) == 3)
+}
+
+func TestSessionCluster(t *testing.T) {
+	b := newFakeBackend()
+	defer b.Close()
+
+	d := newTestRouter(b)
+	defer d.Close()
+
+	c := newTestClient(d)
+	defer c.Close()
+
+	execCommand(c, "CLUSTER", "INFO")
+	resp := readReply(c)
+	assert.Must(bytes.Contains(resp.Value, []byte("cluster_enabled:1\r\n")))
+	assert.Must(bytes.Contains(resp.Value, []byte("cluster_state:ok\r\n")))
+
+	execCommand(c, "CLUSTER", "NODES")
+	resp = readReply(c)
+	var fields = strings.Fields(string(resp.Value))
+	assert.Must(len(fields) == 9 && fields[1] == c.RemoteAddr()+"@0" && fields[8] == "0-16383")
+
+	execCommand(c, "CLUSTER", "SLOTS")
+	resp = readReply(c)
+	assert.Must(len(resp.Array) == 1 && string(resp.Array[0].Array[1].Value) == "16383")
+
+	execCommand(c, "CLUSTER", "KEYSLOT", "somekey")
+	assert.Must(string(readReply(c).Value) == "11058")
+
+	execCommand(c, "CLUSTER", "KEYSLOT", "{user1000}.following")
+	assert.Must(string(readReply(c).Value) == "3443")
+
+	execCommand(c, "CLUSTER", "SLOTS", "extra")
+	assert.Must(readReply(c).IsError())
+
+	execCommand(c, "CLUSTER", "FAILOVER")
+	assert.Must(readReply(c).IsError())
+
+	assert.MustNoError(d.FillSlot(&models.Slot{Id: 0}))
+	execCommand(c, "CLUSTER", "INFO")
+	resp = readReply(c)
+	assert.Must(bytes.Contains(resp.Value, []byte("cluster_state:fail\r\n")))
+}
+
+func TestSessionAnyBackend(t *testing.T) {
+	b0, b1 := newFakeBackend(), newFakeBackend()
+	defer b0.Close()
+	defer b1.Close()
+
+	d := newTestRouter(b0, b1)
+	defer d.Close()
+
+	s := newTestSession()
+	for i := 0; i < 4; i++ {
+		resp := execRequest(s, d, "LOLWUT", "VERSION", strconv.Itoa(i))
+		assert.Must(resp.IsBulkBytes())
+	}
+	resp := execRequest(s, d, "OBJECT", "HELP")
+	assert.Must(resp.IsArray() && len(resp.Array) == 1+len(objectHelpNotes))
+	assert.Must(string(resp.Array[0].Value) == "OBJECT <subcommand> key")
+	for i, line := range objectHelpNotes {
+		assert.Must(resp.Array[1+i].IsString() && string(resp.Array[1+i].Value) == line)
+	}
+
+	assert.Must(len(b0.Calls()) == 5 && len(b1.Calls()) == 0)
+	assert.Must(getCommandType(newRequest("OBJECT", "ENCODING", "key").Multi, "OBJECT") == commandKeyBased)
+
+	c := *config
+	c.AnyBackendSlot = 1
+	s.config = &c
+	for _, args := range [][]string{
+		{"OBJECT", "HELP"}, {"COMMAND", "COUNT"}, {"COMMAND", "DOCS", "get"},
+		{"COMMAND", "LIST"}, {"COMMAND", "GETKEYS", "SET", "a", "b"},
+	} {
+		resp := execRequest(s, d, args...)
+		assert.Must(!resp.IsError())
+	}
+	assert.Must(len(b0.Calls()) == 5 && len(b1.Calls()) == 3)
+	assert.Must(b1.Calls()[2] == "COMMAND GETKEYS SET a b")
+}
+
+func TestSessionCommand(t *testing.T) {
+	b0 := newFakeBackend()
+	defer b0.Close()
+
+	d := newTestRouter(b0)
+	defer d.Close()
+
+	s := newTestSession()
+	resp := execRequest(s, d, "COMMAND", "COUNT")
+	assert.Must(resp.IsInt() && string(resp.Value) == strconv.Itoa(len(commandTable)))
+
+	resp = execRequest(s, d, "COMMAND")
+	assert.Must(resp.IsArray() && len(resp.Array) == len(commandTable))
+
+	resp = execRequest(s, d, "COMMAND", "INFO", "get", "mset", "nosuchcmd")
+	assert.Must(resp.IsArray() && len(resp.Array) == 3)
+	var get = resp.Array[0].Array
+	assert.Must(len(get) == 6 && string(get[0].Value) == "get" && string(get[1].Value) == "2")
+	assert.Must(len(get[2].Array) == 1 && string(get[2].Array[0].Value) == "readonly")
+	var mset = resp.Array[1].Array
+	assert.Must(string(mset[2].Array[0].Value) == "write")
+	assert.Must(string(mset[3].Value) == "1" && string(mset[4].Value) == "-1" && string(mset[5].Value) == "2")
+	assert.Must(resp.Array[2].IsArray() && resp.Array[2].Array == nil)
+
+	resp = execRequest(s, d, "COMMAND", "DOCS", "lpos", "nosuchcmd")
+	assert.Must(resp.IsArray() && len(resp.Array) == 2)
+	assert.Must(string(resp.Array[0].Value) == "lpos")
+	var docs = resp.Array[1].Array
+	assert.Must(len(docs) == 6 && string(docs[1].Value) == commandTable["LPOS"].Summary)
+	assert.Must(string(docs[3].Value) == "6.0.6" && string(docs[5].Value) == "list")
+
+	assert.Must(len(b0.Calls()) == 0)
+}
@@ -0,0 +1,264 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+)
+
+var (
+	RespQueued    = redis.NewString([]byte("QUEUED"))
+	RespExecAbort = redis.NewErrorf("EXECABORT Transaction discarded because of previous errors.")
+)
+
+type txnState struct {
+	conn *redis.Conn
+	addr string
+
+	multi bool
+	dirty bool
+	queue []*Request
+	keys  [][]byte
+}
+
+func (tx *txnState) Close() {
+	if tx.conn != nil {
+		tx.conn.Close()
+	}
+}
+
+func (s *Session) openTxnConn(addr string) (*redis.Conn, error) {
+	c, err := dialBackend(addr, s.config)
+	if err != nil {
+		return nil, err
+	}
+	c.ReaderTimeout = s.config.BackendRecvTimeout.Duration()
+	c.WriterTimeout = s.config.BackendSendTimeout.Duration()
+
+	if err := verifyAuth(c, s.config); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := selectDatabase(c, int(s.database)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Session) resetTxn() {
+	if s.txn != nil {
+		s.txn.Close()
+		s.txn = nil
+	}
+}
+
+func getTxnKeys(r *Request) [][]byte {
+	var step = 0
+	switch r.OpStr {
+	case "MGET", "DEL", "EXISTS", "UNLINK", "TOUCH", "WATCH":
+		step = 1
+	case "MSET", "MSETNX":
+		step = 2
+	}
+	if step == 0 {
+		return [][]byte{getHashKey(r.Multi, r.OpStr)}
+	}
+	var keys [][]byte
+	for i := 1; i < len(r.Multi); i += step {
+		keys = append(keys, r.Multi[i].Value)
+	}
+	return keys
+}
+
+func (s *Session) pinTxnBackend(r *Request, d *Router) *redis.Resp {
+	for _, key := range getTxnKeys(r) {
+		if key == nil {
+			continue
+		}
+		if s.txn.multi {
+			s.txn.keys = append(s.txn.keys, key)
+		}
+		var slot = d.hashSlot(key)
+		var addr = d.GetSlot(slot).BackendAddr
+		switch {
+		case addr == "":
+			return redis.NewErrorf("ERR slot-%04d is not ready", slot)
+		case s.txn.addr == "":
+			s.txn.addr = addr
+		case s.txn.addr != addr:
+			return redis.NewErrorf("ERR keys in transaction must be served by the same backend")
+		}
+	}
+	return nil
+}
+
+func (s *Session) handleRequestTxn(r *Request, d *Router) error {
+	switch r.OpStr {
+	case "MULTI":
+		return s.handleRequestMulti(r)
+	case "EXEC":
+		return s.handleRequestExec(r, d)
+	case "DISCARD":
+		return s.handleRequestDiscard(r)
+	case "WATCH":
+		return s.handleRequestWatch(r, d)
+	case "UNWATCH":
+		return s.handleRequestUnwatch(r)
+	}
+	if resp := s.pinTxnBackend(r, d); resp != nil {
+		s.txn.dirty = true
+		r.Resp = resp
+		return nil
+	}
+	s.txn.queue = append(s.txn.queue, r)
+	r.Resp = RespQueued
+	return nil
+}
+
+func (s *Session) handleRequestMulti(r *Request) error {
+	switch {
+	case len(r.Multi) != 1:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'MULTI' command")
+	case s.txn != nil && s.txn.multi:
+		r.Resp = redis.NewErrorf("ERR MULTI calls can not be nested")
+	default:
+		if s.txn == nil {
+			s.txn = &txnState{}
+		}
+		s.txn.multi = true
+		r.Resp = RespOK
+	}
+	return nil
+}
+
+func (s *Session) handleRequestExec(r *Request, d *Router) error {
+	if s.txn == nil || !s.txn.multi {
+		r.Resp = redis.NewErrorf("ERR EXEC without MULTI")
+		return nil
+	}
+	var tx = s.txn
+	defer s.resetTxn()
+
+	switch {
+	case tx.dirty:
+		r.Resp = RespExecAbort
+		return nil
+	case tx.addr == "":
+		r.Resp = redis.NewArray(nil)
+		return nil
+	}
+	if tx.conn == nil {
+		c, err := s.openTxnConn(tx.addr)
+		if err != nil {
+			return err
+		}
+		tx.conn = c
+	}
+	r.Backend = tx.addr
+
+	// Queued keys are migrated like forwarded ones, and their slots stay on
+	// tx.addr until EXEC is replied.
+	release, err := d.acquireTxnSlots(tx.addr, s.database, tx.keys)
+	if err != nil {
+		r.Resp = redis.NewErrorf("EXECABORT Transaction discarded, %s", err)
+		return nil
+	}
+	defer release()
+
+	var c = tx.conn
+	if err := c.EncodeMultiBulk([]*redis.Resp{redis.NewBulkBytes([]byte("MULTI"))}, false); err != nil {
+		return err
+	}
+	for _, x := range tx.queue {
+		if err := c.EncodeMultiBulk(x.Multi, false); err != nil {
+			return err
+		}
+	}
+	if err := c.EncodeMultiBulk([]*redis.Resp{redis.NewBulkBytes([]byte("EXEC"))}, true); err != nil {
+		return err
+	}
+	for i := 0; i <= len(tx.queue); i++ {
+		if _, err := c.Decode(); err != nil {
+			return err
+		}
+	}
+	resp, err := c.Decode()
+	if err != nil {
+		return err
+	}
+	r.Resp = resp
+
+	// Keys written by the transaction are checked against max_ttl_rules,
+	// like the ones written outside of it.
+	if resp.IsArray() && len(resp.Array) == len(tx.queue) {
+		for i, x := range tx.queue {
+			d.enforceTTL(x, resp.Array[i])
+		}
+	}
+	return nil
+}
+
+func (s *Session) handleRequestDiscard(r *Request) error {
+	if s.txn == nil || !s.txn.multi {
+		r.Resp = redis.NewErrorf("ERR DISCARD without MULTI")
+		return nil
+	}
+	s.resetTxn()
+	r.Resp = RespOK
+	return nil
+}
+
+func (s *Session) handleRequestWatch(r *Request, d *Router) error {
+	switch {
+	case len(r.Multi) < 2:
+		r.Resp = redis.NewErrorf("ERR wrong number of arguments for 'WATCH' command")
+		return nil
+	case s.txn != nil && s.txn.multi:
+		r.Resp = redis.NewErrorf("ERR WATCH inside MULTI is not allowed")
+		return nil
+	}
+	if s.txn == nil {
+		s.txn = &txnState{}
+	}
+	if resp := s.pinTxnBackend(r, d); resp != nil {
+		if s.txn.conn == nil {
+			s.resetTxn()
+		}
+		r.Resp = resp
+		return nil
+	}
+	if s.txn.conn == nil {
+		c, err := s.openTxnConn(s.txn.addr)
+		if err != nil {
+			s.resetTxn()
+			return err
+		}
+		s.txn.conn = c
+	}
+	r.Backend = s.txn.addr
+
+	if err := s.txn.conn.EncodeMultiBulk(r.Multi, true); err != nil {
+		s.resetTxn()
+		return err
+	}
+	resp, err := s.txn.conn.Decode()
+	if err != nil {
+		s.resetTxn()
+		return err
+	}
+	r.Resp = resp
+	return nil
+}
+
+func (s *Session) handleRequestUnwatch(r *Request) error {
+	if s.txn != nil && s.txn.multi {
+		s.txn.queue = append(s.txn.queue, r)
+		r.Resp = RespQueued
+		return nil
+	}
+	s.resetTxn()
+	r.Resp = RespOK
+	return nil
+}
@@ -4,28 +4,52 @@
 package proxy
 
 import (
+	"bytes"
+	"fmt"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/CodisLabs/codis/pkg/models"
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
 )
 
 type Slot struct {
 	id   int
 	lock struct {
-		hold bool
+		hold  bool
+		since time.Time
 		sync.RWMutex
 	}
 	refs sync.WaitGroup
 
+	// admin is set while an admin operation moves keys with the slot blocked
+	// and the router unlocked. Fills in between keep the slot blocked, and the
+	// lock they ask for is applied once the operation ends.
+	admin struct {
+		busy   bool
+		locked bool
+	}
+
 	switched bool
+	version  uint64
 
 	backend, migrate struct {
 		id int
 		bc *sharedBackendConn
 	}
-	replicaGroups [][]*sharedBackendConn
+	migrated  atomic2.Int64
+	migrateAt time.Time
+
+	replicaGroups  [][]*sharedBackendConn
+	replicaWeights [][]int
+	roundrobin     atomic2.Int64
+	weighted       atomic2.Int64
 
 	method forwardMethod
+
+	stats slotStats
 }
 
 func (s *Slot) snapshot() *models.Slot {
@@ -46,17 +70,309 @@ func (s *Slot) snapshot() *models.Slot {
 		}
 		m.ReplicaGroups = append(m.ReplicaGroups, group)
 	}
+	for i := range s.replicaWeights {
+		for _, w := range s.replicaWeights[i] {
+			if w != 1 {
+				for _, weights := range s.replicaWeights {
+					m.ReplicaWeights = append(m.ReplicaWeights, append([]int(nil), weights...))
+				}
+				return m
+			}
+		}
+	}
 	return m
 }
 
-func (s *Slot) blockAndWait() {
+// isMigrating returns true if the slot is still migrating from one backend to
+// another, it's checked after keys are moved without holding the router lock.
+func (s *Slot) isMigrating(from, to string) bool {
+	return s.migrate.bc != nil && s.migrate.bc.Addr() == from && s.backend.bc.Addr() == to
+}
+
+func (s *Slot) block() {
 	if !s.lock.hold {
 		s.lock.hold = true
+		s.lock.since = time.Now()
 		s.lock.Lock()
 	}
+}
+
+func (s *Slot) blockAndWait() {
+	s.block()
 	s.refs.Wait()
 }
 
+// beginAdmin blocks the slot for an admin operation that runs with the router
+// unlocked, only one of them may run at a time. The router must be locked.
+func (s *Slot) beginAdmin() error {
+	if s.admin.busy {
+		return ErrSlotBusy
+	}
+	s.admin.busy, s.admin.locked = true, s.lock.hold
+	s.blockAndWait()
+	return nil
+}
+
+// endAdmin ends the admin operation, the slot is unblocked unless it was
+// locked before or by fills meanwhile. The router must be locked.
+func (s *Slot) endAdmin() {
+	s.admin.busy = false
+	if !s.admin.locked {
+		s.unblock()
+	}
+}
+
+// rollbackMigration moves the keys of the slot already on the migration target
+// back to the source, the slot must be blocked.
+func (s *Slot) rollbackMigration(target, source *sharedBackendConn, databases int32) error {
+	for database := int32(0); database < databases; database++ {
+		keys, err := s.scanKeys(target, database)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, err := s.moveKey(target, source, database, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scanKeys returns all keys of the slot on bc, they're collected before being
+// moved since keys are removed from bc while moving.
+func (s *Slot) scanKeys(bc *sharedBackendConn, database int32) ([][]byte, error) {
+	var keys [][]byte
+	var cursor = []byte("0")
+	for {
+		resp, err := execOnBackend(bc, database,
+			[]byte("SLOTSSCAN"), []byte(strconv.Itoa(s.id)), cursor, []byte("COUNT"), []byte("100"))
+		if err != nil {
+			return nil, err
+		}
+		if !resp.IsArray() || len(resp.Array) != 2 || !resp.Array[1].IsArray() {
+			return nil, fmt.Errorf("bad slotsscan resp: %s", resp.Type)
+		}
+		for _, key := range resp.Array[1].Array {
+			keys = append(keys, key.Value)
+		}
+		cursor = resp.Array[0].Value
+		if string(cursor) == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// moveKey copies key from one backend to another with DUMP and RESTORE ...
+// REPLACE keeping its TTL, and then removes it from the first one. It returns
+// false if the key doesn't exist.
+func (s *Slot) moveKey(from, to *sharedBackendConn, database int32, key []byte) (bool, error) {
+	resp, err := execOnBackend(from, database, []byte("PTTL"), key)
+	if err != nil {
+		return false, err
+	}
+	ttl, err := redis.Btoi64(resp.Value)
+	switch {
+	case err != nil:
+		return false, fmt.Errorf("bad pttl resp: %s", resp.Value)
+	case ttl == -2:
+		return false, nil
+	case ttl < 0:
+		ttl = 0
+	}
+	dump, err := execOnBackend(from, database, []byte("DUMP"), key)
+	if err != nil || dump.Value == nil {
+		return false, err
+	}
+	_, err = execOnBackend(to, database,
+		[]byte("RESTORE"), key, []byte(strconv.FormatInt(ttl, 10)), dump.Value, []byte("REPLACE"))
+	if err != nil {
+		return false, err
+	}
+	if _, err := execOnBackend(from, database, []byte("DEL"), key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// moveKeyWatched moves key like moveKey, but over connections of its own with
+// the key watched on both backends: it's restored to the target and deleted
+// from the source with MULTI/EXEC, which are discarded if the key is changed
+// meanwhile, e.g. by other proxies writing or migrating it. The key is then
+// left to be migrated as usual and ErrKeyChanged is returned.
+func moveKeyWatched(config *Config, from, to string, database int32, key []byte) (bool, error) {
+	src, err := dialDatabase(from, database, config)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	dst, err := dialDatabase(to, database, config)
+	if err != nil {
+		return false, err
+	}
+	defer dst.Close()
+
+	// The target is watched first, so that the key migrated there by others
+	// after being read from the source discards the RESTORE.
+	if _, err := execOnConn(dst, []byte("WATCH"), key); err != nil {
+		return false, err
+	}
+	if _, err := execOnConn(src, []byte("WATCH"), key); err != nil {
+		return false, err
+	}
+	resp, err := execOnConn(src, []byte("PTTL"), key)
+	if err != nil {
+		return false, err
+	}
+	ttl, err := redis.Btoi64(resp.Value)
+	switch {
+	case err != nil:
+		return false, fmt.Errorf("bad pttl resp: %s", resp.Value)
+	case ttl == -2:
+		return false, nil
+	case ttl < 0:
+		ttl = 0
+	}
+	dump, err := execOnConn(src, []byte("DUMP"), key)
+	if err != nil || dump.Value == nil {
+		return false, err
+	}
+	for _, x := range []struct {
+		c    *redis.Conn
+		args [][]byte
+	}{
+		{dst, [][]byte{[]byte("RESTORE"), key, []byte(strconv.FormatInt(ttl, 10)), dump.Value, []byte("REPLACE")}},
+		{src, [][]byte{[]byte("DEL"), key}},
+	} {
+		if _, err := execOnConn(x.c, []byte("MULTI")); err != nil {
+			return false, err
+		}
+		if _, err := execOnConn(x.c, x.args...); err != nil {
+			return false, err
+		}
+		resp, err := execOnConn(x.c, []byte("EXEC"))
+		switch {
+		case err != nil:
+			return false, err
+		case !resp.IsArray():
+			return false, fmt.Errorf("bad exec resp: should be array, but got %s", resp.Type)
+		case resp.Array == nil && x.c == src:
+			// The key is restored but changed on the source, the copy is
+			// dropped so it's not left on both backends.
+			if err := undoRestore(dst, key, dump.Value); err != nil {
+				return false, err
+			}
+			return false, ErrKeyChanged
+		case resp.Array == nil:
+			return false, ErrKeyChanged
+		case len(resp.Array) != 1:
+			return false, fmt.Errorf("bad exec resp: array.len = %d", len(resp.Array))
+		case resp.Array[0].IsError():
+			return false, fmt.Errorf("bad %s resp: %s", x.args[0], resp.Array[0].Value)
+		}
+	}
+	return true, nil
+}
+
+// undoRestore deletes key restored from dump on c, unless it's been changed by
+// others since, e.g. migrated there again with the source's latest value.
+func undoRestore(c *redis.Conn, key, dump []byte) error {
+	if _, err := execOnConn(c, []byte("WATCH"), key); err != nil {
+		return err
+	}
+	resp, err := execOnConn(c, []byte("DUMP"), key)
+	if err != nil || !bytes.Equal(resp.Value, dump) {
+		return err
+	}
+	if _, err := execOnConn(c, []byte("MULTI")); err != nil {
+		return err
+	}
+	if _, err := execOnConn(c, []byte("DEL"), key); err != nil {
+		return err
+	}
+	_, err = execOnConn(c, []byte("EXEC"))
+	return err
+}
+
+// dialDatabase returns a connection of its own to addr with database selected.
+func dialDatabase(addr string, database int32, config *Config) (*redis.Conn, error) {
+	c, err := dialBackend(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	c.ReaderTimeout = config.BackendRecvTimeout.Duration()
+	c.WriterTimeout = config.BackendSendTimeout.Duration()
+
+	if err := verifyAuth(c, config); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := selectDatabase(c, int(database)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// execOnConn is execOnBackend over a connection of its own.
+func execOnConn(c *redis.Conn, args ...[]byte) (*redis.Resp, error) {
+	var multi []*redis.Resp
+	for _, arg := range args {
+		multi = append(multi, redis.NewBulkBytes(arg))
+	}
+	if err := c.EncodeMultiBulk(multi, true); err != nil {
+		return nil, err
+	}
+	resp, err := c.Decode()
+	switch {
+	case err != nil:
+		return nil, err
+	case resp == nil:
+		return nil, ErrRespIsRequired
+	case resp.IsError():
+		return nil, fmt.Errorf("bad %s resp: %s", args[0], resp.Value)
+	}
+	return resp, nil
+}
+
+// execOnBackend sends a command to bc and waits for its reply, error replies
+// are returned as errors.
+func execOnBackend(bc *sharedBackendConn, database int32, args ...[]byte) (*redis.Resp, error) {
+	r := &Request{Batch: &sync.WaitGroup{}}
+	r.OpStr = string(args[0])
+	for _, arg := range args {
+		r.Multi = append(r.Multi, redis.NewBulkBytes(arg))
+	}
+	bc.BackendConn(database, 0, true).PushBack(r)
+	r.Batch.Wait()
+
+	switch {
+	case r.Err != nil:
+		return nil, r.Err
+	case r.Resp == nil:
+		return nil, ErrRespIsRequired
+	case r.Resp.IsError():
+		return nil, fmt.Errorf("bad %s resp: %s", r.OpStr, r.Resp.Value)
+	}
+	return r.Resp, nil
+}
+
+func (s *Slot) release() {
+	s.backend.bc.Release()
+	s.backend.bc = nil
+	s.backend.id = 0
+	s.migrate.bc.Release()
+	s.migrate.bc = nil
+	s.migrate.id = 0
+	for i := range s.replicaGroups {
+		for _, bc := range s.replicaGroups[i] {
+			bc.Release()
+		}
+	}
+	s.replicaGroups = nil
+	s.replicaWeights = nil
+}
+
 func (s *Slot) unblock() {
 	if !s.lock.hold {
 		return
@@ -66,5 +382,14 @@ func (s *Slot) unblock() {
 }
 
 func (s *Slot) forward(r *Request, hkey []byte) error {
-	return s.method.Forward(s, r, hkey)
+	if s.stats.quarantine.Int64() == slotQuarantineHard {
+		return ErrSlotQuarantined
+	}
+	r.Slot = s
+	s.stats.incrRequest(r)
+	if err := s.method.Forward(s, r, hkey); err != nil {
+		s.stats.errors.Incr()
+		return err
+	}
+	return nil
 }
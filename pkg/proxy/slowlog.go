@@ -0,0 +1,122 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	slowLogMaxArgc = 32
+	slowLogMaxArgs = 128
+)
+
+type SlowLogEntry struct {
+	Id        int64         `json:"id"`
+	Timestamp time.Time     `json:"timestamp"`
+	Client    string        `json:"client"`
+	Command   []string      `json:"command"`
+	Key       string        `json:"key,omitempty"`
+	Latency   time.Duration `json:"latency"`
+	Backend   string        `json:"backend,omitempty"`
+	Retries   int           `json:"retries,omitempty"`
+}
+
+type SlowLog struct {
+	mu sync.Mutex
+
+	id   int64
+	pos  int
+	data []SlowLogEntry
+
+	threshold time.Duration
+}
+
+func NewSlowLog(threshold time.Duration, maxlen int) *SlowLog {
+	l := &SlowLog{threshold: threshold}
+	if maxlen > 0 {
+		l.data = make([]SlowLogEntry, 0, maxlen)
+	}
+	return l
+}
+
+func (l *SlowLog) IsSlow(latency time.Duration) bool {
+	return l.threshold > 0 && latency >= l.threshold && cap(l.data) != 0
+}
+
+func (l *SlowLog) Record(r *Request, client string, latency time.Duration) {
+	if !l.IsSlow(latency) {
+		return
+	}
+	e := SlowLogEntry{
+		Timestamp: time.Unix(0, r.UnixNano),
+		Client:    client,
+		Latency:   latency,
+		Backend:   r.Backend,
+		Retries:   r.Retries,
+	}
+	for i, m := range r.Multi {
+		if i == slowLogMaxArgc-1 && len(r.Multi) > slowLogMaxArgc {
+			e.Command = append(e.Command, fmt.Sprintf("... (%d more arguments)", len(r.Multi)-i))
+			break
+		}
+		e.Command = append(e.Command, truncateSlowLogArg(m.Value))
+	}
+	if key := getHashKey(r.Multi, r.OpStr); key != nil {
+		e.Key = truncateSlowLogArg(key)
+	}
+	l.Push(e)
+}
+
+func truncateSlowLogArg(b []byte) string {
+	if len(b) <= slowLogMaxArgs {
+		return string(b)
+	}
+	return fmt.Sprintf("%s... (%d more bytes)", b[:slowLogMaxArgs], len(b)-slowLogMaxArgs)
+}
+
+func (l *SlowLog) Push(e SlowLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cap(l.data) == 0 {
+		return
+	}
+	e.Id = l.id
+	l.id++
+	if len(l.data) < cap(l.data) {
+		l.data = append(l.data, e)
+	} else {
+		l.data[l.pos] = e
+	}
+	l.pos = (l.pos + 1) % cap(l.data)
+}
+
+func (l *SlowLog) Get(n int) []SlowLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n < 0 || n > len(l.data) {
+		n = len(l.data)
+	}
+	var entries = make([]SlowLogEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		j := (l.pos - i + cap(l.data)) % cap(l.data)
+		entries = append(entries, l.data[j])
+	}
+	return entries
+}
+
+func (l *SlowLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.data)
+}
+
+func (l *SlowLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.data = l.data[:0]
+	l.pos = 0
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/utils/assert"
+)
+
+func TestSlowLog(t *testing.T) {
+	l := NewSlowLog(time.Millisecond*10, 4)
+	assert.Must(!l.IsSlow(time.Millisecond))
+	assert.Must(l.IsSlow(time.Millisecond * 10))
+
+	for i := 0; i < 6; i++ {
+		r := newRequest("GET", "key"+strconv.Itoa(i))
+		r.Backend = "127.0.0.1:6379"
+		l.Record(r, "127.0.0.1:10000", time.Millisecond*time.Duration(10+i))
+	}
+	assert.Must(l.Len() == 4)
+
+	entries := l.Get(-1)
+	assert.Must(len(entries) == 4)
+	for i, e := range entries {
+		assert.Must(e.Id == int64(5-i))
+		assert.Must(e.Key == "key"+strconv.Itoa(5-i))
+		assert.Must(e.Client == "127.0.0.1:10000")
+		assert.Must(e.Backend == "127.0.0.1:6379")
+		assert.Must(len(e.Command) == 2 && e.Command[0] == "GET")
+	}
+	assert.Must(len(l.Get(2)) == 2)
+	assert.Must(l.Get(2)[0].Id == 5)
+
+	l.Reset()
+	assert.Must(l.Len() == 0)
+	assert.Must(len(l.Get(10)) == 0)
+}
+
+func TestSlowLogTruncate(t *testing.T) {
+	l := NewSlowLog(time.Millisecond, 1)
+
+	var args = []string{"MSET"}
+	for i := 0; i < 50; i++ {
+		args = append(args, strings.Repeat("x", 200))
+	}
+	l.Record(newRequest(args...), "", time.Second)
+
+	e := l.Get(1)[0]
+	assert.Must(len(e.Command) == slowLogMaxArgc)
+	assert.Must(e.Command[slowLogMaxArgc-1] == "... (20 more arguments)")
+	assert.Must(e.Command[1] == strings.Repeat("x", 128)+"... (72 more bytes)")
+}
+
+func TestSlowLogDisabled(t *testing.T) {
+	for _, l := range []*SlowLog{NewSlowLog(0, 128), NewSlowLog(time.Millisecond, 0)} {
+		assert.Must(!l.IsSlow(time.Second))
+		l.Record(newRequest("GET", "key"), "", time.Second)
+		assert.Must(l.Len() == 0)
+	}
+}
@@ -4,12 +4,14 @@
 package proxy
 
 import (
+	"bytes"
 	"math"
 	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
 	"github.com/CodisLabs/codis/pkg/utils"
 	"github.com/CodisLabs/codis/pkg/utils/sync2/atomic2"
 )
@@ -22,6 +24,32 @@ type opStats struct {
 	redis struct {
 		errors atomic2.Int64
 	}
+	latency [len(latencyBounds)]atomic2.Int64
+}
+
+var latencyBounds = [...]time.Duration{
+	time.Microsecond * 100,
+	time.Microsecond * 250,
+	time.Microsecond * 500,
+	time.Millisecond * 1,
+	time.Millisecond * 2,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 25,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+}
+
+func (s *opStats) incrLatency(d time.Duration) {
+	for i := range latencyBounds {
+		if d <= latencyBounds[i] {
+			s.latency[i].Incr()
+			return
+		}
+	}
 }
 
 func (s *opStats) OpStats() *OpStats {
@@ -143,6 +171,7 @@ func ResetStats() {
 	cmdstats.fails.Set(0)
 	cmdstats.redis.errors.Set(0)
 	sessions.total.Set(sessions.alive.Int64())
+	ResetCommandStats()
 }
 
 func incrOpTotal(n int64) {
@@ -165,11 +194,176 @@ func incrOpStats(e *opStats) {
 		s.redis.errors.Add(n)
 		cmdstats.redis.errors.Add(n)
 	}
+	for i := range e.latency {
+		if n := e.latency[i].Swap(0); n != 0 {
+			s.latency[i].Add(n)
+		}
+	}
+}
+
+type LatencyStats struct {
+	Family string
+	Bounds []time.Duration
+	Counts []int64
+	Calls  int64
+	Nsecs  int64
+}
+
+func getOpFamily(opstr string) string {
+	var flag OpFlag = FlagMayWrite
+	if r, ok := opTable[opstr]; ok {
+		flag = r.Flag
+	}
+	switch {
+	case flag.IsReadOnly():
+		return "read"
+	case flag&FlagWrite != 0:
+		return "write"
+	default:
+		return "other"
+	}
+}
+
+func GetLatencyStatsAll() []*LatencyStats {
+	var families = make(map[string]*LatencyStats)
+	cmdstats.RLock()
+	for _, s := range cmdstats.opmap {
+		family := getOpFamily(s.opstr)
+		l := families[family]
+		if l == nil {
+			l = &LatencyStats{Family: family}
+			l.Bounds = latencyBounds[:]
+			l.Counts = make([]int64, len(latencyBounds))
+			families[family] = l
+		}
+		for i := range s.latency {
+			l.Counts[i] += s.latency[i].Int64()
+		}
+		l.Calls += s.calls.Int64()
+		l.Nsecs += s.nsecs.Int64()
+	}
+	cmdstats.RUnlock()
+
+	var names = make([]string, 0, len(families))
+	for family := range families {
+		names = append(names, family)
+	}
+	sort.Strings(names)
+
+	var all = make([]*LatencyStats, 0, len(names))
+	for _, family := range names {
+		l := families[family]
+		for i := 1; i < len(l.Counts); i++ {
+			l.Counts[i] += l.Counts[i-1]
+		}
+		all = append(all, l)
+	}
+	return all
+}
+
+type commandStats struct {
+	calls   atomic2.Int64
+	nsecs   atomic2.Int64
+	maxns   atomic2.Int64
+	latency [len(latencyBounds) + 1]atomic2.Int64
+}
+
+func (s *commandStats) incrLatency(d time.Duration) {
+	s.calls.Incr()
+	s.nsecs.Add(int64(d))
+	for {
+		max := s.maxns.Int64()
+		if int64(d) <= max || s.maxns.CompareAndSwap(max, int64(d)) {
+			break
+		}
+	}
+	for i := range latencyBounds {
+		if d <= latencyBounds[i] {
+			s.latency[i].Incr()
+			return
+		}
+	}
+	s.latency[len(latencyBounds)].Incr()
+}
+
+func (s *commandStats) CommandStats(family string) *CommandStats {
+	o := &CommandStats{
+		Family: family,
+		Calls:  s.calls.Int64(),
+		Usecs:  s.nsecs.Int64() / 1e3,
+		Counts: make([]int64, len(latencyBounds)),
+	}
+	var n int64
+	for i := range latencyBounds {
+		n += s.latency[i].Int64()
+		o.Counts[i] = n
+	}
+	percentile := func(q float64) int64 {
+		var rank = int64(math.Ceil(q * float64(o.Calls)))
+		for i := range o.Counts {
+			if o.Counts[i] >= rank {
+				return int64(latencyBounds[i] / time.Microsecond)
+			}
+		}
+		return s.maxns.Int64() / 1e3
+	}
+	if o.Calls != 0 {
+		o.UsecsPercall = o.Usecs / o.Calls
+		o.P50 = percentile(0.50)
+		o.P99 = percentile(0.99)
+		o.P999 = percentile(0.999)
+	}
+	return o
+}
+
+// CommandStats is the latency histogram of a command family, measured from
+// the creation of a request to the write of its response. Counts are
+// cumulative and aligned with latencyBounds, percentiles are the upper bound
+// of the bucket they fall in.
+type CommandStats struct {
+	Family       string  `json:"family"`
+	Calls        int64   `json:"calls"`
+	Usecs        int64   `json:"usecs"`
+	UsecsPercall int64   `json:"usecs_percall"`
+	Counts       []int64 `json:"counts"`
+	P50          int64   `json:"p50_usecs"`
+	P99          int64   `json:"p99_usecs"`
+	P999         int64   `json:"p999_usecs"`
+}
+
+type commandStatsTable [numCommandFamilies]commandStats
+
+var cmdfamily atomic.Value
+
+func init() {
+	cmdfamily.Store(&commandStatsTable{})
+}
+
+func incrCommandStats(opstr string, d time.Duration) {
+	t := cmdfamily.Load().(*commandStatsTable)
+	t[getCommandFamily(opstr)].incrLatency(d)
+}
+
+func GetCommandStatsAll() map[string]*CommandStats {
+	t := cmdfamily.Load().(*commandStatsTable)
+	var all = make(map[string]*CommandStats, len(t))
+	for i := range t {
+		family := commandFamily(i).String()
+		all[family] = t[i].CommandStats(family)
+	}
+	return all
+}
+
+func ResetCommandStats() {
+	cmdfamily.Store(&commandStatsTable{})
 }
 
 var sessions struct {
-	total atomic2.Int64
-	alive atomic2.Int64
+	total    atomic2.Int64
+	alive    atomic2.Int64
+	rejected atomic2.Int64
+
+	authFailed atomic2.Int64
 }
 
 func incrSessions() int64 {
@@ -189,6 +383,22 @@ func SessionsAlive() int64 {
 	return sessions.alive.Int64()
 }
 
+func incrSessionsRejected() {
+	sessions.rejected.Incr()
+}
+
+func SessionsRejected() int64 {
+	return sessions.rejected.Int64()
+}
+
+func incrSessionsAuthFailed() {
+	sessions.authFailed.Incr()
+}
+
+func SessionsAuthFailed() int64 {
+	return sessions.authFailed.Int64()
+}
+
 type SysUsage struct {
 	Now time.Time
 	CPU float64
@@ -224,3 +434,161 @@ func GetSysUsage() *SysUsage {
 	}
 	return nil
 }
+
+type slotStats struct {
+	calls  atomic2.Int64
+	errors atomic2.Int64
+	bytes  struct {
+		in, out atomic2.Int64
+	}
+	// failures counts errors caused by backends rather than by commands,
+	// which are used to quarantine slots.
+	failures atomic2.Int64
+
+	last struct {
+		calls, errors int64
+		failures      int64
+		bytes         struct {
+			in, out int64
+		}
+	}
+	rate struct {
+		calls, errors atomic2.Int64
+		bytes         struct {
+			in, out atomic2.Int64
+		}
+	}
+	hot atomic2.Bool
+
+	delta struct {
+		calls, failures int64
+	}
+	window struct {
+		calls, failures []int64
+		next            int
+	}
+	quarantine atomic2.Int64
+}
+
+const (
+	slotQuarantineNone = iota
+	slotQuarantineSoft
+	slotQuarantineHard
+)
+
+func (s *slotStats) incrRequest(r *Request) {
+	var n int64
+	for _, m := range r.Multi {
+		n += int64(len(m.Value))
+	}
+	s.calls.Incr()
+	s.bytes.in.Add(n)
+}
+
+func (s *slotStats) incrResponse(resp *redis.Resp, err error) {
+	if err != nil || resp == nil {
+		s.errors.Incr()
+		s.failures.Incr()
+		return
+	}
+	if resp.IsError() {
+		s.errors.Incr()
+		if bytes.HasPrefix(resp.Value, errRespMasterDown) || bytes.HasPrefix(resp.Value, errRespLoading) {
+			s.failures.Incr()
+		}
+	}
+	s.bytes.out.Add(respBytes(resp))
+}
+
+func (s *slotStats) sample(d time.Duration) {
+	normalized := func(delta int64) int64 {
+		return int64(math.Max(0, float64(delta))*float64(time.Second)/float64(d) + 0.5)
+	}
+	calls, errors := s.calls.Int64(), s.errors.Int64()
+	bytesIn, bytesOut := s.bytes.in.Int64(), s.bytes.out.Int64()
+
+	s.rate.calls.Set(normalized(calls - s.last.calls))
+	s.rate.errors.Set(normalized(errors - s.last.errors))
+	s.rate.bytes.in.Set(normalized(bytesIn - s.last.bytes.in))
+	s.rate.bytes.out.Set(normalized(bytesOut - s.last.bytes.out))
+
+	failures := s.failures.Int64()
+	s.delta.calls, s.delta.failures = calls-s.last.calls, failures-s.last.failures
+	s.last.calls, s.last.errors, s.last.failures = calls, errors, failures
+	s.last.bytes.in, s.last.bytes.out = bytesIn, bytesOut
+}
+
+// errorRate adds the last sample to a window of n samples, and returns the
+// ratio of backend failures to calls in the window, or 0 if there are fewer
+// than min calls in it.
+func (s *slotStats) errorRate(n int, min int64) float64 {
+	if len(s.window.calls) != n {
+		s.window.calls = make([]int64, n)
+		s.window.failures = make([]int64, n)
+		s.window.next = 0
+	}
+	s.window.calls[s.window.next] = s.delta.calls
+	s.window.failures[s.window.next] = s.delta.failures
+	s.window.next = (s.window.next + 1) % n
+
+	var calls, failures int64
+	for i := 0; i < n; i++ {
+		calls += s.window.calls[i]
+		failures += s.window.failures[i]
+	}
+	if calls <= 0 || calls < min {
+		return 0
+	}
+	return math.Min(1, float64(failures)/float64(calls))
+}
+
+func (s *slotStats) SlotStats(id int) *SlotStats {
+	o := &SlotStats{
+		Id:       id,
+		Calls:    s.calls.Int64(),
+		Errors:   s.errors.Int64(),
+		BytesIn:  s.bytes.in.Int64(),
+		BytesOut: s.bytes.out.Int64(),
+	}
+	o.Rate.Calls = s.rate.calls.Int64()
+	o.Rate.Errors = s.rate.errors.Int64()
+	o.Rate.BytesIn = s.rate.bytes.in.Int64()
+	o.Rate.BytesOut = s.rate.bytes.out.Int64()
+	o.Hot = s.hot.IsTrue()
+	switch s.quarantine.Int64() {
+	case slotQuarantineSoft:
+		o.Quarantine = "soft"
+	case slotQuarantineHard:
+		o.Quarantine = "hard"
+	}
+	return o
+}
+
+type SlotStats struct {
+	Id       int   `json:"id"`
+	Calls    int64 `json:"calls"`
+	Errors   int64 `json:"errors"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	Rate struct {
+		Calls    int64 `json:"calls"`
+		Errors   int64 `json:"errors"`
+		BytesIn  int64 `json:"bytes_in"`
+		BytesOut int64 `json:"bytes_out"`
+	} `json:"rate"`
+
+	Hot bool `json:"hot,omitempty"`
+
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+func respBytes(resp *redis.Resp) int64 {
+	var n = int64(len(resp.Value))
+	for _, r := range resp.Array {
+		if r != nil {
+			n += respBytes(r)
+		}
+	}
+	return n
+}
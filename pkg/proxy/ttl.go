@@ -0,0 +1,154 @@
+// Copyright 2016 CodisLabs. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CodisLabs/codis/pkg/proxy/redis"
+	"github.com/CodisLabs/codis/pkg/utils/log"
+	"github.com/CodisLabs/codis/pkg/utils/timesize"
+)
+
+// TTLRule caps the TTL of keys matching the glob Pattern to MaxTTL, it's
+// formatted as "<pattern>=<max_ttl>" in config files, e.g. "cache:*=1h".
+type TTLRule struct {
+	Pattern string
+	MaxTTL  time.Duration
+}
+
+func (r TTLRule) MarshalText() ([]byte, error) {
+	ttl, err := timesize.Duration(r.MaxTTL).MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(r.Pattern + "=" + string(ttl)), nil
+}
+
+func (r *TTLRule) UnmarshalText(text []byte) error {
+	i := bytes.LastIndexByte(text, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid ttl rule '%s'", text)
+	}
+	ttl, err := timesize.Parse(string(text[i+1:]))
+	if err != nil {
+		return err
+	}
+	r.Pattern, r.MaxTTL = string(text[:i]), ttl
+	return nil
+}
+
+// maxTTL returns the max TTL of key by the first rule it matches.
+func (s *Router) maxTTL(key []byte) (time.Duration, bool) {
+	for _, rule := range s.config.MaxTTLRules {
+		if globMatch([]byte(rule.Pattern), key) {
+			return rule.MaxTTL, true
+		}
+	}
+	return 0, false
+}
+
+// maxTTLQueueLen is the max number of keys waiting for their TTL to be
+// checked, keys written beyond are skipped.
+const maxTTLQueueLen = 4096
+
+type ttlCheck struct {
+	database int32
+	key      []byte
+	maxTTL   time.Duration
+}
+
+// enforceTTL checks keys written by r against max_ttl_rules in background, and
+// sends EXPIRE for keys without a TTL or with a TTL longer than allowed.
+func (s *Router) enforceTTL(r *Request, resp *redis.Resp) {
+	if len(s.config.MaxTTLRules) == 0 || r.OpFlag.IsReadOnly() || resp == nil || resp.IsError() {
+		return
+	}
+	for _, key := range commandKeys(r.Multi, r.OpStr) {
+		ttl, ok := s.maxTTL(key)
+		if !ok {
+			continue
+		}
+		s.ttl.Lock()
+		if len(s.ttl.queue) < maxTTLQueueLen {
+			s.ttl.queue = append(s.ttl.queue, &ttlCheck{r.Database, append([]byte(nil), key...), ttl})
+			if !s.ttl.running {
+				s.ttl.running = true
+				go s.loopCapTTL()
+			}
+		} else {
+			log.Debugf("check ttl of key '%s' skipped: too many pending checks", key)
+		}
+		s.ttl.Unlock()
+	}
+}
+
+// loopCapTTL checks queued keys one at a time, and exits once the queue is
+// empty.
+func (s *Router) loopCapTTL() {
+	for {
+		s.ttl.Lock()
+		if len(s.ttl.queue) == 0 {
+			s.ttl.running = false
+			s.ttl.Unlock()
+			return
+		}
+		var c = s.ttl.queue[0]
+		s.ttl.queue[0] = nil
+		s.ttl.queue = s.ttl.queue[1:]
+		s.ttl.Unlock()
+
+		s.capTTL(c.database, c.key, c.maxTTL)
+	}
+}
+
+func (s *Router) capTTL(database int32, key []byte, maxTTL time.Duration) {
+	resp, err := s.execKey(database, []byte("TTL"), key)
+	if err != nil {
+		log.Debugf("check ttl of key '%s' failed: %s", key, err)
+		return
+	}
+	var limit = int64(maxTTL / time.Second)
+	ttl, err := strconv.ParseInt(string(resp.Value), 10, 64)
+	switch {
+	case err != nil:
+		log.Debugf("check ttl of key '%s' failed: bad ttl resp '%s'", key, resp.Value)
+		return
+	case ttl != -1 && ttl <= limit:
+		return
+	}
+	if _, err := s.execKey(database, []byte("EXPIRE"), key, strconv.AppendInt(nil, limit, 10)); err != nil {
+		log.Debugf("cap ttl of key '%s' failed: %s", key, err)
+	}
+}
+
+// execKey dispatches a command of a single key and waits for its reply.
+func (s *Router) execKey(database int32, args ...[]byte) (*redis.Resp, error) {
+	r := &Request{Batch: &sync.WaitGroup{}}
+	r.OpStr = string(args[0])
+	r.OpFlag = opTable[r.OpStr].Flag | FlagMasterOnly
+	r.Database = database
+	r.UnixNano = time.Now().UnixNano()
+	for _, arg := range args {
+		r.Multi = append(r.Multi, redis.NewBulkBytes(arg))
+	}
+	if err := s.dispatch(r); err != nil {
+		return nil, err
+	}
+	r.Batch.Wait()
+
+	switch {
+	case r.Err != nil:
+		return nil, r.Err
+	case r.Resp == nil:
+		return nil, ErrRespIsRequired
+	case r.Resp.IsError():
+		return nil, fmt.Errorf("bad %s resp: %s", r.OpStr, r.Resp.Value)
+	}
+	return r.Resp, nil
+}
@@ -104,6 +104,10 @@ func (l *LogLevel) Set(v LogLevel) {
 	atomic.StoreInt64((*int64)(l), int64(v))
 }
 
+func (l *LogLevel) Get() LogLevel {
+	return LogLevel(atomic.LoadInt64((*int64)(l)))
+}
+
 func (l *LogLevel) Test(m LogType) bool {
 	v := atomic.LoadInt64((*int64)(l))
 	return (v & int64(m)) != 0
@@ -164,6 +168,10 @@ func (l *Logger) SetLevel(v LogLevel) {
 	l.level.Set(v)
 }
 
+func (l *Logger) GetLevel() LogLevel {
+	return l.level.Get()
+}
+
 func (l *Logger) SetLevelString(s string) bool {
 	var v LogLevel
 	if !v.ParseFromString(s) {
@@ -432,6 +440,10 @@ func SetLevelString(s string) bool {
 	return StdLog.SetLevelString(s)
 }
 
+func GetLevel() LogLevel {
+	return StdLog.GetLevel()
+}
+
 func SetTrace(v LogLevel) {
 	StdLog.SetTraceLevel(v)
 }
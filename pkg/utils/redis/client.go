@@ -51,6 +51,24 @@ func NewClient(addr string, auth string, timeout time.Duration) (*Client, error)
 	}, nil
 }
 
+// NewClientUser is NewClient authenticating as username with ACL, or with the
+// password alone if username is empty.
+func NewClientUser(addr string, username, password string, timeout time.Duration) (*Client, error) {
+	if username == "" {
+		return NewClient(addr, password, timeout)
+	}
+	c, err := NewClientNoAuth(addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Do("AUTH", username, password); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.Auth = password
+	return c, nil
+}
+
 func (c *Client) Close() error {
 	return c.conn.Close()
 }
@@ -451,8 +469,9 @@ func (p *Pool) InfoFull(addr string) (_ map[string]string, err error) {
 type InfoCache struct {
 	mu sync.Mutex
 
-	Auth string
-	data map[string]map[string]string
+	Username string
+	Auth     string
+	data     map[string]map[string]string
 
 	Timeout time.Duration
 }
@@ -494,7 +513,7 @@ func (s *InfoCache) GetRunId(addr string) string {
 }
 
 func (s *InfoCache) getSlow(addr string) (map[string]string, error) {
-	c, err := NewClient(addr, s.Auth, s.Timeout)
+	c, err := NewClientUser(addr, s.Username, s.Auth, s.Timeout)
 	if err != nil {
 		return nil, err
 	}